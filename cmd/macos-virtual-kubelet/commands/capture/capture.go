@@ -0,0 +1,127 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/raikerian/macos-virtual-kubelet/internal/manager"
+	"github.com/raikerian/macos-virtual-kubelet/internal/pcap"
+	"github.com/spf13/cobra"
+	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
+	"golang.org/x/term"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type options struct {
+	kubeConfigPath string
+	namespace      string
+	filter         string
+	snapLen        int
+	duration       time.Duration
+	maxBytes       string
+	output         string
+}
+
+// NewCommand creates a new capture subcommand
+// This subcommand captures the traffic of the virtual machine of a pod through the API server.
+func NewCommand(ctx context.Context) *cobra.Command {
+	opts := options{
+		kubeConfigPath: os.Getenv("KUBECONFIG"),
+		namespace:      "default",
+		output:         "-",
+	}
+	if home, err := os.UserHomeDir(); err == nil && opts.kubeConfigPath == "" {
+		opts.kubeConfigPath = filepath.Join(home, ".kube", "config")
+	}
+
+	cmd := &cobra.Command{
+		Use:   "capture <pod>",
+		Short: "Capture the network traffic of the virtual machine of a pod",
+		Long: `Capture the network traffic of the virtual machine of a pod as a pcap-ng stream, e.g.
+
+  macos-virtual-kubelet capture -n ci build-1234 --filter 'tcp port 443' --duration 1m -o build.pcapng
+  macos-virtual-kubelet capture -n ci build-1234 | wireshark -k -i -
+
+The traffic is streamed from the node of the pod through the API server, which requires access
+to the proxy subresource of nodes. Only pods attached in userspace network mode can be captured.
+The filter supports a subset of the tcpdump syntax: tcp, udp, icmp, arp, ip, [src|dst] host, net,
+port and portrange, combined with and, or, not and parentheses.`,
+		Args: cobra.ExactArgs(1),
+		// a failed capture is not a usage error
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(ctx, cmd, args[0], opts)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&opts.kubeConfigPath, "kubeconfig", opts.kubeConfigPath, "kube config file to use for connecting to the Kubernetes API server")
+	flags.StringVarP(&opts.namespace, "namespace", "n", opts.namespace, "namespace of the pod")
+	flags.StringVar(&opts.filter, "filter", "", `capture only the frames matching the filter, e.g. "tcp port 443"`)
+	flags.IntVar(&opts.snapLen, "snaplen", 0, "number of bytes captured of each frame, all of them by default")
+	flags.DurationVar(&opts.duration, "duration", 0, "stop capturing after this duration, on interrupt by default")
+	flags.StringVar(&opts.maxBytes, "max-bytes", "", `stop capturing once the capture reaches this size, e.g. "10Mi"`)
+	flags.StringVarP(&opts.output, "output", "o", opts.output, `file to write the capture to, "-" for the standard output`)
+	return cmd
+}
+
+func run(ctx context.Context, cmd *cobra.Command, pod string, opts options) error {
+	if _, err := pcap.Compile(opts.filter); err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	if opts.output == "-" {
+		if f, ok := out.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+			return errors.New("refusing to write a capture to a terminal, use --output or a pipe")
+		}
+	} else {
+		f, err := os.Create(opts.output)
+		if err != nil {
+			return errors.Wrap(err, "could not create the capture file")
+		}
+		defer f.Close()
+		out = f
+	}
+
+	client, err := nodeutil.ClientsetFromEnv(opts.kubeConfigPath)
+	if err != nil {
+		return err
+	}
+	p, err := client.CoreV1().Pods(opts.namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if p.Spec.NodeName == "" {
+		return errors.Errorf("pod %s/%s is not scheduled to a node yet", opts.namespace, pod)
+	}
+
+	req := client.CoreV1().RESTClient().Get().
+		AbsPath("/api/v1/nodes", p.Spec.NodeName, "proxy", strings.TrimSuffix(manager.CapturePath, "/"), opts.namespace, pod)
+	if opts.filter != "" {
+		req = req.Param("filter", opts.filter)
+	}
+	if opts.snapLen > 0 {
+		req = req.Param("snaplen", strconv.Itoa(opts.snapLen))
+	}
+	if opts.duration > 0 {
+		req = req.Param("duration", opts.duration.String())
+	}
+	if opts.maxBytes != "" {
+		req = req.Param("maxBytes", opts.maxBytes)
+	}
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "could not capture the traffic of pod %s/%s", opts.namespace, pod)
+	}
+	defer stream.Close()
+	if _, err := io.Copy(out, stream); err != nil && ctx.Err() == nil {
+		return errors.Wrap(err, "capture interrupted")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/raikerian/macos-virtual-kubelet/internal/config"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// NewCommand creates a new config subcommand
+// This subcommand is used to check and bootstrap provider configuration files.
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Work with provider configuration files",
+		Long:  "Work with the provider configuration file given with --provider-config",
+	}
+	cmd.AddCommand(newValidateCommand(), newPrintDefaultsCommand())
+	return cmd
+}
+
+func newValidateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate <file>",
+		Short: "Validate a provider configuration file",
+		Long:  "Validate a provider configuration file and print it with the defaults applied",
+		Args:  cobra.ExactArgs(1),
+		// a validation error is not a usage error
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load(args[0])
+			if err != nil {
+				return err
+			}
+			return printConfig(cmd, cfg)
+		},
+	}
+}
+
+func newPrintDefaultsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "print-defaults",
+		Short: "Print the default provider configuration",
+		Long:  "Print the default provider configuration, to be used as a starting point for --provider-config",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return printConfig(cmd, config.Default())
+		},
+	}
+}
+
+func printConfig(cmd *cobra.Command, cfg *config.ProviderConfig) error {
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return errors.Wrap(err, "could not encode provider config")
+	}
+	fmt.Fprint(cmd.OutOrStdout(), string(out))
+	return nil
+}
@@ -0,0 +1,36 @@
+package root
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// dynamicClientFromEnv returns a dynamic client configured the same way as
+// nodeutil.ClientsetFromEnv: from kubeConfigPath when it exists, from the
+// in-cluster configuration otherwise.
+func dynamicClientFromEnv(kubeConfigPath string) (dynamic.Interface, error) {
+	config, err := restConfigFromEnv(kubeConfigPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting rest client config")
+	}
+	return dynamic.NewForConfig(config)
+}
+
+func restConfigFromEnv(kubeConfigPath string) (*rest.Config, error) {
+	if kubeConfigPath == "" {
+		return rest.InClusterConfig()
+	}
+	if _, err := os.Stat(kubeConfigPath); os.IsNotExist(err) {
+		return rest.InClusterConfig()
+	} else if err != nil {
+		return nil, err
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeConfigPath},
+		&clientcmd.ConfigOverrides{},
+	).ClientConfig()
+}
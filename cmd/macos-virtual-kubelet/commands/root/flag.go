@@ -22,6 +22,9 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog"
 )
 
@@ -57,6 +60,36 @@ func (mv mapVar) Type() string {
 	return "map"
 }
 
+// listMapVar is a map flag taking comma-separated key=value pairs, like the
+// kubelet's, e.g. `--system-reserved cpu=1,memory=2Gi`. The flag can also
+// be repeated.
+type listMapVar map[string]string
+
+func (mv listMapVar) String() string {
+	return mapVar(mv).String()
+}
+
+func (mv listMapVar) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return errors.Errorf("invalid format, must be `key=value`: %s", pair)
+		}
+		if err := mapVar(mv).Set(strings.TrimSpace(k) + "=" + strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mv listMapVar) Type() string {
+	return "mapStringString"
+}
+
 func installFlags(flags *pflag.FlagSet, c *Opts) {
 	flags.StringVar(&c.KubeConfigPath, "kubeconfig", c.KubeConfigPath, "kube config file to use for connecting to the Kubernetes API server")
 	flags.StringVar(&c.KubeNamespace, "namespace", c.KubeNamespace, "kubernetes namespace (default is 'all')")
@@ -67,7 +100,7 @@ func installFlags(flags *pflag.FlagSet, c *Opts) {
 	if err := flags.MarkDeprecated("provider", "this flag is not used, aws is the only supported provider"); err != nil {
 		panic(err)
 	}
-	flags.StringVar(&c.ProviderConfigPath, "provider-config", c.ProviderConfigPath, "cloud provider configuration file")
+	flags.StringVar(&c.ProviderConfigPath, "provider-config", c.ProviderConfigPath, "provider configuration file, see the config print-defaults command")
 	flags.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address to listen for metrics/stats requests")
 
 	flags.StringVar(&c.TaintKey, "taint", c.TaintKey, "Set node taint key")
@@ -83,6 +116,14 @@ func installFlags(flags *pflag.FlagSet, c *Opts) {
 	flags.StringVar(&c.TraceSampleRate, "trace-sample-rate", c.TraceSampleRate, "set probability of tracing samples")
 
 	flags.DurationVar(&c.InformerResyncPeriod, "full-resync-period", c.InformerResyncPeriod, "how often to perform a full resync of pods between kubernetes and the provider")
+	flags.IntVar(&c.VMSlots, "vm-slots", c.VMSlots, "number of virtual machines the node runs at the same time, overrides vmSlots of the provider configuration")
+	flags.Var(listMapVar(c.SystemReserved), "system-reserved", "resources reserved for the host OS in name=quantity form, e.g. cpu=1,memory=4Gi")
+	flags.Var(listMapVar(c.KubeReserved), "kube-reserved", "resources reserved for the virtual kubelet in name=quantity form, e.g. cpu=500m,memory=512Mi")
+	flags.DurationVar(&c.SyncFrequency, "sync-frequency", c.SyncFrequency, "how often the volumes of running pods are updated from their ConfigMaps, Secrets and fields")
+	flags.DurationVar(&c.NodeStatusUpdateFrequency, "node-status-update-frequency", c.NodeStatusUpdateFrequency, "how often the host is probed to update the node conditions")
+	flags.Float64Var(&c.MemoryPressureThreshold, "memory-pressure-threshold", c.MemoryPressureThreshold, "percentage of host memory that must remain available before the node reports MemoryPressure")
+	flags.Float64Var(&c.DiskPressureThreshold, "disk-pressure-threshold", c.DiskPressureThreshold, "percentage of host disk that must remain available before the node reports DiskPressure")
+	flags.Float64Var(&c.PIDPressureThreshold, "pid-pressure-threshold", c.PIDPressureThreshold, "percentage of host process IDs that must remain available before the node reports PIDPressure")
 	flags.DurationVar(&c.StartupTimeout, "startup-timeout", c.StartupTimeout, "How long to wait for the virtual-kubelet to start")
 
 	flagset := flag.NewFlagSet("klog", flag.PanicOnError)
@@ -93,6 +134,33 @@ func installFlags(flags *pflag.FlagSet, c *Opts) {
 	})
 }
 
+// parseReserved parses reserved resources given in name=quantity form and
+// returns their sum.
+func parseReserved(reserved ...map[string]string) (corev1.ResourceList, error) {
+	rl := corev1.ResourceList{}
+	for _, m := range reserved {
+		for k, v := range m {
+			name := corev1.ResourceName(k)
+			switch name {
+			case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+			default:
+				return nil, errdefs.InvalidInputf("cannot reserve resource %q", k)
+			}
+			q, err := resource.ParseQuantity(v)
+			if err != nil {
+				return nil, errdefs.AsInvalidInput(errors.Wrapf(err, "invalid quantity for reserved resource %q", k))
+			}
+			if q.Sign() < 0 {
+				return nil, errdefs.InvalidInputf("reserved resource %q must not be negative", k)
+			}
+			total := rl[name]
+			total.Add(q)
+			rl[name] = total
+		}
+	}
+	return rl, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	value, found := os.LookupEnv(key)
 	if found {
@@ -0,0 +1,92 @@
+// Copyright © 2017 The virtual-kubelet authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package root
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestListMapVarSet(t *testing.T) {
+	cases := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "comma separated",
+			args: []string{"--system-reserved", "cpu=1,memory=2Gi"},
+			want: map[string]string{"cpu": "1", "memory": "2Gi"},
+		},
+		{
+			name: "repeated",
+			args: []string{"--system-reserved", "cpu=1", "--system-reserved", "memory=2Gi"},
+			want: map[string]string{"cpu": "1", "memory": "2Gi"},
+		},
+		{
+			name: "spaces and trailing comma",
+			args: []string{"--system-reserved", "cpu = 1, memory=2Gi,"},
+			want: map[string]string{"cpu": "1", "memory": "2Gi"},
+		},
+		{
+			name:    "missing value",
+			args:    []string{"--system-reserved", "cpu=1,memory"},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate key",
+			args:    []string{"--system-reserved", "cpu=1,cpu=2"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mv := listMapVar{}
+			flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			flags.Var(mv, "system-reserved", "")
+
+			err := flags.Parse(tc.args)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", mv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(map[string]string(mv), tc.want) {
+				t.Fatalf("got %v, want %v", mv, tc.want)
+			}
+		})
+	}
+}
+
+func TestMapVarKeepsCommas(t *testing.T) {
+	mv := mapVar{}
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Var(mv, "trace-tag", "")
+
+	if err := flags.Parse([]string{"--trace-tag", "owners=ci,release"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := (map[string]string{"owners": "ci,release"}); !reflect.DeepEqual(map[string]string(mv), want) {
+		t.Fatalf("got %v, want %v", mv, want)
+	}
+}
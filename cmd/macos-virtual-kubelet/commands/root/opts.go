@@ -22,6 +22,7 @@ import (
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"github.com/raikerian/macos-virtual-kubelet/provider"
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -33,6 +34,7 @@ const (
 	DefaultMetricsAddr          = ":10255"
 	DefaultListenPort           = 10250 // TODO(cpuguy83)(VK1.0): Change this to an addr instead of just a port.. we should not be listening on all interfaces.
 	DefaultPodSyncWorkers       = 10
+	DefaultSyncFrequency        = 1 * time.Minute
 	DefaultKubeNamespace        = corev1.NamespaceAll
 
 	DefaultTaintEffect = string(corev1.TaintEffectNoSchedule)
@@ -78,6 +80,27 @@ type Opts struct {
 	TraceSampleRate string
 	TraceConfig     TracingExporterOptions
 
+	// Number of virtual machines the node runs at the same time, overriding
+	// the provider configuration when set
+	VMSlots int
+
+	// Resources reserved for the host OS and for the virtual kubelet itself,
+	// in name=quantity form (e.g. cpu=1,memory=2Gi)
+	SystemReserved map[string]string
+	KubeReserved   map[string]string
+
+	// How often the volumes of running pods are checked for updates of their
+	// ConfigMaps, Secrets and fields
+	SyncFrequency time.Duration
+
+	// How often the host is probed to update the node conditions
+	NodeStatusUpdateFrequency time.Duration
+	// Percentage of memory, disk and PIDs that must remain available before
+	// the node reports the matching pressure condition
+	MemoryPressureThreshold float64
+	DiskPressureThreshold   float64
+	PIDPressureThreshold    float64
+
 	// Startup Timeout is how long to wait for the kubelet to start
 	StartupTimeout time.Duration
 
@@ -107,6 +130,31 @@ func SetDefaultOpts(c *Opts) error {
 		c.PodSyncWorkers = DefaultPodSyncWorkers
 	}
 
+	if c.SystemReserved == nil {
+		c.SystemReserved = map[string]string{}
+	}
+	if c.KubeReserved == nil {
+		c.KubeReserved = map[string]string{}
+	}
+
+	if c.SyncFrequency == 0 {
+		c.SyncFrequency = DefaultSyncFrequency
+	}
+
+	if c.NodeStatusUpdateFrequency == 0 {
+		c.NodeStatusUpdateFrequency = provider.DefaultNodeStatusUpdateFrequency
+	}
+
+	if c.MemoryPressureThreshold == 0 {
+		c.MemoryPressureThreshold = provider.DefaultMemoryPressureThreshold
+	}
+	if c.DiskPressureThreshold == 0 {
+		c.DiskPressureThreshold = provider.DefaultDiskPressureThreshold
+	}
+	if c.PIDPressureThreshold == 0 {
+		c.PIDPressureThreshold = provider.DefaultPIDPressureThreshold
+	}
+
 	if c.TraceConfig.ServiceName == "" {
 		c.TraceConfig.ServiceName = DefaultNodeName
 	}
@@ -19,12 +19,23 @@ import (
 	"crypto/tls"
 	"net/http"
 	"os"
+	"path"
 	"runtime"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/raikerian/macos-virtual-kubelet/internal/config"
 	"github.com/raikerian/macos-virtual-kubelet/internal/manager"
+	"github.com/raikerian/macos-virtual-kubelet/internal/metrics"
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/internal/storage"
+	"github.com/raikerian/macos-virtual-kubelet/internal/vmclass"
+	"github.com/raikerian/macos-virtual-kubelet/internal/volume"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
 	"github.com/raikerian/macos-virtual-kubelet/provider"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
@@ -33,6 +44,11 @@ import (
 	"github.com/virtual-kubelet/virtual-kubelet/node/nodeutil"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apiserver/pkg/server/dynamiccertificates"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 // NewCommand creates a new top-level command.
@@ -65,6 +81,10 @@ func runRootCommand(ctx context.Context, c Opts) error {
 		return errdefs.InvalidInput("pod sync workers must be greater than 0")
 	}
 
+	if c.SyncFrequency <= 0 {
+		return errdefs.InvalidInput("sync frequency must be greater than 0")
+	}
+
 	var taint *corev1.Taint
 	if !c.DisableTaint {
 		var err error
@@ -74,12 +94,31 @@ func runRootCommand(ctx context.Context, c Opts) error {
 		}
 	}
 
+	reserved, err := parseReserved(c.SystemReserved, c.KubeReserved)
+	if err != nil {
+		return err
+	}
+
+	providerConfig, err := loadProviderConfig(c)
+	if err != nil {
+		return err
+	}
+	applyLogLevel(providerConfig)
+
 	// Ensure API client.
 	clientSet, err := nodeutil.ClientsetFromEnv(c.KubeConfigPath)
 	if err != nil {
 		return err
 	}
 
+	dynamicClient, err := dynamicClientFromEnv(c.KubeConfigPath)
+	if err != nil {
+		return err
+	}
+	dynamicInformers := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, c.InformerResyncPeriod)
+	vmClasses := vmclass.NewStore(dynamicInformers)
+	informerFactory := informers.NewSharedInformerFactory(clientSet, c.InformerResyncPeriod)
+
 	// get host name from the env
 	hostName, err := os.Hostname()
 	if err != nil {
@@ -88,24 +127,50 @@ func runRootCommand(ctx context.Context, c Opts) error {
 	// lowercase RFC 1123 subdomain
 	hostName = strings.ToLower(hostName)
 
+	eventBroadcaster := record.NewBroadcaster()
+	defer eventBroadcaster.Shutdown()
+	eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: clientSet.CoreV1().Events(corev1.NamespaceAll)})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: path.Join(hostName, "macos-provider")})
+
+	provisioner, err := storage.NewProvisioner(informerFactory, clientSet, recorder, hostName, providerConfig.DisksPath())
+	if err != nil {
+		return errors.Wrap(err, "could not create volume provisioner")
+	}
+
 	// Set-up the node provider.
 	mux := http.NewServeMux()
+	var (
+		rm *manager.ResourceManager
+		p  *provider.MacOSProvider
+		np *provider.NodeConditionManager
+	)
 	newProvider := func(cfg nodeutil.ProviderConfig) (nodeutil.Provider, node.NodeProvider, error) {
-		rm, err := manager.NewResourceManager(cfg.Pods, cfg.Secrets, cfg.ConfigMaps, cfg.Services)
+		var err error
+		rm, err = manager.NewResourceManager(cfg.Pods, cfg.Secrets, cfg.ConfigMaps, cfg.Services, clientSet, recorder, vmClasses, provisioner, informerFactory.Networking().V1().NetworkPolicies().Lister(), managerConfig(providerConfig))
 		if err != nil {
 			return nil, nil, errors.Wrap(err, "could not create resource manager")
 		}
-		p := provider.NewMacOSProvider(
+		if err := metrics.RegisterVMStates(rm.VMStates); err != nil {
+			return nil, nil, errors.Wrap(err, "could not register vm state metrics")
+		}
+		p = provider.NewMacOSProvider(
 			rm,
 			hostName,
 			c.OperatingSystem,
 			os.Getenv("VKUBELET_POD_IP"),
 			c.ListenPort,
+			reserved,
 		)
 		p.ConfigureNode(ctx, cfg.Node)
 		cfg.Node.Status.NodeInfo.KubeletVersion = c.Version
 
-		return p, nil, nil
+		np = provider.NewNodeConditionManager(cfg.Node, p.ProbeHost, provider.NodeConditionThresholds{
+			MemoryAvailablePercent: c.MemoryPressureThreshold,
+			DiskAvailablePercent:   c.DiskPressureThreshold,
+			PIDAvailablePercent:    c.PIDPressureThreshold,
+		}, c.NodeStatusUpdateFrequency)
+
+		return p, np, nil
 	}
 
 	apiConfig, err := getAPIConfig(c)
@@ -149,6 +214,37 @@ func runRootCommand(ctx context.Context, c Opts) error {
 		return err
 	}
 
+	mux.Handle(manager.CapturePath, rm.CaptureHandler())
+
+	if c.ProviderConfigPath != "" {
+		reloader, err := config.NewReloader(c.ProviderConfigPath, providerConfig, func(cfg *config.ProviderConfig) error {
+			if c.VMSlots != 0 {
+				cfg.VMSlots = c.VMSlots
+			}
+			if err := rm.Reconfigure(managerConfig(cfg)); err != nil {
+				return err
+			}
+			np.UpdateStatus(func(status *corev1.NodeStatus) {
+				p.UpdateCapacity(ctx, status)
+			})
+			applyLogLevel(cfg)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		mux.Handle("/debug/config", reloader)
+		go func() {
+			if err := reloader.Run(ctx); err != nil {
+				log.G(ctx).WithError(err).Error("Provider config is not watched for changes")
+			}
+		}()
+	}
+
+	if err := setupMetrics(ctx, apiConfig, providerConfig.ImageStore.Path); err != nil {
+		return err
+	}
+
 	ctx = log.WithLogger(ctx, log.G(ctx).WithFields(log.Fields{
 		"provider":         c.Provider,
 		"operatingSystem":  c.OperatingSystem,
@@ -157,6 +253,15 @@ func runRootCommand(ctx context.Context, c Opts) error {
 	}))
 
 	go cm.Run(ctx) //nolint:errcheck
+	go rm.SyncVolumes(ctx, c.SyncFrequency)
+	go rm.SyncEgress(ctx, c.SyncFrequency)
+	dynamicInformers.Start(ctx.Done())
+	informerFactory.Start(ctx.Done())
+	go func() {
+		if err := provisioner.Run(ctx, c.SyncFrequency); err != nil {
+			log.G(ctx).WithError(err).Error("Local volumes are not provisioned")
+		}
+	}()
 
 	defer func() {
 		log.G(ctx).Debug("Waiting for controllers to be done")
@@ -179,6 +284,99 @@ func runRootCommand(ctx context.Context, c Opts) error {
 	return nil
 }
 
+func setupMetrics(ctx context.Context, apiCfg *apiServerConfig, imageStorePath string) error {
+	if apiCfg.MetricsAddr == "" {
+		return nil
+	}
+	if err := metrics.RegisterDiskFree(imageStorePath); err != nil {
+		return errors.Wrap(err, "could not register disk metrics")
+	}
+	if err := metrics.Serve(ctx, apiCfg.MetricsAddr, http.NewServeMux()); err != nil {
+		return errors.Wrap(err, "could not start metrics server")
+	}
+	log.G(ctx).Infof("Serving metrics on %s", apiCfg.MetricsAddr)
+	return nil
+}
+
+// loadProviderConfig loads the provider configuration file, if any, and
+// applies the flags overriding it.
+func loadProviderConfig(c Opts) (*config.ProviderConfig, error) {
+	providerConfig := config.Default()
+	if c.ProviderConfigPath != "" {
+		var err error
+		providerConfig, err = config.Load(c.ProviderConfigPath)
+		if err != nil {
+			return nil, errdefs.AsInvalidInput(err)
+		}
+	}
+	if c.VMSlots != 0 {
+		if c.VMSlots < 0 {
+			return nil, errdefs.InvalidInput("vm slots must be greater than 0")
+		}
+		providerConfig.VMSlots = c.VMSlots
+	}
+	if n := providerConfig.Network; n.Mode == spec.NetworkModeBridged && n.Interface != "" {
+		if _, err := network.ResolveInterface(context.Background(), n.Interface, vm.BridgedInterfaces()); err != nil {
+			return nil, errdefs.AsInvalidInput(errors.Wrap(err, "network.interface"))
+		}
+	}
+	return providerConfig, nil
+}
+
+// managerConfig returns the configuration of the virtual machines run by the
+// resource manager.
+func managerConfig(providerConfig *config.ProviderConfig) manager.Config {
+	templates := map[string]manager.Template{}
+	for handler, s := range providerConfig.Templates() {
+		templates[handler] = manager.Template{
+			Policy: sizingPolicy(providerConfig, s.BundlePath),
+			Spec:   s,
+		}
+	}
+	var hostPaths volume.Allowlist
+	for _, entry := range providerConfig.Volumes.HostPathAllowlist {
+		hostPaths = append(hostPaths, volume.HostPathRule{Path: entry.Path, ReadOnly: entry.ReadOnly})
+	}
+	return manager.Config{
+		VMSlots:        providerConfig.VMSlots,
+		Templates:      templates,
+		DefaultHandler: providerConfig.DefaultRuntimeHandler,
+		PodsDir:        providerConfig.PodsPath(),
+		HostPaths:      hostPaths,
+		DisksDir:       providerConfig.DisksPath(),
+		Interfaces:     vm.BridgedInterfaces,
+		NodeIP:         func() string { return provider.NodeInternalIP(context.Background()) },
+		Subnet:         providerConfig.Network.Subnet,
+	}
+}
+
+// applyLogLevel sets the log level of the provider configuration, if any.
+// The level has been validated when the configuration was loaded.
+func applyLogLevel(providerConfig *config.ProviderConfig) {
+	if providerConfig.LogLevel == "" {
+		return
+	}
+	if lvl, err := logrus.ParseLevel(providerConfig.LogLevel); err == nil {
+		logrus.SetLevel(lvl)
+	}
+}
+
+// sizingPolicy returns the policy sizing virtual machines from the pod
+// resources, bounded by what the VM bundle supports.
+func sizingPolicy(providerConfig *config.ProviderConfig, bundlePath string) sizing.Policy {
+	defaults := sizing.Size{
+		CPUs:   providerConfig.Sizing.DefaultCPUs,
+		Memory: uint64(providerConfig.Sizing.DefaultMemory.Value()),
+	}
+	if defaults.CPUs == 0 {
+		defaults.CPUs = vm.ComputeCPUCount()
+	}
+	return sizing.Policy{
+		Defaults: defaults,
+		Limits:   vm.SizeLimits(bundlePath),
+	}
+}
+
 func setAuth(node string, apiCfg *apiServerConfig) nodeutil.NodeOpt {
 	if apiCfg.CACertPath == "" {
 		return func(cfg *nodeutil.NodeConfig) error {
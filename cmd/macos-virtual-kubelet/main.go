@@ -9,6 +9,8 @@ import (
 	"syscall"
 
 	"github.com/pkg/errors"
+	"github.com/raikerian/macos-virtual-kubelet/cmd/macos-virtual-kubelet/commands/capture"
+	"github.com/raikerian/macos-virtual-kubelet/cmd/macos-virtual-kubelet/commands/config"
 	"github.com/raikerian/macos-virtual-kubelet/cmd/macos-virtual-kubelet/commands/providers"
 	"github.com/raikerian/macos-virtual-kubelet/cmd/macos-virtual-kubelet/commands/root"
 	"github.com/raikerian/macos-virtual-kubelet/cmd/macos-virtual-kubelet/commands/version"
@@ -43,7 +45,7 @@ func main() {
 	opts.Version = strings.Join([]string{k8sVersion, "vk-macos", buildVersion}, "-")
 
 	rootCmd := root.NewCommand(ctx, filepath.Base(os.Args[0]), opts)
-	rootCmd.AddCommand(version.NewCommand(buildVersion, buildTime), providers.NewCommand())
+	rootCmd.AddCommand(version.NewCommand(buildVersion, buildTime), providers.NewCommand(), config.NewCommand(), capture.NewCommand(ctx))
 	preRun := rootCmd.PreRunE
 
 	var logLevel string
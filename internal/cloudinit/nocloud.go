@@ -0,0 +1,239 @@
+// Package cloudinit generates the cloud-init NoCloud seed disk Linux guests
+// read their hostname, SSH keys and containers from at first boot.
+package cloudinit
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/guest"
+	"github.com/raikerian/macos-virtual-kubelet/internal/iso9660"
+)
+
+// VolumeID is the label cloud-init looks for to find a NoCloud seed.
+const VolumeID = "cidata"
+
+// Names of the seed files.
+const (
+	UserDataFile      = "user-data"
+	MetaDataFile      = "meta-data"
+	NetworkConfigFile = "network-config"
+)
+
+// unitDir is where the systemd units running the containers are written.
+const unitDir = "/etc/systemd/system"
+
+// volumeDir is where the virtio-fs shares and the disks of the volumes are
+// mounted before being bind mounted in the containers.
+const volumeDir = "/run/vk/volumes"
+
+// diskDevice is the device of a disk with the identifier %s.
+const diskDevice = "/dev/disk/by-id/virtio-%s"
+
+// formatDisk formats the disk $1 unless it already has a filesystem, the
+// first time a claim is used.
+const formatDisk = `blkid "$1" >/dev/null || mkfs.ext4 -q "$1"`
+
+// prepareMountPoint creates the mount point $2 of the bind mount of $1: a
+// directory, or an empty file when $1 is a file like a ConfigMap key.
+const prepareMountPoint = `if [ -d "$1" ]; then mkdir -p "$2"; else mkdir -p "$(dirname "$2")" && touch "$2"; fi`
+
+// Files returns the NoCloud seed files of the guest described by m. The
+// manifest itself is included for agents running in the guest.
+func Files(m *guest.Manifest) ([]iso9660.File, error) {
+	metaData, err := yaml.Marshal(map[string]string{
+		"instance-id":    m.Pod.UID,
+		"local-hostname": m.Hostname,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	userData, err := yaml.Marshal(userData(m))
+	if err != nil {
+		return nil, err
+	}
+
+	networkConfig, err := yaml.Marshal(map[string]interface{}{
+		"version": 2,
+		"ethernets": map[string]interface{}{
+			"primary": map[string]interface{}{
+				"match": map[string]string{"driver": "virtio_net"},
+				"dhcp4": true,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return []iso9660.File{
+		{Name: MetaDataFile, Data: metaData},
+		{Name: UserDataFile, Data: append([]byte("#cloud-config\n"), userData...)},
+		{Name: NetworkConfigFile, Data: networkConfig},
+		{Name: guest.ManifestFile, Data: manifest},
+	}, nil
+}
+
+// WriteSeed writes the NoCloud seed image of the guest described by m to path.
+func WriteSeed(path string, m *guest.Manifest) error {
+	files, err := Files(m)
+	if err != nil {
+		return fmt.Errorf("failed to generate the cloud-init seed: %w", err)
+	}
+	if err := iso9660.WriteFile(path, VolumeID, files); err != nil {
+		return fmt.Errorf("failed to write the cloud-init seed: %w", err)
+	}
+	return nil
+}
+
+type writeFile struct {
+	Path        string `json:"path"`
+	Permissions string `json:"permissions"`
+	Content     string `json:"content"`
+}
+
+type growPart struct {
+	Mode    string   `json:"mode"`
+	Devices []string `json:"devices"`
+}
+
+type cloudConfig struct {
+	Hostname          string      `json:"hostname"`
+	SSHAuthorizedKeys []string    `json:"ssh_authorized_keys,omitempty"`
+	GrowPart          *growPart   `json:"growpart,omitempty"`
+	ResizeRootFS      bool        `json:"resize_rootfs,omitempty"`
+	BootCmd           [][]string  `json:"bootcmd,omitempty"`
+	WriteFiles        []writeFile `json:"write_files,omitempty"`
+	RunCmd            [][]string  `json:"runcmd,omitempty"`
+}
+
+// userData returns the cloud-config running every container of m as a
+// systemd service. Containers without a command run what the image boots
+// and get no service, init containers are left to agents reading the
+// manifest. runcmd only runs at the first boot of the instance, so the
+// volumes are mounted from bootcmd and the services are enabled to come
+// back after a reboot of the guest.
+func userData(m *guest.Manifest) cloudConfig {
+	cfg := cloudConfig{
+		Hostname:          m.Hostname,
+		SSHAuthorizedKeys: m.SSHAuthorizedKeys,
+	}
+	if m.GrowDisk {
+		// grow the root partition and file system into the enlarged disk
+		cfg.GrowPart = &growPart{Mode: "auto", Devices: []string{"/"}}
+		cfg.ResizeRootFS = true
+	}
+
+	cfg.BootCmd = mountCommands(m)
+
+	var units []string
+	for _, c := range m.Containers {
+		if len(c.Command) == 0 {
+			continue
+		}
+		unit := "vk-" + c.Name + ".service"
+		cfg.WriteFiles = append(cfg.WriteFiles, writeFile{
+			Path:        unitDir + "/" + unit,
+			Permissions: "0600",
+			Content:     serviceUnit(m, c),
+		})
+		units = append(units, unit)
+	}
+	if len(units) > 0 {
+		cfg.RunCmd = append(cfg.RunCmd, []string{"systemctl", "daemon-reload"})
+		cfg.RunCmd = append(cfg.RunCmd, append([]string{"systemctl", "enable", "--now", "--no-block"}, units...))
+	}
+	return cfg
+}
+
+// mountCommands returns the commands mounting the share or the disk of
+// every volume of m, then bind mounting them where the containers mount
+// them. They run at every boot.
+func mountCommands(m *guest.Manifest) [][]string {
+	var cmds [][]string
+	for _, id := range m.Disks {
+		device := fmt.Sprintf(diskDevice, id)
+		dir := path.Join(volumeDir, id)
+		cmds = append(cmds,
+			[]string{"sh", "-c", formatDisk, "sh", device},
+			[]string{"mkdir", "-p", dir},
+			[]string{"mount", device, dir},
+		)
+	}
+	for _, tag := range m.Volumes {
+		dir := path.Join(volumeDir, tag)
+		cmds = append(cmds,
+			[]string{"mkdir", "-p", dir},
+			[]string{"mount", "-t", "virtiofs", tag, dir},
+		)
+	}
+	for _, c := range append(append([]guest.Container{}, m.InitContainers...), m.Containers...) {
+		for _, mount := range c.VolumeMounts {
+			source := path.Join(volumeDir, mount.Name, mount.SubPath)
+			cmds = append(cmds,
+				[]string{"sh", "-c", prepareMountPoint, "sh", source, mount.MountPath},
+				[]string{"mount", "--bind", source, mount.MountPath},
+			)
+			if mount.ReadOnly {
+				cmds = append(cmds, []string{"mount", "-o", "remount,bind,ro", mount.MountPath})
+			}
+		}
+	}
+	return cmds
+}
+
+// restartPolicies maps the restart policy of a pod to the one of systemd.
+var restartPolicies = map[v1.RestartPolicy]string{
+	v1.RestartPolicyAlways:    "always",
+	v1.RestartPolicyOnFailure: "on-failure",
+	v1.RestartPolicyNever:     "no",
+}
+
+func serviceUnit(m *guest.Manifest, c guest.Container) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=Container %s of pod %s/%s\n", c.Name, m.Pod.Namespace, m.Pod.Name)
+	// cloud-init.service runs bootcmd, which mounts the volumes
+	b.WriteString("Wants=network-online.target\nAfter=network-online.target cloud-init.service\n\n")
+
+	b.WriteString("[Service]\nType=exec\n")
+	if c.WorkingDir != "" {
+		fmt.Fprintf(&b, "WorkingDirectory=%s\n", escapeSpecifiers(c.WorkingDir))
+	}
+	for _, env := range c.Env {
+		fmt.Fprintf(&b, "Environment=%s\n", quote(env.Name+"="+env.Value, false))
+	}
+	args := make([]string, 0, len(c.Command)+len(c.Args))
+	for _, arg := range append(append([]string{}, c.Command...), c.Args...) {
+		args = append(args, quote(arg, true))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	if restart, ok := restartPolicies[m.RestartPolicy]; ok {
+		fmt.Fprintf(&b, "Restart=%s\n", restart)
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// quote quotes s for a systemd unit setting. Variables are expanded by
+// systemd in ExecStart, so "$" is escaped there.
+func quote(s string, exec bool) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(escapeSpecifiers(s))
+	if exec {
+		s = strings.ReplaceAll(s, "$", "$$")
+	}
+	return `"` + s + `"`
+}
+
+func escapeSpecifiers(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
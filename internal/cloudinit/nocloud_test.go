@@ -0,0 +1,98 @@
+package cloudinit
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/guest"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func testManifest() *guest.Manifest {
+	return &guest.Manifest{
+		Version: guest.ManifestVersion,
+		Pod: guest.Pod{
+			Namespace: "default",
+			Name:      "web",
+			UID:       "0b3c5c9e-8a4a-4c1e-9d4f-3f1b2a6c7d8e",
+		},
+		Hostname:          "web-0",
+		SSHAuthorizedKeys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIK0 admin@example.com"},
+		RestartPolicy:     v1.RestartPolicyAlways,
+		Volumes:           []string{"config", "cache"},
+		Disks:             []string{"data"},
+		GrowDisk:          true,
+		Containers: []guest.Container{
+			{
+				Name:       "server",
+				Image:      "ghcr.io/acme/server:1.0",
+				Command:    []string{"/usr/bin/server"},
+				Args:       []string{"--listen", ":8080", "--greeting", `say "hi" for 100% of $USER`},
+				WorkingDir: "/srv",
+				Env: []guest.EnvVar{
+					{Name: "MODE", Value: "production"},
+					{Name: "API_KEY", Value: "s3cr3t"},
+					{Name: "BANNER", Value: "line one\nline two"},
+				},
+				VolumeMounts: []guest.VolumeMount{
+					{Name: "config", MountPath: "/etc/server", ReadOnly: true},
+					{Name: "cache", MountPath: "/var/cache/server"},
+					{Name: "data", MountPath: "/var/lib/server"},
+				},
+			},
+			{
+				// runs what the image boots
+				Name:  "sidecar",
+				Image: "ghcr.io/acme/sidecar:1.0",
+				VolumeMounts: []guest.VolumeMount{
+					{Name: "config", MountPath: "/etc/sidecar.conf", SubPath: "sidecar.conf", ReadOnly: true},
+				},
+			},
+		},
+	}
+}
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run the tests with -update if the change is expected", name)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	files, err := Files(testManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		golden(t, f.Name, f.Data)
+	}
+}
+
+func TestWriteSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	if err := WriteSeed(path, testManifest()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "seed.iso", got)
+}
@@ -0,0 +1,435 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+const (
+	// APIVersion is the version of the provider configuration format.
+	APIVersion = "macos.virtual-kubelet.io/v1alpha1"
+	// Kind is the kind of the provider configuration.
+	Kind = "ProviderConfig"
+)
+
+// Defaults of the provider configuration.
+const (
+	DefaultBundle = "VM.bundle"
+	// DefaultRuntimeHandler is the handler of the pods without a RuntimeClass.
+	DefaultRuntimeHandler = "macos-vm"
+	// DefaultVMSlots is the number of macOS guests Virtualization.framework
+	// and the macOS license allow to run at the same time.
+	DefaultVMSlots       = 2
+	DefaultDisplayWidth  = 1920
+	DefaultDisplayHeight = 1200
+	DefaultPixelsPerInch = 80
+	// DefaultSubnet is the range the subnets of the virtual machines are
+	// taken from in userspace mode.
+	DefaultSubnet = "10.127.0.0/16"
+)
+
+var (
+	// DefaultMemory is the memory of a virtual machine whose pod does not
+	// request any.
+	DefaultMemory = resource.MustParse("4Gi")
+	// DefaultDiskSize is the size of the disk image created for a bundle
+	// without one.
+	DefaultDiskSize = resource.MustParse("128Gi")
+)
+
+// ProviderConfig is the configuration file of the provider, given with
+// --provider-config. It can be written in YAML or JSON.
+type ProviderConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	ImageStore ImageStore `json:"imageStore"`
+	// RuntimeHandlers maps the handlers of the RuntimeClasses pods select
+	// to the guest their virtual machines boot.
+	RuntimeHandlers map[string]RuntimeHandler `json:"runtimeHandlers"`
+	// DefaultRuntimeHandler is the handler of the pods without a RuntimeClass.
+	DefaultRuntimeHandler string `json:"defaultRuntimeHandler"`
+	// VMSlots is the number of virtual machines the node runs at the same
+	// time. macOS allows at most 2 macOS guests.
+	VMSlots int     `json:"vmSlots"`
+	Sizing  Sizing  `json:"sizing"`
+	Network Network `json:"network"`
+	Display Display `json:"display"`
+	Disk    Disk    `json:"disk"`
+	Devices Devices `json:"devices"`
+	Agent   Agent   `json:"agent"`
+	Volumes Volumes `json:"volumes"`
+
+	// LogLevel overrides --log-level when set, e.g. "debug".
+	LogLevel string `json:"logLevel,omitempty"`
+}
+
+// ImageStore locates the VM bundles on the host.
+type ImageStore struct {
+	// Path is the directory holding the VM bundles. Defaults to the home
+	// directory of the user running the provider.
+	Path string `json:"path"`
+	// Bundle is the name of the VM bundle pods are booted from.
+	Bundle string `json:"bundle"`
+}
+
+// RuntimeHandler is the virtual machine template of a RuntimeClass handler.
+type RuntimeHandler struct {
+	Guest spec.Guest `json:"guest"`
+	// Bundle is the name of the VM bundle in the image store. Defaults to
+	// imageStore.bundle.
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// Sizing is the size of a virtual machine whose pod does not request
+// resources.
+type Sizing struct {
+	// DefaultCPUs is the number of vCPUs. When 0, all but one of the host
+	// CPUs are used.
+	DefaultCPUs uint `json:"defaultCPUs"`
+	// DefaultMemory is the memory size.
+	DefaultMemory resource.Quantity `json:"defaultMemory"`
+}
+
+// Network is the network attachment of the virtual machines.
+type Network struct {
+	// Mode is bridged, nat, isolated or userspace.
+	Mode spec.NetworkMode `json:"mode"`
+	// Interface is the host interface bridged in bridged mode, the
+	// interface of the default route when empty.
+	Interface string `json:"interface"`
+	// Subnet is the IPv4 range the subnets of the virtual machines are
+	// taken from in userspace mode, a /24 each.
+	Subnet string `json:"subnet"`
+}
+
+// Display is the graphics display of the virtual machines.
+type Display struct {
+	Width         int64 `json:"width"`
+	Height        int64 `json:"height"`
+	PixelsPerInch int64 `json:"pixelsPerInch"`
+}
+
+// Disk is the disk image of the virtual machines.
+type Disk struct {
+	// Size is the size the disk image is created with when the bundle does
+	// not have one yet.
+	Size resource.Quantity `json:"size"`
+}
+
+// Devices selects the optional devices attached to the virtual machines.
+// All of them are attached by default.
+type Devices struct {
+	Audio    *bool `json:"audio,omitempty"`
+	Keyboard *bool `json:"keyboard,omitempty"`
+	Pointing *bool `json:"pointing,omitempty"`
+}
+
+// Agent configures the connection to the guest agent.
+type Agent struct {
+	// VsockPort is the virtio socket port the guest agent listens on. The
+	// socket device is not attached when it is 0.
+	VsockPort uint32 `json:"vsockPort"`
+}
+
+// Volumes configures the volumes pods can share with their virtual
+// machines.
+type Volumes struct {
+	// HostPathAllowlist lists the host directories hostPath volumes can
+	// share. Pods with other hostPath volumes are rejected.
+	HostPathAllowlist []HostPathEntry `json:"hostPathAllowlist,omitempty"`
+}
+
+// HostPathEntry allows the hostPath volumes of a host directory or of a
+// directory under it, e.g. a Homebrew or CocoaPods cache.
+type HostPathEntry struct {
+	// Path is an absolute host directory.
+	Path string `json:"path"`
+	// ReadOnly shares the volumes read-only, whatever the pod mounts.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// Default returns a configuration with every field defaulted.
+func Default() *ProviderConfig {
+	cfg := &ProviderConfig{}
+	SetDefaults(cfg)
+	return cfg
+}
+
+// Load reads the configuration file at path, defaults and validates it.
+// Unknown fields are rejected.
+func Load(path string) (*ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provider config: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse decodes a YAML or JSON configuration, defaults and validates it.
+// Unknown fields are rejected.
+func Parse(data []byte) (*ProviderConfig, error) {
+	cfg := &ProviderConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode provider config: %w", err)
+	}
+	SetDefaults(cfg)
+	if errs := Validate(cfg); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid provider config: %w", errs.ToAggregate())
+	}
+	return cfg, nil
+}
+
+// SetDefaults fills the unset fields of cfg.
+func SetDefaults(cfg *ProviderConfig) {
+	if cfg.APIVersion == "" {
+		cfg.APIVersion = APIVersion
+	}
+	if cfg.Kind == "" {
+		cfg.Kind = Kind
+	}
+
+	if cfg.ImageStore.Path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			cfg.ImageStore.Path = home
+		}
+	}
+	if cfg.ImageStore.Bundle == "" {
+		cfg.ImageStore.Bundle = DefaultBundle
+	}
+
+	if cfg.RuntimeHandlers == nil {
+		cfg.RuntimeHandlers = map[string]RuntimeHandler{
+			DefaultRuntimeHandler: {Guest: spec.GuestMacOS},
+		}
+	}
+	for name, h := range cfg.RuntimeHandlers {
+		if h.Bundle == "" {
+			h.Bundle = cfg.ImageStore.Bundle
+			cfg.RuntimeHandlers[name] = h
+		}
+	}
+	if cfg.DefaultRuntimeHandler == "" {
+		cfg.DefaultRuntimeHandler = DefaultRuntimeHandler
+	}
+
+	if cfg.VMSlots == 0 {
+		cfg.VMSlots = DefaultVMSlots
+	}
+
+	if cfg.Sizing.DefaultMemory.IsZero() {
+		cfg.Sizing.DefaultMemory = DefaultMemory.DeepCopy()
+	}
+
+	if cfg.Network.Mode == "" {
+		cfg.Network.Mode = spec.NetworkModeBridged
+	}
+	if cfg.Network.Subnet == "" {
+		cfg.Network.Subnet = DefaultSubnet
+	}
+
+	if cfg.Display.Width == 0 {
+		cfg.Display.Width = DefaultDisplayWidth
+	}
+	if cfg.Display.Height == 0 {
+		cfg.Display.Height = DefaultDisplayHeight
+	}
+	if cfg.Display.PixelsPerInch == 0 {
+		cfg.Display.PixelsPerInch = DefaultPixelsPerInch
+	}
+
+	if cfg.Disk.Size.IsZero() {
+		cfg.Disk.Size = DefaultDiskSize.DeepCopy()
+	}
+
+	for _, device := range []**bool{&cfg.Devices.Audio, &cfg.Devices.Keyboard, &cfg.Devices.Pointing} {
+		if *device == nil {
+			enabled := true
+			*device = &enabled
+		}
+	}
+}
+
+// Validate returns the problems of a defaulted configuration.
+func Validate(cfg *ProviderConfig) field.ErrorList {
+	var errs field.ErrorList
+
+	if cfg.APIVersion != APIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), cfg.APIVersion, []string{APIVersion}))
+	}
+	if cfg.Kind != Kind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), cfg.Kind, []string{Kind}))
+	}
+
+	imageStore := field.NewPath("imageStore")
+	if !filepath.IsAbs(cfg.ImageStore.Path) {
+		errs = append(errs, field.Invalid(imageStore.Child("path"), cfg.ImageStore.Path, "must be an absolute path"))
+	}
+	if cfg.ImageStore.Bundle != filepath.Base(cfg.ImageStore.Bundle) {
+		errs = append(errs, field.Invalid(imageStore.Child("bundle"), cfg.ImageStore.Bundle, "must be a directory name inside the image store"))
+	}
+
+	handlers := field.NewPath("runtimeHandlers")
+	for _, name := range cfg.HandlerNames() {
+		h := cfg.RuntimeHandlers[name]
+		for _, msg := range validation.IsDNS1123Label(name) {
+			errs = append(errs, field.Invalid(handlers.Key(name), name, msg))
+		}
+		if !supportedGuests[h.Guest] {
+			errs = append(errs, field.NotSupported(handlers.Key(name).Child("guest"), h.Guest, guestNames()))
+		}
+		if h.Bundle != filepath.Base(h.Bundle) {
+			errs = append(errs, field.Invalid(handlers.Key(name).Child("bundle"), h.Bundle, "must be a directory name inside the image store"))
+		}
+	}
+	if _, ok := cfg.RuntimeHandlers[cfg.DefaultRuntimeHandler]; !ok {
+		errs = append(errs, field.NotSupported(field.NewPath("defaultRuntimeHandler"), cfg.DefaultRuntimeHandler, cfg.HandlerNames()))
+	}
+
+	if cfg.VMSlots < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("vmSlots"), cfg.VMSlots, "must not be negative"))
+	}
+
+	if cfg.Sizing.DefaultMemory.Sign() < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("sizing", "defaultMemory"), cfg.Sizing.DefaultMemory.String(), "must not be negative"))
+	}
+
+	network := field.NewPath("network")
+	switch cfg.Network.Mode {
+	case spec.NetworkModeBridged:
+	case spec.NetworkModeNAT, spec.NetworkModeIsolated, spec.NetworkModeUserspace:
+		if cfg.Network.Interface != "" {
+			errs = append(errs, field.Forbidden(network.Child("interface"), "only used in bridged mode"))
+		}
+	default:
+		errs = append(errs, field.NotSupported(network.Child("mode"), cfg.Network.Mode, []string{string(spec.NetworkModeBridged), string(spec.NetworkModeNAT), string(spec.NetworkModeIsolated), string(spec.NetworkModeUserspace)}))
+	}
+	if subnet, err := netip.ParsePrefix(cfg.Network.Subnet); err != nil || !subnet.Addr().Is4() || subnet.Bits() > 24 {
+		errs = append(errs, field.Invalid(network.Child("subnet"), cfg.Network.Subnet, "must be an IPv4 range of at least a /24"))
+	}
+
+	display := field.NewPath("display")
+	for _, d := range []struct {
+		name  string
+		value int64
+	}{
+		{"width", cfg.Display.Width},
+		{"height", cfg.Display.Height},
+		{"pixelsPerInch", cfg.Display.PixelsPerInch},
+	} {
+		if d.value < 0 {
+			errs = append(errs, field.Invalid(display.Child(d.name), d.value, "must not be negative"))
+		}
+	}
+
+	if cfg.Disk.Size.Sign() < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("disk", "size"), cfg.Disk.Size.String(), "must not be negative"))
+	}
+
+	allowlist := field.NewPath("volumes", "hostPathAllowlist")
+	for i, entry := range cfg.Volumes.HostPathAllowlist {
+		if !filepath.IsAbs(entry.Path) || filepath.Clean(entry.Path) != entry.Path {
+			errs = append(errs, field.Invalid(allowlist.Index(i).Child("path"), entry.Path, "must be a clean absolute path"))
+		}
+	}
+
+	if cfg.LogLevel != "" {
+		if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("logLevel"), cfg.LogLevel, err.Error()))
+		}
+	}
+
+	return errs
+}
+
+// supportedGuests are the guests a runtime handler can boot.
+var supportedGuests = map[spec.Guest]bool{
+	spec.GuestMacOS: true,
+	spec.GuestLinux: true,
+}
+
+func guestNames() []string {
+	var names []string
+	for g := range supportedGuests {
+		names = append(names, string(g))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HandlerNames returns the sorted names of the runtime handlers.
+func (cfg *ProviderConfig) HandlerNames() []string {
+	names := make([]string, 0, len(cfg.RuntimeHandlers))
+	for name := range cfg.RuntimeHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BundlePath returns the path of the VM bundle pods are booted from.
+func (cfg *ProviderConfig) BundlePath() string {
+	return filepath.Join(cfg.ImageStore.Path, cfg.ImageStore.Bundle)
+}
+
+// PodsPath returns the directory holding the files generated for each pod,
+// e.g. the cloud-init seed of Linux guests.
+func (cfg *ProviderConfig) PodsPath() string {
+	return filepath.Join(cfg.ImageStore.Path, "pods")
+}
+
+// DisksPath returns the directory holding the disk images of the
+// PersistentVolumes provisioned on this node.
+func (cfg *ProviderConfig) DisksPath() string {
+	return filepath.Join(cfg.ImageStore.Path, "disks")
+}
+
+// Templates returns the specs the virtual machines of each runtime handler
+// are created from, without a size as it depends on the pod.
+func (cfg *ProviderConfig) Templates() map[string]spec.Spec {
+	templates := make(map[string]spec.Spec, len(cfg.RuntimeHandlers))
+	for name, h := range cfg.RuntimeHandlers {
+		t := cfg.template()
+		t.Guest = h.Guest
+		t.BundlePath = filepath.Join(cfg.ImageStore.Path, h.Bundle)
+		templates[name] = t
+	}
+	return templates
+}
+
+func (cfg *ProviderConfig) template() spec.Spec {
+	return spec.Spec{
+		BundlePath: cfg.BundlePath(),
+		DiskSize:   uint64(cfg.Disk.Size.Value()),
+		Display: spec.Display{
+			Width:         cfg.Display.Width,
+			Height:        cfg.Display.Height,
+			PixelsPerInch: cfg.Display.PixelsPerInch,
+		},
+		Network: spec.Network{
+			Mode:      cfg.Network.Mode,
+			Interface: cfg.Network.Interface,
+		},
+		Devices: spec.Devices{
+			Audio:    enabled(cfg.Devices.Audio),
+			Keyboard: enabled(cfg.Devices.Keyboard),
+			Pointing: enabled(cfg.Devices.Pointing),
+		},
+		AgentPort: cfg.Agent.VsockPort,
+	}
+}
+
+func enabled(b *bool) bool {
+	return b == nil || *b
+}
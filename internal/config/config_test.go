@@ -0,0 +1,149 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+	"sigs.k8s.io/yaml"
+)
+
+func TestParseDefaults(t *testing.T) {
+	cfg, err := Parse([]byte("imageStore:\n  path: /Users/vk/images\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.APIVersion != APIVersion || cfg.Kind != Kind {
+		t.Errorf("expected %s/%s, got %s/%s", APIVersion, Kind, cfg.APIVersion, cfg.Kind)
+	}
+	if cfg.VMSlots != DefaultVMSlots {
+		t.Errorf("expected %d vm slots, got %d", DefaultVMSlots, cfg.VMSlots)
+	}
+
+	want := spec.Spec{
+		Guest:      spec.GuestMacOS,
+		BundlePath: "/Users/vk/images/VM.bundle",
+		DiskSize:   128 << 30,
+		Display:    spec.Display{Width: 1920, Height: 1200, PixelsPerInch: 80},
+		Network:    spec.Network{Mode: spec.NetworkModeBridged},
+		Devices:    spec.Devices{Audio: true, Keyboard: true, Pointing: true},
+	}
+	if got := cfg.Templates()[DefaultRuntimeHandler]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected template %+v, got %+v", want, got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := `
+apiVersion: macos.virtual-kubelet.io/v1alpha1
+kind: ProviderConfig
+imageStore:
+  path: /var/vms
+  bundle: sonoma.bundle
+vmSlots: 1
+network:
+  mode: nat
+display:
+  width: 1024
+  height: 768
+devices:
+  audio: false
+agent:
+  vsockPort: 1024
+volumes:
+  hostPathAllowlist:
+  - path: /Users/ci/Library/Caches/Homebrew
+    readOnly: true
+  - path: /Users/ci/Library/Developer/Xcode/DerivedData
+`
+	cfg, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := cfg.Templates()[DefaultRuntimeHandler]
+	if got.BundlePath != "/var/vms/sonoma.bundle" {
+		t.Errorf("unexpected bundle path %q", got.BundlePath)
+	}
+	if got.Network != (spec.Network{Mode: spec.NetworkModeNAT}) {
+		t.Errorf("expected nat without an interface, got %+v", got.Network)
+	}
+	if got.Display != (spec.Display{Width: 1024, Height: 768, PixelsPerInch: DefaultPixelsPerInch}) {
+		t.Errorf("unexpected display %+v", got.Display)
+	}
+	if got.Devices != (spec.Devices{Keyboard: true, Pointing: true}) {
+		t.Errorf("unexpected devices %+v", got.Devices)
+	}
+	if got.AgentPort != 1024 {
+		t.Errorf("expected agent port 1024, got %d", got.AgentPort)
+	}
+	if cfg.VMSlots != 1 {
+		t.Errorf("expected 1 vm slot, got %d", cfg.VMSlots)
+	}
+	allowlist := cfg.Volumes.HostPathAllowlist
+	if len(allowlist) != 2 || allowlist[0] != (HostPathEntry{Path: "/Users/ci/Library/Caches/Homebrew", ReadOnly: true}) {
+		t.Errorf("unexpected hostPath allowlist %+v", allowlist)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	cfg, err := Parse([]byte(`{"imageStore": {"path": "/var/vms"}, "vmSlots": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.VMSlots != 1 {
+		t.Errorf("expected 1 vm slot, got %d", cfg.VMSlots)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "unknown field", data: "vmSlot: 1", want: `unknown field "vmSlot"`},
+		{name: "unknown version", data: "apiVersion: v2", want: "apiVersion"},
+		{name: "unknown kind", data: "kind: Pod", want: "kind"},
+		{name: "relative image store", data: "imageStore:\n  path: vms", want: "imageStore.path"},
+		{name: "nested bundle", data: "imageStore:\n  bundle: a/b", want: "imageStore.bundle"},
+		{name: "negative vm slots", data: "vmSlots: -1", want: "vmSlots"},
+		{name: "unknown network mode", data: "network:\n  mode: host", want: "network.mode"},
+		{name: "interface in nat mode", data: "network:\n  mode: nat\n  interface: en1", want: "network.interface"},
+		{name: "interface in isolated mode", data: "network:\n  mode: isolated\n  interface: en1", want: "network.interface"},
+		{name: "interface in userspace mode", data: "network:\n  mode: userspace\n  interface: en1", want: "network.interface"},
+		{name: "small subnet", data: "network:\n  mode: userspace\n  subnet: 10.127.0.0/25", want: "network.subnet"},
+		{name: "IPv6 subnet", data: "network:\n  subnet: fd00::/48", want: "network.subnet"},
+		{name: "negative display", data: "display:\n  width: -1", want: "display.width"},
+		{name: "negative disk", data: "disk:\n  size: -1Gi", want: "disk.size"},
+		{name: "unknown guest", data: "runtimeHandlers:\n  windows-vm:\n    guest: windows", want: "runtimeHandlers[windows-vm].guest"},
+		{name: "invalid handler name", data: "runtimeHandlers:\n  Mac_VM:\n    guest: macos\ndefaultRuntimeHandler: Mac_VM", want: "runtimeHandlers[Mac_VM]"},
+		{name: "unknown default handler", data: "defaultRuntimeHandler: linux-vm", want: "defaultRuntimeHandler"},
+		{name: "invalid quantity", data: "sizing:\n  defaultMemory: lots", want: "quantities must match"},
+		{name: "relative host path", data: "volumes:\n  hostPathAllowlist:\n  - path: caches", want: "volumes.hostPathAllowlist[0].path"},
+		{name: "unclean host path", data: "volumes:\n  hostPathAllowlist:\n  - path: /Users/ci/../root", want: "volumes.hostPathAllowlist[0].path"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.data))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected error to mention %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestDefaultRoundTrip(t *testing.T) {
+	data, err := yaml.Marshal(Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(data); err != nil {
+		t.Fatalf("expected printed defaults to be valid, got %v", err)
+	}
+}
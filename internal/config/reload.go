@@ -0,0 +1,266 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/metrics"
+)
+
+// Results of a reload, used as the label of metrics.ConfigReloads.
+const (
+	ReloadApplied  = "applied"
+	ReloadRejected = "rejected"
+	ReloadFailed   = "failed"
+)
+
+// restartRequired lists the fields that cannot change while the provider
+// runs. Every other field is applied live.
+var restartRequired = []string{
+	"apiVersion",
+	"kind",
+	"imageStore",
+	"runtimeHandlers",
+	"defaultRuntimeHandler",
+	"network",
+	"agent",
+}
+
+// Change is a field that differs between two configurations.
+type Change struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+}
+
+// RequiresRestart reports whether the change can only be applied by
+// restarting the provider.
+func (c Change) RequiresRestart() bool {
+	for _, p := range restartRequired {
+		if c.Path == p || strings.HasPrefix(c.Path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns the fields that differ between old and new, sorted by path.
+func Diff(old, new *ProviderConfig) ([]Change, error) {
+	oldFields, err := flatten(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flatten(new)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for path, v := range oldFields {
+		if nv, ok := newFields[path]; !ok || nv != v {
+			changes = append(changes, Change{Path: path, Old: v, New: newFields[path]})
+		}
+	}
+	for path, v := range newFields {
+		if _, ok := oldFields[path]; !ok {
+			changes = append(changes, Change{Path: path, New: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// flatten returns the leaf values of the JSON form of cfg keyed by their
+// dotted path, e.g. "network.mode".
+func flatten(cfg *ProviderConfig) (map[string]interface{}, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				if prefix != "" {
+					k = prefix + "." + k
+				}
+				walk(k, child)
+			}
+		case []interface{}:
+			// lists are compared as a whole
+			data, _ := json.Marshal(v)
+			fields[prefix] = string(data)
+		default:
+			fields[prefix] = v
+		}
+	}
+	walk("", tree)
+	return fields, nil
+}
+
+// Revision identifies the content of a configuration file.
+func Revision(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Reloader watches the configuration file and applies the changes that do
+// not require a restart.
+type Reloader struct {
+	path  string
+	apply func(*ProviderConfig) error
+
+	mu       sync.RWMutex
+	current  *ProviderConfig
+	revision string
+}
+
+// NewReloader returns a Reloader for the configuration file at path, whose
+// content is cfg. apply is called with every accepted configuration.
+func NewReloader(path string, cfg *ProviderConfig, apply func(*ProviderConfig) error) (*Reloader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provider config: %w", err)
+	}
+	r := &Reloader{
+		path:     path,
+		apply:    apply,
+		current:  cfg,
+		revision: Revision(data),
+	}
+	metrics.SetConfigRevision(r.revision)
+	return r, nil
+}
+
+// Current returns the active configuration and its revision.
+func (r *Reloader) Current() (*ProviderConfig, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current, r.revision
+}
+
+// Run reloads the configuration every time the file changes until ctx is
+// done. The parent directory is watched so that files replaced by rename,
+// like mounted ConfigMaps, are picked up too.
+func (r *Reloader) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+		return fmt.Errorf("failed to watch provider config: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			log.G(ctx).WithError(err).Warn("Error watching provider config")
+		case event := <-watcher.Events:
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if _, err := r.Reload(ctx); err != nil {
+				log.G(ctx).WithError(err).Error("Provider config was not reloaded")
+			}
+		}
+	}
+}
+
+// Reload reads the configuration file and applies it if it changed and
+// does not require a restart. It returns the applied changes.
+func (r *Reloader) Reload(ctx context.Context) ([]Change, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the file is being replaced
+			return nil, nil
+		}
+		metrics.ConfigReloads.WithLabelValues(ReloadFailed).Inc()
+		return nil, fmt.Errorf("failed to read provider config: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	revision := Revision(data)
+	if revision == r.revision {
+		return nil, nil
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues(ReloadFailed).Inc()
+		return nil, err
+	}
+
+	changes, err := Diff(r.current, cfg)
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues(ReloadFailed).Inc()
+		return nil, err
+	}
+	var restart []string
+	for _, c := range changes {
+		if c.RequiresRestart() {
+			restart = append(restart, c.Path)
+		}
+	}
+	if len(restart) > 0 {
+		metrics.ConfigReloads.WithLabelValues(ReloadRejected).Inc()
+		return nil, fmt.Errorf("revision %s changes %s which require a restart", revision, strings.Join(restart, ", "))
+	}
+
+	if err := r.apply(cfg); err != nil {
+		metrics.ConfigReloads.WithLabelValues(ReloadFailed).Inc()
+		return nil, fmt.Errorf("failed to apply revision %s: %w", revision, err)
+	}
+
+	logger := log.G(ctx).WithField("revision", revision)
+	for _, c := range changes {
+		logger.Infof("Provider config changed %s", c)
+	}
+
+	r.current = cfg
+	r.revision = revision
+	metrics.ConfigReloads.WithLabelValues(ReloadApplied).Inc()
+	metrics.SetConfigRevision(revision)
+	return changes, nil
+}
+
+// ServeHTTP serves the active configuration and its revision as JSON.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cfg, revision := r.Current()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Revision string          `json:"revision"`
+		Config   *ProviderConfig `json:"config"`
+	}{revision, cfg}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestReloader(t *testing.T, data string, apply func(*ProviderConfig) error) (*Reloader, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, data)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(path, cfg, apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, path
+}
+
+func TestDiff(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.VMSlots = 1
+	new.Network.Mode = "isolated"
+	new.LogLevel = "debug"
+
+	changes, err := Diff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"logLevel: <nil> -> debug",
+		"network.mode: bridged -> isolated",
+		"vmSlots: 2 -> 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected changes\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	for _, c := range changes {
+		if restart := strings.HasPrefix(c.Path, "network."); c.RequiresRestart() != restart {
+			t.Errorf("expected %s to require a restart: %t", c.Path, restart)
+		}
+	}
+}
+
+func TestReloadAppliesLiveChanges(t *testing.T) {
+	var applied *ProviderConfig
+	r, path := newTestReloader(t, "imageStore:\n  path: /var/vms\n", func(cfg *ProviderConfig) error {
+		applied = cfg
+		return nil
+	})
+	_, before := r.Current()
+
+	writeConfig(t, path, "imageStore:\n  path: /var/vms\nvmSlots: 1\nlogLevel: debug\n")
+	changes, err := r.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("expected 2 changes, got %v", changes)
+	}
+	if applied == nil || applied.VMSlots != 1 {
+		t.Fatalf("expected the new config to be applied, got %+v", applied)
+	}
+	cfg, after := r.Current()
+	if cfg != applied || after == before {
+		t.Errorf("expected revision %s to replace %s", after, before)
+	}
+
+	// an unchanged file is not applied again
+	applied = nil
+	if _, err := r.Reload(context.Background()); err != nil || applied != nil {
+		t.Errorf("expected unchanged config to be skipped, got %v", err)
+	}
+}
+
+func TestReloadAppliesHostPathAllowlist(t *testing.T) {
+	var applied *ProviderConfig
+	r, path := newTestReloader(t, "imageStore:\n  path: /var/vms\n", func(cfg *ProviderConfig) error {
+		applied = cfg
+		return nil
+	})
+
+	writeConfig(t, path, "imageStore:\n  path: /var/vms\nvolumes:\n  hostPathAllowlist:\n  - path: /Users/ci/cache\n    readOnly: true\n")
+	if _, err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if applied == nil || len(applied.Volumes.HostPathAllowlist) != 1 {
+		t.Fatalf("expected the allowlist to be applied live, got %+v", applied)
+	}
+}
+
+func TestReloadRejectsRestartRequiredChanges(t *testing.T) {
+	r, path := newTestReloader(t, "imageStore:\n  path: /var/vms\n", func(cfg *ProviderConfig) error {
+		t.Fatal("expected the config not to be applied")
+		return nil
+	})
+	_, before := r.Current()
+
+	writeConfig(t, path, "imageStore:\n  path: /var/other\nvmSlots: 1\n")
+	_, err := r.Reload(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "imageStore.path") {
+		t.Fatalf("expected imageStore.path to require a restart, got %v", err)
+	}
+	if cfg, after := r.Current(); after != before || cfg.VMSlots != DefaultVMSlots {
+		t.Errorf("expected the active config to be kept")
+	}
+
+	writeConfig(t, path, "vmSlots: [")
+	if _, err := r.Reload(context.Background()); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+}
+
+func TestRunReloadsOnWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	applied := make(chan *ProviderConfig, 1)
+	r, path := newTestReloader(t, "imageStore:\n  path: /var/vms\n", func(cfg *ProviderConfig) error {
+		select {
+		case applied <- cfg:
+		default:
+		}
+		return nil
+	})
+	go r.Run(ctx) //nolint:errcheck
+
+	// the watch may not be set up yet, keep writing until it is
+	for i := 1; i <= 50; i++ {
+		writeConfig(t, path, fmt.Sprintf("imageStore:\n  path: /var/vms\nvmSlots: %d\n", i))
+		select {
+		case cfg := <-applied:
+			if cfg.VMSlots == DefaultVMSlots && i != DefaultVMSlots {
+				t.Errorf("expected vm slots to be reloaded, got %d", cfg.VMSlots)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("config was not reloaded")
+}
+
+func TestReloaderServeHTTP(t *testing.T) {
+	r, _ := newTestReloader(t, "imageStore:\n  path: /var/vms\n", nil)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/debug/config", nil))
+
+	var body struct {
+		Revision string         `json:"revision"`
+		Config   ProviderConfig `json:"config"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if _, revision := r.Current(); body.Revision != revision {
+		t.Errorf("expected revision %s, got %s", revision, body.Revision)
+	}
+	if body.Config.ImageStore.Path != "/var/vms" {
+		t.Errorf("unexpected config %+v", body.Config)
+	}
+}
@@ -0,0 +1,368 @@
+// Package egress decides which destinations the guest of a pod may connect
+// to, from the egress annotations of the pod or, without them, from the
+// NetworkPolicies selecting it.
+package egress
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+const (
+	// AnnotationAllow lists the only destinations the guest may connect
+	// to, e.g. "10.0.0.0/8, tcp://mirror.example.com:443". Entries are
+	// [protocol://]destination[:port[-endPort]], destinations being an
+	// address, a CIDR or a DNS name, "*." matching its subdomains.
+	AnnotationAllow = spec.AnnotationPrefix + "egress-allow"
+	// AnnotationDeny lists the destinations the guest may not connect to,
+	// in the format of AnnotationAllow. It takes precedence over it.
+	AnnotationDeny = spec.AnnotationPrefix + "egress-deny"
+)
+
+// ProtocolICMP is the protocol of ICMP flows. They only match the rules
+// without ports.
+const ProtocolICMP v1.Protocol = "ICMP"
+
+// Policy restricts the destinations of a guest. A nil Policy allows every
+// destination.
+type Policy struct {
+	// Source describes where the policy comes from, for logs.
+	Source string
+	// Deny are the rules of the denied destinations.
+	Deny []Rule
+	// Allow are the rules of the allowed destinations when Restricted.
+	Allow []Rule
+	// Restricted denies the destinations matching no rule of Allow.
+	Restricted bool
+}
+
+// Rule matches the destinations in CIDR, but not in Except, or those
+// resolved from Name, on Ports.
+type Rule struct {
+	CIDR   netip.Prefix
+	Except []netip.Prefix
+	// Name is a DNS name, "*.example.com" matching the subdomains of
+	// example.com.
+	Name string
+	// Ports are the matched ports, every port of every protocol when empty.
+	Ports []PortRange
+}
+
+// PortRange is a range of ports of a protocol. Port 0 stands for every
+// port.
+type PortRange struct {
+	Protocol v1.Protocol
+	Port     uint16
+	EndPort  uint16
+}
+
+// Allows reports whether the guest may send a new flow of protocol to dst,
+// resolved from the DNS names in names.
+func (p *Policy) Allows(protocol v1.Protocol, dst netip.AddrPort, names []string) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p.Deny {
+		if r.matches(protocol, dst, names) {
+			return false
+		}
+	}
+	if !p.Restricted {
+		return true
+	}
+	for _, r := range p.Allow {
+		if r.matches(protocol, dst, names) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(protocol v1.Protocol, dst netip.AddrPort, names []string) bool {
+	if !r.matchesPort(protocol, dst.Port()) {
+		return false
+	}
+	if r.Name != "" {
+		for _, name := range names {
+			if matchName(r.Name, name) {
+				return true
+			}
+		}
+		return false
+	}
+	if !r.CIDR.Contains(dst.Addr()) {
+		return false
+	}
+	for _, except := range r.Except {
+		if except.Contains(dst.Addr()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Rule) matchesPort(protocol v1.Protocol, port uint16) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p.Protocol != protocol {
+			continue
+		}
+		if p.Port == 0 || port == p.Port || (p.EndPort != 0 && port >= p.Port && port <= p.EndPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName reports whether name, e.g. "mirror.example.com.", matches the
+// pattern of a rule.
+func matchName(pattern, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(name, "."+suffix)
+	}
+	return name == pattern
+}
+
+// FromAnnotations returns the policy of the egress annotations, or nil
+// when the pod has none.
+func FromAnnotations(annotations map[string]string) (*Policy, error) {
+	allow, hasAllow := annotations[AnnotationAllow]
+	deny, hasDeny := annotations[AnnotationDeny]
+	if !hasAllow && !hasDeny {
+		return nil, nil
+	}
+	p := &Policy{Source: "annotations", Restricted: hasAllow}
+	var err error
+	if p.Allow, err = parseRules(allow); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", AnnotationAllow, err)
+	}
+	if p.Deny, err = parseRules(deny); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", AnnotationDeny, err)
+	}
+	return p, nil
+}
+
+func parseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		r, err := parseRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseRule parses [protocol://]destination[:port[-endPort]].
+func parseRule(entry string) (Rule, error) {
+	var r Rule
+	rest := entry
+	protocol, dst, hasProtocol := strings.Cut(rest, "://")
+	if hasProtocol {
+		rest = dst
+		switch p := v1.Protocol(strings.ToUpper(protocol)); p {
+		case v1.ProtocolTCP, v1.ProtocolUDP:
+			r.Ports = []PortRange{{Protocol: p}}
+		default:
+			return r, fmt.Errorf("%q: protocol must be tcp or udp", entry)
+		}
+	}
+
+	if host, ports, ok := strings.Cut(rest, ":"); ok {
+		rest = host
+		from, to, isRange := strings.Cut(ports, "-")
+		port, err := parsePort(from)
+		if err != nil {
+			return r, fmt.Errorf("%q: %w", entry, err)
+		}
+		var end uint16
+		if isRange {
+			if end, err = parsePort(to); err != nil {
+				return r, fmt.Errorf("%q: %w", entry, err)
+			}
+			if end < port {
+				return r, fmt.Errorf("%q: port range ends before it starts", entry)
+			}
+		}
+		if !hasProtocol {
+			r.Ports = []PortRange{{Protocol: v1.ProtocolTCP}, {Protocol: v1.ProtocolUDP}}
+		}
+		for i := range r.Ports {
+			r.Ports[i].Port, r.Ports[i].EndPort = port, end
+		}
+	}
+
+	if prefix, err := netip.ParsePrefix(rest); err == nil {
+		r.CIDR = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(rest); err == nil {
+		r.CIDR = netip.PrefixFrom(addr, addr.BitLen())
+	} else if validName(rest) {
+		r.Name = strings.ToLower(rest)
+	} else {
+		return r, fmt.Errorf("%q: destination must be an address, a CIDR or a DNS name", entry)
+	}
+	return r, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+func validName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FromNetworkPolicies returns the policy of the egress rules of the
+// policies selecting pod, or nil when none restricts its egress.
+//
+// Only ipBlock peers are enforced: the pods and namespaces matched by the
+// selectors of other peers are not reachable from a userspace network by
+// their pod IP. Named ports are skipped for the same reason.
+func FromNetworkPolicies(pod *v1.Pod, policies []*networkingv1.NetworkPolicy) *Policy {
+	var (
+		p     = &Policy{Restricted: true}
+		names []string
+	)
+	for _, np := range policies {
+		if np.Namespace != pod.Namespace || !restrictsEgress(np) {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+		if err != nil || !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		names = append(names, np.Name)
+		for _, rule := range np.Spec.Egress {
+			ports, ok := policyPorts(rule.Ports)
+			if !ok {
+				continue
+			}
+			if len(rule.To) == 0 {
+				p.Allow = append(p.Allow,
+					Rule{CIDR: netip.MustParsePrefix("0.0.0.0/0"), Ports: ports},
+					Rule{CIDR: netip.MustParsePrefix("::/0"), Ports: ports})
+				continue
+			}
+			for _, peer := range rule.To {
+				if peer.IPBlock == nil {
+					continue
+				}
+				r, err := ipBlockRule(peer.IPBlock)
+				if err != nil {
+					continue
+				}
+				r.Ports = ports
+				p.Allow = append(p.Allow, r)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	p.Source = "NetworkPolicy " + strings.Join(names, ",")
+	return p
+}
+
+func restrictsEgress(np *networkingv1.NetworkPolicy) bool {
+	for _, t := range np.Spec.PolicyTypes {
+		if t == networkingv1.PolicyTypeEgress {
+			return true
+		}
+	}
+	// policies without types restrict egress when they have egress rules
+	return len(np.Spec.PolicyTypes) == 0 && len(np.Spec.Egress) > 0
+}
+
+// policyPorts converts the ports of an egress rule. It reports false when
+// none of them can be enforced, so that the rule allows nothing.
+func policyPorts(ports []networkingv1.NetworkPolicyPort) ([]PortRange, bool) {
+	var ranges []PortRange
+	for _, p := range ports {
+		r := PortRange{Protocol: v1.ProtocolTCP}
+		if p.Protocol != nil {
+			r.Protocol = *p.Protocol
+		}
+		if p.Port != nil {
+			if p.Port.IntValue() <= 0 || p.Port.IntValue() > 65535 {
+				continue
+			}
+			r.Port = uint16(p.Port.IntValue())
+			if p.EndPort != nil && *p.EndPort > 0 && *p.EndPort <= 65535 {
+				r.EndPort = uint16(*p.EndPort)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, len(ports) == 0 || len(ranges) > 0
+}
+
+func ipBlockRule(block *networkingv1.IPBlock) (Rule, error) {
+	cidr, err := netip.ParsePrefix(block.CIDR)
+	if err != nil {
+		return Rule{}, err
+	}
+	r := Rule{CIDR: cidr.Masked()}
+	for _, e := range block.Except {
+		except, err := netip.ParsePrefix(e)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.Except = append(r.Except, except.Masked())
+	}
+	return r, nil
+}
+
+// ForPod returns the policy of pod: the one of its egress annotations when
+// it has some, the one of the NetworkPolicies of its namespace otherwise.
+// policies may be nil when NetworkPolicies are not watched.
+func ForPod(pod *v1.Pod, policies networkinglisters.NetworkPolicyLister) (*Policy, error) {
+	if p, err := FromAnnotations(pod.Annotations); p != nil || err != nil {
+		return p, err
+	}
+	if policies == nil {
+		return nil, nil
+	}
+	nps, err := policies.NetworkPolicies(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return FromNetworkPolicies(pod, nps), nil
+}
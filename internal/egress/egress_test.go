@@ -0,0 +1,137 @@
+package egress
+
+import (
+	"net/netip"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+type flow struct {
+	protocol v1.Protocol
+	dst      string
+	names    []string
+}
+
+func (f flow) allowed(p *Policy) bool {
+	return p.Allows(f.protocol, netip.MustParseAddrPort(f.dst), f.names)
+}
+
+func TestFromAnnotations(t *testing.T) {
+	p, err := FromAnnotations(map[string]string{
+		AnnotationAllow: "10.0.0.0/8, tcp://*.example.com:443, udp://192.168.1.1:5000-5010",
+		AnnotationDeny:  "10.0.0.99",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		flow flow
+		want bool
+	}{
+		{flow{v1.ProtocolTCP, "10.1.2.3:22", nil}, true},
+		{flow{ProtocolICMP, "10.1.2.3:0", nil}, true},
+		{flow{v1.ProtocolTCP, "10.0.0.99:80", nil}, false},
+		{flow{v1.ProtocolTCP, "93.184.216.34:443", []string{"mirror.example.com"}}, true},
+		{flow{v1.ProtocolTCP, "93.184.216.34:443", []string{"example.com"}}, false},
+		{flow{v1.ProtocolUDP, "93.184.216.34:443", []string{"mirror.example.com"}}, false},
+		{flow{v1.ProtocolTCP, "93.184.216.34:80", []string{"mirror.example.com"}}, false},
+		{flow{v1.ProtocolUDP, "192.168.1.1:5005", nil}, true},
+		{flow{v1.ProtocolUDP, "192.168.1.1:5011", nil}, false},
+		{flow{v1.ProtocolTCP, "8.8.8.8:53", nil}, false},
+	} {
+		if got := tc.flow.allowed(p); got != tc.want {
+			t.Errorf("%+v: expected allowed to be %v", tc.flow, tc.want)
+		}
+	}
+
+	deny, err := FromAnnotations(map[string]string{AnnotationDeny: "169.254.169.254"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (flow{v1.ProtocolTCP, "169.254.169.254:80", nil}).allowed(deny) || !(flow{v1.ProtocolTCP, "8.8.8.8:53", nil}).allowed(deny) {
+		t.Error("expected a deny list alone to allow everything else")
+	}
+
+	if p, err := FromAnnotations(nil); p != nil || err != nil {
+		t.Errorf("expected no policy without annotations, got %+v, %v", p, err)
+	}
+}
+
+func TestFromAnnotationsRejects(t *testing.T) {
+	for _, value := range []string{
+		"sctp://10.0.0.1",
+		"mirror.example.com:http",
+		"mirror.example.com:0",
+		"10.0.0.1:90-80",
+		"mirror_example.com",
+		"-mirror.example.com",
+	} {
+		if _, err := FromAnnotations(map[string]string{AnnotationAllow: value}); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestFromNetworkPolicies(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "build", Labels: map[string]string{"trust": "untrusted"}}}
+	tcp := v1.ProtocolTCP
+	https := intstr.FromInt(443)
+	named := intstr.FromString("https")
+	policies := []*networkingv1.NetworkPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "mirrors"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"trust": "untrusted"}},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{
+					{
+						To:    []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.0.0.0/24"}}}},
+						Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &https}},
+					},
+					// selectors and named ports cannot be enforced
+					{To: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}}},
+					{Ports: []networkingv1.NetworkPolicyPort{{Port: &named}}},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "others"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"trust": "trusted"}},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "ingress"},
+			Spec:       networkingv1.NetworkPolicySpec{PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}},
+		},
+	}
+
+	p := FromNetworkPolicies(pod, policies)
+	if p == nil || p.Source != "NetworkPolicy mirrors" {
+		t.Fatalf("expected the selecting policy to apply, got %+v", p)
+	}
+	for _, tc := range []struct {
+		flow flow
+		want bool
+	}{
+		{flow{v1.ProtocolTCP, "10.1.0.1:443", nil}, true},
+		{flow{v1.ProtocolTCP, "10.0.0.1:443", nil}, false},
+		{flow{v1.ProtocolUDP, "10.1.0.1:443", nil}, false},
+		{flow{v1.ProtocolTCP, "10.1.0.1:80", nil}, false},
+		{flow{v1.ProtocolTCP, "1.1.1.1:443", nil}, false},
+	} {
+		if got := tc.flow.allowed(p); got != tc.want {
+			t.Errorf("%+v: expected allowed to be %v", tc.flow, tc.want)
+		}
+	}
+
+	pod.Labels["trust"] = "unknown"
+	if p := FromNetworkPolicies(pod, policies); p != nil {
+		t.Errorf("expected a pod selected by no egress policy to be unrestricted, got %+v", p)
+	}
+}
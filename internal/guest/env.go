@@ -0,0 +1,280 @@
+package guest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Objects returns the objects the environment of a container refers to.
+type Objects interface {
+	GetConfigMap(name, namespace string) (*v1.ConfigMap, error)
+	GetSecret(name, namespace string) (*v1.Secret, error)
+	ListServices() ([]*v1.Service, error)
+}
+
+// ConfigError is returned when the environment of a container cannot be
+// resolved, e.g. a required ConfigMap key is missing. Like the kubelet, the
+// pod is failed with ConfigErrorReason instead of the creation being retried.
+type ConfigError struct {
+	Container string
+	Err       error
+}
+
+// ConfigErrorReason is the reason of the pods failed by a ConfigError.
+const ConfigErrorReason = "CreateContainerConfigError"
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("container %s: %v", e.Container, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ResolveEnv returns the environment of container c of pod the way the
+// kubelet builds it: the service link variables, then the variables of
+// envFrom in order, then the ones of env with $(VAR) references expanded.
+// A variable defined twice keeps its first position and its last value.
+// Resource fields of containers without a limit use allocatable, the size
+// of the virtual machine.
+func ResolveEnv(pod *v1.Pod, c v1.Container, objects Objects, allocatable v1.ResourceList) ([]EnvVar, error) {
+	fail := func(format string, args ...interface{}) error {
+		return &ConfigError{Container: c.Name, Err: fmt.Errorf(format, args...)}
+	}
+	var env envList
+
+	services, err := serviceEnv(pod, objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range services {
+		env.set(e.Name, e.Value)
+	}
+
+	for _, from := range c.EnvFrom {
+		var data map[string]string
+		switch {
+		case from.ConfigMapRef != nil:
+			ref := from.ConfigMapRef
+			cm, err := objects.GetConfigMap(ref.Name, pod.Namespace)
+			if err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					continue
+				}
+				return nil, fail("configmap %q not found", ref.Name)
+			}
+			data = cm.Data
+		case from.SecretRef != nil:
+			ref := from.SecretRef
+			secret, err := objects.GetSecret(ref.Name, pod.Namespace)
+			if err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					continue
+				}
+				return nil, fail("secret %q not found", ref.Name)
+			}
+			data = make(map[string]string, len(secret.Data))
+			for k, v := range secret.Data {
+				data[k] = string(v)
+			}
+		}
+		for _, key := range sortedKeys(data) {
+			name := from.Prefix + key
+			// the kubelet skips the keys that are not variable names too
+			if len(validation.IsEnvVarName(name)) > 0 {
+				continue
+			}
+			env.set(name, data[key])
+		}
+	}
+
+	for _, e := range c.Env {
+		if e.ValueFrom == nil {
+			env.set(e.Name, Expand(e.Value, env.mapping()))
+			continue
+		}
+
+		switch from := e.ValueFrom; {
+		case from.ConfigMapKeyRef != nil:
+			ref := from.ConfigMapKeyRef
+			cm, err := objects.GetConfigMap(ref.Name, pod.Namespace)
+			if err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					continue
+				}
+				return nil, fail("configmap %q not found", ref.Name)
+			}
+			value, ok := cm.Data[ref.Key]
+			if !ok {
+				if isOptional(ref.Optional) {
+					continue
+				}
+				return nil, fail("couldn't find key %s in ConfigMap %s/%s", ref.Key, pod.Namespace, ref.Name)
+			}
+			env.set(e.Name, value)
+		case from.SecretKeyRef != nil:
+			ref := from.SecretKeyRef
+			secret, err := objects.GetSecret(ref.Name, pod.Namespace)
+			if err != nil {
+				if apierrors.IsNotFound(err) && isOptional(ref.Optional) {
+					continue
+				}
+				return nil, fail("secret %q not found", ref.Name)
+			}
+			value, ok := secret.Data[ref.Key]
+			if !ok {
+				if isOptional(ref.Optional) {
+					continue
+				}
+				return nil, fail("couldn't find key %s in Secret %s/%s", ref.Key, pod.Namespace, ref.Name)
+			}
+			env.set(e.Name, string(value))
+		case from.FieldRef != nil:
+			value, err := PodField(pod, from.FieldRef.FieldPath)
+			if err != nil {
+				return nil, fail("%s: %v", e.Name, err)
+			}
+			env.set(e.Name, value)
+		case from.ResourceFieldRef != nil:
+			value, err := ResourceField(pod, c, from.ResourceFieldRef, allocatable)
+			if err != nil {
+				return nil, fail("%s: %v", e.Name, err)
+			}
+			env.set(e.Name, value)
+		}
+	}
+	return env.vars, nil
+}
+
+// isOptional reports whether a reference marked optional may be missing.
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// PodField returns the value of a downward API field of pod. The pod IP is
+// only known once the guest got an address.
+func PodField(pod *v1.Pod, fieldPath string) (string, error) {
+	if key, ok := subscript(fieldPath, "metadata.labels"); ok {
+		return pod.Labels[key], nil
+	}
+	if key, ok := subscript(fieldPath, "metadata.annotations"); ok {
+		return pod.Annotations[key], nil
+	}
+
+	switch fieldPath {
+	case "metadata.name":
+		return pod.Name, nil
+	case "metadata.namespace":
+		return pod.Namespace, nil
+	case "metadata.uid":
+		return string(pod.UID), nil
+	case "spec.nodeName":
+		return pod.Spec.NodeName, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
+	case "status.podIPs":
+		ips := make([]string, 0, len(pod.Status.PodIPs))
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		return strings.Join(ips, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported fieldPath %q", fieldPath)
+	}
+}
+
+// subscript returns the key of a fieldPath like metadata.labels['app'].
+func subscript(fieldPath, prefix string) (string, bool) {
+	if !strings.HasPrefix(fieldPath, prefix+"['") || !strings.HasSuffix(fieldPath, "']") {
+		return "", false
+	}
+	return fieldPath[len(prefix)+2 : len(fieldPath)-2], true
+}
+
+// ResourceField returns the value of a resource of a container of pod,
+// rounded up to the divisor.
+func ResourceField(pod *v1.Pod, c v1.Container, ref *v1.ResourceFieldSelector, allocatable v1.ResourceList) (string, error) {
+	container := &c
+	if ref.ContainerName != "" && ref.ContainerName != c.Name {
+		container = nil
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].Name == ref.ContainerName {
+				container = &pod.Spec.Containers[i]
+			}
+		}
+		if container == nil {
+			return "", fmt.Errorf("container %q not found", ref.ContainerName)
+		}
+	}
+
+	kind, name, ok := strings.Cut(ref.Resource, ".")
+	if !ok || (kind != "limits" && kind != "requests") {
+		return "", fmt.Errorf("unsupported resource %q", ref.Resource)
+	}
+	resourceName := v1.ResourceName(name)
+	var q resource.Quantity
+	if kind == "limits" {
+		if q, ok = container.Resources.Limits[resourceName]; !ok {
+			q = allocatable[resourceName]
+		}
+	} else {
+		q = container.Resources.Requests[resourceName]
+	}
+
+	divisor := ref.Divisor
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+	if resourceName == v1.ResourceCPU {
+		return strconv.FormatInt(int64(math.Ceil(float64(q.MilliValue())/float64(divisor.MilliValue()))), 10), nil
+	}
+	return strconv.FormatInt(int64(math.Ceil(float64(q.Value())/float64(divisor.Value()))), 10), nil
+}
+
+type envList struct {
+	vars  []EnvVar
+	index map[string]int
+}
+
+func (l *envList) set(name, value string) {
+	if i, ok := l.index[name]; ok {
+		l.vars[i].Value = value
+		return
+	}
+	if l.index == nil {
+		l.index = map[string]int{}
+	}
+	l.index[name] = len(l.vars)
+	l.vars = append(l.vars, EnvVar{Name: name, Value: value})
+}
+
+// mapping returns the values $(VAR) references are expanded to.
+func (l *envList) mapping() func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if i, ok := l.index[name]; ok {
+			return l.vars[i].Value, true
+		}
+		return "", false
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
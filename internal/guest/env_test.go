@@ -0,0 +1,235 @@
+package guest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolveEnv(t *testing.T) {
+	pod := testPod()
+	c := v1.Container{
+		Name: "main",
+		EnvFrom: []v1.EnvFromSource{
+			{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}},
+			{Prefix: "AUTH_", SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "credentials"}}},
+		},
+		Env: []v1.EnvVar{
+			{Name: "MODE", Value: "ci"},
+			{Name: "REGION", Value: "us-east-1"},
+			{Name: "ZONE", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+				Key:                  "REGION",
+			}}},
+		},
+	}
+
+	env, err := ResolveEnv(pod, c, testObjects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EnvVar{
+		{Name: "LOG_LEVEL", Value: "debug"},
+		{Name: "REGION", Value: "us-east-1"},
+		{Name: "AUTH_token", Value: "s3cr3t"},
+		{Name: "MODE", Value: "ci"},
+		{Name: "ZONE", Value: "eu-west-1"},
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+}
+
+func TestResolveEnvExpansion(t *testing.T) {
+	c := v1.Container{
+		Name: "main",
+		Env: []v1.EnvVar{
+			{Name: "HOST", Value: "db"},
+			{Name: "URL", Value: "postgres://$(HOST):$(PORT)/app"},
+			{Name: "PORT", Value: "5432"},
+			{Name: "ESCAPED", Value: "$$(HOST)"},
+		},
+	}
+	env, err := ResolveEnv(testPod(), c, testObjects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EnvVar{
+		{Name: "HOST", Value: "db"},
+		// PORT is defined after URL so it is not expanded
+		{Name: "URL", Value: "postgres://db:$(PORT)/app"},
+		{Name: "PORT", Value: "5432"},
+		{Name: "ESCAPED", Value: "$(HOST)"},
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+}
+
+func TestResolveEnvDownwardAPI(t *testing.T) {
+	pod := testPod()
+	pod.Labels = map[string]string{"app": "runner"}
+	pod.Spec.NodeName = "mac-mini-1"
+	pod.Status.HostIP = "192.168.1.10"
+	field := func(path string) *v1.EnvVarSource {
+		return &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: path}}
+	}
+	c := v1.Container{
+		Name: "main",
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("1Gi")},
+			Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("2Gi")},
+		},
+		Env: []v1.EnvVar{
+			{Name: "POD_NAME", ValueFrom: field("metadata.name")},
+			{Name: "POD_NAMESPACE", ValueFrom: field("metadata.namespace")},
+			{Name: "APP", ValueFrom: field("metadata.labels['app']")},
+			{Name: "NODE", ValueFrom: field("spec.nodeName")},
+			{Name: "HOST_IP", ValueFrom: field("status.hostIP")},
+			{Name: "CPU_LIMIT", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.cpu"}}},
+			{Name: "CPU_MILLIS", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.cpu", Divisor: resource.MustParse("1m")}}},
+			{Name: "MEMORY_LIMIT_MI", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.memory", Divisor: resource.MustParse("1Mi")}}},
+			{Name: "MEMORY_REQUEST", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "requests.memory"}}},
+		},
+	}
+	env, err := ResolveEnv(pod, c, testObjects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EnvVar{
+		{Name: "POD_NAME", Value: "runner"},
+		{Name: "POD_NAMESPACE", Value: "default"},
+		{Name: "APP", Value: "runner"},
+		{Name: "NODE", Value: "mac-mini-1"},
+		{Name: "HOST_IP", Value: "192.168.1.10"},
+		// without a limit the size of the virtual machine is used
+		{Name: "CPU_LIMIT", Value: "4"},
+		{Name: "CPU_MILLIS", Value: "4000"},
+		{Name: "MEMORY_LIMIT_MI", Value: "2048"},
+		{Name: "MEMORY_REQUEST", Value: "1073741824"},
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+}
+
+func TestResolveEnvServiceLinks(t *testing.T) {
+	objects := testObjects
+	objects.services = []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kubernetes"},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.1", Ports: []v1.ServicePort{{Name: "https", Port: 443}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "redis-cache"},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.20", Ports: []v1.ServicePort{{Port: 6379}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "headless"},
+			Spec:       v1.ServiceSpec{ClusterIP: v1.ClusterIPNone, Ports: []v1.ServicePort{{Port: 80}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "db"},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.30", Ports: []v1.ServicePort{{Port: 5432}}},
+		},
+	}
+	pod := testPod()
+	pod.Namespace = "ci"
+
+	env, err := ResolveEnv(pod, v1.Container{Name: "main"}, objects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EnvVar{
+		{Name: "KUBERNETES_SERVICE_HOST", Value: "10.96.0.1"},
+		{Name: "KUBERNETES_SERVICE_PORT", Value: "443"},
+		{Name: "KUBERNETES_SERVICE_PORT_HTTPS", Value: "443"},
+		{Name: "KUBERNETES_PORT", Value: "tcp://10.96.0.1:443"},
+		{Name: "KUBERNETES_PORT_443_TCP", Value: "tcp://10.96.0.1:443"},
+		{Name: "KUBERNETES_PORT_443_TCP_PROTO", Value: "tcp"},
+		{Name: "KUBERNETES_PORT_443_TCP_PORT", Value: "443"},
+		{Name: "KUBERNETES_PORT_443_TCP_ADDR", Value: "10.96.0.1"},
+		{Name: "REDIS_CACHE_SERVICE_HOST", Value: "10.96.0.20"},
+		{Name: "REDIS_CACHE_SERVICE_PORT", Value: "6379"},
+		{Name: "REDIS_CACHE_PORT", Value: "tcp://10.96.0.20:6379"},
+		{Name: "REDIS_CACHE_PORT_6379_TCP", Value: "tcp://10.96.0.20:6379"},
+		{Name: "REDIS_CACHE_PORT_6379_TCP_PROTO", Value: "tcp"},
+		{Name: "REDIS_CACHE_PORT_6379_TCP_PORT", Value: "6379"},
+		{Name: "REDIS_CACHE_PORT_6379_TCP_ADDR", Value: "10.96.0.20"},
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+
+	// the API server is linked even without service links
+	disabled := false
+	pod.Spec.EnableServiceLinks = &disabled
+	env, err = ResolveEnv(pod, v1.Container{Name: "main"}, objects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 8 || env[0].Name != "KUBERNETES_SERVICE_HOST" {
+		t.Errorf("expected only the API server variables, got %v", env)
+	}
+}
+
+func TestResolveEnvOptional(t *testing.T) {
+	optional := true
+	c := v1.Container{
+		Name: "main",
+		EnvFrom: []v1.EnvFromSource{
+			{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}, Optional: &optional}},
+		},
+		Env: []v1.EnvVar{
+			{Name: "KEY", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+				Key:                  "missing",
+				Optional:             &optional,
+			}}},
+			{Name: "SECRET", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "missing"},
+				Key:                  "token",
+				Optional:             &optional,
+			}}},
+		},
+	}
+	env, err := ResolveEnv(testPod(), c, testObjects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 0 {
+		t.Errorf("expected the optional references to be skipped, got %v", env)
+	}
+}
+
+func TestResolveEnvConfigErrors(t *testing.T) {
+	for name, c := range map[string]v1.Container{
+		"configmap key": {Env: []v1.EnvVar{{Name: "VALUE", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+			Key:                  "missing",
+		}}}}},
+		"secret": {Env: []v1.EnvVar{{Name: "VALUE", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "missing"},
+			Key:                  "token",
+		}}}}},
+		"envFrom configmap": {EnvFrom: []v1.EnvFromSource{
+			{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}}},
+		}},
+		"field": {Env: []v1.EnvVar{{Name: "VALUE", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "spec.unknown"}}}}},
+		"resource container": {Env: []v1.EnvVar{{Name: "VALUE", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{
+			ContainerName: "missing",
+			Resource:      "limits.cpu",
+		}}}}},
+	} {
+		c.Name = "main"
+		_, err := ResolveEnv(testPod(), c, testObjects, testAllocatable)
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%s: expected a ConfigError, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package guest
+
+import "strings"
+
+// Expand replaces the $(VAR) references of input with the values returned
+// by mapping, following the kubelet rules: references to unknown variables
+// are kept as is and $$ escapes a $.
+func Expand(input string, mapping func(name string) (string, bool)) string {
+	var b strings.Builder
+	checkpoint := 0
+	for cursor := 0; cursor < len(input); cursor++ {
+		if input[cursor] != '$' || cursor+1 >= len(input) {
+			continue
+		}
+		b.WriteString(input[checkpoint:cursor])
+
+		switch next := input[cursor+1:]; next[0] {
+		case '$':
+			b.WriteByte('$')
+			cursor++
+		case '(':
+			end := strings.IndexByte(next, ')')
+			if end < 0 {
+				b.WriteString("$(")
+				cursor++
+				break
+			}
+			name := next[1:end]
+			if value, ok := mapping(name); ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString("$(" + name + ")")
+			}
+			cursor += end + 1
+		default:
+			b.WriteString(input[cursor : cursor+2])
+			cursor++
+		}
+		checkpoint = cursor + 1
+	}
+	b.WriteString(input[checkpoint:])
+	return b.String()
+}
@@ -0,0 +1,29 @@
+package guest
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"NAME": "world", "EMPTY": ""}
+	mapping := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	for input, want := range map[string]string{
+		"hello $(NAME)":     "hello world",
+		"$(NAME)$(NAME)":    "worldworld",
+		"[$(EMPTY)]":        "[]",
+		"$(UNKNOWN)":        "$(UNKNOWN)",
+		"$$(NAME)":          "$(NAME)",
+		"$$$(NAME)":         "$world",
+		"$(NAME":            "$(NAME",
+		"cost: $5":          "cost: $5",
+		"trailing $":        "trailing $",
+		"no references":     "no references",
+		"$()":               "$()",
+		"nested $($(NAME))": "nested $($(NAME))",
+	} {
+		if got := Expand(input, mapping); got != want {
+			t.Errorf("Expand(%q): expected %q, got %q", input, want, got)
+		}
+	}
+}
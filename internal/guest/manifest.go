@@ -0,0 +1,218 @@
+// Package guest builds the manifest that tells the software inside a virtual
+// machine what the containers of its pod run: command, arguments, working
+// directory and resolved environment. Guests read it at boot from a read-only
+// provisioning disk.
+package guest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/iso9660"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+// AnnotationSSHAuthorizedKeys lists the SSH public keys authorized in the
+// guest, one per line.
+const AnnotationSSHAuthorizedKeys = spec.AnnotationPrefix + "ssh-authorized-keys"
+
+// ManifestVersion is the version of the manifest format. Guests must ignore
+// manifests of a version they do not know.
+const ManifestVersion = "v1"
+
+// ManifestFile is the name of the manifest on the provisioning disk.
+const ManifestFile = "manifest.json"
+
+// VolumeID is the label of the provisioning disk, macOS mounts it at
+// /Volumes/provision.
+const VolumeID = "provision"
+
+// Manifest describes the containers of a pod to its guest.
+type Manifest struct {
+	Version string `json:"version"`
+	Pod     Pod    `json:"pod"`
+	// Hostname is the hostname the guest sets.
+	Hostname          string   `json:"hostname"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	// RestartPolicy applies to every container, like in the pod.
+	RestartPolicy v1.RestartPolicy `json:"restartPolicy,omitempty"`
+	// Volumes are the mount tags of the virtio-fs shares of the volumes.
+	Volumes []string `json:"volumes,omitempty"`
+	// Disks are the identifiers of the disks of the persistentVolumeClaim
+	// volumes, the names of the volumes.
+	Disks          []string    `json:"disks,omitempty"`
+	InitContainers []Container `json:"initContainers,omitempty"`
+	Containers     []Container `json:"containers"`
+	// GrowDisk asks the guest to grow its boot volume to the end of its
+	// disk, which was enlarged for the pod, e.g. with diskutil apfs
+	// resizeContainer on macOS.
+	GrowDisk bool `json:"growDisk,omitempty"`
+}
+
+// Pod identifies the pod of a guest.
+type Pod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+}
+
+// Container is a process the guest runs. Init containers run one after the
+// other to completion before the containers start.
+type Container struct {
+	Name  string `json:"name"`
+	Image string `json:"image,omitempty"`
+	// Command replaces the entrypoint of the guest image when set.
+	Command      []string      `json:"command,omitempty"`
+	Args         []string      `json:"args,omitempty"`
+	WorkingDir   string        `json:"workingDir,omitempty"`
+	Env          []EnvVar      `json:"env,omitempty"`
+	VolumeMounts []VolumeMount `json:"volumeMounts,omitempty"`
+}
+
+// VolumeMount mounts the share of a volume, or a path in it, in a container.
+type VolumeMount struct {
+	// Name is the name of the volume and the mount tag of its share.
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	SubPath   string `json:"subPath,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+}
+
+// EnvVar is an environment variable with its value resolved.
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// NewManifest returns the manifest of pod, resolving the environment of its
+// containers from objects. allocatable is the size of the virtual machine.
+func NewManifest(pod *v1.Pod, objects Objects, allocatable v1.ResourceList) (*Manifest, error) {
+	m := &Manifest{
+		Version: ManifestVersion,
+		Pod: Pod{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			UID:       string(pod.UID),
+		},
+		Hostname:      Hostname(pod),
+		RestartPolicy: pod.Spec.RestartPolicy,
+	}
+	for _, key := range strings.Split(pod.Annotations[AnnotationSSHAuthorizedKeys], "\n") {
+		if key = strings.TrimSpace(key); key != "" {
+			m.SSHAuthorizedKeys = append(m.SSHAuthorizedKeys, key)
+		}
+	}
+
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim != nil {
+			m.Disks = append(m.Disks, v.Name)
+			continue
+		}
+		m.Volumes = append(m.Volumes, v.Name)
+	}
+
+	for _, c := range pod.Spec.InitContainers {
+		container, err := newContainer(pod, c, objects, allocatable)
+		if err != nil {
+			return nil, err
+		}
+		m.InitContainers = append(m.InitContainers, container)
+	}
+	m.Containers = []Container{}
+	for _, c := range pod.Spec.Containers {
+		container, err := newContainer(pod, c, objects, allocatable)
+		if err != nil {
+			return nil, err
+		}
+		m.Containers = append(m.Containers, container)
+	}
+	return m, nil
+}
+
+func newContainer(pod *v1.Pod, c v1.Container, objects Objects, allocatable v1.ResourceList) (Container, error) {
+	env, err := ResolveEnv(pod, c, objects, allocatable)
+	if err != nil {
+		return Container{}, err
+	}
+
+	values := make(map[string]string, len(env))
+	for _, e := range env {
+		values[e.Name] = e.Value
+	}
+	mapping := func(name string) (string, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	expand := func(args []string) []string {
+		if args == nil {
+			return nil
+		}
+		expanded := make([]string, len(args))
+		for i, arg := range args {
+			expanded[i] = Expand(arg, mapping)
+		}
+		return expanded
+	}
+
+	var mounts []VolumeMount
+	for _, m := range c.VolumeMounts {
+		subPath := m.SubPath
+		if m.SubPathExpr != "" {
+			subPath = Expand(m.SubPathExpr, mapping)
+		}
+		mounts = append(mounts, VolumeMount{
+			Name:      m.Name,
+			MountPath: m.MountPath,
+			SubPath:   subPath,
+			ReadOnly:  m.ReadOnly,
+		})
+	}
+
+	return Container{
+		Name:         c.Name,
+		Image:        c.Image,
+		Command:      expand(c.Command),
+		Args:         expand(c.Args),
+		WorkingDir:   c.WorkingDir,
+		Env:          env,
+		VolumeMounts: mounts,
+	}, nil
+}
+
+// Hostname returns the hostname of the guest of pod, like the kubelet does
+// for containers.
+func Hostname(pod *v1.Pod) string {
+	hostname := pod.Spec.Hostname
+	if hostname == "" {
+		hostname = pod.Name
+	}
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-.")
+	}
+	return hostname
+}
+
+// Marshal returns the JSON form of m. The same manifest always gives the
+// same bytes.
+func (m *Manifest) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// WriteDisk writes the provisioning disk holding m to path.
+func WriteDisk(path string, m *Manifest) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode the guest manifest: %w", err)
+	}
+	if err := iso9660.WriteFile(path, VolumeID, []iso9660.File{{Name: ManifestFile, Data: data}}); err != nil {
+		return fmt.Errorf("failed to write the provisioning disk: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package guest
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// fakeObjects holds ConfigMaps and Secrets by namespace/name.
+type fakeObjects struct {
+	configMaps map[string]*v1.ConfigMap
+	secrets    map[string]*v1.Secret
+	services   []*v1.Service
+}
+
+func (f fakeObjects) GetConfigMap(name, namespace string) (*v1.ConfigMap, error) {
+	if cm, ok := f.configMaps[namespace+"/"+name]; ok {
+		return cm, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+}
+
+func (f fakeObjects) GetSecret(name, namespace string) (*v1.Secret, error) {
+	if secret, ok := f.secrets[namespace+"/"+name]; ok {
+		return secret, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+}
+
+func (f fakeObjects) ListServices() ([]*v1.Service, error) {
+	return f.services, nil
+}
+
+var testObjects = fakeObjects{
+	configMaps: map[string]*v1.ConfigMap{
+		"default/settings": {Data: map[string]string{"LOG_LEVEL": "debug", "REGION": "eu-west-1"}},
+	},
+	secrets: map[string]*v1.Secret{
+		"default/credentials": {Data: map[string][]byte{"token": []byte("s3cr3t")}},
+	},
+}
+
+var testAllocatable = v1.ResourceList{
+	v1.ResourceCPU:    resource.MustParse("4"),
+	v1.ResourceMemory: resource.MustParse("8Gi"),
+}
+
+func testPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "runner",
+			UID:       "6f1c1f0e-2b7e-4b8e-9a57-0d6c5e0c2a11",
+			Annotations: map[string]string{
+				AnnotationSSHAuthorizedKeys: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIK0 admin@example.com\n\n",
+			},
+		},
+		Spec: v1.PodSpec{
+			Hostname:      "runner-0",
+			RestartPolicy: v1.RestartPolicyOnFailure,
+			Volumes: []v1.Volume{
+				{Name: "settings", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}}},
+				{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+				{Name: "work", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "work-runner-0"}}},
+			},
+			InitContainers: []v1.Container{
+				{Name: "setup", Command: []string{"/bin/sh", "-c", "defaults write com.acme ready -bool true"}},
+			},
+			Containers: []v1.Container{
+				{
+					Name:       "runner",
+					Image:      "ghcr.io/acme/runner:2.0",
+					Command:    []string{"/usr/local/bin/runner"},
+					Args:       []string{"--once", "--region=$(REGION)", "--literal=$$(REGION)"},
+					WorkingDir: "/Users/runner",
+					EnvFrom: []v1.EnvFromSource{
+						{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}},
+					},
+					VolumeMounts: []v1.VolumeMount{
+						{Name: "settings", MountPath: "/Users/runner/.config/runner", ReadOnly: true},
+						{Name: "cache", MountPath: "/Users/runner/cache", SubPathExpr: "$(REGION)"},
+						{Name: "work", MountPath: "/Users/runner/work"},
+					},
+					Env: []v1.EnvVar{
+						{Name: "LOG_LEVEL", Value: "info"},
+						{Name: "TOKEN", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+							LocalObjectReference: v1.LocalObjectReference{Name: "credentials"},
+							Key:                  "token",
+						}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run the tests with -update if the change is expected", name)
+	}
+}
+
+func TestNewManifest(t *testing.T) {
+	m, err := NewManifest(testPod(), testObjects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, ManifestFile, data)
+}
+
+func TestWriteDisk(t *testing.T) {
+	m, err := NewManifest(testPod(), testObjects, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "provision.iso")
+	if err := WriteDisk(path, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "provision.iso", got)
+}
+
+func TestNewManifestMissingReference(t *testing.T) {
+	if _, err := NewManifest(testPod(), fakeObjects{}, testAllocatable); err == nil {
+		t.Fatal("expected a missing ConfigMap to fail")
+	}
+}
+
+func TestHostname(t *testing.T) {
+	pod := testPod()
+	if got := Hostname(pod); got != "runner-0" {
+		t.Errorf("expected the pod hostname, got %s", got)
+	}
+	pod.Spec.Hostname = ""
+	if got := Hostname(pod); got != "runner" {
+		t.Errorf("expected the pod name, got %s", got)
+	}
+	pod.Name = "a-pod-name-that-is-much-longer-than-the-sixty-three-characters-allowed"
+	if got := Hostname(pod); len(got) > 63 {
+		t.Errorf("expected the hostname to be truncated, got %s", got)
+	}
+}
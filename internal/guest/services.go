@@ -0,0 +1,87 @@
+package guest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// masterService is the service of the API server, linked in every pod.
+const masterService = "kubernetes"
+
+// serviceEnv returns the service link variables of pod: the ones of the
+// API server service, then the ones of the services of its namespace when
+// service links are enabled, sorted by service name.
+func serviceEnv(pod *v1.Pod, objects Objects) ([]EnvVar, error) {
+	services, err := objects.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	enableServiceLinks := pod.Spec.EnableServiceLinks == nil || *pod.Spec.EnableServiceLinks
+
+	linked := map[string]*v1.Service{}
+	for _, s := range services {
+		if s.Spec.ClusterIP == "" || s.Spec.ClusterIP == v1.ClusterIPNone {
+			continue
+		}
+		switch {
+		case s.Namespace == metav1.NamespaceDefault && s.Name == masterService:
+			if _, ok := linked[s.Name]; !ok {
+				linked[s.Name] = s
+			}
+		case s.Namespace == pod.Namespace && enableServiceLinks:
+			linked[s.Name] = s
+		}
+	}
+
+	var env []EnvVar
+	for _, name := range sortedKeys(linked) {
+		env = append(env, serviceLinkEnv(linked[name])...)
+	}
+	return env, nil
+}
+
+// serviceLinkEnv returns the variables describing s, including the Docker
+// link compatible ones, e.g. REDIS_SERVICE_HOST and REDIS_PORT_6379_TCP.
+func serviceLinkEnv(s *v1.Service) []EnvVar {
+	if len(s.Spec.Ports) == 0 {
+		return nil
+	}
+	prefix := envName(s.Name)
+	env := []EnvVar{
+		{Name: prefix + "_SERVICE_HOST", Value: s.Spec.ClusterIP},
+		{Name: prefix + "_SERVICE_PORT", Value: strconv.Itoa(int(s.Spec.Ports[0].Port))},
+	}
+	for _, p := range s.Spec.Ports {
+		if p.Name != "" {
+			env = append(env, EnvVar{Name: prefix + "_SERVICE_PORT_" + envName(p.Name), Value: strconv.Itoa(int(p.Port))})
+		}
+	}
+
+	for i, p := range s.Spec.Ports {
+		protocol := strings.ToLower(string(v1.ProtocolTCP))
+		if p.Protocol != "" {
+			protocol = strings.ToLower(string(p.Protocol))
+		}
+		url := protocol + "://" + net.JoinHostPort(s.Spec.ClusterIP, strconv.Itoa(int(p.Port)))
+		if i == 0 {
+			env = append(env, EnvVar{Name: prefix + "_PORT", Value: url})
+		}
+		portPrefix := fmt.Sprintf("%s_PORT_%d_%s", prefix, p.Port, strings.ToUpper(protocol))
+		env = append(env,
+			EnvVar{Name: portPrefix, Value: url},
+			EnvVar{Name: portPrefix + "_PROTO", Value: protocol},
+			EnvVar{Name: portPrefix + "_PORT", Value: strconv.Itoa(int(p.Port))},
+			EnvVar{Name: portPrefix + "_ADDR", Value: s.Spec.ClusterIP},
+		)
+	}
+	return env
+}
+
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -0,0 +1,289 @@
+// Package iso9660 writes small read-only ISO 9660 images with Joliet names,
+// mounted by both Linux and macOS guests. Images are deterministic: the same
+// files always produce the same bytes.
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// Layout of the image, in sectors. The directories are a single sector,
+// which is enough for the handful of files of a seed disk.
+const (
+	primaryDescriptorSector = 16
+	jolietDescriptorSector  = 17
+	terminatorSector        = 18
+	primaryLPathSector      = 19
+	primaryMPathSector      = 20
+	jolietLPathSector       = 21
+	jolietMPathSector       = 22
+	primaryRootSector       = 23
+	jolietRootSector        = 24
+	firstFileSector         = 25
+)
+
+// pathTableSize is the size of a path table holding only the root.
+const pathTableSize = 10
+
+// File is a file of the root directory of an image.
+type File struct {
+	// Name is the Joliet name of the file, e.g. "user-data". The ISO 9660
+	// name is derived from it.
+	Name string
+	Data []byte
+}
+
+// WriteFile writes an image labeled volumeID holding files to path.
+func WriteFile(path, volumeID string, files []File) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := Write(f, volumeID, files); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Write writes an image labeled volumeID holding files in its root directory.
+func Write(w io.Writer, volumeID string, files []File) error {
+	if len(volumeID) > 16 {
+		return fmt.Errorf("volume identifier %q is longer than 16 characters", volumeID)
+	}
+
+	entries := make([]entry, len(files))
+	primaryNames := map[string]bool{}
+	jolietNames := map[string]bool{}
+	sector := uint32(firstFileSector)
+	for i, f := range files {
+		if f.Name == "" || strings.ContainsAny(f.Name, "/\\") || len(utf16.Encode([]rune(f.Name))) > 64 {
+			return fmt.Errorf("invalid file name %q", f.Name)
+		}
+		if jolietNames[f.Name] {
+			return fmt.Errorf("duplicate file name %q", f.Name)
+		}
+		jolietNames[f.Name] = true
+
+		e := entry{
+			primary: primaryName(f.Name, primaryNames),
+			joliet:  ucs2(f.Name),
+			data:    f.Data,
+			sector:  sector,
+		}
+		primaryNames[e.primary] = true
+		entries[i] = e
+		sector += sectors(len(f.Data))
+	}
+
+	primaryRoot, err := directory(primaryRootSector, entries, func(e entry) []byte { return []byte(e.primary) })
+	if err != nil {
+		return err
+	}
+	jolietRoot, err := directory(jolietRootSector, entries, func(e entry) []byte { return e.joliet })
+	if err != nil {
+		return err
+	}
+
+	image := make([]byte, int(sector)*sectorSize)
+	copy(at(image, primaryDescriptorSector), volumeDescriptor(1, volumeID, sector, primaryRootSector, primaryLPathSector, primaryMPathSector))
+	copy(at(image, jolietDescriptorSector), volumeDescriptor(2, volumeID, sector, jolietRootSector, jolietLPathSector, jolietMPathSector))
+	copy(at(image, terminatorSector), []byte{255, 'C', 'D', '0', '0', '1', 1})
+	copy(at(image, primaryLPathSector), pathTable(primaryRootSector, binary.LittleEndian))
+	copy(at(image, primaryMPathSector), pathTable(primaryRootSector, binary.BigEndian))
+	copy(at(image, jolietLPathSector), pathTable(jolietRootSector, binary.LittleEndian))
+	copy(at(image, jolietMPathSector), pathTable(jolietRootSector, binary.BigEndian))
+	copy(at(image, primaryRootSector), primaryRoot)
+	copy(at(image, jolietRootSector), jolietRoot)
+	for _, e := range entries {
+		copy(at(image, e.sector), e.data)
+	}
+
+	_, err = w.Write(image)
+	return err
+}
+
+type entry struct {
+	primary string
+	joliet  []byte
+	data    []byte
+	sector  uint32
+}
+
+func at(image []byte, sector uint32) []byte {
+	return image[sector*sectorSize:]
+}
+
+func sectors(size int) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+// primaryName returns a unique ISO 9660 level 1 name for name, e.g.
+// "USER_DAT.;1" for "user-data".
+func primaryName(name string, taken map[string]bool) string {
+	clean := func(s string, n int) string {
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			default:
+				return '_'
+			}
+		}, s)
+		if len(s) > n {
+			s = s[:n]
+		}
+		return s
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = clean(base, 8), clean(ext, 3)
+
+	candidate := base + "." + ext + ";1"
+	for i := 1; taken[candidate]; i++ {
+		suffix := fmt.Sprintf("~%d", i)
+		b := base
+		if len(b)+len(suffix) > 8 {
+			b = b[:8-len(suffix)]
+		}
+		candidate = b + suffix + "." + ext + ";1"
+	}
+	return candidate
+}
+
+func ucs2(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.BigEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// padded returns s padded with spaces to n bytes, in UCS-2 for Joliet.
+func padded(s string, n int, joliet bool) []byte {
+	b := make([]byte, n)
+	if joliet {
+		for i := 0; i+1 < n; i += 2 {
+			b[i], b[i+1] = 0, ' '
+		}
+		copy(b, ucs2(s))
+		return b
+	}
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+	return b
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// recordDate is the date of every directory record: 1970-01-01 00:00 UTC,
+// so images do not depend on when they are written.
+var recordDate = []byte{70, 1, 1, 0, 0, 0, 0}
+
+// descriptorDate is recordDate in the volume descriptor format.
+var descriptorDate = append([]byte("1970010100000000"), 0)
+
+func directoryRecord(name []byte, sector, size uint32, dir bool) []byte {
+	length := 33 + len(name)
+	if length%2 == 1 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	bothEndian32(r[2:], sector)
+	bothEndian32(r[10:], size)
+	copy(r[18:], recordDate)
+	if dir {
+		r[25] = 2
+	}
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return r
+}
+
+// directory returns the root directory at sector listing entries sorted by
+// the name returned by name.
+func directory(sector uint32, entries []entry, name func(entry) []byte) ([]byte, error) {
+	sorted := append([]entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return string(name(sorted[i])) < string(name(sorted[j])) })
+
+	dir := append(directoryRecord([]byte{0}, sector, sectorSize, true), directoryRecord([]byte{1}, sector, sectorSize, true)...)
+	for _, e := range sorted {
+		dir = append(dir, directoryRecord(name(e), e.sector, uint32(len(e.data)), false)...)
+	}
+	if len(dir) > sectorSize {
+		return nil, fmt.Errorf("too many files for the root directory")
+	}
+	return dir, nil
+}
+
+func pathTable(rootSector uint32, order binary.ByteOrder) []byte {
+	t := make([]byte, pathTableSize)
+	t[0] = 1
+	order.PutUint32(t[2:], rootSector)
+	order.PutUint16(t[6:], 1)
+	return t
+}
+
+// volumeDescriptor returns the primary (1) or Joliet supplementary (2)
+// volume descriptor.
+func volumeDescriptor(kind byte, volumeID string, size, rootSector, lPathSector, mPathSector uint32) []byte {
+	joliet := kind == 2
+	d := make([]byte, sectorSize)
+	d[0] = kind
+	copy(d[1:], "CD001")
+	d[6] = 1
+	copy(d[8:], padded("", 32, joliet))
+	if joliet {
+		copy(d[40:], padded(volumeID, 32, true))
+		// UCS-2 level 3
+		copy(d[88:], "%/E")
+	} else {
+		copy(d[40:], padded(strings.ToUpper(volumeID), 32, false))
+	}
+	bothEndian32(d[80:], size)
+	bothEndian16(d[120:], 1)
+	bothEndian16(d[124:], 1)
+	bothEndian16(d[128:], sectorSize)
+	bothEndian32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], lPathSector)
+	binary.BigEndian.PutUint32(d[148:], mPathSector)
+	copy(d[156:], directoryRecord([]byte{0}, rootSector, sectorSize, true))
+	for _, field := range []struct{ offset, size int }{
+		{190, 128}, {318, 128}, {446, 128}, {574, 128}, {702, 37}, {739, 37}, {776, 37},
+	} {
+		copy(d[field.offset:], padded("", field.size, joliet))
+	}
+	for _, offset := range []int{813, 830} {
+		copy(d[offset:], descriptorDate)
+	}
+	for _, offset := range []int{847, 864} {
+		copy(d[offset:], "0000000000000000")
+	}
+	d[881] = 1
+	return d
+}
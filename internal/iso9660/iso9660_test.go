@@ -0,0 +1,132 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// readRoot returns the files of the root directory described by the volume
+// descriptor at sector, decoding Joliet names when joliet is set.
+func readRoot(t *testing.T, image []byte, sector uint32, joliet bool) map[string][]byte {
+	t.Helper()
+	d := at(image, sector)
+	root := d[156:]
+	dir := at(image, binary.LittleEndian.Uint32(root[2:]))[:binary.LittleEndian.Uint32(root[10:])]
+
+	files := map[string][]byte{}
+	for len(dir) > 0 && dir[0] > 0 {
+		r := dir[:dir[0]]
+		dir = dir[dir[0]:]
+		if r[25]&2 != 0 {
+			continue
+		}
+		name := r[33 : 33+r[32]]
+		key := string(name)
+		if joliet {
+			var u []uint16
+			for i := 0; i+1 < len(name); i += 2 {
+				u = append(u, binary.BigEndian.Uint16(name[i:]))
+			}
+			key = string(utf16.Decode(u))
+		}
+		extent := binary.LittleEndian.Uint32(r[2:])
+		size := binary.LittleEndian.Uint32(r[10:])
+		files[key] = at(image, extent)[:size]
+	}
+	return files
+}
+
+func TestWrite(t *testing.T) {
+	files := []File{
+		{Name: "user-data", Data: []byte("#cloud-config\n")},
+		{Name: "meta-data", Data: bytes.Repeat([]byte("x"), 3*sectorSize+1)},
+		{Name: "empty"},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, "cidata", files); err != nil {
+		t.Fatal(err)
+	}
+	image := buf.Bytes()
+
+	if len(image)%sectorSize != 0 {
+		t.Fatalf("expected a whole number of sectors, got %d bytes", len(image))
+	}
+	if got := binary.LittleEndian.Uint32(at(image, primaryDescriptorSector)[80:]); int(got)*sectorSize != len(image) {
+		t.Errorf("expected the volume size to match the image, got %d sectors", got)
+	}
+	for sector, kind := range map[uint32]byte{primaryDescriptorSector: 1, jolietDescriptorSector: 2, terminatorSector: 255} {
+		d := at(image, sector)
+		if d[0] != kind || string(d[1:6]) != "CD001" {
+			t.Errorf("expected a volume descriptor of type %d at sector %d, got %v", kind, sector, d[:6])
+		}
+	}
+	if got := strings.TrimSpace(string(at(image, primaryDescriptorSector)[40:72])); got != "CIDATA" {
+		t.Errorf("expected the primary volume CIDATA, got %q", got)
+	}
+	if got := at(image, jolietDescriptorSector)[40:52]; !bytes.Equal(got, ucs2("cidata")) {
+		t.Errorf("expected the Joliet volume cidata, got %q", got)
+	}
+
+	joliet := readRoot(t, image, jolietDescriptorSector, true)
+	primary := readRoot(t, image, primaryDescriptorSector, false)
+	for _, f := range files {
+		if got, ok := joliet[f.Name]; !ok || !bytes.Equal(got, f.Data) {
+			t.Errorf("expected Joliet file %s with %d bytes, got %d", f.Name, len(f.Data), len(got))
+		}
+	}
+	if got := primary["USER_DAT.;1"]; string(got) != "#cloud-config\n" {
+		t.Errorf("expected the ISO 9660 name USER_DAT.;1, got %v", primary)
+	}
+}
+
+func TestWriteIsDeterministic(t *testing.T) {
+	files := []File{{Name: "b", Data: []byte("2")}, {Name: "a", Data: []byte("1")}}
+	var first, second bytes.Buffer
+	if err := Write(&first, "seed", files); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(&second, "seed", files); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("expected the same files to produce the same image")
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	testCases := map[string]struct {
+		volumeID string
+		files    []File
+	}{
+		"long volume":    {"a-very-long-volume-id", nil},
+		"empty name":     {"seed", []File{{Name: ""}}},
+		"nested name":    {"seed", []File{{Name: "etc/hosts"}}},
+		"duplicate name": {"seed", []File{{Name: "a"}, {Name: "a"}}},
+	}
+	for name, tc := range testCases {
+		if err := Write(&bytes.Buffer{}, tc.volumeID, tc.files); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPrimaryName(t *testing.T) {
+	taken := map[string]bool{}
+	for name, want := range map[string]string{
+		"user-data":      "USER_DAT.;1",
+		"network-config": "NETWORK_.;1",
+		"manifest.json":  "MANIFEST.JSO;1",
+	} {
+		if got := primaryName(name, taken); got != want {
+			t.Errorf("expected %s for %s, got %s", want, name, got)
+		}
+	}
+
+	taken["USER_DAT.;1"] = true
+	if got := primaryName("user-data-2", taken); got != "USER_D~1.;1" {
+		t.Errorf("expected a unique name, got %s", got)
+	}
+}
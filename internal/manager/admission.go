@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+)
+
+const (
+	// ResourceVMSlots is the extended resource advertising how many virtual
+	// machines the node can run at the same time.
+	ResourceVMSlots v1.ResourceName = "macos.virtual-kubelet.io/vm-slots"
+)
+
+// admissionError is returned when a pod does not fit on the node.
+// The reason follows the kubelet conventions, e.g. OutOfcpu.
+type admissionError struct {
+	reason  string
+	message string
+}
+
+func (e *admissionError) Error() string {
+	return e.message
+}
+
+func insufficientResource(reason string, resource v1.ResourceName, requested, used, capacity string) *admissionError {
+	return &admissionError{
+		reason:  reason,
+		message: fmt.Sprintf("Node didn't have enough resource: %s, requested: %s, used: %s, capacity: %s", resource, requested, used, capacity),
+	}
+}
+
+// admitLocked checks that a virtual machine taking requests fits on the
+// node. rm.mu must be held.
+func (rm *ResourceManager) admitLocked(requests v1.ResourceList) *admissionError {
+	if used := rm.usedVMSlotsLocked(); used >= rm.vmSlots {
+		return insufficientResource("OutOfvmslots", ResourceVMSlots, "1", fmt.Sprint(used), fmt.Sprint(rm.vmSlots))
+	}
+
+	if rm.allocatable == nil {
+		return nil
+	}
+
+	used := rm.usedResourcesLocked()
+	for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		allocatable, ok := rm.allocatable[name]
+		if !ok {
+			continue
+		}
+		requested := requests[name]
+		inUse := used[name]
+
+		total := inUse.DeepCopy()
+		total.Add(requested)
+		if total.Cmp(allocatable) > 0 {
+			return insufficientResource("OutOf"+string(name), name, quantityString(name, requested), quantityString(name, inUse), quantityString(name, allocatable))
+		}
+	}
+	return nil
+}
+
+// quantityString formats q the way the kubelet reports resources in
+// admission failures: millicores for cpu and bytes for everything else.
+func quantityString(name v1.ResourceName, q resource.Quantity) string {
+	if name == v1.ResourceCPU {
+		return fmt.Sprint(q.MilliValue())
+	}
+	return fmt.Sprint(q.Value())
+}
+
+// rejectLocked records pod as failed so the rejection is reported through
+// GetPodStatus and a warning event instead of the creation being retried.
+// rm.mu must be held.
+func (rm *ResourceManager) rejectLocked(pod *v1.Pod, err *admissionError) {
+	rm.recorder.Event(pod, v1.EventTypeWarning, err.reason, err.message)
+	now := metav1.Now()
+	pod.Status = v1.PodStatus{
+		Phase:     v1.PodFailed,
+		Reason:    err.reason,
+		Message:   err.message,
+		StartTime: &now,
+	}
+	rm.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+}
+
+// activeLocked reports whether the admitted pod uid still holds its
+// resources, i.e. its virtual machine is starting or running. rm.mu must be held.
+func (rm *ResourceManager) activeLocked(uid types.UID) bool {
+	if vm := rm.instances[uid]; vm != nil {
+		switch vm.State() {
+		case vz.VirtualMachineStateStopped, vz.VirtualMachineStateError:
+			return false
+		}
+	}
+	return true
+}
+
+// usedVMSlotsLocked returns the number of admitted pods whose virtual machine
+// is starting or running. rm.mu must be held.
+func (rm *ResourceManager) usedVMSlotsLocked() int {
+	used := 0
+	for uid := range rm.admitted {
+		if rm.activeLocked(uid) {
+			used++
+		}
+	}
+	return used
+}
+
+// usedResourcesLocked sums the resources of the admitted pods whose virtual
+// machine is starting or running. rm.mu must be held.
+func (rm *ResourceManager) usedResourcesLocked() v1.ResourceList {
+	used := v1.ResourceList{}
+	for uid, requests := range rm.admitted {
+		if rm.activeLocked(uid) {
+			sizing.AddResources(used, requests)
+		}
+	}
+	return used
+}
+
+// SetAllocatable sets the resources available to pods. Pods whose requests
+// do not fit in what is left are rejected.
+func (rm *ResourceManager) SetAllocatable(allocatable v1.ResourceList) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.allocatable = allocatable.DeepCopy()
+}
+
+// VMSlots returns the number of virtual machines the node can run at the same time.
+func (rm *ResourceManager) VMSlots() int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.vmSlots
+}
+
+// UsedVMSlots returns the number of virtual machines currently starting or running.
+func (rm *ResourceManager) UsedVMSlots() int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.usedVMSlotsLocked()
+}
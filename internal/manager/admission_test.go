@@ -0,0 +1,235 @@
+package manager
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/internal/volume"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+var testPolicy = sizing.Policy{
+	Defaults: sizing.Size{CPUs: 1, Memory: 1 << 30},
+	Limits:   sizing.Limits{MinCPUs: 1, MaxCPUs: 8, MinMemory: 512 << 20, MaxMemory: 16 << 30},
+}
+
+func testConfig(vmSlots int) Config {
+	return Config{
+		VMSlots: vmSlots,
+		Templates: map[string]Template{
+			"macos-vm": {Policy: testPolicy, Spec: testTemplate},
+		},
+		DefaultHandler: "macos-vm",
+	}
+}
+
+func newTestPod(name string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			UID:       types.UID(name + "-uid"),
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "main"}},
+		},
+	}
+}
+
+func TestCreatePodRejectsWhenVMSlotsExhausted(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a pod whose virtual machine is still being created holds the only slot
+	rm.admitted["running-uid"] = v1.ResourceList{}
+
+	pod := newTestPod("extra")
+	if err := rm.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("expected rejection to be reported through the pod status, got error: %v", err)
+	}
+
+	status := rm.GetPodStatus(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+	if status == nil {
+		t.Fatal("expected rejected pod to have a status")
+	}
+	if status.Phase != v1.PodFailed {
+		t.Errorf("expected phase %s, got %s", v1.PodFailed, status.Phase)
+	}
+	if status.Reason != "OutOfvmslots" {
+		t.Errorf("expected reason OutOfvmslots, got %q", status.Reason)
+	}
+	if used := rm.UsedVMSlots(); used != 1 {
+		t.Errorf("expected rejected pod not to take a slot, got %d used", used)
+	}
+
+	if err := rm.DeletePod(context.Background(), pod); err != nil {
+		t.Fatalf("expected rejected pod to be deleted, got: %v", err)
+	}
+	if rm.GetPod(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}) != nil {
+		t.Error("expected rejected pod to be forgotten after deletion")
+	}
+}
+
+func TestNewResourceManagerRequiresVMSlots(t *testing.T) {
+	if _, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(0)); err == nil {
+		t.Fatal("expected an error for zero vm slots")
+	}
+}
+
+func TestCreatePodRejectsWhenAllocatableExceeded(t *testing.T) {
+	testCases := []struct {
+		name     string
+		requests v1.ResourceList
+		reason   string
+	}{
+		{
+			name:     "cpu",
+			requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1500m")},
+			reason:   "OutOfcpu",
+		},
+		{
+			name:     "memory",
+			requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("5Gi")},
+			reason:   "OutOfmemory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rm.SetAllocatable(v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("4"),
+				v1.ResourceMemory: resource.MustParse("8Gi"),
+			})
+			rm.admitted["running-uid"] = v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("3"),
+				v1.ResourceMemory: resource.MustParse("4Gi"),
+			}
+
+			pod := newTestPod("extra")
+			pod.Spec.Containers[0].Resources.Requests = tc.requests
+			if err := rm.CreatePod(context.Background(), pod); err != nil {
+				t.Fatal(err)
+			}
+
+			status := rm.GetPodStatus(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+			if status.Phase != v1.PodFailed || status.Reason != tc.reason {
+				t.Errorf("expected pod to fail with %s, got %s/%s", tc.reason, status.Phase, status.Reason)
+			}
+		})
+	}
+}
+
+func TestCreatePodAdmitsOnRequests(t *testing.T) {
+	testCases := []struct {
+		name      string
+		resources v1.ResourceRequirements
+	}{
+		{name: "best effort"},
+		{
+			name: "limits above requests",
+			resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+				Limits:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("4")},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rm.SetAllocatable(v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("4"),
+				v1.ResourceMemory: resource.MustParse("8Gi"),
+			})
+			rm.admitted["running-uid"] = v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("3500m"),
+				v1.ResourceMemory: resource.MustParse("7Gi"),
+			}
+			// the host port conflict stops the creation once the pod is
+			// admitted on its resources
+			rm.hostPorts["running-uid"] = []hostPort{{protocol: v1.ProtocolTCP, port: 8080, containerPort: 80}}
+
+			pod := withHostPort(newTestPod("extra"), v1.ContainerPort{ContainerPort: 80, HostPort: 8080})
+			pod.Spec.Containers[0].Resources = tc.resources
+			if err := rm.CreatePod(context.Background(), pod); err != nil {
+				t.Fatal(err)
+			}
+
+			status := rm.GetPodStatus(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+			if status == nil || status.Reason != HostPortConflictReason {
+				t.Errorf("expected the pod to be admitted on its requests rather than its VM size, got %+v", status)
+			}
+		})
+	}
+}
+
+func TestCreatePodRejectsInvalidVMAnnotations(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, recorder, nil, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("custom")
+	pod.Annotations = map[string]string{spec.AnnotationDisplay: "huge"}
+	if err := rm.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("expected rejection to be reported through the pod status, got error: %v", err)
+	}
+
+	status := rm.GetPodStatus(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+	if status == nil || status.Phase != v1.PodFailed || status.Reason != "InvalidVMAnnotation" {
+		t.Fatalf("expected pod to fail with InvalidVMAnnotation, got %+v", status)
+	}
+	if !strings.Contains(status.Message, spec.AnnotationDisplay) {
+		t.Errorf("expected message to name the annotation, got %q", status.Message)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning InvalidVMAnnotation") {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Error("expected a warning event")
+	}
+}
+
+func TestCreatePodRejectsHostPathOutsideAllowlist(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.HostPaths = volume.Allowlist{{Path: "/Users/ci/Library/Caches", ReadOnly: true}}
+	recorder := record.NewFakeRecorder(10)
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, recorder, nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("host")
+	pod.Spec.Volumes = []v1.Volume{{Name: "keys", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/Users/ci/.ssh"}}}}
+	if err := rm.CreatePod(context.Background(), pod); err != nil {
+		t.Fatalf("expected rejection to be reported through the pod status, got error: %v", err)
+	}
+
+	status := rm.GetPodStatus(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+	if status == nil || status.Phase != v1.PodFailed || status.Reason != "HostPathNotAllowed" {
+		t.Fatalf("expected the pod to fail with HostPathNotAllowed, got %+v", status)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "HostPathNotAllowed") || !strings.Contains(event, "/Users/ci/.ssh") {
+		t.Errorf("expected a HostPathNotAllowed event naming the path, got %q", event)
+	}
+}
@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/netstack"
+	"github.com/raikerian/macos-virtual-kubelet/internal/pcap"
+	"github.com/virtual-kubelet/virtual-kubelet/errdefs"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// CapturePath is the path of the capture endpoint, followed by the
+// namespace and the name of the pod, e.g.
+// /debug/capture/default/web?filter=tcp+port+443&duration=30s.
+const CapturePath = "/debug/capture/"
+
+// CapturePod writes the traffic of the virtual machine of the pod nm to w
+// as a pcap-ng stream, until ctx is done or a limit of opts is reached.
+// Only the traffic of userspace networks can be captured.
+func (rm *ResourceManager) CapturePod(ctx context.Context, nm types.NamespacedName, w io.Writer, opts netstack.CaptureOptions) error {
+	rm.mu.RLock()
+	pod := rm.pods[nm]
+	var nw *netstack.Network
+	if pod != nil {
+		nw = rm.networks[pod.UID]
+	}
+	rm.mu.RUnlock()
+	if pod == nil {
+		return errdefs.NotFoundf("pod %s is not running on this node", nm)
+	}
+	if nw == nil {
+		return errdefs.InvalidInputf("the traffic of pod %s cannot be captured: its virtual machine is not attached in userspace network mode", nm)
+	}
+
+	logger := log.G(ctx).WithFields(log.Fields{"namespace": nm.Namespace, "pod": nm.Name, "filter": opts.Filter.String()})
+	logger.Info("Capturing the traffic of the virtual machine")
+	defer logger.Info("Stopped capturing the traffic of the virtual machine")
+	return nw.Capture(ctx, w, nm.String(), opts)
+}
+
+// CaptureHandler serves the captures of CapturePod on CapturePath. The
+// query selects and limits the captured frames: filter, in the syntax of
+// pcap.Compile, snaplen, duration, e.g. 30s, and maxBytes, e.g. 10Mi. The
+// capture lasts until the client goes away by default.
+func (rm *ResourceManager) CaptureHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		namespace, name, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, CapturePath), "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			http.Error(w, "expected "+CapturePath+"<namespace>/<pod>", http.StatusNotFound)
+			return
+		}
+		opts, err := captureOptions(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// the status is only known once the capture starts
+		out := &captureWriter{w: w}
+		err = rm.CapturePod(req.Context(), types.NamespacedName{Namespace: namespace, Name: name}, out, opts)
+		switch {
+		case err == nil:
+		case out.started:
+			log.G(req.Context()).WithError(err).Debug("Capture stream ended")
+		case errdefs.IsNotFound(err):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errdefs.IsInvalidInput(err):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func captureOptions(req *http.Request) (netstack.CaptureOptions, error) {
+	var (
+		opts  netstack.CaptureOptions
+		err   error
+		query = req.URL.Query()
+	)
+	if opts.Filter, err = pcap.Compile(query.Get("filter")); err != nil {
+		return opts, err
+	}
+	if v := query.Get("snaplen"); v != "" {
+		if opts.SnapLen, err = strconv.Atoi(v); err != nil || opts.SnapLen <= 0 {
+			return opts, fmt.Errorf("invalid snaplen %q", v)
+		}
+	}
+	if v := query.Get("duration"); v != "" {
+		if opts.Duration, err = time.ParseDuration(v); err != nil || opts.Duration <= 0 {
+			return opts, fmt.Errorf("invalid duration %q", v)
+		}
+	}
+	if v := query.Get("maxBytes"); v != "" {
+		q, err := resource.ParseQuantity(v)
+		if err != nil || q.Value() <= 0 {
+			return opts, fmt.Errorf("invalid maxBytes %q", v)
+		}
+		opts.MaxBytes = q.Value()
+	}
+	return opts, nil
+}
+
+// captureWriter streams a capture to an HTTP client, flushing every
+// block for the frames to be seen as they are captured.
+type captureWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if !c.started {
+		c.w.Header().Set("Content-Type", "application/x-pcapng")
+		c.started = true
+	}
+	n, err := c.w.Write(p)
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+func TestCaptureHandler(t *testing.T) {
+	cfg := testConfig(2)
+	cfg.Subnet = "10.127.0.0/16"
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, db := newTestPod("web"), newTestPod("db")
+	if _, err := rm.attachNetwork(context.Background(), web, spec.Spec{Network: spec.Network{Mode: spec.NetworkModeUserspace, MACAddress: "02:4a:0b:c0:0d:0e"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer rm.removeGuest(context.Background(), web.UID)
+	for _, pod := range []*v1.Pod{web, db} {
+		rm.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+	}
+
+	for path, want := range map[string]int{
+		"/debug/capture/default":                         http.StatusNotFound,
+		"/debug/capture/default/api":                     http.StatusNotFound,
+		"/debug/capture/default/db":                      http.StatusBadRequest,
+		"/debug/capture/default/web?filter=tcp+port+web": http.StatusBadRequest,
+		"/debug/capture/default/web?duration=forever":    http.StatusBadRequest,
+		"/debug/capture/default/web?maxBytes=-1":         http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		rm.CaptureHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("%s: expected status %d, got %d: %s", path, want, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	rm.CaptureHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/capture/default/web?filter=tcp&duration=50ms", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-pcapng" {
+		t.Fatalf("expected a capture, got status %d: %s", w.Code, w.Body)
+	}
+	if body := w.Body.Bytes(); len(body) < 12 || binary.LittleEndian.Uint32(body) != 0x0A0D0D0A || !bytes.Contains(body, []byte("default/web")) {
+		t.Errorf("expected a pcap-ng stream of the pod, got %x", body)
+	}
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/egress"
+	"github.com/raikerian/macos-virtual-kubelet/internal/metrics"
+	"github.com/raikerian/macos-virtual-kubelet/internal/netstack"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// applyEgress restricts the flows of the guest of pod on nw to its egress
+// policy, unless it is already applied. It is kept when it cannot be
+// computed.
+func (rm *ResourceManager) applyEgress(ctx context.Context, pod *v1.Pod, nw *netstack.Network) error {
+	policy, err := egress.ForPod(pod, rm.policies)
+	if err != nil {
+		return err
+	}
+
+	rm.mu.Lock()
+	applied, ok := rm.egress[pod.UID]
+	if ok && reflect.DeepEqual(applied, policy) {
+		rm.mu.Unlock()
+		return nil
+	}
+	rm.egress[pod.UID] = policy
+	rm.mu.Unlock()
+
+	logger := log.G(ctx).WithFields(log.Fields{"namespace": pod.Namespace, "pod": pod.Name})
+	if policy == nil {
+		if ok {
+			logger.Info("Lifted the egress policy")
+		}
+		nw.SetFilter(nil)
+		return nil
+	}
+	logger.WithField("policy", policy.Source).Info("Applying the egress policy")
+	nw.SetFilter(egressFilter(logger, pod.Namespace, policy))
+	return nil
+}
+
+// egressFilter returns the filter enforcing policy, logging and counting
+// the denied flows of the pods of namespace.
+func egressFilter(logger log.Logger, namespace string, policy *egress.Policy) netstack.Filter {
+	return func(flow netstack.Flow) bool {
+		if policy.Allows(flow.Protocol, flow.Destination, flow.Names) {
+			return true
+		}
+		metrics.EgressDenied.WithLabelValues(namespace, strings.ToLower(string(flow.Protocol))).Inc()
+		logger.WithFields(log.Fields{
+			"protocol":    flow.Protocol,
+			"destination": flow.Destination,
+			"names":       strings.Join(flow.Names, ","),
+			"policy":      policy.Source,
+		}).Info("Denied egress connection")
+		return false
+	}
+}
+
+// syncEgress applies the egress policies of the running pods again, for
+// changes of their NetworkPolicies to be enforced.
+func (rm *ResourceManager) syncEgress(ctx context.Context) {
+	type running struct {
+		pod *v1.Pod
+		nw  *netstack.Network
+	}
+	var pods []running
+	rm.mu.RLock()
+	for _, pod := range rm.pods {
+		if nw := rm.networks[pod.UID]; nw != nil {
+			pods = append(pods, running{pod: pod, nw: nw})
+		}
+	}
+	rm.mu.RUnlock()
+
+	for _, r := range pods {
+		if err := rm.applyEgress(ctx, r.pod, r.nw); err != nil {
+			log.G(ctx).WithFields(log.Fields{"namespace": r.pod.Namespace, "pod": r.pod.Name}).WithError(err).Warn("Failed to update the egress policy")
+		}
+	}
+}
+
+// SyncEgress keeps the egress policies of the running pods up to date,
+// checking them every period until ctx is done.
+func (rm *ResourceManager) SyncEgress(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rm.syncEgress(ctx)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/cloudinit"
+	"github.com/raikerian/macos-virtual-kubelet/internal/guest"
+	"github.com/raikerian/macos-virtual-kubelet/internal/metrics"
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/internal/storage"
+	"github.com/raikerian/macos-virtual-kubelet/internal/volume"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// Names of the disk images in the directory of a pod: the cloud-init seed
+// of Linux guests, the provisioning disk of macOS guests and the boot disk
+// of the pods needing a larger one than their bundle.
+const (
+	seedImage      = "seed.iso"
+	provisionImage = "provision.iso"
+	bootImage      = "Disk.img"
+)
+
+// volumesDir is the directory of a pod holding its volumes.
+const volumesDir = "volumes"
+
+// podDir returns the directory holding the files generated for the virtual
+// machine of the pod uid, or "" when no pods directory is configured.
+func (rm *ResourceManager) podDir(uid types.UID) string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if rm.podsDir == "" {
+		return ""
+	}
+	return filepath.Join(rm.podsDir, string(uid))
+}
+
+// prepareGuest writes the disk the guest of pod is provisioned from at boot
+// and the volumes of pod, and returns s with them attached. An
+// *admissionError is returned when the environment of a container cannot be
+// resolved, a *volume.MountError when a volume cannot be written or its
+// claim is not bound yet.
+func (rm *ResourceManager) prepareGuest(pod *v1.Pod, s spec.Spec, size sizing.Size) (spec.Spec, error) {
+	manifest, err := guest.NewManifest(pod, rm, size.ResourceList())
+	var configErr *guest.ConfigError
+	if errors.As(err, &configErr) {
+		return s, &admissionError{reason: guest.ConfigErrorReason, message: configErr.Error()}
+	}
+	if err != nil {
+		return s, err
+	}
+
+	dir := rm.podDir(pod.UID)
+	if dir == "" {
+		return s, fmt.Errorf("no pods directory to write the guest files to")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return s, fmt.Errorf("failed to create the pod directory: %w", err)
+	}
+
+	if s, manifest.GrowDisk, err = prepareBootDisk(dir, s); err != nil {
+		return s, err
+	}
+
+	shares, err := volume.Prepare(filepath.Join(dir, volumesDir), pod, rm, size.ResourceList(), rm.hostPathAllowlist())
+	var hostPathErr *volume.HostPathError
+	if errors.As(err, &hostPathErr) {
+		// the allowlist changed since the pod was admitted
+		return s, volumeAdmissionError(err)
+	}
+	if err != nil {
+		return s, err
+	}
+	s.Shares = append(append([]spec.Share(nil), s.Shares...), shares...)
+
+	claimDisks, err := rm.attachClaims(pod)
+	if err != nil {
+		return s, err
+	}
+	s.Disks = append(append([]spec.Disk(nil), s.Disks...), claimDisks...)
+
+	var disk string
+	if s.Guest == spec.GuestLinux {
+		disk = filepath.Join(dir, seedImage)
+		err = cloudinit.WriteSeed(disk, manifest)
+	} else {
+		disk = filepath.Join(dir, provisionImage)
+		err = guest.WriteDisk(disk, manifest)
+	}
+	if err != nil {
+		return s, err
+	}
+	s.Disks = append(s.Disks, spec.Disk{Path: disk, ReadOnly: true})
+	return s, nil
+}
+
+// prepareBootDisk clones the disk image of the bundle of s into dir when it
+// is smaller than the boot disk size of s, grows the clone and returns s
+// booting from it. The bundle image is shared by every pod of its runtime
+// handler and never resized. It reports whether the guest has a larger disk
+// to grow its boot volume into.
+func prepareBootDisk(dir string, s spec.Spec) (spec.Spec, bool, error) {
+	if s.BootDiskSize == 0 {
+		return s, false, nil
+	}
+	src := vm.GetDiskImagePath(s.BundlePath)
+	info, err := os.Stat(src)
+	if err != nil {
+		return s, false, fmt.Errorf("failed to stat the disk image of the bundle: %w", err)
+	}
+	if uint64(info.Size()) >= s.BootDiskSize {
+		return s, false, nil
+	}
+
+	s.BootDisk = filepath.Join(dir, bootImage)
+	start := time.Now()
+	if err := storage.CloneDisk(src, s.BootDisk, int64(s.BootDiskSize)); err != nil {
+		return s, false, fmt.Errorf("failed to clone the disk image of the bundle: %w", err)
+	}
+	metrics.BundleCloneDuration.Observe(time.Since(start).Seconds())
+	return s, true, nil
+}
+
+// attachClaims returns the disks of the persistentVolumeClaim volumes of
+// pod, creating their images on first use. An image is attached to one
+// virtual machine at a time: a pod waits for the previous pod of its claim,
+// e.g. the previous instance of a StatefulSet pod, to be deleted.
+func (rm *ResourceManager) attachClaims(pod *v1.Pod) ([]spec.Disk, error) {
+	rm.mu.RLock()
+	disksDir := rm.disksDir
+	rm.mu.RUnlock()
+
+	var disks []spec.Disk
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		if rm.claims == nil || disksDir == "" {
+			return nil, &admissionError{reason: volume.UnsupportedReason, message: fmt.Sprintf("volume %s: persistentVolumeClaim volumes are not provisioned on this node", v.Name)}
+		}
+		path, size, err := storage.Image(rm.claims, pod.Namespace, v.PersistentVolumeClaim.ClaimName, disksDir)
+		if errors.Is(err, storage.ErrUnsupportedVolume) {
+			return nil, &admissionError{reason: volume.UnsupportedReason, message: fmt.Sprintf("volume %s: %v", v.Name, err)}
+		}
+		if err != nil {
+			return nil, &volume.MountError{Volume: v.Name, Err: err}
+		}
+
+		rm.mu.Lock()
+		if user, ok := rm.diskUsers[path]; ok && user != pod.UID {
+			rm.mu.Unlock()
+			return nil, &volume.MountError{Volume: v.Name, Err: fmt.Errorf("persistentvolumeclaim %q is in use by another pod", v.PersistentVolumeClaim.ClaimName)}
+		}
+		rm.diskUsers[path] = pod.UID
+		rm.mu.Unlock()
+
+		if _, err := storage.CreateDisk(path, size); err != nil {
+			return nil, &volume.MountError{Volume: v.Name, Err: fmt.Errorf("failed to create disk image: %w", err)}
+		}
+		disks = append(disks, spec.Disk{Path: path, ReadOnly: v.PersistentVolumeClaim.ReadOnly, ID: v.Name})
+	}
+	return disks, nil
+}
+
+// hostPathAllowlist returns the host directories hostPath volumes can share.
+func (rm *ResourceManager) hostPathAllowlist() volume.Allowlist {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.hostPaths
+}
+
+// volumeAdmissionError returns the rejection of a pod whose volume cannot be
+// shared.
+func volumeAdmissionError(err error) *admissionError {
+	var hostPathErr *volume.HostPathError
+	if errors.As(err, &hostPathErr) {
+		return &admissionError{reason: volume.HostPathNotAllowedReason, message: hostPathErr.Error()}
+	}
+	return &admissionError{reason: volume.UnsupportedReason, message: err.Error()}
+}
+
+// syncVolumes rewrites the volumes of the running pods whose ConfigMap,
+// Secret or fields changed, so that the guests see the update.
+func (rm *ResourceManager) syncVolumes(ctx context.Context) {
+	for _, pod := range rm.GetPods() {
+		rm.mu.RLock()
+		allocatable, ok := rm.sizes[pod.UID]
+		rm.mu.RUnlock()
+		dir := rm.podDir(pod.UID)
+		if !ok || dir == "" || len(pod.Spec.Volumes) == 0 {
+			continue
+		}
+		dir = filepath.Join(dir, volumesDir)
+		// the pod may be deleted in the meantime
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+
+		updated, err := volume.Update(dir, pod, rm, allocatable)
+		logger := log.G(ctx).WithFields(log.Fields{"namespace": pod.Namespace, "pod": pod.Name})
+		if err != nil {
+			logger.WithError(err).Warn("Failed to update volumes")
+		}
+		if len(updated) > 0 {
+			logger.WithField("volumes", updated).Debug("Updated volumes")
+		}
+	}
+}
+
+// SyncVolumes keeps the volumes of the running pods up to date, checking
+// them every period until ctx is done.
+func (rm *ResourceManager) SyncVolumes(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rm.syncVolumes(ctx)
+		}
+	}
+}
+
+// removeGuest deletes the files generated for the pod uid, detaches the
+// images of its claims, which are kept, forgets its tokens, frees its host
+// ports and stops its userspace network.
+func (rm *ResourceManager) removeGuest(ctx context.Context, uid types.UID) {
+	rm.tokens.DeleteServiceAccountToken(uid)
+	rm.unpublishHostPorts(ctx, uid)
+	rm.detachNetwork(ctx, uid)
+	rm.mu.Lock()
+	for path, user := range rm.diskUsers {
+		if user == uid {
+			delete(rm.diskUsers, path)
+		}
+	}
+	rm.mu.Unlock()
+
+	dir := rm.podDir(uid)
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.G(ctx).WithError(err).Warn("Failed to remove the pod directory")
+	}
+}
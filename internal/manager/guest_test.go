@@ -0,0 +1,240 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/storage"
+	"github.com/raikerian/macos-virtual-kubelet/internal/volume"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+func TestPrepareGuest(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.PodsDir = t.TempDir()
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("linux")
+
+	s, err := rm.prepareGuest(pod, testTemplate, testPolicy.Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provision := filepath.Join(cfg.PodsDir, string(pod.UID), provisionImage)
+	if len(s.Disks) != 1 || s.Disks[0] != (spec.Disk{Path: provision, ReadOnly: true}) {
+		t.Fatalf("expected the provisioning disk to be attached read-only to a macOS guest, got %+v", s.Disks)
+	}
+
+	linux := testTemplate
+	linux.Guest = spec.GuestLinux
+	s, err = rm.prepareGuest(pod, linux, testPolicy.Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := filepath.Join(cfg.PodsDir, string(pod.UID), seedImage)
+	if len(s.Disks) != 1 || s.Disks[0] != (spec.Disk{Path: seed, ReadOnly: true}) {
+		t.Fatalf("expected the seed to be attached read-only, got %+v", s.Disks)
+	}
+	if _, err := os.Stat(seed); err != nil {
+		t.Fatalf("expected the seed to be written: %v", err)
+	}
+
+	pod.Spec.Volumes = []v1.Volume{{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	s, err = rm.prepareGuest(pod, testTemplate, testPolicy.Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scratch := filepath.Join(cfg.PodsDir, string(pod.UID), volumesDir, "scratch")
+	if len(s.Shares) != 1 || s.Shares[0] != (spec.Share{Tag: "scratch", Path: scratch}) {
+		t.Fatalf("expected the emptyDir volume to be shared, got %+v", s.Shares)
+	}
+
+	rm.removeGuest(context.Background(), pod.UID)
+	if _, err := os.Stat(filepath.Dir(seed)); !os.IsNotExist(err) {
+		t.Errorf("expected the pod directory to be removed, got %v", err)
+	}
+}
+
+func TestPrepareGuestClonesLargerBootDisk(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.PodsDir = t.TempDir()
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bundle, "Disk.img"), make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	template := testTemplate
+	template.BundlePath = bundle
+
+	pod := newTestPod("large")
+	template.BootDiskSize = 4096
+	s, err := rm.prepareGuest(pod, template, testPolicy.Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BootDisk != "" {
+		t.Errorf("expected a large enough bundle image to be booted as is, got %s", s.BootDisk)
+	}
+
+	template.BootDiskSize = 1 << 20
+	s, err = rm.prepareGuest(pod, template, testPolicy.Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := filepath.Join(cfg.PodsDir, string(pod.UID), bootImage)
+	if s.BootDisk != clone {
+		t.Fatalf("expected the pod to boot from its own clone, got %q", s.BootDisk)
+	}
+	if info, err := os.Stat(clone); err != nil || info.Size() != 1<<20 {
+		t.Errorf("expected the clone to be grown to 1Mi, got %v %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(bundle, "Disk.img")); err != nil || info.Size() != 4096 {
+		t.Errorf("expected the bundle image to be left untouched, got %v %v", info, err)
+	}
+}
+
+func TestPrepareGuestRejectsMissingReferences(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.PodsDir = t.TempDir()
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("config")
+	pod.Spec.Containers[0].Env = []v1.EnvVar{{
+		Name: "TOKEN",
+		ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "missing"},
+			Key:                  "token",
+		}},
+	}}
+
+	_, err = rm.prepareGuest(pod, testTemplate, testPolicy.Defaults)
+	var admitErr *admissionError
+	if !errors.As(err, &admitErr) || admitErr.reason != "CreateContainerConfigError" {
+		t.Fatalf("expected a CreateContainerConfigError rejection, got %v", err)
+	}
+
+	optional := true
+	pod.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Optional = &optional
+	if _, err := rm.prepareGuest(pod, testTemplate, testPolicy.Defaults); err != nil {
+		t.Fatalf("expected an optional reference to be skipped, got %v", err)
+	}
+}
+
+// fakeClaims serves claims and volumes from maps keyed by name.
+type fakeClaims struct {
+	claims  map[string]*v1.PersistentVolumeClaim
+	volumes map[string]*v1.PersistentVolume
+}
+
+func (f fakeClaims) GetClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	if c, ok := f.claims[name]; ok && c.Namespace == namespace {
+		return c, nil
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("persistentvolumeclaims"), name)
+}
+
+func (f fakeClaims) GetVolume(name string) (*v1.PersistentVolume, error) {
+	if pv, ok := f.volumes[name]; ok {
+		return pv, nil
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("persistentvolumes"), name)
+}
+
+func TestPrepareGuestAttachesClaims(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.PodsDir = t.TempDir()
+	cfg.DisksDir = t.TempDir()
+
+	class := "local-disk"
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data-web-0", UID: "claim-uid"},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &class,
+			Resources:        v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")}},
+		},
+	}
+	pv, err := storage.NewVolume(claim, &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local-disk"}}, "node", cfg.DisksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := fakeClaims{
+		claims:  map[string]*v1.PersistentVolumeClaim{claim.Name: claim},
+		volumes: map[string]*v1.PersistentVolume{pv.Name: pv},
+	}
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, claims, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("web-0")
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim.Name}}}}
+
+	var mountErr *volume.MountError
+	if _, err := rm.prepareGuest(pod, testTemplate, testPolicy.Defaults); !errors.As(err, &mountErr) {
+		t.Fatalf("expected the pod to wait for its claim to be bound, got %v", err)
+	}
+
+	claim.Spec.VolumeName = pv.Name
+	claim.Status.Phase = v1.ClaimBound
+	s, err := rm.prepareGuest(pod, testTemplate, testPolicy.Defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := pv.Spec.Local.Path
+	if len(s.Disks) != 2 || s.Disks[0] != (spec.Disk{Path: image, ID: "data"}) {
+		t.Fatalf("expected the disk of the claim to be attached, got %+v", s.Disks)
+	}
+	info, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<30 {
+		t.Errorf("expected a 1Gi image, got %d bytes", info.Size())
+	}
+
+	next := newTestPod("web-0-next")
+	next.Spec.Volumes = pod.Spec.Volumes
+	if _, err := rm.prepareGuest(next, testTemplate, testPolicy.Defaults); !errors.As(err, &mountErr) {
+		t.Fatalf("expected the disk to be attached to one pod at a time, got %v", err)
+	}
+	rm.removeGuest(context.Background(), pod.UID)
+	if _, err := rm.prepareGuest(next, testTemplate, testPolicy.Defaults); err != nil {
+		t.Fatalf("expected the disk to be reattached to the next pod, got %v", err)
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Errorf("expected the image to be kept: %v", err)
+	}
+}
+
+func TestPrepareGuestRejectsClaimsWithoutProvisioner(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.PodsDir = t.TempDir()
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("web-0")
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data-web-0"}}}}
+
+	_, err = rm.prepareGuest(pod, testTemplate, testPolicy.Defaults)
+	var admitErr *admissionError
+	if !errors.As(err, &admitErr) || admitErr.reason != "UnsupportedVolume" {
+		t.Fatalf("expected an UnsupportedVolume rejection, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// HostPortConflictReason is the reason of the rejection of the pods
+// publishing a host port another pod publishes.
+const HostPortConflictReason = "HostPortConflict"
+
+// hostPort is a port of the host published by a container.
+type hostPort struct {
+	protocol v1.Protocol
+	// ip is the address the port is published on, the node IP when empty
+	ip            string
+	port          int32
+	containerPort int32
+}
+
+// conflicts reports whether p and o cannot be published together: an
+// empty or unspecified address stands for every address, as for the
+// scheduler.
+func (p hostPort) conflicts(o hostPort) bool {
+	if p.protocol != o.protocol || p.port != o.port {
+		return false
+	}
+	return wildcardIP(p.ip) || wildcardIP(o.ip) || p.ip == o.ip
+}
+
+func (p hostPort) String() string {
+	ip := p.ip
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(ip, strconv.Itoa(int(p.port))), p.protocol)
+}
+
+func wildcardIP(ip string) bool {
+	return ip == "" || ip == "0.0.0.0"
+}
+
+// podHostPorts returns the host ports the containers of pod publish.
+func podHostPorts(pod *v1.Pod) ([]hostPort, error) {
+	var ports []hostPort
+	for _, c := range pod.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.HostPort == 0 {
+				continue
+			}
+			p := hostPort{protocol: cp.Protocol, ip: cp.HostIP, port: cp.HostPort, containerPort: cp.ContainerPort}
+			if p.protocol == "" {
+				p.protocol = v1.ProtocolTCP
+			}
+			if p.protocol != v1.ProtocolTCP && p.protocol != v1.ProtocolUDP {
+				return nil, fmt.Errorf("host port %d of container %s: protocol %s is not supported", cp.HostPort, c.Name, p.protocol)
+			}
+			if p.ip != "" {
+				addr, err := netip.ParseAddr(p.ip)
+				if err != nil {
+					return nil, fmt.Errorf("host port %d of container %s: invalid host IP %q", cp.HostPort, c.Name, cp.HostIP)
+				}
+				p.ip = addr.String()
+			}
+			for _, other := range ports {
+				if p.conflicts(other) {
+					return nil, fmt.Errorf("host port %s of container %s is published twice", p, c.Name)
+				}
+			}
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// reserveHostPortsLocked reserves ports for the pod uid, unless one of
+// them is reserved by another pod. rm.mu must be held.
+func (rm *ResourceManager) reserveHostPortsLocked(uid types.UID, ports []hostPort) *admissionError {
+	for _, p := range ports {
+		for other, ownerPorts := range rm.hostPorts {
+			for _, o := range ownerPorts {
+				if other != uid && p.conflicts(o) {
+					return &admissionError{
+						reason:  HostPortConflictReason,
+						message: fmt.Sprintf("host port %s is already published by another pod", p),
+					}
+				}
+			}
+		}
+	}
+	if len(ports) > 0 {
+		rm.hostPorts[uid] = ports
+	}
+	return nil
+}
+
+// publishHostPorts listens on the host ports reserved for pod and forwards
+// them to its guest: through its userspace network, or to the pod IP
+// otherwise.
+func (rm *ResourceManager) publishHostPorts(ctx context.Context, pod *v1.Pod) error {
+	rm.mu.RLock()
+	ports := rm.hostPorts[pod.UID]
+	nw := rm.networks[pod.UID]
+	nodeIP := rm.nodeIP
+	rm.mu.RUnlock()
+
+	nm := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	for _, p := range ports {
+		ip := p.ip
+		if wildcardIP(ip) && nodeIP != nil {
+			ip = nodeIP()
+		}
+		addr := net.JoinHostPort(ip, strconv.Itoa(int(p.port)))
+
+		if nw != nil {
+			if err := nw.Publish(p.protocol, addr, p.containerPort); err != nil {
+				return fmt.Errorf("failed to publish host port %s: %w", p, err)
+			}
+			continue
+		}
+		proxy, err := network.NewProxy(p.protocol, addr, rm.dialPodIP(nm, pod.UID, p.protocol, p.containerPort))
+		if err != nil {
+			return fmt.Errorf("failed to publish host port %s: %w", p, err)
+		}
+		rm.mu.Lock()
+		rm.hostProxies[pod.UID] = append(rm.hostProxies[pod.UID], proxy)
+		rm.mu.Unlock()
+	}
+	if len(ports) > 0 {
+		log.G(ctx).WithFields(log.Fields{"namespace": pod.Namespace, "pod": pod.Name}).Infof("Published %d host ports", len(ports))
+	}
+	return nil
+}
+
+// dialPodIP returns the dialer of port of the pod nm, at the pod IP known
+// when the connection is forwarded: it is discovered after the virtual
+// machine starts.
+func (rm *ResourceManager) dialPodIP(nm types.NamespacedName, uid types.UID, protocol v1.Protocol, port int32) network.DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		rm.mu.RLock()
+		var ip string
+		if pod := rm.pods[nm]; pod != nil && pod.UID == uid {
+			ip = pod.Status.PodIP
+		}
+		rm.mu.RUnlock()
+		if ip == "" {
+			return nil, fmt.Errorf("the IP of pod %s is not known yet", nm)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, strings.ToLower(string(protocol)), net.JoinHostPort(ip, strconv.Itoa(int(port))))
+	}
+}
+
+// unpublishHostPorts stops forwarding the host ports of the pod uid and
+// frees them. Those of userspace networks are closed with the network.
+func (rm *ResourceManager) unpublishHostPorts(ctx context.Context, uid types.UID) {
+	rm.mu.Lock()
+	proxies := rm.hostProxies[uid]
+	delete(rm.hostProxies, uid)
+	delete(rm.hostPorts, uid)
+	rm.mu.Unlock()
+	for _, proxy := range proxies {
+		if err := proxy.Close(); err != nil {
+			log.G(ctx).WithError(err).Warn("Failed to stop publishing a host port")
+		}
+	}
+}
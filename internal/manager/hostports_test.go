@@ -0,0 +1,184 @@
+package manager
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+func withHostPort(pod *v1.Pod, port v1.ContainerPort) *v1.Pod {
+	pod.Spec.Containers[0].Ports = append(pod.Spec.Containers[0].Ports, port)
+	return pod
+}
+
+func TestPodHostPorts(t *testing.T) {
+	pod := newTestPod("web")
+	withHostPort(pod, v1.ContainerPort{ContainerPort: 8080})
+	withHostPort(pod, v1.ContainerPort{ContainerPort: 80, HostPort: 8080})
+	withHostPort(pod, v1.ContainerPort{ContainerPort: 53, HostPort: 5353, Protocol: v1.ProtocolUDP, HostIP: "10.0.0.1"})
+	ports, err := podHostPorts(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []hostPort{
+		{protocol: v1.ProtocolTCP, port: 8080, containerPort: 80},
+		{protocol: v1.ProtocolUDP, ip: "10.0.0.1", port: 5353, containerPort: 53},
+	}
+	if len(ports) != len(want) || ports[0] != want[0] || ports[1] != want[1] {
+		t.Errorf("expected %+v, got %+v", want, ports)
+	}
+
+	for _, port := range []v1.ContainerPort{
+		{ContainerPort: 80, HostPort: 80, Protocol: v1.ProtocolSCTP},
+		{ContainerPort: 80, HostPort: 80, HostIP: "localhost"},
+		{ContainerPort: 81, HostPort: 8080, HostIP: "10.0.0.1"},
+	} {
+		if _, err := podHostPorts(withHostPort(pod.DeepCopy(), port)); err == nil {
+			t.Errorf("expected %+v to be rejected", port)
+		}
+	}
+}
+
+func TestReserveHostPorts(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if err := rm.reserveHostPortsLocked("web-uid", []hostPort{{protocol: v1.ProtocolTCP, ip: "10.0.0.1", port: 80}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		port     hostPort
+		conflict bool
+	}{
+		{hostPort{protocol: v1.ProtocolTCP, ip: "10.0.0.1", port: 80}, true},
+		{hostPort{protocol: v1.ProtocolTCP, port: 80}, true},
+		{hostPort{protocol: v1.ProtocolTCP, ip: "0.0.0.0", port: 80}, true},
+		{hostPort{protocol: v1.ProtocolTCP, ip: "10.0.0.2", port: 80}, false},
+		{hostPort{protocol: v1.ProtocolUDP, ip: "10.0.0.1", port: 80}, false},
+		{hostPort{protocol: v1.ProtocolTCP, ip: "10.0.0.1", port: 81}, false},
+	} {
+		err := rm.reserveHostPortsLocked("db-uid", []hostPort{tc.port})
+		if got := err != nil; got != tc.conflict {
+			t.Errorf("%s: expected conflict to be %v, got %v", tc.port, tc.conflict, err)
+		}
+		if err != nil && err.reason != HostPortConflictReason {
+			t.Errorf("unexpected reason %s", err.reason)
+		}
+		delete(rm.hostPorts, "db-uid")
+	}
+}
+
+func TestCreatePodRejectsHostPortConflicts(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.hostPorts["web-uid"] = []hostPort{{protocol: v1.ProtocolTCP, port: 8080, containerPort: 80}}
+
+	pod := withHostPort(newTestPod("api"), v1.ContainerPort{ContainerPort: 80, HostPort: 8080})
+	if err := rm.CreatePod(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	status := rm.GetPodStatus(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+	if status == nil || status.Phase != v1.PodFailed || status.Reason != HostPortConflictReason {
+		t.Fatalf("expected the pod to fail with %s, got %+v", HostPortConflictReason, status)
+	}
+	if _, ok := rm.admitted[pod.UID]; ok {
+		t.Error("expected the rejected pod not to hold resources")
+	}
+
+	isolated := withHostPort(newTestPod("isolated"), v1.ContainerPort{ContainerPort: 80, HostPort: 9090})
+	isolated.Annotations = map[string]string{spec.AnnotationNetwork: "isolated"}
+	if err := rm.CreatePod(context.Background(), isolated); err != nil {
+		t.Fatal(err)
+	}
+	if status := rm.GetPodStatus(types.NamespacedName{Namespace: isolated.Namespace, Name: isolated.Name}); status == nil || status.Reason != "HostPortUnsupported" {
+		t.Errorf("expected an isolated pod not to publish host ports, got %+v", status)
+	}
+}
+
+func TestPublishHostPorts(t *testing.T) {
+	guest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+	go func() {
+		for {
+			c, err := guest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAddr := free.Addr().String()
+	free.Close()
+
+	cfg := testConfig(1)
+	cfg.NodeIP = func() string { return "127.0.0.1" }
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("web")
+	rm.hostPorts[pod.UID] = []hostPort{{protocol: v1.ProtocolTCP, port: int32(free.Addr().(*net.TCPAddr).Port), containerPort: int32(guest.Addr().(*net.TCPAddr).Port)}}
+	rm.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+	if err := rm.publishHostPorts(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", hostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed while the pod IP is unknown")
+	}
+	c.Close()
+
+	rm.mu.Lock()
+	setPodIP(pod, "127.0.0.1")
+	rm.mu.Unlock()
+	c, err = net.Dial("tcp", hostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected the guest to answer, got %q, %v", buf, err)
+	}
+	c.Close()
+
+	rm.removeGuest(context.Background(), pod.UID)
+	if _, err := net.Dial("tcp", hostAddr); err == nil {
+		t.Error("expected the host port to be closed with the pod")
+	}
+	if len(rm.hostPorts) != 0 || len(rm.hostProxies) != 0 {
+		t.Error("expected the host port to be freed")
+	}
+}
@@ -0,0 +1,167 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/netstack"
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// ipDiscoveryPeriod is how often the address of a guest is looked up until
+// it is found, ipDiscoveryTimeout when the lookup is given up.
+const (
+	ipDiscoveryPeriod  = 2 * time.Second
+	ipDiscoveryTimeout = 10 * time.Minute
+)
+
+// ipSource returns where the address of a guest attached with n is found:
+// the DHCP leases of the host in NAT mode, its neighbor table in bridged
+// mode. Guests of a userspace network have no pod IP: their address is
+// private to the network, reachable only through its host ports, and the
+// node IP would be shared by every pod of the node.
+func ipSource(n spec.Network) network.Source {
+	switch n.Mode {
+	case spec.NetworkModeNAT:
+		return network.LeaseSource{}
+	case spec.NetworkModeBridged:
+		return network.NeighborSource{Interface: n.Interface}
+	}
+	return nil
+}
+
+// discoverPodIP looks up the address of the virtual machine of the pod nm
+// until it is found, the pod is deleted or ipDiscoveryTimeout passes, and
+// publishes it in the status of the pod.
+func (rm *ResourceManager) discoverPodIP(ctx context.Context, nm types.NamespacedName, uid types.UID, n spec.Network) {
+	source := ipSource(n)
+	if source == nil || n.MACAddress == "" {
+		return
+	}
+	logger := log.G(ctx).WithFields(log.Fields{"namespace": nm.Namespace, "pod": nm.Name})
+
+	ticker := time.NewTicker(ipDiscoveryPeriod)
+	defer ticker.Stop()
+	timeout := time.After(ipDiscoveryTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout:
+			logger.WithField("mac", n.MACAddress).Warn("Gave up discovering the pod IP")
+			return
+		case <-ticker.C:
+		}
+		found, err := rm.lookupPodIP(ctx, nm, uid, source, n.MACAddress)
+		if err != nil {
+			logger.WithError(err).Debug("Failed to look up the pod IP")
+		}
+		if found {
+			return
+		}
+	}
+}
+
+// lookupPodIP looks up the address of mac in source once and sets it on the
+// pod nm. It reports whether the lookup is over: the address is found or
+// the pod is gone.
+func (rm *ResourceManager) lookupPodIP(ctx context.Context, nm types.NamespacedName, uid types.UID, source network.Source, mac string) (bool, error) {
+	rm.mu.RLock()
+	_, running := rm.instances[uid]
+	rm.mu.RUnlock()
+	if !running {
+		return true, nil
+	}
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return true, err
+	}
+	ip, err := source.Lookup(ctx, hw)
+	if err != nil || ip == nil {
+		return false, err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	pod := rm.pods[nm]
+	if pod == nil || pod.UID != uid {
+		return true, nil
+	}
+	setPodIP(pod, ip.String())
+	log.G(ctx).WithFields(log.Fields{"namespace": nm.Namespace, "pod": nm.Name, "ip": ip}).Info("Discovered the pod IP")
+	return true, nil
+}
+
+func setPodIP(pod *v1.Pod, ip string) {
+	pod.Status.PodIP = ip
+	pod.Status.PodIPs = []v1.PodIP{{IP: ip}}
+}
+
+// attachNetwork starts the userspace network of the virtual machine of pod
+// when s is attached in userspace mode, restricted to the egress policy and
+// shaped to the bandwidth of the pod, and returns s attached to it. The
+// bandwidth of pods attached otherwise is not limited.
+func (rm *ResourceManager) attachNetwork(ctx context.Context, pod *v1.Pod, s spec.Spec) (spec.Spec, error) {
+	uid := pod.UID
+	if s.Network.Mode != spec.NetworkModeUserspace {
+		return s, nil
+	}
+	if rm.subnets == nil {
+		return s, fmt.Errorf("no subnet to run the userspace network of the virtual machine in")
+	}
+	mac, err := net.ParseMAC(s.Network.MACAddress)
+	if err != nil {
+		return s, fmt.Errorf("invalid MAC address %s: %w", s.Network.MACAddress, err)
+	}
+	subnet, err := rm.subnets.Allocate(uid)
+	if err != nil {
+		return s, err
+	}
+	bandwidth, err := network.PodBandwidth(pod.Annotations)
+	if err != nil {
+		rm.subnets.Release(uid)
+		return s, err
+	}
+	nw, err := netstack.New(netstack.Config{Subnet: subnet, MAC: mac, Bandwidth: bandwidth})
+	if err != nil {
+		rm.subnets.Release(uid)
+		return s, fmt.Errorf("failed to start the userspace network: %w", err)
+	}
+
+	rm.mu.Lock()
+	rm.networks[uid] = nw
+	rm.mu.Unlock()
+	if err := rm.applyEgress(ctx, pod, nw); err != nil {
+		rm.detachNetwork(ctx, uid)
+		return s, fmt.Errorf("failed to apply the egress policy: %w", err)
+	}
+	s.Network.File = nw.GuestFile()
+	return s, nil
+}
+
+// detachNetwork stops the userspace network of the pod uid, if any, and
+// frees its subnet.
+func (rm *ResourceManager) detachNetwork(ctx context.Context, uid types.UID) {
+	rm.mu.Lock()
+	nw := rm.networks[uid]
+	delete(rm.networks, uid)
+	delete(rm.egress, uid)
+	rm.mu.Unlock()
+	if rm.subnets != nil {
+		rm.subnets.Release(uid)
+	}
+	if nw == nil {
+		return
+	}
+	if err := nw.Close(); err != nil {
+		log.G(ctx).WithError(err).Warn("Failed to stop the userspace network")
+	}
+}
@@ -0,0 +1,159 @@
+package manager
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+// fakeSource knows the addresses of a map keyed by MAC address.
+type fakeSource map[string]string
+
+func (f fakeSource) Lookup(_ context.Context, mac net.HardwareAddr) (net.IP, error) {
+	return net.ParseIP(f[mac.String()]), nil
+}
+
+func TestLookupPodIP(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("web")
+	nm := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	rm.pods[nm] = pod
+	rm.instances[pod.UID] = &vz.VirtualMachine{}
+	mac := "02:4a:0b:c0:0d:0e"
+
+	done, err := rm.lookupPodIP(context.Background(), nm, pod.UID, fakeSource{}, mac)
+	if err != nil || done {
+		t.Fatalf("expected the lookup to go on until the guest gets an address, got %v, %v", done, err)
+	}
+
+	done, err = rm.lookupPodIP(context.Background(), nm, pod.UID, fakeSource{mac: "192.168.64.5"}, mac)
+	if err != nil || !done {
+		t.Fatalf("expected the address to be found, got %v, %v", done, err)
+	}
+	if pod.Status.PodIP != "192.168.64.5" || len(pod.Status.PodIPs) != 1 || pod.Status.PodIPs[0] != (v1.PodIP{IP: "192.168.64.5"}) {
+		t.Errorf("expected the address in the pod status, got %+v", pod.Status)
+	}
+
+	delete(rm.instances, pod.UID)
+	if done, _ := rm.lookupPodIP(context.Background(), nm, pod.UID, fakeSource{}, mac); !done {
+		t.Error("expected the lookup to stop once the pod is deleted")
+	}
+}
+
+func TestAttachNetwork(t *testing.T) {
+	cfg := testConfig(2)
+	cfg.Subnet = "10.127.0.0/16"
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nat := spec.Spec{Network: spec.Network{Mode: spec.NetworkModeNAT, MACAddress: "02:4a:0b:c0:0d:0e"}}
+	if s, err := rm.attachNetwork(context.Background(), newTestPod("nat"), nat); err != nil || s.Network != nat.Network || len(rm.networks) != 0 {
+		t.Errorf("expected a NAT guest to be left alone, got %+v, %v", s.Network, err)
+	}
+
+	userspace := spec.Spec{Network: spec.Network{Mode: spec.NetworkModeUserspace, MACAddress: "02:4a:0b:c0:0d:0e"}}
+	s, err := rm.attachNetwork(context.Background(), newTestPod("web"), userspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw := rm.networks["web-uid"]
+	if nw == nil || s.Network.File != nw.GuestFile() {
+		t.Fatalf("expected the guest to be attached to its network, got %+v", s.Network)
+	}
+	if got := nw.Subnet().String(); got != "10.127.0.0/24" {
+		t.Errorf("expected the first subnet, got %s", got)
+	}
+
+	rm.removeGuest(context.Background(), "web-uid")
+	if len(rm.networks) != 0 {
+		t.Error("expected the network to be stopped with the guest")
+	}
+	if _, err := nw.GuestFile().Stat(); err == nil {
+		t.Error("expected the file handle of the guest to be closed")
+	}
+	if s, err := rm.attachNetwork(context.Background(), newTestPod("db"), userspace); err != nil || rm.networks["db-uid"].Subnet().String() != "10.127.0.0/24" {
+		t.Errorf("expected the subnet to be reused, got %+v, %v", s.Network, err)
+	}
+	rm.removeGuest(context.Background(), "db-uid")
+}
+
+func TestAttachNetworkWithoutSubnet(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.attachNetwork(context.Background(), newTestPod("web"), spec.Spec{Network: spec.Network{Mode: spec.NetworkModeUserspace, MACAddress: "02:4a:0b:c0:0d:0e"}}); err == nil {
+		t.Error("expected a userspace network to require a subnet")
+	}
+}
+
+// fakePolicies lists the NetworkPolicies of a slice.
+type fakePolicies []*networkingv1.NetworkPolicy
+
+func (f fakePolicies) List(selector labels.Selector) ([]*networkingv1.NetworkPolicy, error) {
+	return f, nil
+}
+
+func (f fakePolicies) NetworkPolicies(namespace string) networkinglisters.NetworkPolicyNamespaceLister {
+	return f
+}
+
+func (f fakePolicies) Get(name string) (*networkingv1.NetworkPolicy, error) {
+	for _, np := range f {
+		if np.Name == name {
+			return np, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(networkingv1.Resource("networkpolicies"), name)
+}
+
+func TestSyncEgress(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.Subnet = "10.127.0.0/16"
+	policies := fakePolicies{}
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), nil, nil, &policies, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("web")
+	if _, err := rm.attachNetwork(context.Background(), pod, spec.Spec{Network: spec.Network{Mode: spec.NetworkModeUserspace, MACAddress: "02:4a:0b:c0:0d:0e"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer rm.removeGuest(context.Background(), pod.UID)
+	rm.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+	if p, ok := rm.egress[pod.UID]; !ok || p != nil {
+		t.Fatalf("expected an unrestricted pod, got %+v", p)
+	}
+
+	policies = append(policies, &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: "deny-all"},
+		Spec:       networkingv1.NetworkPolicySpec{PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}},
+	})
+	rm.syncEgress(context.Background())
+	if p := rm.egress[pod.UID]; p == nil || p.Source != "NetworkPolicy deny-all" {
+		t.Fatalf("expected the NetworkPolicy to be applied, got %+v", p)
+	}
+
+	policies = policies[:0]
+	rm.syncEgress(context.Background())
+	if p, ok := rm.egress[pod.UID]; !ok || p != nil {
+		t.Errorf("expected the policy to be lifted, got %+v", p)
+	}
+}
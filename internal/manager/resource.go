@@ -2,36 +2,173 @@ package manager
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/exp/maps"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	corev1listers "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/Code-Hex/vz/v3"
+	"github.com/raikerian/macos-virtual-kubelet/internal/egress"
+	"github.com/raikerian/macos-virtual-kubelet/internal/metrics"
+	"github.com/raikerian/macos-virtual-kubelet/internal/netstack"
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/internal/storage"
+	"github.com/raikerian/macos-virtual-kubelet/internal/token"
+	"github.com/raikerian/macos-virtual-kubelet/internal/vmclass"
+	"github.com/raikerian/macos-virtual-kubelet/internal/volume"
 	"github.com/raikerian/macos-virtual-kubelet/pkg/vm"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
 )
 
 // ResourceManager acts as a passthrough to a cache (lister) for pods assigned to the current node.
 // It is also a passthrough to a cache (lister) for Kubernetes secrets and config maps.
 type ResourceManager struct {
+	mu        sync.RWMutex
 	pods      map[types.NamespacedName]*v1.Pod
 	instances map[types.UID]*vz.VirtualMachine
+	// admitted holds the requests of the pods admitted to run a virtual
+	// machine, sizes the resources of their virtual machine
+	admitted    map[types.UID]v1.ResourceList
+	sizes       map[types.UID]v1.ResourceList
+	allocatable v1.ResourceList
+	vmSlots     int
+	templates   map[string]Template
+	// defaultHandler is the runtime handler of the pods without a RuntimeClass
+	defaultHandler string
+	podsDir        string
+	hostPaths      volume.Allowlist
+	disksDir       string
+	interfaces     func() []string
+	// diskUsers maps the disk images of claims to the pod attaching them
+	diskUsers map[string]types.UID
+	// subnets are the subnets of the userspace networks, nil when no range
+	// is configured
+	subnets  *netstack.Pool
+	networks map[types.UID]*netstack.Network
+	// egress holds the egress policies applied to the userspace networks,
+	// nil for the unrestricted ones
+	egress map[types.UID]*egress.Policy
+	// hostPorts holds the host ports reserved by the admitted pods,
+	// hostProxies the proxies publishing them outside userspace networks
+	hostPorts   map[types.UID][]hostPort
+	hostProxies map[types.UID][]*network.Proxy
+	nodeIP      func() string
+
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	classes  vmclass.Getter
+	claims   storage.Claims
+	policies networkinglisters.NetworkPolicyLister
+	tokens   *token.Manager
 
-	// potentially not needed listers
 	podLister       corev1listers.PodLister
 	secretLister    corev1listers.SecretLister
 	configMapLister corev1listers.ConfigMapLister
 	serviceLister   corev1listers.ServiceLister
 }
 
+// Config configures the virtual machines run by a ResourceManager.
+type Config struct {
+	// VMSlots is the number of virtual machines run at the same time.
+	VMSlots int
+	// Templates maps the RuntimeClass handlers pods select to the template
+	// of their virtual machines.
+	Templates map[string]Template
+	// DefaultHandler is the handler of the pods without a RuntimeClass.
+	DefaultHandler string
+	// PodsDir holds a directory per pod for the files generated for its
+	// virtual machine.
+	PodsDir string
+	// HostPaths are the host directories hostPath volumes can share.
+	HostPaths volume.Allowlist
+	// DisksDir holds the disk images of the claims of pods.
+	DisksDir string
+	// Interfaces lists the host interfaces virtual machines can be bridged
+	// to. The interfaces of bridged pods are neither checked nor detected
+	// when it is nil.
+	Interfaces func() []string
+	// NodeIP returns the address host ports are published on when pods do
+	// not select one. They are published on every address when it is nil.
+	NodeIP func() string
+	// Subnet is the range the subnets of the virtual machines attached in
+	// userspace mode are taken from, e.g. 10.127.0.0/16. It is only read
+	// by NewResourceManager as running networks keep their subnet.
+	Subnet string
+}
+
+// Template is the virtual machine of the pods using a runtime handler.
+type Template struct {
+	// Policy sizes the virtual machine of each pod.
+	Policy sizing.Policy
+	// Spec is the spec virtual machines are created from once sized.
+	Spec spec.Spec
+}
+
+func (cfg Config) validate() error {
+	if cfg.VMSlots <= 0 {
+		return fmt.Errorf("vm slots must be greater than 0, got %d", cfg.VMSlots)
+	}
+	if _, ok := cfg.Templates[cfg.DefaultHandler]; !ok {
+		return fmt.Errorf("default runtime handler %q has no template", cfg.DefaultHandler)
+	}
+	return nil
+}
+
 // NewResourceManager returns a ResourceManager with the internal maps initialized.
-func NewResourceManager(podLister corev1listers.PodLister, secretLister corev1listers.SecretLister, configMapLister corev1listers.ConfigMapLister, serviceLister corev1listers.ServiceLister) (*ResourceManager, error) {
-	rm := ResourceManager{
-		pods:      map[types.NamespacedName]*v1.Pod{},
-		instances: map[types.UID]*vz.VirtualMachine{},
+func NewResourceManager(podLister corev1listers.PodLister, secretLister corev1listers.SecretLister, configMapLister corev1listers.ConfigMapLister, serviceLister corev1listers.ServiceLister, client kubernetes.Interface, recorder record.EventRecorder, classes vmclass.Getter, claims storage.Claims, policies networkinglisters.NetworkPolicyLister, cfg Config) (*ResourceManager, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	var subnets *netstack.Pool
+	if cfg.Subnet != "" {
+		var err error
+		if subnets, err = netstack.NewPool(cfg.Subnet); err != nil {
+			return nil, err
+		}
+	}
 
+	rm := ResourceManager{
+		pods:           map[types.NamespacedName]*v1.Pod{},
+		instances:      map[types.UID]*vz.VirtualMachine{},
+		admitted:       map[types.UID]v1.ResourceList{},
+		sizes:          map[types.UID]v1.ResourceList{},
+		vmSlots:        cfg.VMSlots,
+		templates:      cfg.Templates,
+		defaultHandler: cfg.DefaultHandler,
+		podsDir:        cfg.PodsDir,
+		hostPaths:      cfg.HostPaths,
+		disksDir:       cfg.DisksDir,
+		interfaces:     cfg.Interfaces,
+		diskUsers:      map[string]types.UID{},
+		subnets:        subnets,
+		networks:       map[types.UID]*netstack.Network{},
+		egress:         map[types.UID]*egress.Policy{},
+		hostPorts:      map[types.UID][]hostPort{},
+		hostProxies:    map[types.UID][]*network.Proxy{},
+		nodeIP:         cfg.NodeIP,
+
+		client:          client,
+		recorder:        recorder,
+		classes:         classes,
+		claims:          claims,
+		policies:        policies,
+		tokens:          token.NewManager(client),
 		podLister:       podLister,
 		secretLister:    secretLister,
 		configMapLister: configMapLister,
@@ -40,56 +177,211 @@ func NewResourceManager(podLister corev1listers.PodLister, secretLister corev1li
 	return &rm, nil
 }
 
+// Reconfigure replaces the configuration of the virtual machines created from
+// now on. Running virtual machines keep their slot even if the new number of
+// slots is lower than the slots in use.
+func (rm *ResourceManager) Reconfigure(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.vmSlots = cfg.VMSlots
+	rm.templates = cfg.Templates
+	rm.defaultHandler = cfg.DefaultHandler
+	rm.podsDir = cfg.PodsDir
+	rm.hostPaths = cfg.HostPaths
+	rm.disksDir = cfg.DisksDir
+	rm.interfaces = cfg.Interfaces
+	rm.nodeIP = cfg.NodeIP
+	return nil
+}
+
 func (rm *ResourceManager) CreatePod(ctx context.Context, pod *v1.Pod) error {
 	uid := pod.GetUID()
+	nm := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
 
-	cpuSpec := pod.Spec.Containers[0].Resources.Requests[v1.ResourceCPU]
-	memorySpec := pod.Spec.Containers[0].Resources.Requests[v1.ResourceMemory]
+	size, requests, vmSpec, err := rm.podVMSpec(ctx, pod)
+	var admitErr *admissionError
+	if errors.As(err, &admitErr) {
+		log.G(ctx).WithField("reason", admitErr.reason).Warnf("Rejecting pod: %s", admitErr.message)
+		rm.mu.Lock()
+		rm.rejectLocked(pod, admitErr)
+		rm.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	cpu, ok := cpuSpec.AsInt64()
-	if !ok {
-		log.G(ctx).Warn("Failed to get CPU request")
+	// podVMSpec validated the host ports
+	hostPorts, _ := podHostPorts(pod)
+	rm.mu.Lock()
+	admitErr = rm.admitLocked(requests)
+	if admitErr == nil {
+		admitErr = rm.reserveHostPortsLocked(uid, hostPorts)
 	}
-	memory, ok := memorySpec.AsInt64()
-	if !ok {
-		log.G(ctx).Warn("Failed to get memory request")
+	if admitErr != nil {
+		log.G(ctx).WithField("reason", admitErr.reason).Warnf("Rejecting pod: %s", admitErr.message)
+		rm.rejectLocked(pod, admitErr)
+		rm.mu.Unlock()
+		return nil
+	}
+	rm.admitted[uid] = requests
+	rm.sizes[uid] = size.ResourceList()
+	rm.mu.Unlock()
+
+	vmSpec, err = rm.prepareGuest(pod, vmSpec, size)
+	if errors.As(err, &admitErr) {
+		log.G(ctx).WithField("reason", admitErr.reason).Warnf("Rejecting pod: %s", admitErr.message)
+		rm.removeGuest(ctx, uid)
+		rm.mu.Lock()
+		delete(rm.admitted, uid)
+		delete(rm.sizes, uid)
+		rm.rejectLocked(pod, admitErr)
+		rm.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		var mountErr *volume.MountError
+		if errors.As(err, &mountErr) {
+			rm.recorder.Event(pod, v1.EventTypeWarning, volume.MountErrorReason, mountErr.Error())
+		}
+		rm.removeGuest(ctx, uid)
+		rm.release(uid)
+		metrics.VMCreateErrors.WithLabelValues("guest").Inc()
+		return err
+	}
+
+	vmSpec, err = rm.attachNetwork(ctx, pod, vmSpec)
+	if err != nil {
+		rm.removeGuest(ctx, uid)
+		rm.release(uid)
+		metrics.VMCreateErrors.WithLabelValues("network").Inc()
+		return err
 	}
 
-	vm, err := createVirtualMachine(uint(cpu), uint64(memory))
+	if err := rm.publishHostPorts(ctx, pod); err != nil {
+		rm.removeGuest(ctx, uid)
+		rm.release(uid)
+		metrics.VMCreateErrors.WithLabelValues("network").Inc()
+		return err
+	}
+
+	vm, err := createVirtualMachine(vmSpec)
 	if err != nil {
+		rm.removeGuest(ctx, uid)
+		rm.release(uid)
+		metrics.VMCreateErrors.WithLabelValues("configuration").Inc()
 		return err
 	}
 
+	start := time.Now()
 	if err := vm.Start(); err != nil {
+		rm.removeGuest(ctx, uid)
+		rm.release(uid)
+		metrics.VMCreateErrors.WithLabelValues("start").Inc()
 		return err
 	}
+	metrics.VMBootDuration.Observe(time.Since(start).Seconds())
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[sizing.Annotation] = size.String()
 
-	rm.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod
+	rm.mu.Lock()
+	rm.pods[nm] = pod
 	rm.instances[uid] = vm
+	rm.mu.Unlock()
+	go rm.discoverPodIP(context.WithoutCancel(ctx), nm, uid, vmSpec.Network)
+
+	if err := rm.annotatePod(ctx, pod, sizing.Annotation, size.String()); err != nil {
+		log.G(ctx).WithError(err).Warn("Failed to record the virtual machine size on the pod")
+	}
+
+	return nil
+}
 
+// UpdatePod refreshes the metadata of a known pod. The virtual machine is
+// left untouched as its spec cannot change after creation.
+func (rm *ResourceManager) UpdatePod(ctx context.Context, pod *v1.Pod) error {
+	nm := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	known := rm.pods[nm]
+	if known == nil {
+		return nil
+	}
+	updated := pod.DeepCopy()
+	updated.Status = known.Status
+	rm.pods[nm] = updated
 	return nil
 }
 
+// annotatePod sets the annotation key on pod in the API server.
+func (rm *ResourceManager) annotatePod(ctx context.Context, pod *v1.Pod, key, value string) error {
+	if rm.client == nil {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = rm.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
 func (rm *ResourceManager) DeletePod(ctx context.Context, pod *v1.Pod) error {
 	nm := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
-	if rm.pods[nm] == nil {
+	rm.mu.RLock()
+	known := rm.pods[nm]
+	rm.mu.RUnlock()
+	if known == nil {
 		return nil
 	}
 
 	uid := pod.GetUID()
+	rm.mu.RLock()
 	vm := rm.instances[uid]
+	rm.mu.RUnlock()
 
-	if err := vm.Stop(); err != nil {
-		return err
+	if vm != nil {
+		if err := vm.Stop(); err != nil {
+			metrics.VMDeleteErrors.WithLabelValues("stop").Inc()
+			return err
+		}
 	}
 
-	rm.pods[nm] = nil
-	rm.instances[uid] = nil
+	rm.mu.Lock()
+	delete(rm.pods, nm)
+	delete(rm.instances, uid)
+	delete(rm.admitted, uid)
+	delete(rm.sizes, uid)
+	rm.mu.Unlock()
 
+	rm.removeGuest(ctx, uid)
 	return nil
 }
 
+// release frees the resources admitted for uid.
+func (rm *ResourceManager) release(uid types.UID) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.admitted, uid)
+	delete(rm.sizes, uid)
+}
+
 func (rm *ResourceManager) GetPod(nm types.NamespacedName) *v1.Pod {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
 	return rm.pods[nm]
 }
 
@@ -99,7 +391,14 @@ func (rm *ResourceManager) GetPodStatus(nm types.NamespacedName) *v1.PodStatus {
 		return nil
 	}
 
+	rm.mu.RLock()
 	vm := rm.instances[pod.GetUID()]
+	rm.mu.RUnlock()
+	if vm == nil {
+		// the pod was rejected and never got a virtual machine
+		return &pod.Status
+	}
+
 	switch vm.State() {
 	case vz.VirtualMachineStateStarting:
 		pod.Status.Phase = v1.PodPending
@@ -124,42 +423,66 @@ func (rm *ResourceManager) GetPodStatus(nm types.NamespacedName) *v1.PodStatus {
 }
 
 func (rm *ResourceManager) GetPods() []*v1.Pod {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
 	return maps.Values(rm.pods)
 }
 
+// VMStates returns the number of virtual machines in each state.
+func (rm *ResourceManager) VMStates() map[string]int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	states := map[string]int{}
+	for _, vm := range rm.instances {
+		states[vmStateName(vm.State())]++
+	}
+	return states
+}
+
+// vmStateName returns a short lowercase name for a virtual machine state,
+// e.g. "running" for vz.VirtualMachineStateRunning.
+func vmStateName(state vz.VirtualMachineState) string {
+	return strings.ToLower(strings.TrimPrefix(state.String(), "VirtualMachineState"))
+}
+
 // GetConfigMap retrieves the specified config map from the cache.
-// func (rm *ResourceManager) GetConfigMap(name, namespace string) (*v1.ConfigMap, error) {
-// 	return rm.configMapLister.ConfigMaps(namespace).Get(name)
-// }
-
-// // GetSecret retrieves the specified secret from Kubernetes.
-// func (rm *ResourceManager) GetSecret(name, namespace string) (*v1.Secret, error) {
-// 	return rm.secretLister.Secrets(namespace).Get(name)
-// }
-
-// // ListServices retrieves the list of services from Kubernetes.
-// func (rm *ResourceManager) ListServices() ([]*v1.Service, error) {
-// 	return rm.serviceLister.List(labels.Everything())
-// }
-
-func createVirtualMachine(cpuCount uint, memorySize uint64) (*vz.VirtualMachine, error) {
-	platformConfig, err := vm.SetupMacPlatformConfiguration()
-	if err != nil {
-		return nil, err
+func (rm *ResourceManager) GetConfigMap(name, namespace string) (*v1.ConfigMap, error) {
+	if rm.configMapLister == nil {
+		return nil, apierrors.NewNotFound(v1.Resource("configmaps"), name)
 	}
+	return rm.configMapLister.ConfigMaps(namespace).Get(name)
+}
+
+// GetSecret retrieves the specified secret from the cache.
+func (rm *ResourceManager) GetSecret(name, namespace string) (*v1.Secret, error) {
+	if rm.secretLister == nil {
+		return nil, apierrors.NewNotFound(v1.Resource("secrets"), name)
+	}
+	return rm.secretLister.Secrets(namespace).Get(name)
+}
+
+// GetServiceAccountToken returns a token of the service account name in
+// namespace, requested with tr unless a cached one is still fresh.
+func (rm *ResourceManager) GetServiceAccountToken(namespace, name string, tr *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error) {
+	return rm.tokens.GetServiceAccountToken(namespace, name, tr)
+}
 
-	if cpuCount == 0 {
-		// cpu count wasnt provided, compute the basic one
-		cpuCount = vm.ComputeCPUCount()
+// ListServices retrieves the list of services from the cache.
+func (rm *ResourceManager) ListServices() ([]*v1.Service, error) {
+	if rm.serviceLister == nil {
+		return nil, nil
 	}
-	if memorySize == 0 {
-		// memory size wasnt provided, compute the basic one
-		memorySize = vm.ComputeMemorySize()
+	return rm.serviceLister.List(labels.Everything())
+}
+
+func createVirtualMachine(s spec.Spec) (*vz.VirtualMachine, error) {
+	plan, err := spec.LoadPlan(s)
+	if err != nil {
+		return nil, err
 	}
 
-	// bridge physical interface en0
-	// en0 is the default interface on Apple Silicon Macs
-	config, err := vm.CreateVMConfiguration(platformConfig, cpuCount, memorySize, "en0")
+	config, err := vm.CreateVMConfiguration(plan)
 	if err != nil {
 		return nil, err
 	}
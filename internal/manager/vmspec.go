@@ -0,0 +1,199 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/egress"
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/internal/vmclass"
+	"github.com/raikerian/macos-virtual-kubelet/internal/volume"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+// RuntimeHandlers returns the sorted RuntimeClass handlers pods can select.
+func (rm *ResourceManager) RuntimeHandlers() []string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	handlers := make([]string, 0, len(rm.templates))
+	for h := range rm.templates {
+		handlers = append(handlers, h)
+	}
+	sort.Strings(handlers)
+	return handlers
+}
+
+// podVMSpec returns the size and spec of the virtual machine of pod: the
+// template of its runtime handler, customized by the VM class of the pod,
+// then by its VM annotations. It also returns the requests the pod is
+// admitted against, the same requests plus overhead the scheduler counts.
+// An *admissionError is returned when the pod cannot run on the node.
+func (rm *ResourceManager) podVMSpec(ctx context.Context, pod *v1.Pod) (sizing.Size, v1.ResourceList, spec.Spec, error) {
+	handler, overhead, err := rm.podRuntimeHandler(ctx, pod)
+	if err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, err
+	}
+
+	rm.mu.RLock()
+	template, ok := rm.templates[handler]
+	rm.mu.RUnlock()
+	if !ok {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{
+			reason:  "UnknownRuntimeHandler",
+			message: fmt.Sprintf("runtime handler %q is not supported, supported handlers: %s", handler, strings.Join(rm.RuntimeHandlers(), ", ")),
+		}
+	}
+	policy, vmSpec := template.Policy, template.Spec
+	if pod.Spec.OS != nil && pod.Spec.OS.Name == v1.Linux && vmSpec.Guest != spec.GuestLinux {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{
+			reason:  "UnsupportedOS",
+			message: fmt.Sprintf("runtime handler %q boots a %s guest, the pod requires %s", handler, vmSpec.Guest, pod.Spec.OS.Name),
+		}
+	}
+	if err := volume.Validate(pod, rm.hostPathAllowlist()); err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, volumeAdmissionError(err)
+	}
+
+	class, err := rm.podVMClass(pod, handler)
+	if err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, err
+	}
+	if class != nil {
+		if errs := vmclass.Validate(class); len(errs) > 0 {
+			return sizing.Size{}, nil, spec.Spec{}, &admissionError{
+				reason:  "InvalidVMClass",
+				message: fmt.Sprintf("%s %s is invalid: %v", vmclass.Kind, class.Name, errs.ToAggregate()),
+			}
+		}
+		for _, c := range pod.Spec.Containers {
+			if !vmclass.AllowsImage(class, c.Image) {
+				return sizing.Size{}, nil, spec.Spec{}, &admissionError{
+					reason:  "ImageNotAllowed",
+					message: fmt.Sprintf("image %s of container %s is not allowed by %s %s", c.Image, c.Name, vmclass.Kind, class.Name),
+				}
+			}
+		}
+		policy, vmSpec = vmclass.Apply(class, policy, vmSpec)
+	}
+
+	// The RuntimeClass admission controller usually sets the overhead
+	// already, it is only added here when it did not run.
+	if pod.Spec.Overhead == nil && overhead != nil {
+		pod = pod.DeepCopy()
+		pod.Spec.Overhead = overhead
+	}
+	size, err := policy.Compute(pod)
+	if err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{reason: "UnsupportedVMSize", message: err.Error()}
+	}
+
+	vmSpec, err = spec.FromAnnotations(vmSpec, pod.Annotations)
+	if err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{reason: "InvalidVMAnnotation", message: err.Error()}
+	}
+	egressPolicy, err := egress.FromAnnotations(pod.Annotations)
+	if err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{reason: "InvalidVMAnnotation", message: err.Error()}
+	}
+	if _, err := network.PodBandwidth(pod.Annotations); err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{reason: "InvalidVMAnnotation", message: err.Error()}
+	}
+	if egressPolicy != nil && vmSpec.Network.Mode != spec.NetworkModeUserspace {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{
+			reason:  "EgressPolicyUnsupported",
+			message: fmt.Sprintf("egress annotations are only enforced in userspace network mode, not in %s mode", vmSpec.Network.Mode),
+		}
+	}
+
+	hostPorts, err := podHostPorts(pod)
+	if err != nil {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{reason: "HostPortUnsupported", message: err.Error()}
+	}
+	if len(hostPorts) > 0 && vmSpec.Network.Mode == spec.NetworkModeIsolated {
+		return sizing.Size{}, nil, spec.Spec{}, &admissionError{
+			reason:  "HostPortUnsupported",
+			message: fmt.Sprintf("host port %s cannot be published: the virtual machine is isolated from the network", hostPorts[0]),
+		}
+	}
+
+	if vmSpec.Network.Mode == spec.NetworkModeBridged {
+		rm.mu.RLock()
+		interfaces := rm.interfaces
+		rm.mu.RUnlock()
+		if interfaces != nil {
+			iface, err := network.ResolveInterface(ctx, vmSpec.Network.Interface, interfaces())
+			if err != nil {
+				return sizing.Size{}, nil, spec.Spec{}, &admissionError{reason: network.InterfaceNotFoundReason, message: err.Error()}
+			}
+			vmSpec.Network.Interface = iface
+		}
+	}
+
+	vmSpec.CPUs = size.CPUs
+	vmSpec.Memory = size.Memory
+	vmSpec.Network.MACAddress = network.MACAddress(pod.UID).String()
+	return size, sizing.PodRequests(pod), vmSpec, nil
+}
+
+// podRuntimeHandler returns the handler of the RuntimeClass of pod, or the
+// default handler for pods without one, along with the fixed overhead of
+// the RuntimeClass.
+func (rm *ResourceManager) podRuntimeHandler(ctx context.Context, pod *v1.Pod) (string, v1.ResourceList, error) {
+	if pod.Spec.RuntimeClassName == nil || *pod.Spec.RuntimeClassName == "" {
+		rm.mu.RLock()
+		defer rm.mu.RUnlock()
+		return rm.defaultHandler, nil, nil
+	}
+
+	name := *pod.Spec.RuntimeClassName
+	if rm.client == nil {
+		return "", nil, fmt.Errorf("cannot get RuntimeClass %s without a client", name)
+	}
+	runtimeClass, err := rm.client.NodeV1().RuntimeClasses().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil, &admissionError{reason: "RuntimeClassNotFound", message: fmt.Sprintf("RuntimeClass %s not found", name)}
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get RuntimeClass %s: %w", name, err)
+	}
+
+	var overhead v1.ResourceList
+	if runtimeClass.Overhead != nil {
+		overhead = runtimeClass.Overhead.PodFixed
+	}
+	return runtimeClass.Handler, overhead, nil
+}
+
+// podVMClass returns the VM class named by the annotation of pod or, when
+// it exists, the one named after its runtime handler. It returns nil when
+// the pod has no class.
+func (rm *ResourceManager) podVMClass(pod *v1.Pod, handler string) (*vmclass.MacOSVMClass, error) {
+	if name, ok := pod.Annotations[vmclass.Annotation]; ok {
+		if rm.classes == nil {
+			return nil, &admissionError{reason: "VMClassNotFound", message: fmt.Sprintf("%s %s not found: VM classes are not available", vmclass.Kind, name)}
+		}
+		class, err := rm.classes.Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil, &admissionError{reason: "VMClassNotFound", message: fmt.Sprintf("%s %s not found", vmclass.Kind, name)}
+		}
+		return class, err
+	}
+
+	if pod.Spec.RuntimeClassName == nil || rm.classes == nil {
+		return nil, nil
+	}
+	class, err := rm.classes.Get(handler)
+	if apierrors.IsNotFound(err) {
+		// the handler does not need a VM class
+		return nil, nil
+	}
+	return class, err
+}
@@ -0,0 +1,351 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/egress"
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+	"github.com/raikerian/macos-virtual-kubelet/internal/vmclass"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+type fakeClasses map[string]*vmclass.MacOSVMClass
+
+func (f fakeClasses) Get(name string) (*vmclass.MacOSVMClass, error) {
+	if class, ok := f[name]; ok {
+		return class, nil
+	}
+	return nil, apierrors.NewNotFound(vmclass.GroupVersionResource.GroupResource(), name)
+}
+
+var testTemplate = spec.Spec{
+	Display: spec.Display{Width: 1920, Height: 1200, PixelsPerInch: 80},
+	Network: spec.Network{Mode: spec.NetworkModeBridged, Interface: "en0"},
+	Devices: spec.Devices{Audio: true, Keyboard: true, Pointing: true},
+}
+
+func newClassTestManager(t *testing.T, objects ...*nodev1.RuntimeClass) *ResourceManager {
+	t.Helper()
+	memory := resource.MustParse("8Gi")
+	classes := fakeClasses{
+		"large": {
+			ObjectMeta: metav1.ObjectMeta{Name: "large"},
+			Spec: vmclass.MacOSVMClassSpec{
+				CPUs:          4,
+				Memory:        &memory,
+				Network:       &vmclass.Network{Mode: spec.NetworkModeNAT},
+				AllowedImages: []string{"ghcr.io/acme/*"},
+			},
+		},
+		"macos-ci": {
+			ObjectMeta: metav1.ObjectMeta{Name: "macos-ci"},
+			Spec:       vmclass.MacOSVMClassSpec{CPUs: 4},
+		},
+		"broken": {
+			ObjectMeta: metav1.ObjectMeta{Name: "broken"},
+			Spec:       vmclass.MacOSVMClassSpec{CPUs: -1},
+		},
+	}
+	client := fake.NewSimpleClientset()
+	for _, rc := range objects {
+		if _, err := client.NodeV1().RuntimeClasses().Create(context.Background(), rc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := testConfig(1)
+	cfg.Templates["macos-ci"] = cfg.Templates["macos-vm"]
+	rm, err := NewResourceManager(nil, nil, nil, nil, client, record.NewFakeRecorder(10), classes, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rm
+}
+
+func TestPodVMSpecFromClassAnnotation(t *testing.T) {
+	rm := newClassTestManager(t)
+	pod := newTestPod("classy")
+	pod.Spec.Containers[0].Image = "ghcr.io/acme/runner:1.0"
+	pod.Annotations = map[string]string{
+		vmclass.Annotation:     "large",
+		spec.AnnotationDisplay: "1024x768",
+	}
+
+	size, _, vmSpec, err := rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.CPUs != 4 || size.Memory != 8<<30 {
+		t.Errorf("expected the class size, got %s", size)
+	}
+	if vmSpec.Network.Mode != spec.NetworkModeNAT {
+		t.Errorf("expected the class network, got %+v", vmSpec.Network)
+	}
+	if vmSpec.Display.Width != 1024 {
+		t.Errorf("expected the annotation to override the class display, got %+v", vmSpec.Display)
+	}
+	if vmSpec.CPUs != size.CPUs || vmSpec.Memory != size.Memory {
+		t.Errorf("expected the spec to be sized, got %+v", vmSpec)
+	}
+}
+
+func TestPodVMSpecFromRuntimeClassHandler(t *testing.T) {
+	rm := newClassTestManager(t,
+		&nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "ci"}, Handler: "macos-ci"},
+		&nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "plain"}, Handler: "macos-vm"},
+	)
+
+	pod := newTestPod("runtime")
+	runtimeClass := "ci"
+	pod.Spec.RuntimeClassName = &runtimeClass
+	size, _, _, err := rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.CPUs != 4 {
+		t.Errorf("expected the class of the handler, got %s", size)
+	}
+
+	// a handler without a VM class keeps the provider configuration
+	runtimeClass = "plain"
+	size, _, vmSpec, err := rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testTemplate.Network
+	want.MACAddress = network.MACAddress(pod.UID).String()
+	if size != testPolicy.Defaults || vmSpec.Network != want {
+		t.Errorf("expected the provider configuration, got %s %+v", size, vmSpec)
+	}
+}
+
+func TestPodVMSpecClassRejections(t *testing.T) {
+	testCases := []struct {
+		name   string
+		class  string
+		image  string
+		reason string
+	}{
+		{name: "missing class", class: "missing", reason: "VMClassNotFound"},
+		{name: "invalid class", class: "broken", reason: "InvalidVMClass"},
+		{name: "image not allowed", class: "large", image: "docker.io/library/ubuntu", reason: "ImageNotAllowed"},
+	}
+
+	rm := newClassTestManager(t)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newTestPod("rejected")
+			pod.Spec.Containers[0].Image = tc.image
+			pod.Annotations = map[string]string{vmclass.Annotation: tc.class}
+
+			_, _, _, err := rm.podVMSpec(context.Background(), pod)
+			var admitErr *admissionError
+			if !errors.As(err, &admitErr) {
+				t.Fatalf("expected an admission error, got %v", err)
+			}
+			if admitErr.reason != tc.reason {
+				t.Errorf("expected reason %s, got %s: %s", tc.reason, admitErr.reason, admitErr.message)
+			}
+		})
+	}
+}
+
+func TestPodVMSpecRuntimeClassOverhead(t *testing.T) {
+	rm := newClassTestManager(t, &nodev1.RuntimeClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "heavy"},
+		Handler:    "macos-vm",
+		Overhead: &nodev1.Overhead{PodFixed: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("1"),
+			v1.ResourceMemory: resource.MustParse("512Mi"),
+		}},
+	})
+
+	pod := newTestPod("overhead")
+	runtimeClass := "heavy"
+	pod.Spec.RuntimeClassName = &runtimeClass
+	pod.Spec.Containers[0].Resources.Requests = v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("2"),
+		v1.ResourceMemory: resource.MustParse("2Gi"),
+	}
+
+	size, requests, _, err := rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.CPUs != 3 || size.Memory != 2<<30+512<<20 {
+		t.Errorf("expected the overhead to be added, got %s", size)
+	}
+	if cpu, memory := requests[v1.ResourceCPU], requests[v1.ResourceMemory]; cpu.Value() != 3 || memory.Value() != 2<<30+512<<20 {
+		t.Errorf("expected the overhead to be admitted, got %v", requests)
+	}
+	if pod.Spec.Overhead != nil {
+		t.Error("expected the pod not to be modified")
+	}
+
+	// an overhead set by the admission controller is not added twice
+	pod.Spec.Overhead = v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")}
+	size, _, _, err = rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size.CPUs != 3 || size.Memory != 2<<30 {
+		t.Errorf("expected the pod overhead to be used, got %s", size)
+	}
+}
+
+func TestPodVMSpecRuntimeClassRejections(t *testing.T) {
+	rm := newClassTestManager(t, &nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "windows"}, Handler: "windows-vm"})
+
+	for runtimeClass, reason := range map[string]string{
+		"windows": "UnknownRuntimeHandler",
+		"missing": "RuntimeClassNotFound",
+	} {
+		pod := newTestPod("rejected")
+		pod.Spec.RuntimeClassName = &runtimeClass
+
+		_, _, _, err := rm.podVMSpec(context.Background(), pod)
+		var admitErr *admissionError
+		if !errors.As(err, &admitErr) {
+			t.Fatalf("expected an admission error for %s, got %v", runtimeClass, err)
+		}
+		if admitErr.reason != reason {
+			t.Errorf("expected reason %s for %s, got %s: %s", reason, runtimeClass, admitErr.reason, admitErr.message)
+		}
+	}
+}
+
+func TestPodVMSpecGuestOS(t *testing.T) {
+	client := fake.NewSimpleClientset(&nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "linux"}, Handler: "linux-vm"})
+	cfg := testConfig(1)
+	linux := cfg.Templates["macos-vm"]
+	linux.Spec.Guest = spec.GuestLinux
+	cfg.Templates["linux-vm"] = linux
+	rm, err := NewResourceManager(nil, nil, nil, nil, client, record.NewFakeRecorder(10), fakeClasses{}, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("linux")
+	pod.Spec.OS = &v1.PodOS{Name: v1.Linux}
+	_, _, _, err = rm.podVMSpec(context.Background(), pod)
+	var admitErr *admissionError
+	if !errors.As(err, &admitErr) || admitErr.reason != "UnsupportedOS" {
+		t.Fatalf("expected a linux pod to be rejected by the macOS handler, got %v", err)
+	}
+
+	runtimeClass := "linux"
+	pod.Spec.RuntimeClassName = &runtimeClass
+	_, _, vmSpec, err := rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmSpec.Guest != spec.GuestLinux {
+		t.Errorf("expected a linux guest, got %s", vmSpec.Guest)
+	}
+}
+
+func TestPodVMSpecRejectsUnsupportedVolumes(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), fakeClasses{}, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("nfs")
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{NFS: &v1.NFSVolumeSource{Server: "nas", Path: "/data"}}}}
+	_, _, _, err = rm.podVMSpec(context.Background(), pod)
+	var admitErr *admissionError
+	if !errors.As(err, &admitErr) || admitErr.reason != "UnsupportedVolume" {
+		t.Fatalf("expected an nfs volume to be rejected, got %v", err)
+	}
+}
+
+func TestPodVMSpecResolvesBridgedInterfaces(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.Interfaces = func() []string { return []string{"en0", "en1"} }
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), fakeClasses{}, nil, nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("bridged")
+	pod.Annotations = map[string]string{spec.AnnotationNetwork: "bridged:en1"}
+	_, _, vmSpec, err := rm.podVMSpec(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmSpec.Network.Interface != "en1" {
+		t.Errorf("expected the interface of the pod, got %+v", vmSpec.Network)
+	}
+
+	pod.Annotations[spec.AnnotationNetwork] = "bridged:en9"
+	_, _, _, err = rm.podVMSpec(context.Background(), pod)
+	var admitErr *admissionError
+	if !errors.As(err, &admitErr) || admitErr.reason != "NetworkInterfaceNotFound" {
+		t.Fatalf("expected a missing interface to be rejected, got %v", err)
+	}
+	if !strings.Contains(admitErr.message, "available interfaces: en0, en1") {
+		t.Errorf("expected the rejection to list the available interfaces, got %q", admitErr.message)
+	}
+
+	pod.Annotations[spec.AnnotationNetwork] = "isolated"
+	if _, _, vmSpec, err = rm.podVMSpec(context.Background(), pod); err != nil || vmSpec.Network.Mode != spec.NetworkModeIsolated {
+		t.Errorf("expected an isolated pod not to need an interface, got %+v, %v", vmSpec.Network, err)
+	}
+}
+
+func TestPodVMSpecEgressAnnotations(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), fakeClasses{}, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("build")
+	pod.Annotations = map[string]string{
+		spec.AnnotationNetwork: "userspace",
+		egress.AnnotationAllow: "tcp://mirror.example.com:443",
+	}
+	if _, _, _, err := rm.podVMSpec(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+
+	pod.Annotations[egress.AnnotationAllow] = "mirror.example.com:http"
+	var admitErr *admissionError
+	if _, _, _, err := rm.podVMSpec(context.Background(), pod); !errors.As(err, &admitErr) || admitErr.reason != "InvalidVMAnnotation" {
+		t.Errorf("expected an invalid rule to be rejected, got %v", err)
+	}
+
+	pod.Annotations[egress.AnnotationAllow] = "10.0.0.0/8"
+	pod.Annotations[spec.AnnotationNetwork] = "nat"
+	if _, _, _, err := rm.podVMSpec(context.Background(), pod); !errors.As(err, &admitErr) || admitErr.reason != "EgressPolicyUnsupported" {
+		t.Errorf("expected an egress policy to require a userspace network, got %v", err)
+	}
+}
+
+func TestPodVMSpecRejectsInvalidBandwidth(t *testing.T) {
+	rm, err := NewResourceManager(nil, nil, nil, nil, nil, record.NewFakeRecorder(10), fakeClasses{}, nil, nil, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := newTestPod("download")
+	pod.Annotations = map[string]string{network.EgressBandwidthAnnotation: "10M"}
+	if _, _, _, err := rm.podVMSpec(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+
+	pod.Annotations[network.EgressBandwidthAnnotation] = "fast"
+	var admitErr *admissionError
+	if _, _, _, err := rm.podVMSpec(context.Background(), pod); !errors.As(err, &admitErr) || admitErr.reason != "InvalidVMAnnotation" {
+		t.Errorf("expected an invalid bandwidth to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+const namespace = "macos_virtual_kubelet"
+
+var (
+	// Registry holds every provider metric. It is served on the metrics address.
+	Registry = prometheus.NewRegistry()
+
+	// VMBootDuration observes how long it takes for a virtual machine to start.
+	VMBootDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vm_boot_duration_seconds",
+		Help:      "Time taken to start a virtual machine.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+
+	// VMCreateErrors counts failed virtual machine creations by reason.
+	VMCreateErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vm_create_errors_total",
+		Help:      "Number of virtual machines that failed to be created, by reason.",
+	}, []string{"reason"})
+
+	// VMDeleteErrors counts failed virtual machine deletions by reason.
+	VMDeleteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vm_delete_errors_total",
+		Help:      "Number of virtual machines that failed to be deleted, by reason.",
+	}, []string{"reason"})
+
+	// EgressDenied counts the flows of guests denied by their egress policy.
+	EgressDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "egress_denied_total",
+		Help:      "Number of connections of virtual machines denied by their egress policy, by pod namespace and protocol.",
+	}, []string{"namespace", "protocol"})
+
+	// BundleCloneDuration observes how long it takes to clone the disk image
+	// of a VM bundle for a pod.
+	BundleCloneDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bundle_clone_duration_seconds",
+		Help:      "Time taken to clone the disk image of a VM bundle for a pod.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	// ConfigRevision is 1 for the revision of the active provider configuration.
+	ConfigRevision = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_revision",
+		Help:      "Revision of the active provider configuration, set to 1.",
+	}, []string{"revision"})
+
+	// ConfigReloads counts provider configuration reloads by result.
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of provider configuration reloads, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		VMBootDuration,
+		VMCreateErrors,
+		VMDeleteErrors,
+		EgressDenied,
+		BundleCloneDuration,
+		ConfigRevision,
+		ConfigReloads,
+	)
+}
+
+// SetConfigRevision reports revision as the active provider configuration.
+func SetConfigRevision(revision string) {
+	ConfigRevision.Reset()
+	ConfigRevision.WithLabelValues(revision).Set(1)
+}
+
+// vmStateCollector reports the number of virtual machines in each state.
+// States are read at scrape time so the gauge never drifts from the manager.
+type vmStateCollector struct {
+	desc   *prometheus.Desc
+	states func() map[string]int
+}
+
+// RegisterVMStates registers a collector reporting the number of virtual
+// machines per state as returned by states.
+func RegisterVMStates(states func() map[string]int) error {
+	return Registry.Register(&vmStateCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "vms"),
+			"Number of virtual machines, by state.",
+			[]string{"state"}, nil,
+		),
+		states: states,
+	})
+}
+
+func (c *vmStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *vmStateCollector) Collect(ch chan<- prometheus.Metric) {
+	for state, n := range c.states() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), state)
+	}
+}
+
+// diskFreeCollector reports the free space of the file system holding path.
+type diskFreeCollector struct {
+	desc *prometheus.Desc
+	path string
+}
+
+// RegisterDiskFree registers a collector reporting the free space available
+// on the file system holding path.
+func RegisterDiskFree(path string) error {
+	return Registry.Register(&diskFreeCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "disk_free_bytes"),
+			"Free space on the file system holding the VM images.",
+			[]string{"path"}, nil,
+		),
+		path: path,
+	})
+}
+
+func (c *diskFreeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *diskFreeCollector) Collect(ch chan<- prometheus.Metric) {
+	usage, err := disk.Usage(c.path)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(usage.Free), c.path)
+}
+
+// Handler returns the HTTP handler serving the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves the metrics on addr until ctx is done.
+func Serve(ctx context.Context, addr string, mux *http.ServeMux) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux.Handle("/metrics", Handler())
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.G(ctx).WithError(err).Error("Metrics server exited")
+		}
+	}()
+	return nil
+}
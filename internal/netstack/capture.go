@@ -0,0 +1,132 @@
+package netstack
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/pcap"
+)
+
+// captureBacklog is the number of frames queued for a capture before the
+// next ones are dropped.
+const captureBacklog = 1024
+
+// CaptureOptions select and limit the frames of a capture.
+type CaptureOptions struct {
+	// Filter selects the captured frames, all of them when nil.
+	Filter *pcap.Filter
+	// SnapLen is the number of bytes captured of each frame,
+	// pcap.DefaultSnapLen when 0.
+	SnapLen int
+	// Duration ends the capture when not 0.
+	Duration time.Duration
+	// MaxBytes ends the capture once the stream reaches that size, when
+	// not 0.
+	MaxBytes int64
+}
+
+// Capture writes the frames exchanged with the guest to w as a pcap-ng
+// stream of the interface name, until ctx is done, a limit of opts is
+// reached or the network is closed. Frames the capture cannot keep up
+// with are dropped and reported at the end of the stream.
+func (n *Network) Capture(ctx context.Context, w io.Writer, name string, opts CaptureOptions) error {
+	pw, err := pcap.NewWriter(w, name, opts.SnapLen)
+	if err != nil {
+		return err
+	}
+	t := n.link.captures.add(opts.Filter)
+	defer n.link.captures.remove(t)
+
+	var timeout <-chan time.Time
+	if opts.Duration > 0 {
+		timer := time.NewTimer(opts.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// the reader is likely gone, the statistics are best effort
+			pw.WriteStatistics(time.Now(), t.dropped.Load())
+			return nil
+		case <-n.link.ctx.Done():
+		case <-timeout:
+		case f := <-t.frames:
+			if err := pw.WriteFrame(f.ts, f.frame, f.dir); err != nil {
+				return err
+			}
+			if opts.MaxBytes == 0 || pw.Written() < opts.MaxBytes {
+				continue
+			}
+		}
+		return pw.WriteStatistics(time.Now(), t.dropped.Load())
+	}
+}
+
+type capturedFrame struct {
+	ts    time.Time
+	frame []byte
+	dir   pcap.Direction
+}
+
+// captureTap receives the frames a capture selects.
+type captureTap struct {
+	filter  *pcap.Filter
+	frames  chan capturedFrame
+	dropped atomic.Uint64
+}
+
+// captures are the running captures of a link.
+type captures struct {
+	// active counts the taps, for frames not to be copied without them
+	active atomic.Int32
+	mu     sync.RWMutex
+	taps   map[*captureTap]struct{}
+}
+
+func (c *captures) add(filter *pcap.Filter) *captureTap {
+	t := &captureTap{filter: filter, frames: make(chan capturedFrame, captureBacklog)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.taps == nil {
+		c.taps = map[*captureTap]struct{}{}
+	}
+	c.taps[t] = struct{}{}
+	c.active.Add(1)
+	return t
+}
+
+func (c *captures) remove(t *captureTap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.taps, t)
+	c.active.Add(-1)
+}
+
+// capture hands a copy of frame, sent in direction dir from the point of
+// view of the guest, to the taps selecting it.
+func (c *captures) capture(frame []byte, dir pcap.Direction) {
+	if c.active.Load() == 0 {
+		return
+	}
+	now := time.Now()
+	var copied []byte
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for t := range c.taps {
+		if !t.filter.Match(frame) {
+			continue
+		}
+		if copied == nil {
+			copied = append([]byte(nil), frame...)
+		}
+		select {
+		case t.frames <- capturedFrame{ts: now, frame: copied, dir: dir}:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
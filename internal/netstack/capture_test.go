@@ -0,0 +1,129 @@
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/pcap"
+)
+
+// capturedFrames returns the frames of the enhanced packet blocks of a
+// pcap-ng stream.
+func capturedFrames(t *testing.T, stream []byte) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for len(stream) >= 12 {
+		typ := binary.LittleEndian.Uint32(stream)
+		length := binary.LittleEndian.Uint32(stream[4:])
+		if int(length) > len(stream) || length < 12 {
+			t.Fatalf("invalid block length %d", length)
+		}
+		if typ == 6 {
+			body := stream[8 : length-4]
+			frames = append(frames, body[20:20+binary.LittleEndian.Uint32(body[12:])])
+		}
+		stream = stream[length:]
+	}
+	return frames
+}
+
+// startCapture captures the frames of n selected by opts until the
+// returned function is called, which returns the stream.
+func startCapture(t *testing.T, n *Network, opts CaptureOptions) func() []byte {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- n.Capture(ctx, &buf, "default/web", opts) }()
+	for n.link.captures.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return func() []byte {
+		t.Helper()
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+}
+
+func TestCapture(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+	port := listenEcho(t)
+	filter, err := pcap.Compile("tcp and host " + n.HostIP().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := startCapture(t, n, CaptureOptions{Filter: filter})
+
+	resolve(t, s, n, "host."+Zone+".")
+	c, err := dialHost(s, n, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c, "captured")
+	c.Close()
+
+	frames := capturedFrames(t, stop())
+	// the handshake and the exchange, in both directions
+	if len(frames) < 4 {
+		t.Fatalf("expected the connection to be captured, got %d frames", len(frames))
+	}
+	for _, frame := range frames {
+		if !filter.Match(frame) {
+			t.Errorf("expected the frames to match the filter, got %x", frame)
+		}
+	}
+	if !bytes.Contains(bytes.Join(frames, nil), []byte("captured")) {
+		t.Error("expected the payload to be captured")
+	}
+	if n.link.captures.active.Load() != 0 {
+		t.Error("expected the capture to be removed once done")
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+	port := listenEcho(t)
+
+	start := time.Now()
+	var buf bytes.Buffer
+	if err := n.Capture(context.Background(), &buf, "default/web", CaptureOptions{Duration: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected the capture to last its duration, took %s", elapsed)
+	}
+
+	done := make(chan error, 1)
+	buf.Reset()
+	go func() { done <- n.Capture(context.Background(), &buf, "", CaptureOptions{MaxBytes: 1024}) }()
+	for n.link.captures.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c, err := dialHost(s, n, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		echo(t, c, string(bytes.Repeat([]byte{'x'}, 200)))
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the capture to end at its size limit")
+	}
+	if buf.Len() < 1024 || buf.Len() > 1024+2*(MTU+100) {
+		t.Errorf("expected the capture to stop past 1024 bytes, wrote %d", buf.Len())
+	}
+}
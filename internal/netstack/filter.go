@@ -0,0 +1,300 @@
+package netstack
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ProtocolICMP is the protocol of the ICMP flows of the guest.
+const ProtocolICMP v1.Protocol = "ICMP"
+
+// flowTTL is how long the decision on a UDP or ICMP flow is kept, so that
+// the filter is consulted once per flow rather than per datagram.
+const flowTTL = 30 * time.Second
+
+// minNameTTL is the shortest time a DNS answer maps an address to a name,
+// the guest caching answers beyond their TTL.
+const minNameTTL = time.Minute
+
+// maxEntries bounds the flows and names remembered before the expired ones
+// are pruned.
+const maxEntries = 4096
+
+// Flow is a new flow of the guest.
+type Flow struct {
+	// Protocol is TCP, UDP or ICMP.
+	Protocol v1.Protocol
+	// Destination is the address and port the flow is sent to, the port
+	// being 0 for ICMP.
+	Destination netip.AddrPort
+	// Names are the DNS names the gateway resolved the destination from
+	// for the guest.
+	Names []string
+}
+
+// Filter reports whether the guest may start flow. It runs for the first
+// segment of TCP connections and for the first datagram of UDP and ICMP
+// flows. Traffic to the gateway itself is never filtered.
+type Filter func(flow Flow) bool
+
+// SetFilter restricts the flows of the guest to those f allows, or lifts
+// the restrictions when f is nil. Established TCP connections are kept.
+// Fragmented packets of the guest are dropped while a filter is set.
+func (n *Network) SetFilter(f Filter) {
+	n.link.setFilter(f)
+}
+
+type flowKey struct {
+	protocol v1.Protocol
+	srcPort  uint16
+	dst      netip.AddrPort
+}
+
+type decision struct {
+	allowed bool
+	expires time.Time
+}
+
+// filter holds the state of the filtering of the flows of the guest.
+type filter struct {
+	mu    sync.Mutex
+	allow Filter
+	flows map[flowKey]decision
+	// names maps the addresses resolved by the gateway to their names and
+	// the time they expire
+	names map[netip.Addr]map[string]time.Time
+}
+
+func (l *link) setFilter(f Filter) {
+	l.filter.mu.Lock()
+	defer l.filter.mu.Unlock()
+	l.filter.allow = f
+	l.filter.flows = map[flowKey]decision{}
+}
+
+// allowed reports whether the IPv4 packet ip of the guest may reach the
+// gateway. Denied TCP connections are reset.
+func (l *link) allowed(frame []byte) bool {
+	l.filter.mu.Lock()
+	allow := l.filter.allow
+	l.filter.mu.Unlock()
+	if allow == nil {
+		return true
+	}
+
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	// malformed packets are left to the stack, which drops them
+	if !ip.IsValid(len(ip)) {
+		return true
+	}
+	dst := addr(ip.DestinationAddress())
+	if dst == l.gatewayIP || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return true
+	}
+	// fragments are dropped, the first one may not hold the ports or
+	// flags the flow is filtered on
+	if ip.More() || ip.FragmentOffset() != 0 {
+		return false
+	}
+
+	key := flowKey{dst: netip.AddrPortFrom(dst, 0)}
+	switch ip.TransportProtocol() {
+	case header.TCPProtocolNumber:
+		tcp := header.TCP(ip.Payload())
+		if len(tcp) < header.TCPMinimumSize {
+			return true
+		}
+		// only connections are filtered, the segments of refused ones are
+		// answered with a reset by the stack
+		if flags := tcp.Flags(); !flags.Contains(header.TCPFlagSyn) || flags.Contains(header.TCPFlagAck) {
+			return true
+		}
+		flow := Flow{Protocol: v1.ProtocolTCP, Destination: netip.AddrPortFrom(dst, tcp.DestinationPort())}
+		flow.Names = l.namesOf(dst)
+		if allow(flow) {
+			return true
+		}
+		l.reset(frame)
+		return false
+	case header.UDPProtocolNumber:
+		udp := header.UDP(ip.Payload())
+		if len(udp) < header.UDPMinimumSize {
+			return true
+		}
+		key.protocol = v1.ProtocolUDP
+		key.srcPort = udp.SourcePort()
+		key.dst = netip.AddrPortFrom(dst, udp.DestinationPort())
+	case header.ICMPv4ProtocolNumber:
+		key.protocol = ProtocolICMP
+	default:
+		return true
+	}
+	return l.decide(key, allow)
+}
+
+// decide returns the decision on the UDP or ICMP flow key, asking allow
+// when it is unknown or expired.
+func (l *link) decide(key flowKey, allow Filter) bool {
+	now := time.Now()
+	l.filter.mu.Lock()
+	d, ok := l.filter.flows[key]
+	l.filter.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.allowed
+	}
+
+	d = decision{
+		allowed: allow(Flow{Protocol: key.protocol, Destination: key.dst, Names: l.namesOf(key.dst.Addr())}),
+		expires: now.Add(flowTTL),
+	}
+	l.filter.mu.Lock()
+	defer l.filter.mu.Unlock()
+	if len(l.filter.flows) >= maxEntries {
+		for k, old := range l.filter.flows {
+			if !now.Before(old.expires) {
+				delete(l.filter.flows, k)
+			}
+		}
+	}
+	l.filter.flows[key] = d
+	return d.allowed
+}
+
+// reset answers the TCP connection request of the guest in frame with a
+// reset, for the connection to fail at once rather than time out.
+func (l *link) reset(frame []byte) {
+	eth := header.Ethernet(frame)
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	syn := header.TCP(ip.Payload())
+
+	rst := make([]byte, header.EthernetMinimumSize+header.IPv4MinimumSize+header.TCPMinimumSize)
+	header.Ethernet(rst).Encode(&header.EthernetFields{
+		SrcAddr: eth.DestinationAddress(),
+		DstAddr: eth.SourceAddress(),
+		Type:    header.IPv4ProtocolNumber,
+	})
+	rip := header.IPv4(rst[header.EthernetMinimumSize:])
+	rip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(rip)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     ip.DestinationAddress(),
+		DstAddr:     ip.SourceAddress(),
+	})
+	rip.SetChecksum(^rip.CalculateChecksum())
+	tcp := header.TCP(rip.Payload())
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    syn.DestinationPort(),
+		DstPort:    syn.SourcePort(),
+		AckNum:     syn.SequenceNumber() + 1 + uint32(len(syn.Payload())),
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagRst | header.TCPFlagAck,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, rip.SourceAddress(), rip.DestinationAddress(), uint16(len(tcp)))
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+	l.send(rst)
+}
+
+// snoop records the addresses in the DNS answers of the gateway in frame,
+// for flows to be matched by name.
+func (l *link) snoop(frame []byte) {
+	eth := header.Ethernet(frame)
+	if len(frame) < header.EthernetMinimumSize || eth.Type() != header.IPv4ProtocolNumber {
+		return
+	}
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	if !ip.IsValid(len(ip)) || ip.TransportProtocol() != header.UDPProtocolNumber || addr(ip.SourceAddress()) != l.gatewayIP {
+		return
+	}
+	udp := header.UDP(ip.Payload())
+	if len(udp) < header.UDPMinimumSize || udp.SourcePort() != 53 {
+		return
+	}
+	var m dns.Msg
+	if err := m.Unpack(udp.Payload()); err != nil || !m.Response {
+		return
+	}
+
+	// the names of the question and of its aliases all resolve to the
+	// addresses of the answer
+	var names []string
+	for _, q := range m.Question {
+		names = append(names, q.Name)
+	}
+	var addrs []netip.Addr
+	ttl := minNameTTL
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			names = append(names, rr.Hdr.Name, rr.Target)
+		case *dns.A:
+			if a, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+				addrs = append(addrs, a)
+				names = append(names, rr.Hdr.Name)
+				ttl = max(ttl, time.Duration(rr.Hdr.Ttl)*time.Second)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+
+	now := time.Now()
+	l.filter.mu.Lock()
+	defer l.filter.mu.Unlock()
+	if l.filter.names == nil || len(l.filter.names) >= maxEntries {
+		l.pruneNamesLocked(now)
+	}
+	for _, a := range addrs {
+		known := l.filter.names[a]
+		if known == nil {
+			known = map[string]time.Time{}
+			l.filter.names[a] = known
+		}
+		for _, name := range names {
+			known[strings.ToLower(strings.TrimSuffix(name, "."))] = now.Add(ttl)
+		}
+	}
+}
+
+func (l *link) pruneNamesLocked(now time.Time) {
+	if l.filter.names == nil {
+		l.filter.names = map[netip.Addr]map[string]time.Time{}
+		return
+	}
+	for a, known := range l.filter.names {
+		for name, expires := range known {
+			if !now.Before(expires) {
+				delete(known, name)
+			}
+		}
+		if len(known) == 0 {
+			delete(l.filter.names, a)
+		}
+	}
+}
+
+// namesOf returns the names the gateway resolved a from.
+func (l *link) namesOf(a netip.Addr) []string {
+	now := time.Now()
+	l.filter.mu.Lock()
+	defer l.filter.mu.Unlock()
+	var names []string
+	for name, expires := range l.filter.names[a] {
+		if now.Before(expires) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func addr(a tcpip.Address) netip.Addr {
+	return netip.AddrFrom4(a.As4())
+}
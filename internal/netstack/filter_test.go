@@ -0,0 +1,198 @@
+package netstack
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	v1 "k8s.io/api/core/v1"
+)
+
+// recordingFilter allows the TCP flows to allowed ports and records the
+// flows it is asked about.
+type recordingFilter struct {
+	mu      sync.Mutex
+	allowed []uint16
+	flows   []Flow
+}
+
+func (f *recordingFilter) allow(flow Flow) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flows = append(f.flows, flow)
+	return flow.Protocol == v1.ProtocolTCP && slices.Contains(f.allowed, flow.Destination.Port())
+}
+
+func (f *recordingFilter) seen() []Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.flows)
+}
+
+// listenEcho serves a TCP echo server on the host and returns its port.
+func listenEcho(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveEcho(l)
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// resolve looks name up from the guest s through the gateway of n.
+func resolve(t *testing.T, s *stack.Stack, n *Network, name string) {
+	t.Helper()
+	c, err := gonet.DialUDP(s, nil, &tcpip.FullAddress{NIC: 1, Addr: address(n.Gateway()), Port: 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	if _, _, err := (&dns.Client{Timeout: 5 * time.Second}).ExchangeWithConn(q, &dns.Conn{Conn: c}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dialHost(s *stack.Stack, n *Network, port uint16) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return gonet.DialContextTCP(ctx, s, tcpip.FullAddress{NIC: 1, Addr: address(n.HostIP()), Port: port}, ipv4.ProtocolNumber)
+}
+
+func TestFilter(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+	allowed, denied := listenEcho(t), listenEcho(t)
+	f := &recordingFilter{allowed: []uint16{allowed}}
+	n.SetFilter(f.allow)
+
+	resolve(t, s, n, "host."+Zone+".")
+	c, err := dialHost(s, n, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c, "allowed")
+	c.Close()
+
+	start := time.Now()
+	if _, err := dialHost(s, n, denied); err == nil {
+		t.Fatal("expected the connection to be denied")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the denied connection to be reset at once, took %s", elapsed)
+	}
+
+	flows := f.seen()
+	if len(flows) != 2 {
+		t.Fatalf("expected a flow per connection, DNS being unfiltered, got %+v", flows)
+	}
+	if flows[0].Destination.Addr() != n.HostIP() || flows[0].Destination.Port() != allowed {
+		t.Errorf("unexpected flow %+v", flows[0])
+	}
+	if !slices.Contains(flows[0].Names, "host."+Zone) {
+		t.Errorf("expected the flow to carry the resolved name, got %v", flows[0].Names)
+	}
+
+	n.SetFilter(nil)
+	c, err = dialHost(s, n, denied)
+	if err != nil {
+		t.Fatalf("expected the filter to be lifted: %v", err)
+	}
+	echo(t, c, "unfiltered")
+	c.Close()
+}
+
+func TestFilterUDP(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+	f := &recordingFilter{}
+	n.SetFilter(f.allow)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	c, err := gonet.DialUDP(s, nil, &tcpip.FullAddress{NIC: 1, Addr: address(n.HostIP()), Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, msg := range []string{"one", "two"} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("expected the datagrams to be dropped")
+	}
+	if flows := f.seen(); len(flows) != 1 || flows[0].Protocol != v1.ProtocolUDP {
+		t.Errorf("expected the decision on the flow to be kept, got %+v", flows)
+	}
+}
+
+func TestFilterDropsFragments(t *testing.T) {
+	g := &countingGateway{}
+	l := &link{gateway: g, gatewayIP: netip.MustParseAddr("10.127.3.1")}
+	f := &recordingFilter{}
+	l.setFilter(f.allow)
+
+	// a SYN to a denied address split after the ports, the flags being in
+	// the second fragment
+	segment := make([]byte, header.TCPMinimumSize)
+	header.TCP(segment).Encode(&header.TCPFields{
+		SrcPort:    40000,
+		DstPort:    22,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+	})
+	mac, _ := net.ParseMAC(GatewayMAC)
+	fragment := func(payload []byte, offset uint16, more bool) []byte {
+		frame := make([]byte, header.EthernetMinimumSize+header.IPv4MinimumSize+len(payload))
+		header.Ethernet(frame).Encode(&header.EthernetFields{
+			SrcAddr: tcpip.LinkAddress(testMAC),
+			DstAddr: tcpip.LinkAddress(mac),
+			Type:    header.IPv4ProtocolNumber,
+		})
+		var flags uint8
+		if more {
+			flags = header.IPv4FlagMoreFragments
+		}
+		ip := header.IPv4(frame[header.EthernetMinimumSize:])
+		ip.Encode(&header.IPv4Fields{
+			TotalLength:    uint16(len(ip)),
+			Flags:          flags,
+			FragmentOffset: offset,
+			TTL:            64,
+			Protocol:       uint8(header.TCPProtocolNumber),
+			SrcAddr:        tcpip.AddrFrom4([4]byte{10, 127, 3, 2}),
+			DstAddr:        tcpip.AddrFrom4([4]byte{192, 0, 2, 1}),
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		copy(ip.Payload(), payload)
+		return frame
+	}
+	l.receive(fragment(segment[:8], 0, true))
+	l.receive(fragment(segment[8:], 8, false))
+
+	if delivered := g.bytes.Load(); delivered != 0 {
+		t.Errorf("expected the fragments to be dropped, %d bytes were delivered", delivered)
+	}
+}
@@ -0,0 +1,149 @@
+package netstack
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+var testMAC = net.HardwareAddr{0x02, 0x4a, 0x0b, 0xc0, 0x0d, 0x0e}
+
+// testGuest simulates the guest of a Network: it exchanges the frames of
+// its network device over the guest end of the socket pair, like
+// Virtualization.framework does.
+type testGuest struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newTestGuest(t *testing.T, n *Network) *testGuest {
+	t.Helper()
+	conn, err := net.FileConn(n.GuestFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testGuest{t: t, conn: conn}
+}
+
+// dhcp broadcasts the DHCP message m and returns the reply of the gateway.
+func (g *testGuest) dhcp(m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	g.t.Helper()
+	payload := m.ToBytes()
+	frame := make([]byte, header.EthernetMinimumSize+header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: tcpip.LinkAddress(testMAC),
+		DstAddr: header.EthernetBroadcastAddress,
+		Type:    header.IPv4ProtocolNumber,
+	})
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(ip)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     header.IPv4Any,
+		DstAddr:     header.IPv4Broadcast,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	header.UDP(ip.Payload()).Encode(&header.UDPFields{
+		SrcPort: dhcpv4.ClientPort,
+		DstPort: dhcpv4.ServerPort,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(ip.Payload()[header.UDPMinimumSize:], payload)
+	if _, err := g.conn.Write(frame); err != nil {
+		g.t.Fatal(err)
+	}
+
+	buf := make([]byte, 65535)
+	g.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer g.conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := g.conn.Read(buf)
+		if err != nil {
+			g.t.Fatalf("no DHCP reply: %v", err)
+		}
+		eth := header.Ethernet(buf[:n])
+		if eth.Type() != header.IPv4ProtocolNumber {
+			continue
+		}
+		ip := header.IPv4(buf[header.EthernetMinimumSize:n])
+		if ip.TransportProtocol() != header.UDPProtocolNumber {
+			continue
+		}
+		u := header.UDP(ip.Payload())
+		if u.DestinationPort() != dhcpv4.ClientPort {
+			continue
+		}
+		reply, err := dhcpv4.FromBytes(u.Payload())
+		if err != nil {
+			g.t.Fatal(err)
+		}
+		return reply
+	}
+}
+
+// start configures ip on a gVisor stack standing for the guest network
+// stack, routed through gateway.
+func (g *testGuest) start(ip, gateway netip.Addr) *stack.Stack {
+	g.t.Helper()
+	link := channel.New(256, MTU, tcpip.LinkAddress(testMAC))
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := s.CreateNIC(1, ethernet.New(link)); err != nil {
+		g.t.Fatal(err)
+	}
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: address(ip), PrefixLen: SubnetBits},
+	}, stack.AddressProperties{}); err != nil {
+		g.t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, Gateway: address(gateway), NIC: 1}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g.t.Cleanup(func() {
+		cancel()
+		s.Close()
+		s.Wait()
+	})
+	go func() {
+		for {
+			pkt := link.ReadContext(ctx)
+			if pkt.IsNil() {
+				return
+			}
+			g.conn.Write(pkt.ToView().AsSlice())
+			pkt.DecRef()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := g.conn.Read(buf)
+			if err != nil {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(append([]byte(nil), buf[:n]...))})
+			link.InjectInbound(header.IPv4ProtocolNumber, pkt)
+			pkt.DecRef()
+		}
+	}()
+	return s
+}
@@ -0,0 +1,151 @@
+package netstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/pcap"
+)
+
+// maxFrameSize is the largest frame read from the guest.
+const maxFrameSize = 65535
+
+// ingressQueueSize is the number of frames to the guest waiting to be
+// written. Frames are dropped while the queue is full.
+const ingressQueueSize = 256
+
+// A frame to the guest is written again every sendBackoff while the socket
+// buffer is full, at most sendRetries times. It is then dropped, like a NIC
+// whose ring is full would do.
+const (
+	sendRetries = 10
+	sendBackoff = time.Millisecond
+)
+
+// gateway is the interface of the gateway in the stack.
+type gateway interface {
+	DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr)
+	LinkAddress() tcpip.LinkAddress
+}
+
+// link carries the ethernet frames between the guest, at the other end of
+// conn, and the gateway: a switch with two ports. The frames to the guest
+// are shaped by ingress, those of the guest by egress, when not nil.
+// Frames to the guest wait in queue for writeIngress to write them, so that
+// the stack of the gateway never waits for the shaper or the guest.
+type link struct {
+	conn      net.Conn
+	gateway   gateway
+	gatewayIP netip.Addr
+	filter    filter
+	ingress   *rate.Limiter
+	egress    *rate.Limiter
+	queue     chan []byte
+	captures  captures
+	// ctx is done when the link is closed, ending the waits of the frames
+	ctx context.Context
+}
+
+// DeliverNetworkPacket sends a frame of the gateway to the guest. It is
+// called on the write path of the stack, so it must not block.
+func (l *link) DeliverNetworkPacket(_ tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	frame := pkt.ToView().AsSlice()
+	l.snoop(frame)
+	l.send(frame)
+}
+
+// send queues frame for writeIngress. It is dropped when the queue is
+// full.
+func (l *link) send(frame []byte) {
+	select {
+	case l.queue <- frame:
+	default:
+	}
+}
+
+// writeIngress writes the queued frames to the guest as the ingress shaper
+// lets them through, until the link is closed.
+func (l *link) writeIngress() {
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case frame := <-l.queue:
+			if shape(l.ctx, l.ingress, len(frame)) {
+				l.write(frame)
+			}
+		}
+	}
+}
+
+func (l *link) write(frame []byte) {
+	l.captures.capture(frame, pcap.Inbound)
+	var backoff *time.Timer
+	for i := 0; ; i++ {
+		_, err := l.conn.Write(frame)
+		// the socket buffer is full until the guest reads
+		if !errors.Is(err, syscall.ENOBUFS) || i == sendRetries {
+			return
+		}
+		if backoff == nil {
+			backoff = time.NewTimer(sendBackoff)
+		} else {
+			backoff.Reset(sendBackoff)
+		}
+		select {
+		case <-l.ctx.Done():
+			backoff.Stop()
+			return
+		case <-backoff.C:
+		}
+	}
+}
+
+// run delivers the frames of the guest to the gateway until conn is
+// closed.
+func (l *link) run() {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, err := l.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		l.receive(buf[:n])
+	}
+}
+
+// receive delivers a frame of the guest to the gateway. The gateway is the
+// only other host of the segment, frames to other addresses are dropped,
+// as are the packets of the flows the filter denies.
+func (l *link) receive(frame []byte) {
+	l.captures.capture(frame, pcap.Outbound)
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+	eth := header.Ethernet(frame)
+	if dst := eth.DestinationAddress(); dst != l.gateway.LinkAddress() && dst != header.EthernetBroadcastAddress {
+		return
+	}
+	if eth.Type() == header.IPv4ProtocolNumber && !l.allowed(frame) {
+		return
+	}
+	// the guest is held back until the frame is let through
+	if !shape(l.ctx, l.egress, len(frame)) {
+		return
+	}
+	data := buffer.MakeWithData(frame)
+	data.TrimFront(header.EthernetMinimumSize)
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: data})
+	defer pkt.DecRef()
+	l.gateway.DeliverNetworkPacket(eth.Type(), pkt)
+}
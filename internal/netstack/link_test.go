@@ -0,0 +1,62 @@
+package netstack
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fullConn is the socket of a guest that stopped reading its NIC.
+type fullConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *fullConn) Write([]byte) (int, error) {
+	c.writes.Add(1)
+	return 0, syscall.ENOBUFS
+}
+
+func TestSendDropsWhenGuestStalls(t *testing.T) {
+	conn := &fullConn{}
+	l := &link{conn: conn, ctx: context.Background()}
+
+	start := time.Now()
+	l.write(testFrame())
+	if writes := conn.writes.Load(); writes != sendRetries+1 {
+		t.Errorf("expected the frame to be written %d times before being dropped, got %d", sendRetries+1, writes)
+	}
+	if elapsed := time.Since(start); elapsed < sendRetries*sendBackoff {
+		t.Errorf("expected the writes to back off, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn.writes.Store(0)
+	l.ctx = ctx
+	l.write(testFrame())
+	if writes := conn.writes.Load(); writes != 1 {
+		t.Errorf("expected a closed link to stop writing, got %d writes", writes)
+	}
+}
+
+func TestSendDoesNotBlockTheStack(t *testing.T) {
+	// an unshaped link to a guest that never reads: the frames queue up
+	// behind the retries of the first one, then are dropped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := &link{conn: &fullConn{}, queue: make(chan []byte, ingressQueueSize), ctx: ctx}
+	go l.writeIngress()
+
+	frame := testFrame()
+	start := time.Now()
+	for i := 0; i < 2*ingressQueueSize; i++ {
+		l.send(frame)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected frames to be queued without waiting, took %s", elapsed)
+	}
+}
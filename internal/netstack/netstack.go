@@ -0,0 +1,392 @@
+// Package netstack runs the userspace network of the virtual machines
+// attached through a file handle. Each virtual machine gets its own subnet
+// behind a gateway built on the gVisor TCP/IP stack, which serves DHCP and
+// DNS and forwards the connections of the guest through the host. The
+// guest exchanges ethernet frames with the gateway over a datagram socket
+// pair.
+package netstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dhcp"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/dns"
+	"github.com/containers/gvisor-tap-vsock/pkg/services/forwarder"
+	"github.com/containers/gvisor-tap-vsock/pkg/tap"
+	gvtypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/network"
+)
+
+// MTU is the largest frame payload exchanged with the guest.
+const MTU = 1500
+
+// Zone is the DNS zone of the names of the gateway and of the host, e.g.
+// host.vm.internal.
+const Zone = "vm.internal"
+
+// GatewayMAC is the address of the gateway on every subnet.
+const GatewayMAC = "5a:94:ef:e4:0c:dd"
+
+// Socket buffer sizes recommended for the file handle attachment of
+// Virtualization.framework.
+const (
+	sendBufferSize    = 1 << 20
+	receiveBufferSize = 4 << 20
+)
+
+// nic is the gateway interface in the stack.
+const nic = 1
+
+// Config is the network of a virtual machine.
+type Config struct {
+	// Subnet is the subnet of the virtual machine, e.g. 10.127.3.0/24.
+	Subnet netip.Prefix
+	// MAC is the address of the network device of the guest, leased the
+	// guest address.
+	MAC net.HardwareAddr
+	// Bandwidth limits the traffic to and from the guest.
+	Bandwidth network.Bandwidth
+}
+
+// Network is the userspace network of a virtual machine.
+type Network struct {
+	subnet  netip.Prefix
+	gateway netip.Addr
+	guestIP netip.Addr
+	hostIP  netip.Addr
+
+	guest  *os.File
+	conn   net.Conn
+	link   *link
+	stack  *stack.Stack
+	dhcp   *dhcp.Server
+	dnsUDP net.PacketConn
+	dnsTCP net.Listener
+
+	// running tracks the link delivering the frames of the guest, stop
+	// ends the waits of its shaped frames
+	running sync.WaitGroup
+	stop    context.CancelFunc
+
+	mu        sync.Mutex
+	published map[publishKey]*network.Proxy
+}
+
+type publishKey struct {
+	protocol v1.Protocol
+	addr     string
+}
+
+// New starts the network of cfg. The guest is attached to GuestFile and
+// leased GuestIP. Connections of the guest to HostIP reach the loopback
+// interface of the host.
+func New(cfg Config) (*Network, error) {
+	subnet := cfg.Subnet.Masked()
+	if !subnet.Addr().Is4() || subnet.Bits() > 29 {
+		return nil, fmt.Errorf("subnet %s must be an IPv4 subnet of at least a /29", cfg.Subnet)
+	}
+	if len(cfg.MAC) == 0 {
+		return nil, errors.New("the guest has no MAC address")
+	}
+	n := &Network{
+		subnet:    subnet,
+		gateway:   subnet.Addr().Next(),
+		guestIP:   subnet.Addr().Next().Next(),
+		hostIP:    lastHost(subnet),
+		published: map[publishKey]*network.Proxy{},
+	}
+
+	guest, conn, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	n.guest, n.conn = guest, conn
+
+	if err := n.start(cfg); err != nil {
+		n.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// start creates the gateway and its services and connects the guest.
+func (n *Network) start(cfg Config) error {
+	endpoint, err := tap.NewLinkEndpoint(false, MTU, GatewayMAC, n.gateway.String(), []string{n.hostIP.String()})
+	if err != nil {
+		return fmt.Errorf("failed to create the gateway endpoint: %w", err)
+	}
+	var ctx context.Context
+	ctx, n.stop = context.WithCancel(context.Background())
+	n.link = &link{
+		conn:      n.conn,
+		gateway:   endpoint,
+		gatewayIP: n.gateway,
+		ingress:   newLimiter(cfg.Bandwidth.Ingress),
+		egress:    newLimiter(cfg.Bandwidth.Egress),
+		queue:     make(chan []byte, ingressQueueSize),
+		ctx:       ctx,
+	}
+	endpoint.Connect(n.link)
+
+	n.stack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	if err := n.stack.CreateNIC(nic, endpoint); err != nil {
+		return fmt.Errorf("failed to create the gateway interface: %s", err)
+	}
+	if err := n.stack.AddProtocolAddress(nic, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: address(n.gateway).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("failed to address the gateway: %s", err)
+	}
+	// the gateway answers for every destination of the guest
+	n.stack.SetSpoofing(nic, true)
+	n.stack.SetPromiscuousMode(nic, true)
+	route, err := tcpip.NewSubnet(address(n.subnet.Addr()), tcpip.MaskFromBytes(net.CIDRMask(n.subnet.Bits(), 32)))
+	if err != nil {
+		return err
+	}
+	n.stack.SetRouteTable([]tcpip.Route{{Destination: route, NIC: nic}})
+
+	var natLock sync.Mutex
+	nat := map[tcpip.Address]tcpip.Address{address(n.hostIP): tcpip.AddrFrom4([4]byte{127, 0, 0, 1})}
+	n.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.TCP(n.stack, nat, &natLock).HandlePacket)
+	n.stack.SetTransportProtocolHandler(udp.ProtocolNumber, forwarder.UDP(n.stack, nat, &natLock).HandlePacket)
+
+	if err := n.serveDNS(); err != nil {
+		return err
+	}
+	if err := n.serveDHCP(cfg.MAC); err != nil {
+		return err
+	}
+
+	n.running.Add(1)
+	go func() {
+		defer n.running.Done()
+		n.link.run()
+	}()
+	n.running.Add(1)
+	go func() {
+		defer n.running.Done()
+		n.link.writeIngress()
+	}()
+	return nil
+}
+
+// serveDNS answers the names of Zone and forwards the other queries to the
+// resolver of the host.
+func (n *Network) serveDNS() error {
+	gateway := tcpip.FullAddress{NIC: nic, Addr: address(n.gateway), Port: 53}
+	udpConn, err := gonet.DialUDP(n.stack, &gateway, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS queries: %w", err)
+	}
+	n.dnsUDP = udpConn
+	tcpListener, err := gonet.ListenTCP(n.stack, gateway, ipv4.ProtocolNumber)
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS queries: %w", err)
+	}
+	n.dnsTCP = tcpListener
+	server, err := dns.New(n.dnsUDP, n.dnsTCP, []gvtypes.Zone{{
+		Name: Zone + ".",
+		Records: []gvtypes.Record{
+			{Name: "gateway", IP: net.IP(n.gateway.AsSlice())},
+			{Name: "host", IP: net.IP(n.hostIP.AsSlice())},
+		},
+	}})
+	if err != nil {
+		return err
+	}
+	go func() { _ = server.Serve() }()
+	go func() { _ = server.ServeTCP() }()
+	return nil
+}
+
+// serveDHCP leases the guest address to mac.
+func (n *Network) serveDHCP(mac net.HardwareAddr) error {
+	subnet := &net.IPNet{IP: net.IP(n.subnet.Addr().AsSlice()), Mask: net.CIDRMask(n.subnet.Bits(), 32)}
+	pool := tap.NewIPPool(subnet)
+	pool.Reserve(net.IP(n.gateway.AsSlice()), GatewayMAC)
+	pool.Reserve(net.IP(n.hostIP.AsSlice()), GatewayMAC)
+	pool.Reserve(net.IP(n.guestIP.AsSlice()), mac.String())
+
+	var err error
+	n.dhcp, err = dhcp.New(&gvtypes.Configuration{
+		MTU:              MTU,
+		Subnet:           subnet.String(),
+		GatewayIP:        n.gateway.String(),
+		DNSSearchDomains: []string{Zone},
+	}, n.stack, pool)
+	if err != nil {
+		return fmt.Errorf("failed to start the DHCP server: %w", err)
+	}
+	go func() { _ = n.dhcp.Serve() }()
+	return nil
+}
+
+// GuestFile is the file handle the network device of the virtual machine is
+// attached to.
+func (n *Network) GuestFile() *os.File {
+	return n.guest
+}
+
+// Subnet returns the subnet of the virtual machine.
+func (n *Network) Subnet() netip.Prefix {
+	return n.subnet
+}
+
+// Gateway returns the address of the gateway, the router and DNS server of
+// the guest.
+func (n *Network) Gateway() netip.Addr {
+	return n.gateway
+}
+
+// GuestIP returns the address leased to the guest.
+func (n *Network) GuestIP() netip.Addr {
+	return n.guestIP
+}
+
+// HostIP returns the address the guest reaches the loopback interface of
+// the host at, also known as host.vm.internal.
+func (n *Network) HostIP() netip.Addr {
+	return n.hostIP
+}
+
+// DialGuest connects to port of the guest over TCP or UDP.
+func (n *Network) DialGuest(ctx context.Context, protocol v1.Protocol, port int32) (net.Conn, error) {
+	remote := tcpip.FullAddress{NIC: nic, Addr: address(n.guestIP), Port: uint16(port)}
+	switch protocol {
+	case v1.ProtocolTCP:
+		return gonet.DialContextTCP(ctx, n.stack, remote, ipv4.ProtocolNumber)
+	case v1.ProtocolUDP:
+		return gonet.DialUDP(n.stack, nil, &remote, ipv4.ProtocolNumber)
+	}
+	return nil, fmt.Errorf("unsupported protocol %s", protocol)
+}
+
+// Publish forwards the connections to the host address addr, e.g.
+// 127.0.0.1:8080, to port of the guest.
+func (n *Network) Publish(protocol v1.Protocol, addr string, port int32) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := publishKey{protocol: protocol, addr: addr}
+	if _, ok := n.published[key]; ok {
+		return fmt.Errorf("%s %s is already published", protocol, addr)
+	}
+	proxy, err := network.NewProxy(protocol, addr, func(ctx context.Context) (net.Conn, error) {
+		return n.DialGuest(ctx, protocol, port)
+	})
+	if err != nil {
+		return err
+	}
+	n.published[key] = proxy
+	return nil
+}
+
+// Unpublish stops forwarding the host address addr.
+func (n *Network) Unpublish(protocol v1.Protocol, addr string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := publishKey{protocol: protocol, addr: addr}
+	proxy, ok := n.published[key]
+	if !ok {
+		return nil
+	}
+	delete(n.published, key)
+	return proxy.Close()
+}
+
+// Close stops the network and its published ports and closes the file
+// handle of the guest.
+func (n *Network) Close() error {
+	n.mu.Lock()
+	for key, proxy := range n.published {
+		proxy.Close()
+		delete(n.published, key)
+	}
+	n.mu.Unlock()
+
+	if n.dhcp != nil {
+		n.dhcp.Underlying.Close()
+	}
+	if n.dnsUDP != nil {
+		n.dnsUDP.Close()
+	}
+	if n.dnsTCP != nil {
+		n.dnsTCP.Close()
+	}
+	// the link stops with its connection, before the gateway it delivers to
+	if n.stop != nil {
+		n.stop()
+	}
+	n.conn.Close()
+	n.running.Wait()
+	if n.stack != nil {
+		n.stack.Close()
+		n.stack.Wait()
+	}
+	return n.guest.Close()
+}
+
+// socketPair returns the two ends of a datagram socket pair: the file
+// handle of the guest and the connection of the gateway.
+func socketPair() (*os.File, net.Conn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create a socket pair: %w", err)
+	}
+	for _, fd := range fds {
+		unix.CloseOnExec(fd)
+		// best effort, the system may cap the sizes
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, sendBufferSize)
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, receiveBufferSize)
+	}
+
+	guest := os.NewFile(uintptr(fds[0]), "guest")
+	gateway := os.NewFile(uintptr(fds[1]), "gateway")
+	defer gateway.Close()
+	conn, err := net.FileConn(gateway)
+	if err != nil {
+		guest.Close()
+		return nil, nil, fmt.Errorf("failed to open the gateway end of the socket pair: %w", err)
+	}
+	return guest, conn, nil
+}
+
+func address(a netip.Addr) tcpip.Address {
+	return tcpip.AddrFrom4(a.As4())
+}
+
+// lastHost returns the last address of subnet before its broadcast address.
+func lastHost(subnet netip.Prefix) netip.Addr {
+	a := subnet.Addr().As4()
+	hostBits := 32 - subnet.Bits()
+	for i := 3; i >= 0 && hostBits > 0; i-- {
+		bits := hostBits
+		if bits > 8 {
+			bits = 8
+		}
+		a[i] |= byte(1<<bits - 1)
+		hostBits -= bits
+	}
+	return netip.AddrFrom4(a).Prev()
+}
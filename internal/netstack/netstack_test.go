@@ -0,0 +1,258 @@
+package netstack
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	v1 "k8s.io/api/core/v1"
+)
+
+func newTestNetwork(t *testing.T) *Network {
+	t.Helper()
+	n, err := New(Config{Subnet: netip.MustParsePrefix("10.127.3.0/24"), MAC: testMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// startGuest returns the stack of a guest configured with its lease.
+func startGuest(t *testing.T, n *Network) *stack.Stack {
+	t.Helper()
+	return newTestGuest(t, n).start(n.GuestIP(), n.Gateway())
+}
+
+func echo(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("expected %q back, got %q", msg, buf)
+	}
+}
+
+func serveEcho(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+// freePort returns a host address nothing listens on.
+func freePort(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestNewAddressesTheSubnet(t *testing.T) {
+	n := newTestNetwork(t)
+	for name, got := range map[string]netip.Addr{"gateway": n.Gateway(), "guest": n.GuestIP(), "host": n.HostIP()} {
+		want := map[string]string{"gateway": "10.127.3.1", "guest": "10.127.3.2", "host": "10.127.3.254"}[name]
+		if got.String() != want {
+			t.Errorf("expected the %s at %s, got %s", name, want, got)
+		}
+	}
+
+	if _, err := New(Config{Subnet: netip.MustParsePrefix("10.127.3.0/30"), MAC: testMAC}); err == nil {
+		t.Error("expected a /30 to be too small")
+	}
+	if _, err := New(Config{Subnet: netip.MustParsePrefix("10.127.3.0/24")}); err == nil {
+		t.Error("expected a MAC address to be required")
+	}
+}
+
+func TestDHCPLeasesTheGuestAddress(t *testing.T) {
+	n := newTestNetwork(t)
+	g := newTestGuest(t, n)
+
+	discover, err := dhcpv4.NewDiscovery(testMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := g.dhcp(discover)
+	if offer.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Fatalf("expected an offer, got %s", offer.MessageType())
+	}
+	if !offer.YourIPAddr.Equal(net.IP(n.GuestIP().AsSlice())) {
+		t.Errorf("expected the guest to be offered %s, got %s", n.GuestIP(), offer.YourIPAddr)
+	}
+	if routers := offer.Router(); len(routers) != 1 || !routers[0].Equal(net.IP(n.Gateway().AsSlice())) {
+		t.Errorf("expected the gateway to be the router, got %v", routers)
+	}
+	if servers := offer.DNS(); len(servers) != 1 || !servers[0].Equal(net.IP(n.Gateway().AsSlice())) {
+		t.Errorf("expected the gateway to be the DNS server, got %v", servers)
+	}
+
+	request, err := dhcpv4.NewRequestFromOffer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack := g.dhcp(request); ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(offer.YourIPAddr) {
+		t.Errorf("expected the offer to be acknowledged, got %s for %s", ack.MessageType(), ack.YourIPAddr)
+	}
+}
+
+func TestDNS(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+
+	server := tcpip.FullAddress{NIC: 1, Addr: address(n.Gateway()), Port: 53}
+	for name, want := range map[string]string{
+		"host." + Zone + ".": n.HostIP().String(),
+		// forwarded to the resolver of the host, which knows no such name
+		"vm.invalid.": "",
+	} {
+		c, err := gonet.DialUDP(s, nil, &server, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r, _, err := (&dns.Client{Timeout: 5 * time.Second}).ExchangeWithConn(q, &dns.Conn{Conn: c})
+		c.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want == "" {
+			if r.Rcode != dns.RcodeNameError {
+				t.Errorf("expected %s not to exist, got %v", name, r)
+			}
+			continue
+		}
+		if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != want {
+			t.Errorf("expected %s to resolve to %s, got %v", name, want, r.Answer)
+		}
+	}
+}
+
+func TestGuestReachesTheHost(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveEcho(l)
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := gonet.DialContextTCP(ctx, s, tcpip.FullAddress{NIC: 1, Addr: address(n.HostIP()), Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "from the guest")
+}
+
+func TestPublish(t *testing.T) {
+	n := newTestNetwork(t)
+	s := startGuest(t, n)
+
+	l, err := gonet.ListenTCP(s, tcpip.FullAddress{NIC: 1, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveEcho(l)
+
+	u, err := gonet.DialUDP(s, &tcpip.FullAddress{NIC: 1, Port: 53}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			m, from, err := u.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			u.WriteTo(buf[:m], from)
+		}
+	}()
+
+	tcpAddr, udpAddr := freePort(t, "tcp"), freePort(t, "udp")
+	if err := n.Publish(v1.ProtocolTCP, tcpAddr, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Publish(v1.ProtocolTCP, tcpAddr, 80); err == nil {
+		t.Error("expected an address to be published once")
+	}
+	if err := n.Publish(v1.ProtocolUDP, udpAddr, 53); err != nil {
+		t.Fatal(err)
+	}
+
+	for network, addr := range map[string]string{"tcp": tcpAddr, "udp": udpAddr} {
+		c, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, c, "from the host over "+network)
+		c.Close()
+	}
+
+	if err := n.Unpublish(v1.ProtocolTCP, tcpAddr); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := net.Dial("tcp", tcpAddr); err == nil {
+		c.Close()
+		t.Error("expected the unpublished address to be closed")
+	}
+}
+
+func TestCloseUnpublishes(t *testing.T) {
+	n, err := New(Config{Subnet: netip.MustParsePrefix("10.127.4.0/24"), MAC: testMAC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := freePort(t, "tcp")
+	if err := n.Publish(v1.ProtocolTCP, addr, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("expected the published addresses to be closed with the network")
+	}
+}
@@ -0,0 +1,33 @@
+package netstack
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// burstDivisor sizes the token buckets shaping the traffic of the guest to
+// a tenth of a second of traffic.
+const burstDivisor = 10
+
+// newLimiter returns a token bucket letting bitsPerSecond through, or nil
+// when bitsPerSecond is 0. The bucket always holds at least a full frame.
+func newLimiter(bitsPerSecond int64) *rate.Limiter {
+	if bitsPerSecond <= 0 {
+		return nil
+	}
+	bytesPerSecond := float64(bitsPerSecond) / 8
+	burst := max(int(bytesPerSecond/burstDivisor), MTU+header.EthernetMinimumSize)
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// shape waits until limiter lets a frame of size bytes through. It reports
+// false when the frame is to be dropped: it is larger than the bucket or
+// the link is closed. A nil limiter lets every frame through.
+func shape(ctx context.Context, limiter *rate.Limiter, size int) bool {
+	if limiter == nil {
+		return true
+	}
+	return limiter.WaitN(ctx, size) == nil
+}
@@ -0,0 +1,138 @@
+package netstack
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// countingGateway counts the bytes of the frames it is delivered.
+type countingGateway struct {
+	bytes atomic.Int64
+}
+
+func (g *countingGateway) DeliverNetworkPacket(_ tcpip.NetworkProtocolNumber, pkt stack.PacketBufferPtr) {
+	g.bytes.Add(int64(pkt.Size()) + header.EthernetMinimumSize)
+}
+
+func (g *countingGateway) LinkAddress() tcpip.LinkAddress {
+	mac, _ := net.ParseMAC(GatewayMAC)
+	return tcpip.LinkAddress(mac)
+}
+
+// testFrame returns a full frame from the guest to the gateway.
+func testFrame() []byte {
+	frame := make([]byte, MTU+header.EthernetMinimumSize)
+	mac, _ := net.ParseMAC(GatewayMAC)
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: tcpip.LinkAddress(testMAC),
+		DstAddr: tcpip.LinkAddress(mac),
+		Type:    header.ARPProtocolNumber,
+	})
+	return frame
+}
+
+// shapedLink returns a link over an in-memory connection, shaped to
+// ingress and egress bits per second, and the end of the guest.
+func shapedLink(t *testing.T, ingress, egress int64) (*link, *countingGateway, net.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	guest, conn := net.Pipe()
+	g := &countingGateway{}
+	l := &link{conn: conn, gateway: g, ingress: newLimiter(ingress), egress: newLimiter(egress), queue: make(chan []byte, ingressQueueSize), ctx: ctx}
+	go l.run()
+	go l.writeIngress()
+	t.Cleanup(func() {
+		cancel()
+		guest.Close()
+		conn.Close()
+	})
+	return l, g, guest
+}
+
+// checkThroughput checks that sent bytes, of which the first bucket passed
+// at once, took as long as the limit of bitsPerSecond requires.
+func checkThroughput(t *testing.T, sent int64, elapsed time.Duration, bitsPerSecond int64) {
+	t.Helper()
+	burst := int64(newLimiter(bitsPerSecond).Burst())
+	got := float64(sent-burst) * 8 / elapsed.Seconds()
+	if got > float64(bitsPerSecond)*1.05 {
+		t.Errorf("expected at most %d bits per second, got %.0f", bitsPerSecond, got)
+	}
+	if got < float64(bitsPerSecond)/2 {
+		t.Errorf("expected about %d bits per second, got only %.0f", bitsPerSecond, got)
+	}
+}
+
+func TestShapeEgress(t *testing.T) {
+	const limit = 8_000_000
+	_, g, guest := shapedLink(t, 0, limit)
+
+	frame := testFrame()
+	start := time.Now()
+	var sent int64
+	for time.Since(start) < 500*time.Millisecond {
+		if _, err := guest.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		sent += int64(len(frame))
+	}
+	// the last frame is delivered once written
+	time.Sleep(10 * time.Millisecond)
+	checkThroughput(t, g.bytes.Load(), time.Since(start), limit)
+	if delivered := g.bytes.Load(); delivered < sent-int64(len(frame)) {
+		t.Errorf("expected the guest to be held back rather than dropped, sent %d bytes, %d delivered", sent, delivered)
+	}
+}
+
+func TestShapeIngress(t *testing.T) {
+	const limit = 8_000_000
+	l, _, guest := shapedLink(t, limit, 0)
+
+	var received atomic.Int64
+	go func() {
+		buf := make([]byte, maxFrameSize)
+		for {
+			n, err := guest.Read(buf)
+			if err != nil {
+				return
+			}
+			received.Add(int64(n))
+		}
+	}()
+	frame := testFrame()
+	start := time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		l.send(frame)
+	}
+	checkThroughput(t, received.Load(), time.Since(start), limit)
+}
+
+func TestShapeIngressDoesNotBlockTheStack(t *testing.T) {
+	// a guest that never reads: the shaped frames queue up, then are dropped
+	l, _, _ := shapedLink(t, 8000, 0)
+
+	frame := testFrame()
+	start := time.Now()
+	for i := 0; i < 2*ingressQueueSize; i++ {
+		l.send(frame)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected shaped frames to be queued without waiting, took %s", elapsed)
+	}
+}
+
+func TestShapeUnlimited(t *testing.T) {
+	if newLimiter(0) != nil {
+		t.Error("expected no limiter without a limit")
+	}
+	if burst := newLimiter(1000).Burst(); burst != MTU+header.EthernetMinimumSize {
+		t.Errorf("expected the bucket to hold a full frame, got %d bytes", burst)
+	}
+}
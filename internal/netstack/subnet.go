@@ -0,0 +1,84 @@
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// SubnetBits is the prefix length of the subnet of each virtual machine.
+const SubnetBits = 24
+
+// ErrNoSubnet is returned when every subnet of a pool is in use.
+var ErrNoSubnet = errors.New("no subnet left")
+
+// Pool hands out the subnets of a range to the virtual machines of pods,
+// one each.
+type Pool struct {
+	base netip.Prefix
+
+	mu        sync.Mutex
+	allocated map[netip.Prefix]types.UID
+}
+
+// NewPool returns a Pool of the /24 subnets of base, e.g. 10.127.0.0/16.
+func NewPool(base string) (*Pool, error) {
+	prefix, err := netip.ParsePrefix(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet: %w", err)
+	}
+	if !prefix.Addr().Is4() || prefix.Bits() > SubnetBits {
+		return nil, fmt.Errorf("subnet %s must be an IPv4 range of at least a /%d", base, SubnetBits)
+	}
+	return &Pool{base: prefix.Masked(), allocated: map[netip.Prefix]types.UID{}}, nil
+}
+
+// Allocate returns the subnet of the pod uid, taking a free one on first
+// use.
+func (p *Pool) Allocate(uid types.UID) (netip.Prefix, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var free netip.Prefix
+	for subnet := netip.PrefixFrom(p.base.Addr(), SubnetBits); p.base.Contains(subnet.Addr()); subnet = next(subnet) {
+		user, ok := p.allocated[subnet]
+		if ok && user == uid {
+			return subnet, nil
+		}
+		if !ok && !free.IsValid() {
+			free = subnet
+		}
+	}
+	if !free.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("%w in %s", ErrNoSubnet, p.base)
+	}
+	p.allocated[free] = uid
+	return free, nil
+}
+
+// Release frees the subnet of the pod uid.
+func (p *Pool) Release(uid types.UID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for subnet, user := range p.allocated {
+		if user == uid {
+			delete(p.allocated, subnet)
+		}
+	}
+}
+
+// next returns the subnet following subnet, or an invalid one past the end
+// of the address space.
+func next(subnet netip.Prefix) netip.Prefix {
+	a := subnet.Addr().As4()
+	for i := SubnetBits/8 - 1; i >= 0; i-- {
+		a[i]++
+		if a[i] != 0 {
+			return netip.PrefixFrom(netip.AddrFrom4(a), SubnetBits)
+		}
+	}
+	return netip.Prefix{}
+}
@@ -0,0 +1,40 @@
+package netstack
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p, err := NewPool("10.127.0.0/23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := p.Allocate("a")
+	if err != nil || a.String() != "10.127.0.0/24" {
+		t.Fatalf("expected the first subnet, got %s, %v", a, err)
+	}
+	if again, _ := p.Allocate("a"); again != a {
+		t.Errorf("expected a pod to keep its subnet, got %s", again)
+	}
+	b, err := p.Allocate("b")
+	if err != nil || b.String() != "10.127.1.0/24" {
+		t.Fatalf("expected the second subnet, got %s, %v", b, err)
+	}
+	if _, err := p.Allocate("c"); !errors.Is(err, ErrNoSubnet) {
+		t.Errorf("expected the pool to be exhausted, got %v", err)
+	}
+
+	p.Release("a")
+	if c, err := p.Allocate("c"); err != nil || c != a {
+		t.Errorf("expected a released subnet to be reused, got %s, %v", c, err)
+	}
+}
+
+func TestNewPoolRejects(t *testing.T) {
+	for _, base := range []string{"10.127.0.0", "10.127.0.0/25", "fd00::/64"} {
+		if _, err := NewPool(base); err == nil {
+			t.Errorf("expected %s to be rejected", base)
+		}
+	}
+}
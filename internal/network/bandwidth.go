@@ -0,0 +1,65 @@
+package network
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The annotations limiting the bandwidth of a pod, in bits per second, as
+// honored by the bandwidth CNI plugin.
+const (
+	IngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	EgressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+)
+
+// The bounds of the bandwidth limits, those enforced by the kubelet.
+var (
+	minBandwidth = resource.MustParse("1k")
+	maxBandwidth = resource.MustParse("1P")
+)
+
+// Bandwidth is the bandwidth of a pod in bits per second, 0 standing for
+// no limit.
+type Bandwidth struct {
+	// Ingress limits the traffic to the pod.
+	Ingress int64
+	// Egress limits the traffic of the pod.
+	Egress int64
+}
+
+// IsZero reports whether b limits nothing.
+func (b Bandwidth) IsZero() bool {
+	return b.Ingress == 0 && b.Egress == 0
+}
+
+// PodBandwidth returns the bandwidth limits of the annotations of a pod,
+// e.g. "10M" for 10 megabits per second.
+func PodBandwidth(annotations map[string]string) (Bandwidth, error) {
+	var (
+		b   Bandwidth
+		err error
+	)
+	if b.Ingress, err = parseBandwidth(annotations, IngressBandwidthAnnotation); err != nil {
+		return Bandwidth{}, err
+	}
+	if b.Egress, err = parseBandwidth(annotations, EgressBandwidthAnnotation); err != nil {
+		return Bandwidth{}, err
+	}
+	return b, nil
+}
+
+func parseBandwidth(annotations map[string]string, key string) (int64, error) {
+	value, ok := annotations[key]
+	if !ok {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q: %w", key, value, err)
+	}
+	if q.Cmp(minBandwidth) < 0 || q.Cmp(maxBandwidth) > 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be between %s and %s", key, value, minBandwidth.String(), maxBandwidth.String())
+	}
+	return q.Value(), nil
+}
@@ -0,0 +1,22 @@
+package network
+
+import "testing"
+
+func TestPodBandwidth(t *testing.T) {
+	b, err := PodBandwidth(map[string]string{IngressBandwidthAnnotation: "10M", EgressBandwidthAnnotation: "1.5G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Ingress != 10_000_000 || b.Egress != 1_500_000_000 {
+		t.Errorf("unexpected bandwidth %+v", b)
+	}
+	if b, err := PodBandwidth(nil); err != nil || !b.IsZero() {
+		t.Errorf("expected no limit without annotations, got %+v, %v", b, err)
+	}
+
+	for _, value := range []string{"fast", "999", "2P"} {
+		if _, err := PodBandwidth(map[string]string{EgressBandwidthAnnotation: value}); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
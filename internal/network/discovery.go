@@ -0,0 +1,86 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// Source finds the IP address of the guest with a MAC address.
+type Source interface {
+	// Lookup returns the address of mac, or nil when it is not known yet.
+	Lookup(ctx context.Context, mac net.HardwareAddr) (net.IP, error)
+}
+
+// LeaseSource finds guests in the lease database of the DHCP server
+// serving them, for the NAT mode.
+type LeaseSource struct {
+	// Path is the lease database, DefaultLeaseFile when empty.
+	Path string
+}
+
+// Lookup returns the address of the lease of mac expiring last.
+func (s LeaseSource) Lookup(ctx context.Context, mac net.HardwareAddr) (net.IP, error) {
+	path := s.Path
+	if path == "" {
+		path = DefaultLeaseFile
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// no lease was ever given
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	leases, err := ParseLeases(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var found *Lease
+	for i, lease := range leases {
+		if bytes.Equal(lease.HardwareAddr, mac) && (found == nil || lease.Expires.After(found.Expires)) {
+			found = &leases[i]
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return found.IP, nil
+}
+
+// NeighborSource finds guests in the neighbor table of the host, for the
+// bridged mode. The guest must have sent traffic for its entry to exist.
+type NeighborSource struct {
+	// Interface restricts the lookup to the entries of a host interface.
+	Interface string
+	// Command prints the neighbor table, arp -an when empty.
+	Command []string
+}
+
+// Lookup returns the address of the entry of mac.
+func (s NeighborSource) Lookup(ctx context.Context, mac net.HardwareAddr) (net.IP, error) {
+	command := s.Command
+	if len(command) == 0 {
+		command = []string{"arp", "-an"}
+	}
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the neighbor table: %w", err)
+	}
+	neighbors, err := ParseNeighbors(bytes.NewReader(out))
+	if err != nil {
+		return nil, err
+	}
+	for _, neighbor := range neighbors {
+		if bytes.Equal(neighbor.HardwareAddr, mac) && (s.Interface == "" || neighbor.Interface == s.Interface) {
+			return neighbor.IP, nil
+		}
+	}
+	return nil, nil
+}
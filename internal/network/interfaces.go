@@ -0,0 +1,85 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// InterfaceNotFoundReason is the reason of the pods rejected for an
+// *InterfaceError.
+const InterfaceNotFoundReason = "NetworkInterfaceNotFound"
+
+// InterfaceError is returned when a virtual machine cannot be bridged to
+// Interface, or to any interface when it is empty.
+type InterfaceError struct {
+	Interface string
+	// Available are the interfaces virtual machines can be bridged to.
+	Available []string
+}
+
+func (e *InterfaceError) Error() string {
+	available := "none"
+	if len(e.Available) > 0 {
+		available = strings.Join(e.Available, ", ")
+	}
+	if e.Interface == "" {
+		return fmt.Sprintf("no network interface to bridge, available interfaces: %s", available)
+	}
+	return fmt.Sprintf("network interface %s not found, available interfaces: %s", e.Interface, available)
+}
+
+// ResolveInterface returns the interface to bridge among available: name,
+// or when it is empty the interface of the default route, falling back to
+// the first available one.
+func ResolveInterface(ctx context.Context, name string, available []string) (string, error) {
+	if name != "" {
+		if !slices.Contains(available, name) {
+			return "", &InterfaceError{Interface: name, Available: available}
+		}
+		return name, nil
+	}
+	if len(available) == 0 {
+		return "", &InterfaceError{}
+	}
+	if iface, err := DefaultRouteInterface(ctx); err == nil && slices.Contains(available, iface) {
+		return iface, nil
+	}
+	return available[0], nil
+}
+
+// DefaultRouteInterface returns the interface of the default IPv4 route of
+// the host.
+func DefaultRouteInterface(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, "route", "-n", "get", "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the default route: %w", err)
+	}
+	return ParseRoute(strings.NewReader(string(out)))
+}
+
+// ParseRoute returns the interface of the output of route get on macOS,
+// e.g.
+//
+//	   route to: default
+//	destination: default
+//	    gateway: 192.168.1.1
+//	  interface: en0
+func ParseRoute(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "interface" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no interface in the route")
+}
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "route"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	iface, err := ParseRoute(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface != "en7" {
+		t.Errorf("expected en7, got %q", iface)
+	}
+	if _, err := ParseRoute(strings.NewReader("route: writing to routing socket: not in table\n")); err == nil {
+		t.Error("expected a missing route to fail")
+	}
+}
+
+func TestResolveInterface(t *testing.T) {
+	ctx := context.Background()
+	if iface, err := ResolveInterface(ctx, "en1", []string{"en0", "en1"}); err != nil || iface != "en1" {
+		t.Errorf("expected the configured interface, got %q, %v", iface, err)
+	}
+
+	_, err := ResolveInterface(ctx, "en9", []string{"en0", "en1"})
+	var ifaceErr *InterfaceError
+	if !errors.As(err, &ifaceErr) || ifaceErr.Interface != "en9" {
+		t.Fatalf("expected an InterfaceError, got %v", err)
+	}
+	if want := "network interface en9 not found, available interfaces: en0, en1"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+
+	if _, err := ResolveInterface(ctx, "", nil); !errors.As(err, &ifaceErr) {
+		t.Errorf("expected an InterfaceError without any interface, got %v", err)
+	}
+	// without a default route among them, the first interface is used
+	if iface, err := ResolveInterface(ctx, "", []string{"bridge-test0"}); err != nil || iface != "bridge-test0" {
+		t.Errorf("expected the first available interface, got %q, %v", iface, err)
+	}
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// DefaultLeaseFile is the lease database of the macOS DHCP server, which
+// serves the virtual machines attached in NAT mode.
+const DefaultLeaseFile = "/var/db/dhcpd_leases"
+
+// Lease is a lease of the macOS DHCP server.
+type Lease struct {
+	Name         string
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+	Expires      time.Time
+}
+
+// ParseLeases parses a lease database of the macOS DHCP server: blocks of
+// key=value lines in braces, e.g.
+//
+//	{
+//		name=ubuntu
+//		ip_address=192.168.64.3
+//		hw_address=1,2:a:b:c:d:e
+//		identifier=1,2:a:b:c:d:e
+//		lease=0x64790d5c
+//	}
+//
+// hw_address is prefixed with the hardware type and drops the leading
+// zeros of the bytes. Leases of other hardware types than ethernet, e.g.
+// "ff," followed by the DUID of a guest using a client identifier, are
+// skipped, as are malformed leases: the database is shared by every
+// virtual machine of the host.
+func ParseLeases(ctx context.Context, r io.Reader) ([]Lease, error) {
+	var leases []Lease
+	var fields map[string]string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case line == "{":
+			if fields != nil {
+				return nil, fmt.Errorf("line %d: unterminated lease", n)
+			}
+			fields = map[string]string{}
+		case line == "}":
+			if fields == nil {
+				return nil, fmt.Errorf("line %d: unexpected }", n)
+			}
+			lease, ok, err := newLease(fields)
+			if err != nil {
+				log.G(ctx).WithError(err).Debugf("Skipping the lease ending on line %d", n)
+			}
+			if ok && err == nil {
+				leases = append(leases, lease)
+			}
+			fields = nil
+		default:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || fields == nil {
+				return nil, fmt.Errorf("line %d: unexpected %q", n, line)
+			}
+			fields[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if fields != nil {
+		return nil, fmt.Errorf("unterminated lease")
+	}
+	return leases, nil
+}
+
+// newLease returns the lease described by fields. It reports false for the
+// leases of hardware other than ethernet.
+func newLease(fields map[string]string) (Lease, bool, error) {
+	// the hardware type of ethernet is 1
+	hw, ok := strings.CutPrefix(fields["hw_address"], "1,")
+	if !ok {
+		return Lease{}, false, nil
+	}
+
+	lease := Lease{Name: fields["name"]}
+	if lease.IP = net.ParseIP(fields["ip_address"]); lease.IP == nil {
+		return Lease{}, false, fmt.Errorf("invalid ip_address %q", fields["ip_address"])
+	}
+	mac, err := parseMAC(hw)
+	if err != nil {
+		return Lease{}, false, fmt.Errorf("invalid hw_address %q: %w", fields["hw_address"], err)
+	}
+	lease.HardwareAddr = mac
+	if v, ok := fields["lease"]; ok {
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(v, "0x"), 16, 64)
+		if err != nil {
+			return Lease{}, false, fmt.Errorf("invalid lease %q", v)
+		}
+		lease.Expires = time.Unix(seconds, 0)
+	}
+	return lease, true, nil
+}
+
+// parseMAC parses a MAC address whose bytes may have dropped their leading
+// zero, as printed by macOS.
+func parseMAC(s string) (net.HardwareAddr, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("expected 6 bytes")
+	}
+	mac := make(net.HardwareAddr, 0, 6)
+	for _, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || part == "" {
+			return nil, fmt.Errorf("invalid byte %q", part)
+		}
+		mac = append(mac, byte(b))
+	}
+	return mac, nil
+}
@@ -0,0 +1,92 @@
+package network
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustMAC(t *testing.T, s string) net.HardwareAddr {
+	t.Helper()
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mac
+}
+
+func TestParseLeases(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "dhcpd_leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	leases, err := ParseLeases(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Lease{
+		{Name: "runner-0", IP: net.ParseIP("192.168.64.3"), HardwareAddr: mustMAC(t, "02:4a:0b:c0:0d:0e"), Expires: time.Unix(0x64790d5c, 0)},
+		{Name: "web-0", IP: net.ParseIP("192.168.64.4"), HardwareAddr: mustMAC(t, "06:0f:10:a2:3b:c4"), Expires: time.Unix(0x64790e10, 0)},
+		{Name: "runner-0", IP: net.ParseIP("192.168.64.7"), HardwareAddr: mustMAC(t, "02:4a:0b:c0:0d:0e"), Expires: time.Unix(0x6479a1f0, 0)},
+	}
+	if !reflect.DeepEqual(leases, want) {
+		t.Errorf("expected %+v, got %+v", want, leases)
+	}
+}
+
+func TestParseLeasesErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"unterminated": "{\n\tip_address=192.168.64.3\n\thw_address=1,2:4a:b:c0:d:e\n",
+		"nested":       "{\n{\n",
+		"outside":      "ip_address=192.168.64.3\n",
+	} {
+		if _, err := ParseLeases(context.Background(), strings.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseLeasesSkipsMalformedLeases(t *testing.T) {
+	for name, data := range map[string]string{
+		"bad ip":    "{\n\tip_address=192.168.64\n\thw_address=1,2:4a:b:c0:d:e\n}\n",
+		"bad mac":   "{\n\tip_address=192.168.64.3\n\thw_address=1,2:4a:b:c0\n}\n",
+		"bad lease": "{\n\tip_address=192.168.64.3\n\thw_address=1,2:4a:b:c0:d:e\n\tlease=0xzz\n}\n",
+	} {
+		valid := "{\n\tip_address=192.168.64.4\n\thw_address=1,6:f:10:a2:3b:c4\n}\n"
+		leases, err := ParseLeases(context.Background(), strings.NewReader(data+valid))
+		if err != nil {
+			t.Errorf("%s: expected the lease to be skipped, got %v", name, err)
+			continue
+		}
+		if len(leases) != 1 || !leases[0].IP.Equal(net.ParseIP("192.168.64.4")) {
+			t.Errorf("%s: expected only the valid lease, got %+v", name, leases)
+		}
+	}
+}
+
+func TestLeaseSource(t *testing.T) {
+	source := LeaseSource{Path: filepath.Join("testdata", "dhcpd_leases")}
+
+	ip, err := source.Lookup(context.Background(), mustMAC(t, "02:4a:0b:c0:0d:0e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.64.7")) {
+		t.Errorf("expected the lease expiring last, got %v", ip)
+	}
+
+	if ip, err := source.Lookup(context.Background(), mustMAC(t, "02:00:00:00:00:01")); ip != nil || err != nil {
+		t.Errorf("expected an unknown address not to be found, got %v, %v", ip, err)
+	}
+	missing := LeaseSource{Path: filepath.Join(t.TempDir(), "dhcpd_leases")}
+	if ip, err := missing.Lookup(context.Background(), mustMAC(t, "02:4a:0b:c0:0d:0e")); ip != nil || err != nil {
+		t.Errorf("expected a missing database to have no lease, got %v, %v", ip, err)
+	}
+}
@@ -0,0 +1,20 @@
+// Package network derives the network identity of the virtual machines of
+// pods and discovers the addresses their guests get.
+package network
+
+import (
+	"crypto/sha256"
+	"net"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// MACAddress returns the MAC address of the virtual machine of the pod uid:
+// a locally administered unicast address hashed from uid, so that it is
+// stable across restarts of the virtual machine.
+func MACAddress(uid types.UID) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(uid))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
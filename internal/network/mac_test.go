@@ -0,0 +1,22 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMACAddress(t *testing.T) {
+	mac := MACAddress("0b3c5c9e-8a4a-4c1e-9d4f-3f1b2a6c7d8e")
+	if len(mac) != 6 {
+		t.Fatalf("expected 6 bytes, got %v", mac)
+	}
+	if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 {
+		t.Errorf("expected a locally administered unicast address, got %v", mac)
+	}
+	if !bytes.Equal(mac, MACAddress("0b3c5c9e-8a4a-4c1e-9d4f-3f1b2a6c7d8e")) {
+		t.Error("expected the address to be stable")
+	}
+	if bytes.Equal(mac, MACAddress("5e7d1a40-2b9f-4c33-8a61-0d2e4f6b8c9a")) {
+		t.Error("expected pods to get different addresses")
+	}
+}
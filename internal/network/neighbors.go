@@ -0,0 +1,42 @@
+package network
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+)
+
+// Neighbor is an entry of the neighbor table of the host.
+type Neighbor struct {
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+	Interface    string
+}
+
+// ParseNeighbors parses the output of arp -an on macOS, e.g.
+//
+//	? (192.168.1.20) at 2:a:b:c:d:e on en0 ifscope [ethernet]
+//
+// Incomplete entries, without a hardware address yet, are skipped.
+func ParseNeighbors(r io.Reader) ([]Neighbor, error) {
+	var neighbors []Neighbor
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "at" {
+			continue
+		}
+		ip := net.ParseIP(strings.Trim(fields[1], "()"))
+		mac, err := parseMAC(fields[3])
+		if ip == nil || err != nil {
+			continue
+		}
+		neighbor := Neighbor{IP: ip, HardwareAddr: mac}
+		if len(fields) >= 6 && fields[4] == "on" {
+			neighbor.Interface = fields[5]
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	return neighbors, scanner.Err()
+}
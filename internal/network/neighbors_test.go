@@ -0,0 +1,48 @@
+package network
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNeighbors(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "arp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	neighbors, err := ParseNeighbors(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Neighbor{
+		{IP: net.ParseIP("192.168.1.1"), HardwareAddr: mustMAC(t, "74:ac:b9:01:02:03"), Interface: "en0"},
+		{IP: net.ParseIP("192.168.1.20"), HardwareAddr: mustMAC(t, "02:4a:0b:c0:0d:0e"), Interface: "en0"},
+		{IP: net.ParseIP("192.168.2.20"), HardwareAddr: mustMAC(t, "02:4a:0b:c0:0d:0f"), Interface: "en7"},
+		{IP: net.ParseIP("224.0.0.251"), HardwareAddr: mustMAC(t, "01:00:5e:00:00:fb"), Interface: "en0"},
+	}
+	if !reflect.DeepEqual(neighbors, want) {
+		t.Errorf("expected %+v, got %+v", want, neighbors)
+	}
+}
+
+func TestNeighborSource(t *testing.T) {
+	source := NeighborSource{Command: []string{"cat", filepath.Join("testdata", "arp")}}
+	ip, err := source.Lookup(context.Background(), mustMAC(t, "02:4a:0b:c0:0d:0f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.2.20")) {
+		t.Errorf("expected 192.168.2.20, got %v", ip)
+	}
+
+	source.Interface = "en0"
+	if ip, err := source.Lookup(context.Background(), mustMAC(t, "02:4a:0b:c0:0d:0f")); ip != nil || err != nil {
+		t.Errorf("expected the entries of other interfaces to be skipped, got %v, %v", ip, err)
+	}
+}
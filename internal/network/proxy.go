@@ -0,0 +1,233 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// udpIdleTimeout is how long the datagrams of a UDP client are forwarded
+// to the same guest connection without traffic.
+const udpIdleTimeout = 90 * time.Second
+
+// dialTimeout bounds the connection to the guest of a forwarded connection.
+const dialTimeout = 10 * time.Second
+
+// DialFunc connects to the port of a guest traffic is forwarded to.
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Proxy forwards the TCP connections or UDP datagrams received on a host
+// address to a guest.
+type Proxy struct {
+	dial DialFunc
+
+	listener net.Listener
+	packets  net.PacketConn
+
+	mu sync.Mutex
+	// conns are the open connections, of clients and to the guest
+	conns map[net.Conn]struct{}
+	// udpClients maps the addresses of UDP clients to their connection to
+	// the guest
+	udpClients map[string]net.Conn
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// NewProxy listens on the host address addr, e.g. 192.168.1.10:8080, and
+// forwards what it receives to the connections returned by dial.
+func NewProxy(protocol v1.Protocol, addr string, dial DialFunc) (*Proxy, error) {
+	p := &Proxy{dial: dial, conns: map[net.Conn]struct{}{}, udpClients: map[string]net.Conn{}}
+	var err error
+	switch protocol {
+	case v1.ProtocolTCP:
+		if p.listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+		p.wg.Add(1)
+		go p.serveTCP()
+	case v1.ProtocolUDP:
+		if p.packets, err = net.ListenPacket("udp", addr); err != nil {
+			return nil, err
+		}
+		p.wg.Add(1)
+		go p.serveUDP()
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", protocol)
+	}
+	return p, nil
+}
+
+// Addr returns the host address the proxy listens on.
+func (p *Proxy) Addr() net.Addr {
+	if p.listener != nil {
+		return p.listener.Addr()
+	}
+	return p.packets.LocalAddr()
+}
+
+// Close stops listening and closes the forwarded connections.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	} else {
+		err = p.packets.Close()
+	}
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) serveTCP() {
+	defer p.wg.Done()
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !p.track(client) {
+			client.Close()
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.forwardTCP(client)
+		}()
+	}
+}
+
+func (p *Proxy) forwardTCP(client net.Conn) {
+	defer p.untrack(client)
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	guest, err := p.dial(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	if !p.track(guest) {
+		guest.Close()
+		return
+	}
+	defer p.untrack(guest)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(guest, client)
+		closeWrite(guest)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, guest)
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// closeWrite half-closes c when it supports it, so that the peer sees the
+// end of the stream of the other side.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+func (p *Proxy) serveUDP() {
+	defer p.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := p.packets.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		guest, err := p.udpClient(from)
+		if err != nil {
+			continue
+		}
+		guest.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		guest.Write(buf[:n])
+	}
+}
+
+// udpClient returns the connection to the guest of the UDP client from,
+// dialing it and forwarding its replies on first use.
+func (p *Proxy) udpClient(from net.Addr) (net.Conn, error) {
+	key := from.String()
+	p.mu.Lock()
+	guest, ok := p.udpClients[key]
+	p.mu.Unlock()
+	if ok {
+		return guest, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	guest, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.track(guest) {
+		guest.Close()
+		return nil, errors.New("proxy closed")
+	}
+	p.mu.Lock()
+	p.udpClients[key] = guest
+	p.mu.Unlock()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			p.mu.Lock()
+			delete(p.udpClients, key)
+			p.mu.Unlock()
+			p.untrack(guest)
+		}()
+		buf := make([]byte, 65535)
+		for {
+			guest.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+			n, err := guest.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := p.packets.WriteTo(buf[:n], from); err != nil {
+				return
+			}
+		}
+	}()
+	return guest, nil
+}
+
+// track records the open connection c, closed with the proxy, unless the
+// proxy is closed already.
+func (p *Proxy) track(c net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+// untrack closes c and forgets it.
+func (p *Proxy) untrack(c net.Conn) {
+	c.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+}
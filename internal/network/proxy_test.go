@@ -0,0 +1,123 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// echoTCP serves a TCP echo server standing for a guest port.
+func echoTCP(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echoUDP serves a UDP echo server standing for a guest port.
+func echoUDP(t *testing.T) string {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], from)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func dialer(network, addr string) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("expected %q back, got %q", msg, buf)
+	}
+}
+
+func TestProxyTCP(t *testing.T) {
+	p, err := NewProxy(v1.ProtocolTCP, "127.0.0.1:0", dialer("tcp", echoTCP(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "hello")
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected forwarded connections to be closed with the proxy")
+	}
+	if _, err := net.Dial("tcp", p.Addr().String()); err == nil {
+		t.Error("expected the proxy to stop listening")
+	}
+}
+
+func TestProxyUDP(t *testing.T) {
+	p, err := NewProxy(v1.ProtocolUDP, "127.0.0.1:0", dialer("udp", echoUDP(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for _, msg := range []string{"one", "two"} {
+		c, err := net.Dial("udp", p.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, c, msg)
+		c.Close()
+	}
+}
+
+func TestProxyUnsupportedProtocol(t *testing.T) {
+	if _, err := NewProxy(v1.ProtocolSCTP, "127.0.0.1:0", nil); err == nil {
+		t.Error("expected SCTP to be rejected")
+	}
+}
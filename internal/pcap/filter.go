@@ -0,0 +1,311 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Filter selects ethernet frames. It is compiled from an expression in a
+// subset of the tcpdump syntax:
+//
+//	tcp | udp | icmp | arp | ip
+//	[src|dst] host <address>
+//	[src|dst] net <cidr>
+//	[src|dst] port <port>
+//	[src|dst] portrange <port>-<port>
+//
+// combined with and (&&), or (||), not (!) and parentheses. Primitives
+// next to each other are combined with and, e.g. "tcp port 443".
+// A nil Filter matches every frame.
+type Filter struct {
+	expr  string
+	match func(p *packet) bool
+}
+
+// String returns the expression of f.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Match reports whether f selects the ethernet frame.
+func (f *Filter) Match(frame []byte) bool {
+	if f == nil {
+		return true
+	}
+	p := decode(frame)
+	return f.match(&p)
+}
+
+// Compile returns the filter of expr, or nil when expr is empty.
+func Compile(expr string) (*Filter, error) {
+	tokens := tokenize(expr)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &parser{tokens: tokens}
+	match, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", expr, p.peek())
+	}
+	return &Filter{expr: expr, match: match}, nil
+}
+
+// Protocols of the packets.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	protocolICMP  = 1
+	protocolTCP   = 6
+	protocolUDP   = 17
+)
+
+// packet are the fields of a frame filters match.
+type packet struct {
+	etherType uint16
+	protocol  uint8
+	src, dst  netip.Addr
+	// hasPorts is set for TCP and UDP packets carrying their header
+	hasPorts         bool
+	srcPort, dstPort uint16
+}
+
+func decode(frame []byte) packet {
+	var p packet
+	if len(frame) < 14 {
+		return p
+	}
+	p.etherType = binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+	switch p.etherType {
+	case etherTypeARP:
+		if len(payload) >= 28 {
+			p.src = netip.AddrFrom4([4]byte(payload[14:18]))
+			p.dst = netip.AddrFrom4([4]byte(payload[24:28]))
+		}
+	case etherTypeIPv4:
+		if len(payload) < 20 || payload[0]>>4 != 4 {
+			return p
+		}
+		p.protocol = payload[9]
+		p.src = netip.AddrFrom4([4]byte(payload[12:16]))
+		p.dst = netip.AddrFrom4([4]byte(payload[16:20]))
+		ihl := int(payload[0]&0x0f) * 4
+		fragmentOffset := binary.BigEndian.Uint16(payload[6:8]) & 0x1fff
+		if (p.protocol == protocolTCP || p.protocol == protocolUDP) && fragmentOffset == 0 && len(payload) >= ihl+4 {
+			p.hasPorts = true
+			p.srcPort = binary.BigEndian.Uint16(payload[ihl : ihl+2])
+			p.dstPort = binary.BigEndian.Uint16(payload[ihl+2 : ihl+4])
+		}
+	}
+	return p
+}
+
+func tokenize(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() (string, error) {
+	if p.done() {
+		return "", fmt.Errorf("unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *parser) or() (func(*packet) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pkt *packet) bool { return l(pkt) || right(pkt) }
+	}
+	return left, nil
+}
+
+func (p *parser) and() (func(*packet) bool, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for !p.done() && p.peek() != "or" && p.peek() != ")" {
+		if p.peek() == "and" {
+			p.pos++
+		}
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pkt *packet) bool { return l(pkt) && right(pkt) }
+	}
+	return left, nil
+}
+
+func (p *parser) not() (func(*packet) bool, error) {
+	if p.peek() != "not" {
+		return p.primary()
+	}
+	p.pos++
+	m, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	return func(pkt *packet) bool { return !m(pkt) }, nil
+}
+
+func (p *parser) primary() (func(*packet) bool, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "(":
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing, err := p.next(); err != nil || closing != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	case "ip":
+		return func(pkt *packet) bool { return pkt.etherType == etherTypeIPv4 }, nil
+	case "arp":
+		return func(pkt *packet) bool { return pkt.etherType == etherTypeARP }, nil
+	case "tcp":
+		return isProtocol(protocolTCP), nil
+	case "udp":
+		return isProtocol(protocolUDP), nil
+	case "icmp":
+		return isProtocol(protocolICMP), nil
+	case "src", "dst":
+		qualifier, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return p.qualified(token, qualifier)
+	case "host", "net", "port", "portrange":
+		return p.qualified("", token)
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+func isProtocol(protocol uint8) func(*packet) bool {
+	return func(pkt *packet) bool { return pkt.etherType == etherTypeIPv4 && pkt.protocol == protocol }
+}
+
+// qualified parses the value of qualifier, applying to the source or the
+// destination as dir says, or to either when it is empty.
+func (p *parser) qualified(dir, qualifier string) (func(*packet) bool, error) {
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch qualifier {
+	case "host":
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		return matchAddr(dir, func(a netip.Addr) bool { return a == addr }), nil
+	case "net":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		return matchAddr(dir, prefix.Contains), nil
+	case "port":
+		port, err := parsePort(value)
+		if err != nil {
+			return nil, err
+		}
+		return matchPort(dir, port, port), nil
+	case "portrange":
+		from, to, ok := strings.Cut(value, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid port range %q", value)
+		}
+		first, err := parsePort(from)
+		if err != nil {
+			return nil, err
+		}
+		last, err := parsePort(to)
+		if err != nil {
+			return nil, err
+		}
+		return matchPort(dir, first, last), nil
+	}
+	return nil, fmt.Errorf("unexpected %q after %s", qualifier, dir)
+}
+
+func matchAddr(dir string, match func(netip.Addr) bool) func(*packet) bool {
+	return func(pkt *packet) bool {
+		if !pkt.src.IsValid() {
+			return false
+		}
+		switch dir {
+		case "src":
+			return match(pkt.src)
+		case "dst":
+			return match(pkt.dst)
+		}
+		return match(pkt.src) || match(pkt.dst)
+	}
+}
+
+func matchPort(dir string, first, last uint16) func(*packet) bool {
+	in := func(port uint16) bool { return port >= first && port <= last }
+	return func(pkt *packet) bool {
+		if !pkt.hasPorts {
+			return false
+		}
+		switch dir {
+		case "src":
+			return in(pkt.srcPort)
+		case "dst":
+			return in(pkt.dstPort)
+		}
+		return in(pkt.srcPort) || in(pkt.dstPort)
+	}
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
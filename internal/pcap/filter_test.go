@@ -0,0 +1,73 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipv4Frame returns an ethernet frame of an IPv4 packet of protocol.
+func ipv4Frame(protocol uint8, src, dst string, srcPort, dstPort uint16) []byte {
+	frame := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+	ip := frame[14:]
+	ip[0] = 0x45
+	ip[9] = protocol
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(ip[12:], s[:])
+	copy(ip[16:], d[:])
+	binary.BigEndian.PutUint16(ip[20:], srcPort)
+	binary.BigEndian.PutUint16(ip[22:], dstPort)
+	return frame
+}
+
+func arpFrame(sender, target string) []byte {
+	frame := make([]byte, 14+28)
+	binary.BigEndian.PutUint16(frame[12:], etherTypeARP)
+	s, t := netip.MustParseAddr(sender).As4(), netip.MustParseAddr(target).As4()
+	copy(frame[14+14:], s[:])
+	copy(frame[14+24:], t[:])
+	return frame
+}
+
+func TestFilter(t *testing.T) {
+	https := ipv4Frame(protocolTCP, "10.127.3.2", "93.184.216.34", 49152, 443)
+	dns := ipv4Frame(protocolUDP, "10.127.3.2", "10.127.3.1", 53000, 53)
+	ping := ipv4Frame(protocolICMP, "10.127.3.2", "10.127.3.254", 0, 0)
+	arp := arpFrame("10.127.3.2", "10.127.3.1")
+
+	for _, tc := range []struct {
+		expr  string
+		match []bool // https, dns, ping, arp
+	}{
+		{"", []bool{true, true, true, true}},
+		{"tcp", []bool{true, false, false, false}},
+		{"tcp port 443", []bool{true, false, false, false}},
+		{"udp and dst port 53", []bool{false, true, false, false}},
+		{"src port 53", []bool{false, false, false, false}},
+		{"portrange 40-60", []bool{false, true, false, false}},
+		{"host 10.127.3.1", []bool{false, true, false, true}},
+		{"dst net 10.127.3.0/24", []bool{false, true, true, true}},
+		{"not arp and not icmp", []bool{true, true, false, false}},
+		{"icmp || (udp && port 53)", []bool{false, true, true, false}},
+		{"!(ip)", []bool{false, false, false, true}},
+	} {
+		f, err := Compile(tc.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.expr, err)
+		}
+		for i, frame := range [][]byte{https, dns, ping, arp} {
+			if got := f.Match(frame); got != tc.match[i] {
+				t.Errorf("%q: expected frame %d to match %v", tc.expr, i, tc.match[i])
+			}
+		}
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	for _, expr := range []string{"tcp and", "port http", "host 10.0.0", "(tcp", "tcp)", "src tcp", "ether host 02:00:00:00:00:01", "portrange 1"} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package pcap writes captured ethernet frames as pcap-ng streams, readable
+// by Wireshark and tcpdump, and selects the captured frames with filters in
+// a subset of the tcpdump syntax.
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Block types of pcap-ng.
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockInterfaceStatistics  = 0x00000005
+	blockEnhancedPacket       = 0x00000006
+)
+
+// Options of the blocks of pcap-ng.
+const (
+	optEndOfOpt      = 0
+	optSHBUserAppl   = 4
+	optIFName        = 2
+	optEPBFlags      = 2
+	optISBEndTime    = 3
+	optISBIfDrop     = 5
+	byteOrderMagic   = 0x1A2B3C4D
+	linkTypeEthernet = 1
+)
+
+// Direction is the direction of a frame, seen from the captured interface.
+type Direction uint32
+
+// The directions of the epb_flags option.
+const (
+	Inbound  Direction = 1
+	Outbound Direction = 2
+)
+
+// DefaultSnapLen is the default number of bytes captured of each frame.
+const DefaultSnapLen = 65535
+
+// Writer writes a pcap-ng stream of the frames of a single ethernet
+// interface.
+type Writer struct {
+	w       io.Writer
+	snapLen int
+	written int64
+}
+
+// NewWriter starts a pcap-ng stream on w of the interface name, capturing
+// at most snapLen bytes of each frame, DefaultSnapLen when 0.
+func NewWriter(w io.Writer, name string, snapLen int) (*Writer, error) {
+	if snapLen <= 0 {
+		snapLen = DefaultSnapLen
+	}
+	pw := &Writer{w: w, snapLen: snapLen}
+
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	// the length of the section is not known up front
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF)
+	shb = appendOption(shb, optSHBUserAppl, []byte("macos-virtual-kubelet"))
+	shb = appendOption(shb, optEndOfOpt, nil)
+	if err := pw.writeBlock(blockSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeEthernet)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(snapLen))
+	if name != "" {
+		idb = appendOption(idb, optIFName, []byte(name))
+	}
+	idb = appendOption(idb, optEndOfOpt, nil)
+	if err := pw.writeBlock(blockInterfaceDescription, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Written returns the number of bytes of the stream written so far.
+func (pw *Writer) Written() int64 {
+	return pw.written
+}
+
+// WriteFrame writes frame, captured at ts in direction dir.
+func (pw *Writer) WriteFrame(ts time.Time, frame []byte, dir Direction) error {
+	captured := frame
+	if len(captured) > pw.snapLen {
+		captured = captured[:pw.snapLen]
+	}
+	micros := uint64(ts.UnixMicro())
+
+	epb := make([]byte, 0, 20+len(captured)+3+12+4)
+	epb = binary.LittleEndian.AppendUint32(epb, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(micros>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(micros))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(captured)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = append(epb, captured...)
+	epb = append(epb, make([]byte, pad(len(captured)))...)
+	epb = appendOption(epb, optEPBFlags, binary.LittleEndian.AppendUint32(nil, uint32(dir)))
+	epb = appendOption(epb, optEndOfOpt, nil)
+	return pw.writeBlock(blockEnhancedPacket, epb)
+}
+
+// WriteStatistics ends the capture at ts, reporting the number of frames
+// dropped by the capture.
+func (pw *Writer) WriteStatistics(ts time.Time, dropped uint64) error {
+	micros := uint64(ts.UnixMicro())
+	var isb []byte
+	isb = binary.LittleEndian.AppendUint32(isb, 0)
+	isb = binary.LittleEndian.AppendUint32(isb, uint32(micros>>32))
+	isb = binary.LittleEndian.AppendUint32(isb, uint32(micros))
+	end := binary.LittleEndian.AppendUint32(nil, uint32(micros>>32))
+	end = binary.LittleEndian.AppendUint32(end, uint32(micros))
+	isb = appendOption(isb, optISBEndTime, end)
+	isb = appendOption(isb, optISBIfDrop, binary.LittleEndian.AppendUint64(nil, dropped))
+	isb = appendOption(isb, optEndOfOpt, nil)
+	return pw.writeBlock(blockInterfaceStatistics, isb)
+}
+
+// writeBlock writes a block of type typ with body, padded to 32 bits.
+func (pw *Writer) writeBlock(typ uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, typ)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	n, err := pw.w.Write(block)
+	pw.written += int64(n)
+	return err
+}
+
+// appendOption appends an option with value, padded to 32 bits.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad(len(value)))...)
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,80 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// blocks splits a pcap-ng stream in its blocks, checking their framing.
+func blocks(t *testing.T, stream []byte) map[uint32][][]byte {
+	t.Helper()
+	found := map[uint32][][]byte{}
+	for len(stream) > 0 {
+		if len(stream) < 12 {
+			t.Fatalf("truncated block %x", stream)
+		}
+		typ := binary.LittleEndian.Uint32(stream)
+		length := binary.LittleEndian.Uint32(stream[4:])
+		if length%4 != 0 || int(length) > len(stream) {
+			t.Fatalf("invalid length %d of block %#x", length, typ)
+		}
+		if trailer := binary.LittleEndian.Uint32(stream[length-4:]); trailer != length {
+			t.Fatalf("block %#x ends with length %d, starts with %d", typ, trailer, length)
+		}
+		found[typ] = append(found[typ], stream[8:length-4])
+		stream = stream[length:]
+	}
+	return found
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "default/web", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.UnixMicro(1_700_000_000_123_456)
+	frame := bytes.Repeat([]byte{0xab}, 21)
+	if err := w.WriteFrame(ts, frame, Outbound); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteStatistics(ts, 3); err != nil {
+		t.Fatal(err)
+	}
+	if w.Written() != int64(buf.Len()) {
+		t.Errorf("expected %d bytes written, got %d", buf.Len(), w.Written())
+	}
+
+	found := blocks(t, buf.Bytes())
+	if shb := found[blockSectionHeader]; len(shb) != 1 || binary.LittleEndian.Uint32(shb[0]) != byteOrderMagic {
+		t.Fatalf("expected a section header, got %x", shb)
+	}
+	idb := found[blockInterfaceDescription]
+	if len(idb) != 1 || binary.LittleEndian.Uint16(idb[0]) != linkTypeEthernet || binary.LittleEndian.Uint32(idb[0][4:]) != 16 {
+		t.Fatalf("expected an ethernet interface with the snap length, got %x", idb)
+	}
+	if !bytes.Contains(idb[0], []byte("default/web")) {
+		t.Error("expected the interface to be named")
+	}
+
+	epb := found[blockEnhancedPacket]
+	if len(epb) != 1 {
+		t.Fatalf("expected a packet, got %d", len(epb))
+	}
+	micros := uint64(binary.LittleEndian.Uint32(epb[0][4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[0][8:]))
+	if micros != uint64(ts.UnixMicro()) {
+		t.Errorf("expected timestamp %d, got %d", ts.UnixMicro(), micros)
+	}
+	if captured, original := binary.LittleEndian.Uint32(epb[0][12:]), binary.LittleEndian.Uint32(epb[0][16:]); captured != 16 || original != 21 {
+		t.Errorf("expected 16 of 21 bytes captured, got %d of %d", captured, original)
+	}
+	// the flags option follows the data padded to 16 bytes
+	if flags := binary.LittleEndian.Uint32(epb[0][20+16+4:]); Direction(flags) != Outbound {
+		t.Errorf("expected an outbound frame, got flags %d", flags)
+	}
+	if isb := found[blockInterfaceStatistics]; len(isb) != 1 {
+		t.Errorf("expected the statistics of the capture, got %d blocks", len(isb))
+	}
+}
@@ -0,0 +1,180 @@
+package sizing
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Annotation records the size of the virtual machine created for a pod.
+const Annotation = "macos.virtual-kubelet.io/effective-vm-size"
+
+// memoryAlignment is the granularity Virtualization.framework accepts for the
+// memory size of a virtual machine.
+const memoryAlignment = 1024 * 1024
+
+// Size is the hardware a virtual machine is created with.
+type Size struct {
+	CPUs   uint
+	Memory uint64
+}
+
+// String formats the size the way it is recorded in the pod annotation,
+// e.g. "cpu=4,memory=8Gi".
+func (s Size) String() string {
+	return fmt.Sprintf("cpu=%d,memory=%s", s.CPUs, resource.NewQuantity(int64(s.Memory), resource.BinarySI))
+}
+
+// ResourceList returns the resources the virtual machine takes on the host.
+func (s Size) ResourceList() v1.ResourceList {
+	return v1.ResourceList{
+		v1.ResourceCPU:    *resource.NewQuantity(int64(s.CPUs), resource.DecimalSI),
+		v1.ResourceMemory: *resource.NewQuantity(int64(s.Memory), resource.BinarySI),
+	}
+}
+
+// Limits bound the size of a virtual machine. They come from
+// Virtualization.framework and from the requirements of the VM bundle.
+type Limits struct {
+	MinCPUs   uint
+	MaxCPUs   uint
+	MinMemory uint64
+	MaxMemory uint64
+}
+
+// Policy turns pod resources into a virtual machine size.
+type Policy struct {
+	// Defaults is used for resources the pod neither requests nor limits.
+	Defaults Size
+	Limits   Limits
+}
+
+// Compute returns the size of the virtual machine backing pod.
+//
+// The limit of a resource is used when every container sets one, the
+// request otherwise, both including init containers and the pod overhead.
+// CPUs are rounded up to whole vCPUs and memory up to a whole MiB. Sizes
+// below the minimums are raised to them unless the pod limits the resource
+// below the minimum, in which case an error is returned, as it is when the
+// size exceeds the maximums.
+func (p Policy) Compute(pod *v1.Pod) (Size, error) {
+	requests := PodRequests(pod)
+	limits := PodLimits(pod)
+
+	size := p.Defaults
+	if q, ok := effective(v1.ResourceCPU, requests, limits); ok {
+		size.CPUs = uint((q.MilliValue() + 999) / 1000)
+	}
+	if q, ok := effective(v1.ResourceMemory, requests, limits); ok {
+		size.Memory = alignMemory(uint64(q.Value()))
+	}
+
+	if size.CPUs < p.Limits.MinCPUs {
+		if _, limited := limits[v1.ResourceCPU]; limited {
+			return Size{}, fmt.Errorf("cpu limit of %d vCPUs is below the minimum of %d", size.CPUs, p.Limits.MinCPUs)
+		}
+		size.CPUs = p.Limits.MinCPUs
+	}
+	if p.Limits.MaxCPUs > 0 && size.CPUs > p.Limits.MaxCPUs {
+		return Size{}, fmt.Errorf("%d vCPUs exceed the maximum of %d", size.CPUs, p.Limits.MaxCPUs)
+	}
+
+	if size.Memory < p.Limits.MinMemory {
+		if _, limited := limits[v1.ResourceMemory]; limited {
+			return Size{}, fmt.Errorf("memory limit of %d bytes is below the minimum of %d", size.Memory, p.Limits.MinMemory)
+		}
+		size.Memory = alignMemory(p.Limits.MinMemory)
+	}
+	if p.Limits.MaxMemory > 0 && size.Memory > p.Limits.MaxMemory {
+		return Size{}, fmt.Errorf("%d bytes of memory exceed the maximum of %d", size.Memory, p.Limits.MaxMemory)
+	}
+
+	return size, nil
+}
+
+// effective returns the limit of the resource if set, the request otherwise.
+func effective(name v1.ResourceName, requests, limits v1.ResourceList) (resource.Quantity, bool) {
+	if q, ok := limits[name]; ok && !q.IsZero() {
+		return q, true
+	}
+	if q, ok := requests[name]; ok && !q.IsZero() {
+		return q, true
+	}
+	return resource.Quantity{}, false
+}
+
+func alignMemory(memory uint64) uint64 {
+	return (memory + memoryAlignment - 1) / memoryAlignment * memoryAlignment
+}
+
+// PodRequests returns the cpu and memory requested by pod. Like the
+// scheduler, it takes the larger of the sum of the app containers and any
+// single init container, plus the pod overhead.
+func PodRequests(pod *v1.Pod) v1.ResourceList {
+	requests := v1.ResourceList{}
+	for _, c := range pod.Spec.Containers {
+		AddResources(requests, c.Resources.Requests)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		maxResources(requests, c.Resources.Requests)
+	}
+	AddResources(requests, pod.Spec.Overhead)
+	return requests
+}
+
+// PodLimits returns the cpu and memory limits of pod, computed like
+// PodRequests. A resource is only included when every container limits it.
+func PodLimits(pod *v1.Pod) v1.ResourceList {
+	limits := v1.ResourceList{}
+	for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		var total resource.Quantity
+		limited := len(pod.Spec.Containers) > 0
+		for _, c := range pod.Spec.Containers {
+			q, ok := c.Resources.Limits[name]
+			if !ok {
+				limited = false
+				break
+			}
+			total.Add(q)
+		}
+		if !limited {
+			continue
+		}
+		for _, c := range pod.Spec.InitContainers {
+			if q, ok := c.Resources.Limits[name]; ok && q.Cmp(total) > 0 {
+				total = q.DeepCopy()
+			}
+		}
+		if q, ok := pod.Spec.Overhead[name]; ok {
+			total.Add(q)
+		}
+		limits[name] = total
+	}
+	return limits
+}
+
+// AddResources adds the cpu and memory of add to list.
+func AddResources(list, add v1.ResourceList) {
+	for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		q, ok := add[name]
+		if !ok {
+			continue
+		}
+		v := list[name]
+		v.Add(q)
+		list[name] = v
+	}
+}
+
+func maxResources(list, other v1.ResourceList) {
+	for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		q, ok := other[name]
+		if !ok {
+			continue
+		}
+		if v, ok := list[name]; !ok || q.Cmp(v) > 0 {
+			list[name] = q.DeepCopy()
+		}
+	}
+}
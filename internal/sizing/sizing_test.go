@@ -0,0 +1,164 @@
+package sizing
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	mib = 1024 * 1024
+	gib = 1024 * mib
+)
+
+var testPolicy = Policy{
+	Defaults: Size{CPUs: 2, Memory: 4 * gib},
+	Limits:   Limits{MinCPUs: 1, MaxCPUs: 8, MinMemory: 2 * gib, MaxMemory: 16 * gib},
+}
+
+func podWithResources(containers ...v1.ResourceRequirements) *v1.Pod {
+	pod := &v1.Pod{}
+	for _, r := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Resources: r})
+	}
+	return pod
+}
+
+func list(cpu, memory string) v1.ResourceList {
+	rl := v1.ResourceList{}
+	if cpu != "" {
+		rl[v1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		rl[v1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return rl
+}
+
+func TestCompute(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pod     *v1.Pod
+		want    Size
+		wantErr bool
+	}{
+		{
+			name: "defaults without resources",
+			pod:  podWithResources(v1.ResourceRequirements{}),
+			want: Size{CPUs: 2, Memory: 4 * gib},
+		},
+		{
+			name: "millicores round up to whole vCPUs",
+			pod:  podWithResources(v1.ResourceRequirements{Requests: list("500m", "")}),
+			want: Size{CPUs: 1, Memory: 4 * gib},
+		},
+		{
+			name: "fractional memory",
+			pod:  podWithResources(v1.ResourceRequirements{Requests: list("", "3.5Gi")}),
+			want: Size{CPUs: 2, Memory: 3584 * mib},
+		},
+		{
+			name: "decimal memory is aligned to a MiB",
+			pod:  podWithResources(v1.ResourceRequirements{Requests: list("", "3G")}),
+			want: Size{CPUs: 2, Memory: 2862 * mib},
+		},
+		{
+			name: "requests are summed across containers",
+			pod: podWithResources(
+				v1.ResourceRequirements{Requests: list("1500m", "2Gi")},
+				v1.ResourceRequirements{Requests: list("1", "1Gi")},
+			),
+			want: Size{CPUs: 3, Memory: 3 * gib},
+		},
+		{
+			name: "limits win over requests",
+			pod:  podWithResources(v1.ResourceRequirements{Requests: list("1", "2Gi"), Limits: list("4", "8Gi")}),
+			want: Size{CPUs: 4, Memory: 8 * gib},
+		},
+		{
+			name: "limits are ignored unless every container sets them",
+			pod: podWithResources(
+				v1.ResourceRequirements{Requests: list("1", "2Gi"), Limits: list("4", "8Gi")},
+				v1.ResourceRequirements{Requests: list("1", "1Gi")},
+			),
+			want: Size{CPUs: 2, Memory: 3 * gib},
+		},
+		{
+			name: "small requests are raised to the minimums",
+			pod:  podWithResources(v1.ResourceRequirements{Requests: list("100m", "512Mi")}),
+			want: Size{CPUs: 1, Memory: 2 * gib},
+		},
+		{
+			name:    "limits below the minimums are rejected",
+			pod:     podWithResources(v1.ResourceRequirements{Limits: list("1", "1Gi")}),
+			wantErr: true,
+		},
+		{
+			name:    "cpu above the maximum is rejected",
+			pod:     podWithResources(v1.ResourceRequirements{Requests: list("16", "")}),
+			wantErr: true,
+		},
+		{
+			name:    "memory above the maximum is rejected",
+			pod:     podWithResources(v1.ResourceRequirements{Requests: list("", "32Gi")}),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := testPolicy.Compute(tc.pod)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got size %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestComputeIncludesOverhead(t *testing.T) {
+	pod := podWithResources(v1.ResourceRequirements{Requests: list("1", "2Gi")})
+	pod.Spec.Overhead = list("500m", "512Mi")
+
+	got, err := testPolicy.Compute(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Size{CPUs: 2, Memory: 2*gib + 512*mib}); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestPodRequests(t *testing.T) {
+	pod := podWithResources(
+		v1.ResourceRequirements{Requests: list("500m", "1Gi")},
+		v1.ResourceRequirements{Requests: list("500m", "")},
+	)
+	pod.Spec.InitContainers = []v1.Container{
+		{Resources: v1.ResourceRequirements{Requests: list("2", "512Mi")}},
+	}
+	pod.Spec.Overhead = list("", "256Mi")
+
+	requests := PodRequests(pod)
+	if cpu := requests[v1.ResourceCPU]; cpu.Cmp(resource.MustParse("2")) != 0 {
+		t.Errorf("expected cpu request of 2, got %s", cpu.String())
+	}
+	if memory := requests[v1.ResourceMemory]; memory.Cmp(resource.MustParse("1280Mi")) != 0 {
+		t.Errorf("expected memory request of 1280Mi, got %s", memory.String())
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	if got, want := (Size{CPUs: 4, Memory: 8 * gib}).String(), "cpu=4,memory=8Gi"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build darwin
+// +build darwin
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// cloneFile clones src to dst with clonefile(2), so the copy takes no space
+// until either file is written.
+func cloneFile(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
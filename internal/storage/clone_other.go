@@ -0,0 +1,29 @@
+//go:build !darwin
+// +build !darwin
+
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// cloneFile copies src to dst, which must not exist.
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,99 @@
+// Package storage provisions PersistentVolumes backed by disk images on the
+// host, attached to the virtual machines of the pods claiming them as
+// additional virtio block devices.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ErrUnsupportedVolume is returned for a claim bound to a volume that is not
+// a disk image of this host.
+var ErrUnsupportedVolume = errors.New("volume is not a disk image provisioned on this node")
+
+// Claims returns the PersistentVolumeClaims of pods and the
+// PersistentVolumes they are bound to.
+type Claims interface {
+	GetClaim(namespace, name string) (*v1.PersistentVolumeClaim, error)
+	GetVolume(name string) (*v1.PersistentVolume, error)
+}
+
+// Image returns the path and size of the disk image of the volume bound to
+// the claim name in namespace. Images live in disksDir.
+func Image(claims Claims, namespace, name, disksDir string) (string, int64, error) {
+	claim, err := claims.GetClaim(namespace, name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", 0, fmt.Errorf("persistentvolumeclaim %q not found", name)
+		}
+		return "", 0, err
+	}
+	if claim.Spec.VolumeName == "" || claim.Status.Phase != v1.ClaimBound {
+		return "", 0, fmt.Errorf("persistentvolumeclaim %q is not bound yet", name)
+	}
+	pv, err := claims.GetVolume(claim.Spec.VolumeName)
+	if err != nil {
+		return "", 0, fmt.Errorf("persistentvolume %q: %w", claim.Spec.VolumeName, err)
+	}
+
+	if pv.Annotations[AnnotationProvisionedBy] != ProvisionerName || pv.Spec.Local == nil || !within(pv.Spec.Local.Path, disksDir) {
+		return "", 0, fmt.Errorf("persistentvolume %q: %w", pv.Name, ErrUnsupportedVolume)
+	}
+	size := pv.Spec.Capacity[v1.ResourceStorage]
+	return pv.Spec.Local.Path, size.Value(), nil
+}
+
+// CreateDisk creates the disk image path of size bytes unless it exists.
+// The image is sparse: it only takes the space the guest writes.
+func CreateDisk(path string, size int64) (created bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// CloneDisk copies the disk image src to dst, which must not exist, and grows
+// the copy to size bytes when it is smaller. The copy shares the blocks of
+// src until they are written where the file system supports clones, e.g.
+// APFS. src is never modified.
+func CloneDisk(src, dst string, size int64) error {
+	if err := cloneFile(src, dst); err != nil {
+		return err
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if info.Size() < size {
+		if err := os.Truncate(dst, size); err != nil {
+			os.Remove(dst)
+			return err
+		}
+	}
+	return nil
+}
+
+// within reports whether path is a file directly in dir.
+func within(path, dir string) bool {
+	return filepath.IsAbs(path) && filepath.Dir(path) == filepath.Clean(dir) && !strings.HasPrefix(filepath.Base(path), ".")
+}
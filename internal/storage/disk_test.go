@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestCreateDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disks", "pvc-1.img")
+
+	created, err := CreateDisk(path, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("expected the image to be created")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<30 {
+		t.Errorf("expected a 1Gi image, got %d bytes", info.Size())
+	}
+
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	created, err = CreateDisk(path, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("expected the existing image to be kept")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Errorf("expected the content of the image to be kept, got %q", data)
+	}
+}
+
+func TestCloneDisk(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "Disk.img")
+	if err := os.WriteFile(src, []byte("boot"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "pod", "Disk.img")
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloneDisk(src, dst, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<20 {
+		t.Errorf("expected the clone to be grown to 1Mi, got %d bytes", info.Size())
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "boot" {
+		t.Errorf("expected the source image to be left untouched, got %q", data)
+	}
+
+	if err := CloneDisk(src, dst, 1<<20); err == nil {
+		t.Error("expected an existing clone not to be overwritten")
+	}
+}
+
+// fakeClaims serves claims and volumes from maps keyed by name.
+type fakeClaims struct {
+	claims  map[string]*v1.PersistentVolumeClaim
+	volumes map[string]*v1.PersistentVolume
+}
+
+func (f fakeClaims) GetClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	if c, ok := f.claims[name]; ok && c.Namespace == namespace {
+		return c, nil
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("persistentvolumeclaims"), name)
+}
+
+func (f fakeClaims) GetVolume(name string) (*v1.PersistentVolume, error) {
+	if pv, ok := f.volumes[name]; ok {
+		return pv, nil
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("persistentvolumes"), name)
+}
+
+func TestImage(t *testing.T) {
+	disksDir := t.TempDir()
+	claim := testClaim()
+	pv, err := NewVolume(claim, testClass(), "node", disksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := fakeClaims{
+		claims:  map[string]*v1.PersistentVolumeClaim{claim.Name: claim},
+		volumes: map[string]*v1.PersistentVolume{pv.Name: pv},
+	}
+
+	if _, _, err := Image(claims, "default", "missing", disksDir); err == nil {
+		t.Error("expected a missing claim to fail")
+	}
+	if _, _, err := Image(claims, "default", claim.Name, disksDir); err == nil {
+		t.Error("expected an unbound claim to fail")
+	}
+
+	claim.Spec.VolumeName = pv.Name
+	claim.Status.Phase = v1.ClaimBound
+	path, size, err := Image(claims, "default", claim.Name, disksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(disksDir, pv.Name+".img") || size != 1<<30 {
+		t.Errorf("expected the 1Gi image of %s, got %s of %d bytes", pv.Name, path, size)
+	}
+
+	for name, mutate := range map[string]func(*v1.PersistentVolume){
+		"other provisioner": func(pv *v1.PersistentVolume) { pv.Annotations = nil },
+		"outside disks":     func(pv *v1.PersistentVolume) { pv.Spec.Local.Path = "/var/lib/data.img" },
+		"not local":         func(pv *v1.PersistentVolume) { pv.Spec.Local = nil },
+	} {
+		other := pv.DeepCopy()
+		mutate(other)
+		claims.volumes[pv.Name] = other
+		if _, _, err := Image(claims, "default", claim.Name, disksDir); !errors.Is(err, ErrUnsupportedVolume) {
+			t.Errorf("%s: expected ErrUnsupportedVolume, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	storagev1listers "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+)
+
+// ProvisionerName is the provisioner of the StorageClasses whose claims are
+// provisioned as disk images. The StorageClasses must use the
+// WaitForFirstConsumer binding mode so that the node of the pod is known.
+const ProvisionerName = "macos.virtual-kubelet.io/local-disk"
+
+// Annotations set on claims and volumes by the scheduler and provisioners.
+const (
+	AnnotationSelectedNode  = "volume.kubernetes.io/selected-node"
+	AnnotationProvisionedBy = "pv.kubernetes.io/provisioned-by"
+)
+
+// Reasons of the events recorded on claims.
+const (
+	ProvisioningSucceeded = "ProvisioningSucceeded"
+	ProvisioningFailed    = "ProvisioningFailed"
+)
+
+// imageExt is the extension of the disk images.
+const imageExt = ".img"
+
+// Provisioner binds the claims of its StorageClasses scheduled on its node
+// to volumes backed by disk images, and deletes the images of the released
+// volumes whose reclaim policy is Delete.
+type Provisioner struct {
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	node     string
+	disksDir string
+
+	claims  corev1listers.PersistentVolumeClaimLister
+	volumes corev1listers.PersistentVolumeLister
+	classes storagev1listers.StorageClassLister
+	synced  []cache.InformerSynced
+	changed chan struct{}
+}
+
+// NewProvisioner returns a provisioner of the node writing images to
+// disksDir. factory must be started for the provisioner to run.
+func NewProvisioner(factory informers.SharedInformerFactory, client kubernetes.Interface, recorder record.EventRecorder, node, disksDir string) (*Provisioner, error) {
+	p := &Provisioner{
+		client:   client,
+		recorder: recorder,
+		node:     node,
+		disksDir: disksDir,
+		claims:   factory.Core().V1().PersistentVolumeClaims().Lister(),
+		volumes:  factory.Core().V1().PersistentVolumes().Lister(),
+		classes:  factory.Storage().V1().StorageClasses().Lister(),
+		changed:  make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { p.notify() },
+		UpdateFunc: func(interface{}, interface{}) { p.notify() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		factory.Core().V1().PersistentVolumeClaims().Informer(),
+		factory.Core().V1().PersistentVolumes().Informer(),
+		factory.Storage().V1().StorageClasses().Informer(),
+	} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, err
+		}
+		p.synced = append(p.synced, informer.HasSynced)
+	}
+	return p, nil
+}
+
+func (p *Provisioner) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// GetClaim returns the claim name in namespace.
+func (p *Provisioner) GetClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	return p.claims.PersistentVolumeClaims(namespace).Get(name)
+}
+
+// GetVolume returns the volume name.
+func (p *Provisioner) GetVolume(name string) (*v1.PersistentVolume, error) {
+	return p.volumes.Get(name)
+}
+
+// Run provisions and deletes volumes when claims or volumes change, and
+// every period, until ctx is done.
+func (p *Provisioner) Run(ctx context.Context, period time.Duration) error {
+	if !cache.WaitForCacheSync(ctx.Done(), p.synced...) {
+		return fmt.Errorf("failed to sync the storage informers: %w", ctx.Err())
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		if err := p.reconcile(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("Failed to reconcile local volumes")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) reconcile(ctx context.Context) error {
+	claims, err := p.claims.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		if !p.shouldProvision(claim) {
+			continue
+		}
+		if err := p.provision(ctx, claim); err != nil {
+			log.G(ctx).WithError(err).WithField("claim", claim.Namespace+"/"+claim.Name).Warn("Failed to provision volume")
+			p.recorder.Event(claim, v1.EventTypeWarning, ProvisioningFailed, err.Error())
+		}
+	}
+
+	volumes, err := p.volumes.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, pv := range volumes {
+		if !p.shouldDelete(pv) {
+			continue
+		}
+		if err := p.delete(ctx, pv); err != nil {
+			log.G(ctx).WithError(err).WithField("volume", pv.Name).Warn("Failed to delete volume")
+		}
+	}
+	return nil
+}
+
+// shouldProvision reports whether claim waits for a volume of this
+// provisioner on this node.
+func (p *Provisioner) shouldProvision(claim *v1.PersistentVolumeClaim) bool {
+	if claim.Spec.VolumeName != "" || claim.DeletionTimestamp != nil || claim.Annotations[AnnotationSelectedNode] != p.node {
+		return false
+	}
+	if claim.Spec.StorageClassName == nil {
+		return false
+	}
+	class, err := p.classes.Get(*claim.Spec.StorageClassName)
+	if err != nil || class.Provisioner != ProvisionerName {
+		return false
+	}
+	// the volume is created, the claim is not bound yet
+	if _, err := p.volumes.Get(VolumeName(claim)); err == nil {
+		return false
+	}
+	return true
+}
+
+func (p *Provisioner) provision(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
+	class, err := p.classes.Get(*claim.Spec.StorageClassName)
+	if err != nil {
+		return err
+	}
+	pv, err := NewVolume(claim, class, p.node, p.disksDir)
+	if err != nil {
+		return err
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create persistentvolume %s: %w", pv.Name, err)
+	}
+	log.G(ctx).WithField("claim", claim.Namespace+"/"+claim.Name).WithField("volume", pv.Name).Info("Provisioned volume")
+	p.recorder.Eventf(claim, v1.EventTypeNormal, ProvisioningSucceeded, "Successfully provisioned volume %s", pv.Name)
+	return nil
+}
+
+// shouldDelete reports whether pv is a released volume of this node to
+// delete.
+func (p *Provisioner) shouldDelete(pv *v1.PersistentVolume) bool {
+	return pv.Annotations[AnnotationProvisionedBy] == ProvisionerName &&
+		pv.Spec.Local != nil && within(pv.Spec.Local.Path, p.disksDir) &&
+		pv.Status.Phase == v1.VolumeReleased &&
+		pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete &&
+		pv.DeletionTimestamp == nil
+}
+
+func (p *Provisioner) delete(ctx context.Context, pv *v1.PersistentVolume) error {
+	if err := os.Remove(pv.Spec.Local.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove disk image: %w", err)
+	}
+	if err := p.client.CoreV1().PersistentVolumes().Delete(ctx, pv.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	log.G(ctx).WithField("volume", pv.Name).Info("Deleted volume")
+	return nil
+}
+
+// VolumeName returns the name of the volume provisioned for claim.
+func VolumeName(claim *v1.PersistentVolumeClaim) string {
+	return "pvc-" + string(claim.UID)
+}
+
+// NewVolume returns the volume provisioned for claim of class, bound to it
+// and pinned to node. Its disk image in disksDir is created when a pod
+// first uses it.
+func NewVolume(claim *v1.PersistentVolumeClaim, class *storagev1.StorageClass, node, disksDir string) (*v1.PersistentVolume, error) {
+	if claim.Spec.VolumeMode != nil && *claim.Spec.VolumeMode == v1.PersistentVolumeBlock {
+		return nil, fmt.Errorf("block volumes are not supported, only filesystem ones")
+	}
+	size, ok := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	if !ok || size.Sign() <= 0 {
+		return nil, fmt.Errorf("the claim must request storage")
+	}
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if class.ReclaimPolicy != nil {
+		reclaimPolicy = *class.ReclaimPolicy
+	}
+	volumeMode := v1.PersistentVolumeFilesystem
+
+	name := VolumeName(claim)
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{AnnotationProvisionedBy: ProvisionerName},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: size},
+			AccessModes:                   claim.Spec.AccessModes,
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			StorageClassName:              class.Name,
+			MountOptions:                  class.MountOptions,
+			VolumeMode:                    &volumeMode,
+			ClaimRef: &v1.ObjectReference{
+				Kind:       "PersistentVolumeClaim",
+				APIVersion: "v1",
+				Namespace:  claim.Namespace,
+				Name:       claim.Name,
+				UID:        claim.UID,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				Local: &v1.LocalVolumeSource{Path: filepath.Join(disksDir, name+imageExt)},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{{
+						MatchExpressions: []v1.NodeSelectorRequirement{{
+							Key:      v1.LabelHostname,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{node},
+						}},
+					}},
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func testClass() *storagev1.StorageClass {
+	retain := v1.PersistentVolumeReclaimRetain
+	return &storagev1.StorageClass{
+		ObjectMeta:    metav1.ObjectMeta{Name: "local-disk"},
+		Provisioner:   ProvisionerName,
+		ReclaimPolicy: &retain,
+	}
+}
+
+func testClaim() *v1.PersistentVolumeClaim {
+	class := "local-disk"
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "data-web-0",
+			UID:         "6f1c2b5e",
+			Annotations: map[string]string{AnnotationSelectedNode: "node"},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			StorageClassName: &class,
+			Resources:        v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")}},
+		},
+	}
+}
+
+func TestNewVolume(t *testing.T) {
+	pv, err := NewVolume(testClaim(), testClass(), "node", "/disks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Name != "pvc-6f1c2b5e" || pv.Annotations[AnnotationProvisionedBy] != ProvisionerName {
+		t.Errorf("unexpected metadata %+v", pv.ObjectMeta)
+	}
+	if pv.Spec.Local == nil || pv.Spec.Local.Path != "/disks/pvc-6f1c2b5e.img" {
+		t.Errorf("expected a local volume in the disks directory, got %+v", pv.Spec.PersistentVolumeSource)
+	}
+	if size := pv.Spec.Capacity[v1.ResourceStorage]; size.String() != "1Gi" {
+		t.Errorf("expected the requested capacity, got %s", size.String())
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		t.Errorf("expected the reclaim policy of the class, got %s", pv.Spec.PersistentVolumeReclaimPolicy)
+	}
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Name != "data-web-0" || pv.Spec.ClaimRef.UID != "6f1c2b5e" {
+		t.Errorf("expected the volume to be bound to the claim, got %+v", pv.Spec.ClaimRef)
+	}
+	if terms := pv.Spec.NodeAffinity.Required.NodeSelectorTerms; len(terms) != 1 || terms[0].MatchExpressions[0].Values[0] != "node" {
+		t.Errorf("expected the volume to be pinned to the node, got %+v", terms)
+	}
+
+	block := testClaim()
+	mode := v1.PersistentVolumeBlock
+	block.Spec.VolumeMode = &mode
+	if _, err := NewVolume(block, testClass(), "node", "/disks"); err == nil {
+		t.Error("expected a block claim to be rejected")
+	}
+	empty := testClaim()
+	empty.Spec.Resources.Requests = nil
+	if _, err := NewVolume(empty, testClass(), "node", "/disks"); err == nil {
+		t.Error("expected a claim without a storage request to be rejected")
+	}
+}
+
+// newTestProvisioner returns a provisioner whose listers serve objects,
+// without running the informers.
+func newTestProvisioner(t *testing.T, disksDir string, objects ...interface{}) (*Provisioner, *fake.Clientset, *record.FakeRecorder) {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	recorder := record.NewFakeRecorder(10)
+	p, err := NewProvisioner(factory, client, recorder, "node", disksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objects {
+		var indexer interface{ Add(interface{}) error }
+		switch obj.(type) {
+		case *v1.PersistentVolumeClaim:
+			indexer = factory.Core().V1().PersistentVolumeClaims().Informer().GetIndexer()
+		case *v1.PersistentVolume:
+			indexer = factory.Core().V1().PersistentVolumes().Informer().GetIndexer()
+		case *storagev1.StorageClass:
+			indexer = factory.Storage().V1().StorageClasses().Informer().GetIndexer()
+		}
+		if err := indexer.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p, client, recorder
+}
+
+func TestProvisionerProvisions(t *testing.T) {
+	ctx := context.Background()
+	other := testClaim()
+	other.Name, other.UID = "data-web-1", "other"
+	other.Annotations[AnnotationSelectedNode] = "other-node"
+	foreign := testClaim()
+	foreign.Name, foreign.UID = "data-db-0", "foreign"
+	foreignClass := "standard"
+	foreign.Spec.StorageClassName = &foreignClass
+
+	p, client, recorder := newTestProvisioner(t, "/disks", testClass(), testClaim(), other, foreign,
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "standard"}, Provisioner: "kubernetes.io/no-provisioner"})
+	if err := p.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes.Items) != 1 || volumes.Items[0].Name != "pvc-6f1c2b5e" {
+		t.Fatalf("expected only the claim of the node and class to be provisioned, got %+v", volumes.Items)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ProvisioningSucceeded) {
+		t.Errorf("expected a %s event, got %q", ProvisioningSucceeded, event)
+	}
+}
+
+func TestProvisionerRecordsFailures(t *testing.T) {
+	claim := testClaim()
+	claim.Spec.Resources.Requests = nil
+	p, _, recorder := newTestProvisioner(t, "/disks", testClass(), claim)
+	if err := p.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ProvisioningFailed) {
+		t.Errorf("expected a %s event, got %q", ProvisioningFailed, event)
+	}
+}
+
+func TestProvisionerDeletesReleasedVolumes(t *testing.T) {
+	ctx := context.Background()
+	disksDir := t.TempDir()
+	claim := testClaim()
+
+	class := testClass()
+	deleteVolume := v1.PersistentVolumeReclaimDelete
+	class.ReclaimPolicy = &deleteVolume
+	released, err := NewVolume(claim, class, "node", disksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released.Status.Phase = v1.VolumeReleased
+	retained, err := NewVolume(claim, testClass(), "node", disksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retained.Name = "pvc-retained"
+	retained.Spec.Local.Path = filepath.Join(disksDir, retained.Name+".img")
+	retained.Status.Phase = v1.VolumeReleased
+	for _, pv := range []*v1.PersistentVolume{released, retained} {
+		if _, err := CreateDisk(pv.Spec.Local.Path, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, client, _ := newTestProvisioner(t, disksDir, released, retained)
+	for _, pv := range []*v1.PersistentVolume{released, retained} {
+		if _, err := client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(released.Spec.Local.Path); !os.IsNotExist(err) {
+		t.Errorf("expected the released image to be removed, got %v", err)
+	}
+	if _, err := client.CoreV1().PersistentVolumes().Get(ctx, released.Name, metav1.GetOptions{}); err == nil {
+		t.Error("expected the released volume to be deleted")
+	}
+	if _, err := os.Stat(retained.Spec.Local.Path); err != nil {
+		t.Errorf("expected the retained image to be kept: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Package token requests the bound service account tokens of pods from the
+// TokenRequest API and caches them until they need to be refreshed, like
+// the token manager of the kubelet.
+package token
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxTTL is the age after which a token is refreshed whatever its
+// expiration.
+const maxTTL = 24 * time.Hour
+
+// requestTimeout bounds a TokenRequest.
+const requestTimeout = 10 * time.Second
+
+// Manager caches the tokens of service accounts by request.
+type Manager struct {
+	client kubernetes.Interface
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]*authenticationv1.TokenRequest
+}
+
+// NewManager returns a Manager requesting tokens with client.
+func NewManager(client kubernetes.Interface) *Manager {
+	return &Manager{
+		client: client,
+		now:    time.Now,
+		cache:  map[string]*authenticationv1.TokenRequest{},
+	}
+}
+
+// GetServiceAccountToken returns a token of the service account name in
+// namespace for tr. A cached token is returned until 80% of its lifetime, or
+// 24 hours, have passed; it is still returned if the refresh fails while it
+// is valid.
+func (m *Manager) GetServiceAccountToken(namespace, name string, tr *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error) {
+	key := cacheKey(namespace, name, tr)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanupLocked()
+	cached, ok := m.cache[key]
+	if ok && !m.requiresRefresh(cached) {
+		return cached, nil
+	}
+
+	if m.client == nil {
+		return nil, fmt.Errorf("no client to request a token of serviceaccount %s/%s", namespace, name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := m.client.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, tr, metav1.CreateOptions{})
+	if err != nil {
+		if ok && !m.expired(cached) {
+			return cached, nil
+		}
+		return nil, fmt.Errorf("failed to request a token of serviceaccount %s/%s: %w", namespace, name, err)
+	}
+	m.cache[key] = resp
+	return resp, nil
+}
+
+// DeleteServiceAccountToken forgets the tokens bound to the pod uid.
+func (m *Manager) DeleteServiceAccountToken(uid types.UID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, tr := range m.cache {
+		if ref := tr.Spec.BoundObjectRef; ref != nil && ref.UID == uid {
+			delete(m.cache, key)
+		}
+	}
+}
+
+// requiresRefresh reports whether tr is older than 80% of its lifetime or
+// than maxTTL.
+func (m *Manager) requiresRefresh(tr *authenticationv1.TokenRequest) bool {
+	if tr.Spec.ExpirationSeconds == nil {
+		return true
+	}
+	now := m.now()
+	exp := tr.Status.ExpirationTimestamp.Time
+	issued := exp.Add(-time.Duration(*tr.Spec.ExpirationSeconds) * time.Second)
+	lifetime := exp.Sub(issued)
+	return now.After(issued.Add(lifetime*8/10)) || now.After(issued.Add(maxTTL))
+}
+
+func (m *Manager) expired(tr *authenticationv1.TokenRequest) bool {
+	return !m.now().Before(tr.Status.ExpirationTimestamp.Time)
+}
+
+// cleanupLocked drops the expired tokens, e.g. of deleted pods.
+func (m *Manager) cleanupLocked() {
+	for key, tr := range m.cache {
+		if m.expired(tr) {
+			delete(m.cache, key)
+		}
+	}
+}
+
+// cacheKey identifies the token of the service account name in namespace
+// requested with tr.
+func cacheKey(namespace, name string, tr *authenticationv1.TokenRequest) string {
+	var exp string
+	if tr.Spec.ExpirationSeconds != nil {
+		exp = strconv.FormatInt(*tr.Spec.ExpirationSeconds, 10)
+	}
+	var ref string
+	if r := tr.Spec.BoundObjectRef; r != nil {
+		ref = r.Kind + "/" + r.Name + "/" + string(r.UID)
+	}
+	return strings.Join([]string{namespace, name, strings.Join(tr.Spec.Audiences, ","), exp, ref}, "|")
+}
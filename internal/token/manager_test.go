@@ -0,0 +1,99 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestManager returns a Manager whose tokens are issued at the time of
+// the returned clock, numbered by request. Requests fail while *fail is set.
+func newTestManager() (*Manager, *time.Time, *int, *bool) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	requests := 0
+	fail := false
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		requests++
+		tr := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenRequest).DeepCopy()
+		tr.Status.Token = fmt.Sprintf("token-%d", requests)
+		tr.Status.ExpirationTimestamp = metav1.NewTime(now.Add(time.Duration(*tr.Spec.ExpirationSeconds) * time.Second))
+		return true, tr, nil
+	})
+	m := NewManager(client)
+	m.now = func() time.Time { return now }
+	return m, &now, &requests, &fail
+}
+
+func testRequest(uid string) *authenticationv1.TokenRequest {
+	expiration := int64(3600)
+	return &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			ExpirationSeconds: &expiration,
+			BoundObjectRef:    &authenticationv1.BoundObjectReference{Kind: "Pod", Name: "runner", UID: types.UID("pod-" + uid)},
+		},
+	}
+}
+
+func TestGetServiceAccountTokenRefreshes(t *testing.T) {
+	m, now, requests, fail := newTestManager()
+
+	tr, err := m.GetServiceAccountToken("ci", "default", testRequest("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status.Token != "token-1" {
+		t.Errorf("expected a new token, got %q", tr.Status.Token)
+	}
+
+	*now = now.Add(30 * time.Minute)
+	if tr, _ = m.GetServiceAccountToken("ci", "default", testRequest("1")); tr.Status.Token != "token-1" || *requests != 1 {
+		t.Errorf("expected the cached token before 80%% of its lifetime, got %q after %d requests", tr.Status.Token, *requests)
+	}
+	if tr, _ = m.GetServiceAccountToken("ci", "builder", testRequest("1")); tr.Status.Token != "token-2" {
+		t.Errorf("expected another service account to get its own token, got %q", tr.Status.Token)
+	}
+
+	*now = now.Add(20 * time.Minute)
+	*fail = true
+	if tr, err = m.GetServiceAccountToken("ci", "default", testRequest("1")); err != nil || tr.Status.Token != "token-1" {
+		t.Errorf("expected the valid token to be kept when the refresh fails, got %v, %v", tr, err)
+	}
+	*fail = false
+	if tr, _ = m.GetServiceAccountToken("ci", "default", testRequest("1")); tr.Status.Token != "token-3" {
+		t.Errorf("expected the token to be refreshed after 80%% of its lifetime, got %q", tr.Status.Token)
+	}
+
+	*now = now.Add(2 * time.Hour)
+	*fail = true
+	if _, err := m.GetServiceAccountToken("ci", "default", testRequest("1")); err == nil {
+		t.Error("expected an expired token not to be returned")
+	}
+}
+
+func TestDeleteServiceAccountToken(t *testing.T) {
+	m, _, requests, _ := newTestManager()
+	for _, uid := range []string{"1", "2"} {
+		if _, err := m.GetServiceAccountToken("ci", "default", testRequest(uid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.DeleteServiceAccountToken("pod-1")
+	if _, err := m.GetServiceAccountToken("ci", "default", testRequest("2")); err != nil || *requests != 2 {
+		t.Errorf("expected the token of the other pod to be kept, got %v after %d requests", err, *requests)
+	}
+	if _, err := m.GetServiceAccountToken("ci", "default", testRequest("1")); err != nil || *requests != 3 {
+		t.Errorf("expected the token of the deleted pod to be requested again, got %v after %d requests", err, *requests)
+	}
+}
@@ -0,0 +1,224 @@
+package vmclass
+
+import (
+	"fmt"
+	"path"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+// Annotation selects the MacOSVMClass of a pod by name.
+const Annotation = spec.AnnotationPrefix + "vm-class"
+
+// Kind is the kind of the MacOSVMClass custom resource.
+const Kind = "MacOSVMClass"
+
+// GroupVersionResource identifies the cluster-scoped MacOSVMClass custom resource.
+var GroupVersionResource = schema.GroupVersionResource{
+	Group:    "macos.virtual-kubelet.io",
+	Version:  "v1alpha1",
+	Resource: "macosvmclasses",
+}
+
+// MacOSVMClass is a named set of virtual machine settings pods refer to
+// instead of repeating the VM annotations.
+type MacOSVMClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MacOSVMClassSpec `json:"spec"`
+}
+
+// MacOSVMClassSpec holds the settings of a MacOSVMClass. Unset fields keep
+// the value of the provider configuration.
+type MacOSVMClassSpec struct {
+	// CPUs is the number of vCPUs of a pod that does not request cpu.
+	CPUs int64 `json:"cpus,omitempty"`
+	// Memory is the memory of a pod that does not request memory.
+	Memory *resource.Quantity `json:"memory,omitempty"`
+	// Disk is the minimum size of the boot disk. Pods boot from their own
+	// grown clone of the disk image of the bundle when it is smaller.
+	Disk    *resource.Quantity `json:"disk,omitempty"`
+	Display *Display           `json:"display,omitempty"`
+	Network *Network           `json:"network,omitempty"`
+	Devices *Devices           `json:"devices,omitempty"`
+	// AllowedImages restricts the container images of the pods using the
+	// class. Entries are path.Match patterns, e.g. "ghcr.io/acme/*". All
+	// images are allowed when empty.
+	AllowedImages []string `json:"allowedImages,omitempty"`
+}
+
+// Display is the graphics display of the virtual machine.
+type Display struct {
+	Width         int64 `json:"width"`
+	Height        int64 `json:"height"`
+	PixelsPerInch int64 `json:"pixelsPerInch,omitempty"`
+}
+
+// Network is the network attachment of the virtual machine.
+type Network struct {
+	Mode      spec.NetworkMode `json:"mode"`
+	Interface string           `json:"interface,omitempty"`
+}
+
+// Devices selects the optional devices of the virtual machine.
+type Devices struct {
+	Audio    *bool `json:"audio,omitempty"`
+	Keyboard *bool `json:"keyboard,omitempty"`
+	Pointing *bool `json:"pointing,omitempty"`
+}
+
+// FromUnstructured converts a MacOSVMClass read by the dynamic client.
+func FromUnstructured(u *unstructured.Unstructured) (*MacOSVMClass, error) {
+	class := &MacOSVMClass{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), class); err != nil {
+		return nil, fmt.Errorf("failed to decode %s %s: %w", Kind, u.GetName(), err)
+	}
+	return class, nil
+}
+
+// Validate returns the problems of class.
+func Validate(class *MacOSVMClass) field.ErrorList {
+	var errs field.ErrorList
+	p := field.NewPath("spec")
+	s := class.Spec
+
+	if s.CPUs < 0 {
+		errs = append(errs, field.Invalid(p.Child("cpus"), s.CPUs, "must not be negative"))
+	}
+	if s.Memory != nil && s.Memory.Sign() <= 0 {
+		errs = append(errs, field.Invalid(p.Child("memory"), s.Memory.String(), "must be greater than 0"))
+	}
+	if s.Disk != nil && s.Disk.Sign() <= 0 {
+		errs = append(errs, field.Invalid(p.Child("disk"), s.Disk.String(), "must be greater than 0"))
+	}
+	if d := s.Display; d != nil {
+		if d.Width <= 0 {
+			errs = append(errs, field.Invalid(p.Child("display", "width"), d.Width, "must be greater than 0"))
+		}
+		if d.Height <= 0 {
+			errs = append(errs, field.Invalid(p.Child("display", "height"), d.Height, "must be greater than 0"))
+		}
+		if d.PixelsPerInch < 0 {
+			errs = append(errs, field.Invalid(p.Child("display", "pixelsPerInch"), d.PixelsPerInch, "must not be negative"))
+		}
+	}
+	if n := s.Network; n != nil {
+		switch n.Mode {
+		case spec.NetworkModeBridged:
+		case spec.NetworkModeNAT, spec.NetworkModeIsolated, spec.NetworkModeUserspace:
+			if n.Interface != "" {
+				errs = append(errs, field.Forbidden(p.Child("network", "interface"), "only used in bridged mode"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(p.Child("network", "mode"), n.Mode, []string{string(spec.NetworkModeBridged), string(spec.NetworkModeNAT), string(spec.NetworkModeIsolated), string(spec.NetworkModeUserspace)}))
+		}
+	}
+	for i, pattern := range s.AllowedImages {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, field.Invalid(p.Child("allowedImages").Index(i), pattern, err.Error()))
+		}
+	}
+	return errs
+}
+
+// Apply returns the sizing policy and VM spec of the pods using class,
+// starting from the ones of the provider configuration.
+func Apply(class *MacOSVMClass, policy sizing.Policy, base spec.Spec) (sizing.Policy, spec.Spec) {
+	s := class.Spec
+	if s.CPUs > 0 {
+		policy.Defaults.CPUs = uint(s.CPUs)
+	}
+	if s.Memory != nil {
+		policy.Defaults.Memory = uint64(s.Memory.Value())
+	}
+	if s.Disk != nil {
+		base.BootDiskSize = uint64(s.Disk.Value())
+	}
+	if d := s.Display; d != nil {
+		base.Display.Width = d.Width
+		base.Display.Height = d.Height
+		if d.PixelsPerInch > 0 {
+			base.Display.PixelsPerInch = d.PixelsPerInch
+		}
+	}
+	if n := s.Network; n != nil {
+		base.Network.Mode = n.Mode
+		switch {
+		case n.Mode != spec.NetworkModeBridged:
+			base.Network.Interface = ""
+		case n.Interface != "":
+			base.Network.Interface = n.Interface
+		}
+	}
+	if d := s.Devices; d != nil {
+		for _, device := range []struct {
+			set *bool
+			dst *bool
+		}{
+			{d.Audio, &base.Devices.Audio},
+			{d.Keyboard, &base.Devices.Keyboard},
+			{d.Pointing, &base.Devices.Pointing},
+		} {
+			if device.set != nil {
+				*device.dst = *device.set
+			}
+		}
+	}
+	return policy, base
+}
+
+// AllowsImage reports whether pods using class may run image.
+func AllowsImage(class *MacOSVMClass, image string) bool {
+	if len(class.Spec.AllowedImages) == 0 {
+		return true
+	}
+	for _, pattern := range class.Spec.AllowedImages {
+		if ok, _ := path.Match(pattern, image); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Getter returns MacOSVMClasses by name.
+type Getter interface {
+	Get(name string) (*MacOSVMClass, error)
+}
+
+// Store is a Getter backed by a dynamic informer.
+type Store struct {
+	informer informers.GenericInformer
+}
+
+// NewStore returns a Store watching MacOSVMClasses through factory. The
+// factory must be started for the store to be filled.
+func NewStore(factory dynamicinformer.DynamicSharedInformerFactory) *Store {
+	return &Store{informer: factory.ForResource(GroupVersionResource)}
+}
+
+// Get returns the MacOSVMClass name. It fails until the informer synced.
+func (s *Store) Get(name string) (*MacOSVMClass, error) {
+	if !s.informer.Informer().HasSynced() {
+		return nil, fmt.Errorf("%s informer has not synced yet", Kind)
+	}
+	obj, err := s.informer.Lister().Get(name)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %T in the %s informer", obj, Kind)
+	}
+	return FromUnstructured(u)
+}
@@ -0,0 +1,148 @@
+package vmclass
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+func newUnstructuredClass(name string, s map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": GroupVersionResource.GroupVersion().String(),
+		"kind":       Kind,
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       s,
+	}}
+}
+
+// newTestStore returns a synced Store serving objects from a fake dynamic client.
+func newTestStore(t *testing.T, objects ...runtime.Object) *Store {
+	t.Helper()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		GroupVersionResource: Kind + "List",
+	}, objects...)
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	store := NewStore(factory)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), store.informer.Informer().HasSynced) {
+		t.Fatal("informer did not sync")
+	}
+	return store
+}
+
+func TestStoreGet(t *testing.T) {
+	store := newTestStore(t, newUnstructuredClass("ci-large", map[string]interface{}{
+		"cpus":          int64(8),
+		"memory":        "16Gi",
+		"display":       map[string]interface{}{"width": int64(2560), "height": int64(1440)},
+		"network":       map[string]interface{}{"mode": "nat"},
+		"devices":       map[string]interface{}{"audio": false},
+		"allowedImages": []interface{}{"ghcr.io/acme/*"},
+	}))
+
+	class, err := store.Get("ci-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class.Spec.CPUs != 8 || class.Spec.Memory.Cmp(resource.MustParse("16Gi")) != 0 {
+		t.Errorf("unexpected size in %+v", class.Spec)
+	}
+	if class.Spec.Network == nil || class.Spec.Network.Mode != spec.NetworkModeNAT {
+		t.Errorf("unexpected network %+v", class.Spec.Network)
+	}
+	if errs := Validate(class); len(errs) > 0 {
+		t.Errorf("expected class to be valid, got %v", errs)
+	}
+
+	if _, err := store.Get("missing"); !apierrors.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	audio := false
+	memory := resource.MustParse("16Gi")
+	disk := resource.MustParse("200Gi")
+	class := &MacOSVMClass{Spec: MacOSVMClassSpec{
+		CPUs:    8,
+		Memory:  &memory,
+		Disk:    &disk,
+		Display: &Display{Width: 2560, Height: 1440},
+		Network: &Network{Mode: spec.NetworkModeNAT},
+		Devices: &Devices{Audio: &audio},
+	}}
+	policy := sizing.Policy{Defaults: sizing.Size{CPUs: 2, Memory: 4 << 30}}
+	base := spec.Spec{
+		DiskSize: 64 << 30,
+		Display:  spec.Display{Width: 1920, Height: 1200, PixelsPerInch: 80},
+		Network:  spec.Network{Mode: spec.NetworkModeBridged, Interface: "en0"},
+		Devices:  spec.Devices{Audio: true, Keyboard: true, Pointing: true},
+	}
+
+	gotPolicy, got := Apply(class, policy, base)
+	if want := (sizing.Size{CPUs: 8, Memory: 16 << 30}); gotPolicy.Defaults != want {
+		t.Errorf("expected defaults %s, got %s", want, gotPolicy.Defaults)
+	}
+	want := spec.Spec{
+		DiskSize:     64 << 30,
+		BootDiskSize: 200 << 30,
+		Display:      spec.Display{Width: 2560, Height: 1440, PixelsPerInch: 80},
+		Network:      spec.Network{Mode: spec.NetworkModeNAT},
+		Devices:      spec.Devices{Audio: false, Keyboard: true, Pointing: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	if _, got := Apply(&MacOSVMClass{}, policy, base); !reflect.DeepEqual(got, base) {
+		t.Errorf("expected an empty class to keep the base spec, got %+v", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	zero := resource.MustParse("0")
+	class := &MacOSVMClass{Spec: MacOSVMClassSpec{
+		CPUs:          -1,
+		Memory:        &zero,
+		Display:       &Display{Width: 0, Height: 10},
+		Network:       &Network{Mode: "host"},
+		AllowedImages: []string{"["},
+	}}
+	errs := Validate(class)
+	if len(errs) != 5 {
+		t.Errorf("expected 5 errors, got %v", errs)
+	}
+}
+
+func TestAllowsImage(t *testing.T) {
+	class := &MacOSVMClass{Spec: MacOSVMClassSpec{AllowedImages: []string{"ghcr.io/acme/*", "xcode:15"}}}
+	for image, want := range map[string]bool{
+		"ghcr.io/acme/runner:1.0": true,
+		"xcode:15":                true,
+		"xcode:14":                false,
+		"ghcr.io/other/runner":    false,
+	} {
+		if got := AllowsImage(class, image); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %s allowed: %t, got %t", image, want, got)
+		}
+	}
+	if !AllowsImage(&MacOSVMClass{}, "anything") {
+		t.Error("expected a class without allowed images to allow everything")
+	}
+}
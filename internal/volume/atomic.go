@@ -0,0 +1,195 @@
+package volume
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File is a file of a volume.
+type File struct {
+	Data []byte
+	Mode os.FileMode
+}
+
+// Names of the entries the atomic writer keeps next to the files of a volume.
+// The guest sees the files through symlinks to dataDir, which points to the
+// timestamped directory holding the current version.
+const (
+	dataDir    = "..data"
+	newDataDir = "..data_tmp"
+)
+
+// WriteAtomic writes payload, files by path relative to dir, so that a
+// reader in the guest sees either all the old files or all the new ones,
+// like the kubelet does for ConfigMap and Secret volumes. Nothing is written
+// when dir already holds payload. changed reports whether files were
+// written.
+func WriteAtomic(dir string, payload map[string]File) (changed bool, err error) {
+	for path := range payload {
+		if err := validatePath(path); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+
+	oldVersion, err := os.Readlink(filepath.Join(dir, dataDir))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if oldVersion != "" {
+		same, err := holds(filepath.Join(dir, oldVersion), payload)
+		if err != nil {
+			return false, err
+		}
+		if same {
+			return false, nil
+		}
+	}
+
+	version, err := os.MkdirTemp(dir, time.Now().UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return false, err
+	}
+	if err := os.Chmod(version, 0o755); err != nil {
+		return false, err
+	}
+	for path, f := range payload {
+		name := filepath.Join(version, path)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return false, err
+		}
+		if err := os.WriteFile(name, f.Data, f.Mode); err != nil {
+			return false, err
+		}
+		// WriteFile applies the umask
+		if err := os.Chmod(name, f.Mode); err != nil {
+			return false, err
+		}
+	}
+
+	// renaming a symlink over dataDir is the atomic switch
+	tmp := filepath.Join(dir, newDataDir)
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Symlink(filepath.Base(version), tmp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, dataDir)); err != nil {
+		return false, err
+	}
+
+	if err := linkTopLevel(dir, payload); err != nil {
+		return false, err
+	}
+	if oldVersion != "" {
+		if err := os.RemoveAll(filepath.Join(dir, oldVersion)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// validatePath rejects the paths escaping the volume or clashing with the
+// entries of the atomic writer.
+func validatePath(path string) error {
+	if path == "" || !filepath.IsLocal(path) {
+		return fmt.Errorf("invalid path %q: must be relative and may not contain '..'", path)
+	}
+	if strings.HasPrefix(path, "..") {
+		return fmt.Errorf("invalid path %q: may not start with '..'", path)
+	}
+	return nil
+}
+
+// holds reports whether the directory version holds exactly payload.
+func holds(version string, payload map[string]File) (bool, error) {
+	count := 0
+	err := filepath.WalkDir(version, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		count++
+		rel, err := filepath.Rel(version, path)
+		if err != nil {
+			return err
+		}
+		f, ok := payload[rel]
+		if !ok {
+			return errDiffers
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm() != f.Mode.Perm() {
+			return errDiffers
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, f.Data) {
+			return errDiffers
+		}
+		return nil
+	})
+	if errors.Is(err, errDiffers) || os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil && count == len(payload), err
+}
+
+var errDiffers = errors.New("volume differs")
+
+// linkTopLevel points the top level entries of payload to dataDir and
+// removes the links of the entries it no longer has.
+func linkTopLevel(dir string, payload map[string]File) error {
+	want := map[string]bool{}
+	for path := range payload {
+		want[strings.SplitN(filepath.ToSlash(path), "/", 2)[0]] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..") || want[e.Name()] {
+			continue
+		}
+		if e.Type()&os.ModeSymlink != 0 {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		link := filepath.Join(dir, name)
+		target := filepath.Join(dataDir, name)
+		if existing, err := os.Readlink(link); err == nil && existing == target {
+			continue
+		}
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "config")
+
+	changed, err := WriteAtomic(dir, map[string]File{
+		"app.conf":       {Data: []byte("level=debug"), Mode: 0o644},
+		"certs/ca.crt":   {Data: []byte("ca"), Mode: 0o600},
+		"certs/tls.crt":  {Data: []byte("cert"), Mode: 0o600},
+		"removed.conf":   {Data: []byte("old"), Mode: 0o644},
+		"unchanged.conf": {Data: []byte("same"), Mode: 0o644},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expected the first write to change the volume")
+	}
+	first, err := os.Readlink(filepath.Join(dir, dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "certs", "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	changed, err = WriteAtomic(dir, map[string]File{
+		"app.conf":       {Data: []byte("level=debug"), Mode: 0o644},
+		"certs/ca.crt":   {Data: []byte("ca"), Mode: 0o600},
+		"certs/tls.crt":  {Data: []byte("cert"), Mode: 0o600},
+		"removed.conf":   {Data: []byte("old"), Mode: 0o644},
+		"unchanged.conf": {Data: []byte("same"), Mode: 0o644},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("expected the same payload to leave the volume untouched")
+	}
+
+	changed, err = WriteAtomic(dir, map[string]File{
+		"app.conf":       {Data: []byte("level=info"), Mode: 0o644},
+		"certs/ca.crt":   {Data: []byte("ca"), Mode: 0o600},
+		"unchanged.conf": {Data: []byte("same"), Mode: 0o644},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expected the new payload to change the volume")
+	}
+	for path, want := range map[string]string{
+		"app.conf":       "level=info",
+		"certs/ca.crt":   "ca",
+		"unchanged.conf": "same",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: expected %q, got %q", path, want, got)
+		}
+	}
+	for _, path := range []string{"removed.conf", "certs/tls.crt"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "removed.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected the link of removed.conf to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, first)); !os.IsNotExist(err) {
+		t.Errorf("expected the previous version to be removed, got %v", err)
+	}
+}
+
+func TestWriteAtomicModeChange(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := WriteAtomic(dir, map[string]File{"key": {Data: []byte("v"), Mode: 0o644}}); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := WriteAtomic(dir, map[string]File{"key": {Data: []byte("v"), Mode: 0o400}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expected a mode change to rewrite the volume")
+	}
+}
+
+func TestWriteAtomicInvalidPaths(t *testing.T) {
+	for _, path := range []string{"", "/etc/passwd", "../escape", "a/../../escape", "..data", "..hidden"} {
+		if _, err := WriteAtomic(t.TempDir(), map[string]File{path: {Mode: 0o644}}); err == nil {
+			t.Errorf("expected %q to be rejected", path)
+		}
+	}
+}
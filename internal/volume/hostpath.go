@@ -0,0 +1,109 @@
+package volume
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// HostPathNotAllowedReason is the reason of the pods rejected for a
+// *HostPathError.
+const HostPathNotAllowedReason = "HostPathNotAllowed"
+
+// HostPathRule allows the hostPath volumes of Path or of a directory under
+// it.
+type HostPathRule struct {
+	Path string
+	// ReadOnly shares the volumes read-only, whatever the pod mounts.
+	ReadOnly bool
+}
+
+// Allowlist is the list of host directories hostPath volumes can share.
+// hostPath volumes are rejected when it is empty.
+type Allowlist []HostPathRule
+
+// HostPathError is returned for a hostPath volume outside of the allowlist.
+type HostPathError struct {
+	Volume string
+	Path   string
+}
+
+func (e *HostPathError) Error() string {
+	return fmt.Sprintf("volume %s: hostPath %s is not allowed on this node", e.Volume, e.Path)
+}
+
+// Match returns the rule allowing path. Symlinks are resolved first so that
+// a link in an allowed directory cannot share a directory outside of it.
+func (l Allowlist) Match(path string) (HostPathRule, bool) {
+	if !filepath.IsAbs(path) {
+		return HostPathRule{}, false
+	}
+	resolved := resolve(path)
+	for _, rule := range l {
+		if within(resolved, resolve(rule.Path)) {
+			return rule, true
+		}
+	}
+	return HostPathRule{}, false
+}
+
+// resolve returns path with the symlinks of its longest existing prefix
+// resolved.
+func resolve(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(resolve(parent), filepath.Base(path))
+}
+
+// within reports whether path is dir or a path under it.
+func within(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// validateHostPath checks that the hostPath volume v can be shared.
+func validateHostPath(v v1.Volume, allowlist Allowlist) error {
+	switch t := v.HostPath.Type; {
+	case t == nil, *t == v1.HostPathUnset, *t == v1.HostPathDirectory, *t == v1.HostPathDirectoryOrCreate:
+	default:
+		return &UnsupportedError{Volume: v.Name, Reason: fmt.Sprintf("hostPath type %s cannot be shared, only directories can", *t)}
+	}
+	if _, ok := allowlist.Match(v.HostPath.Path); !ok {
+		return &HostPathError{Volume: v.Name, Path: v.HostPath.Path}
+	}
+	return nil
+}
+
+// prepareHostPath returns the share of the hostPath volume v, creating its
+// directory for the DirectoryOrCreate type.
+func prepareHostPath(v v1.Volume, allowlist Allowlist, readOnly bool) (string, bool, error) {
+	rule, ok := allowlist.Match(v.HostPath.Path)
+	if !ok {
+		return "", false, &HostPathError{Volume: v.Name, Path: v.HostPath.Path}
+	}
+	path := resolve(v.HostPath.Path)
+	if t := v.HostPath.Type; t != nil && *t == v1.HostPathDirectoryOrCreate {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return "", false, &MountError{Volume: v.Name, Err: err}
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false, &MountError{Volume: v.Name, Err: err}
+	}
+	if !info.IsDir() {
+		return "", false, &MountError{Volume: v.Name, Err: fmt.Errorf("hostPath %s is not a directory", v.HostPath.Path)}
+	}
+	return path, rule.ReadOnly || readOnly, nil
+}
@@ -0,0 +1,117 @@
+package volume
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+func TestAllowlistMatch(t *testing.T) {
+	root := t.TempDir()
+	caches := filepath.Join(root, "caches")
+	outside := filepath.Join(root, "secrets")
+	for _, dir := range []string{filepath.Join(caches, "homebrew"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(caches, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	allowlist := Allowlist{{Path: caches, ReadOnly: true}}
+
+	for path, allowed := range map[string]bool{
+		caches:                                   true,
+		filepath.Join(caches, "homebrew"):        true,
+		filepath.Join(caches, "not-created-yet"): true,
+		filepath.Join(caches, "..", "secrets"):   false,
+		filepath.Join(caches, "escape"):          false,
+		filepath.Join(caches, "escape", "keys"):  false,
+		caches + "-other":                        false,
+		outside:                                  false,
+		"caches":                                 false,
+	} {
+		rule, ok := allowlist.Match(path)
+		if ok != allowed {
+			t.Errorf("%s: expected allowed to be %v", path, allowed)
+		}
+		if ok && !rule.ReadOnly {
+			t.Errorf("%s: expected the read-only rule", path)
+		}
+	}
+
+	if _, ok := Allowlist(nil).Match(caches); ok {
+		t.Error("expected an empty allowlist to allow nothing")
+	}
+}
+
+func TestPrepareHostPath(t *testing.T) {
+	root := t.TempDir()
+	readOnlyCache := filepath.Join(root, "DerivedData")
+	if err := os.Mkdir(readOnlyCache, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	allowlist := Allowlist{
+		{Path: readOnlyCache, ReadOnly: true},
+		{Path: filepath.Join(root, "writable")},
+	}
+	directoryOrCreate := v1.HostPathDirectoryOrCreate
+	pod := testPod()
+	pod.Spec.Volumes = []v1.Volume{
+		{Name: "derived-data", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: readOnlyCache}}},
+		{Name: "cocoapods", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: filepath.Join(root, "writable", "cocoapods"), Type: &directoryOrCreate}}},
+	}
+	pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{
+		{Name: "derived-data", MountPath: "/Users/runner/Library/Developer/Xcode/DerivedData"},
+		{Name: "cocoapods", MountPath: "/Users/runner/Library/Caches/CocoaPods"},
+	}
+
+	shares, err := Prepare(t.TempDir(), pod, testObjects(), testAllocatable, allowlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []spec.Share{
+		// the rule makes the share read-only even though the mount is not
+		{Tag: "derived-data", Path: readOnlyCache, ReadOnly: true},
+		{Tag: "cocoapods", Path: filepath.Join(root, "writable", "cocoapods")},
+	}
+	if len(shares) != len(want) || shares[0] != want[0] || shares[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, shares)
+	}
+	if info, err := os.Stat(filepath.Join(root, "writable", "cocoapods")); err != nil || !info.IsDir() {
+		t.Errorf("expected the DirectoryOrCreate directory to be created, got %v", err)
+	}
+}
+
+func TestValidateHostPath(t *testing.T) {
+	root := t.TempDir()
+	allowlist := Allowlist{{Path: root}}
+	pod := testPod()
+
+	pod.Spec.Volumes = []v1.Volume{{Name: "etc", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/etc"}}}}
+	var hostPathErr *HostPathError
+	if err := Validate(pod, allowlist); !errors.As(err, &hostPathErr) || hostPathErr.Path != "/etc" {
+		t.Errorf("expected a HostPathError, got %v", err)
+	}
+
+	file := v1.HostPathFile
+	pod.Spec.Volumes = []v1.Volume{{Name: "socket", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: filepath.Join(root, "file"), Type: &file}}}}
+	var unsupported *UnsupportedError
+	if err := Validate(pod, allowlist); !errors.As(err, &unsupported) {
+		t.Errorf("expected a file hostPath to be unsupported, got %v", err)
+	}
+
+	pod.Spec.Volumes = []v1.Volume{{Name: "missing", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: filepath.Join(root, "missing")}}}}
+	if err := Validate(pod, allowlist); err != nil {
+		t.Fatal(err)
+	}
+	var mountErr *MountError
+	if _, err := Prepare(t.TempDir(), pod, testObjects(), testAllocatable, allowlist); !errors.As(err, &mountErr) {
+		t.Errorf("expected a missing directory to fail to mount, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package volume
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/raikerian/macos-virtual-kubelet/internal/guest"
+)
+
+// Objects returns the objects the volumes of a pod are made of.
+type Objects interface {
+	GetConfigMap(name, namespace string) (*v1.ConfigMap, error)
+	GetSecret(name, namespace string) (*v1.Secret, error)
+	GetServiceAccountToken(namespace, name string, tr *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error)
+}
+
+// defaultTokenExpiration is the lifetime of the tokens of the projections
+// without one, the default of the API server.
+const defaultTokenExpiration = 3600
+
+// ConfigMapPayload returns the files of a ConfigMap volume of pod. A missing
+// optional ConfigMap gives no files.
+func ConfigMapPayload(pod *v1.Pod, source *v1.ConfigMapVolumeSource, objects Objects) (map[string]File, error) {
+	return configMapPayload(pod, source.Name, source.Items, source.Optional, mode(source.DefaultMode, v1.ConfigMapVolumeSourceDefaultMode), objects)
+}
+
+func configMapPayload(pod *v1.Pod, name string, items []v1.KeyToPath, optional *bool, defaultMode os.FileMode, objects Objects) (map[string]File, error) {
+	cm, err := objects.GetConfigMap(name, pod.Namespace)
+	if err != nil {
+		if apierrors.IsNotFound(err) && isOptional(optional) {
+			return map[string]File{}, nil
+		}
+		return nil, fmt.Errorf("configmap %q: %w", name, err)
+	}
+	data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		data[k] = v
+	}
+	payload, err := keyPayload(data, items, optional, defaultMode)
+	if err != nil {
+		return nil, fmt.Errorf("configmap %q: %w", name, err)
+	}
+	return payload, nil
+}
+
+// SecretPayload returns the files of a Secret volume of pod. A missing
+// optional Secret gives no files.
+func SecretPayload(pod *v1.Pod, source *v1.SecretVolumeSource, objects Objects) (map[string]File, error) {
+	return secretPayload(pod, source.SecretName, source.Items, source.Optional, mode(source.DefaultMode, v1.SecretVolumeSourceDefaultMode), objects)
+}
+
+func secretPayload(pod *v1.Pod, name string, items []v1.KeyToPath, optional *bool, defaultMode os.FileMode, objects Objects) (map[string]File, error) {
+	secret, err := objects.GetSecret(name, pod.Namespace)
+	if err != nil {
+		if apierrors.IsNotFound(err) && isOptional(optional) {
+			return map[string]File{}, nil
+		}
+		return nil, fmt.Errorf("secret %q: %w", name, err)
+	}
+	payload, err := keyPayload(secret.Data, items, optional, defaultMode)
+	if err != nil {
+		return nil, fmt.Errorf("secret %q: %w", name, err)
+	}
+	return payload, nil
+}
+
+// keyPayload returns a file per key of data, or only the ones of items when
+// there are some. A missing key is an error unless optional.
+func keyPayload(data map[string][]byte, items []v1.KeyToPath, optional *bool, defaultMode os.FileMode) (map[string]File, error) {
+	payload := map[string]File{}
+	if len(items) == 0 {
+		for k, v := range data {
+			payload[k] = File{Data: v, Mode: defaultMode}
+		}
+		return payload, nil
+	}
+	for _, item := range items {
+		v, ok := data[item.Key]
+		if !ok {
+			if isOptional(optional) {
+				continue
+			}
+			return nil, fmt.Errorf("couldn't find key %s", item.Key)
+		}
+		payload[item.Path] = File{Data: v, Mode: mode(item.Mode, int32(defaultMode))}
+	}
+	return payload, nil
+}
+
+// DownwardAPIPayload returns the files of a downwardAPI volume of pod.
+// allocatable is the size of the virtual machine, used for the limits that
+// are not set.
+func DownwardAPIPayload(pod *v1.Pod, source *v1.DownwardAPIVolumeSource, allocatable v1.ResourceList) (map[string]File, error) {
+	return downwardAPIPayload(pod, source.Items, mode(source.DefaultMode, v1.DownwardAPIVolumeSourceDefaultMode), allocatable)
+}
+
+func downwardAPIPayload(pod *v1.Pod, items []v1.DownwardAPIVolumeFile, defaultMode os.FileMode, allocatable v1.ResourceList) (map[string]File, error) {
+	payload := map[string]File{}
+	for _, item := range items {
+		var value string
+		var err error
+		switch {
+		case item.FieldRef != nil:
+			value, err = fieldValue(pod, item.FieldRef.FieldPath)
+		case item.ResourceFieldRef != nil:
+			value, err = guest.ResourceField(pod, v1.Container{}, item.ResourceFieldRef, allocatable)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", item.Path, err)
+		}
+		payload[item.Path] = File{Data: []byte(value), Mode: mode(item.Mode, int32(defaultMode))}
+	}
+	return payload, nil
+}
+
+// fieldValue returns the value of a downward API field of pod. Unlike in
+// the environment, all labels or annotations can be projected in a file.
+func fieldValue(pod *v1.Pod, fieldPath string) (string, error) {
+	switch fieldPath {
+	case "metadata.labels":
+		return formatMap(pod.Labels), nil
+	case "metadata.annotations":
+		return formatMap(pod.Annotations), nil
+	default:
+		return guest.PodField(pod, fieldPath)
+	}
+}
+
+// formatMap formats m like the kubelet: a key="value" line per key, sorted.
+func formatMap(m map[string]string) string {
+	lines := make([]string, 0, len(m))
+	for k, v := range m {
+		lines = append(lines, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// ProjectedPayload returns the files of a projected volume of pod, merging
+// its sources. Service account tokens are bound to pod, the CA bundle comes
+// from the kube-root-ca.crt ConfigMap projected next to them.
+func ProjectedPayload(pod *v1.Pod, source *v1.ProjectedVolumeSource, objects Objects, allocatable v1.ResourceList) (map[string]File, error) {
+	defaultMode := mode(source.DefaultMode, v1.ProjectedVolumeSourceDefaultMode)
+	payload := map[string]File{}
+	for _, projection := range source.Sources {
+		var files map[string]File
+		var err error
+		switch {
+		case projection.ConfigMap != nil:
+			p := projection.ConfigMap
+			files, err = configMapPayload(pod, p.Name, p.Items, p.Optional, defaultMode, objects)
+		case projection.Secret != nil:
+			p := projection.Secret
+			files, err = secretPayload(pod, p.Name, p.Items, p.Optional, defaultMode, objects)
+		case projection.DownwardAPI != nil:
+			files, err = downwardAPIPayload(pod, projection.DownwardAPI.Items, defaultMode, allocatable)
+		case projection.ServiceAccountToken != nil:
+			files, err = tokenPayload(pod, projection.ServiceAccountToken, defaultMode, objects)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for path, f := range files {
+			payload[path] = f
+		}
+	}
+	return payload, nil
+}
+
+// tokenPayload returns the file of a token of the service account of pod,
+// bound to pod.
+func tokenPayload(pod *v1.Pod, projection *v1.ServiceAccountTokenProjection, defaultMode os.FileMode, objects Objects) (map[string]File, error) {
+	expiration := int64(defaultTokenExpiration)
+	if projection.ExpirationSeconds != nil {
+		expiration = *projection.ExpirationSeconds
+	}
+	var audiences []string
+	if projection.Audience != "" {
+		audiences = []string{projection.Audience}
+	}
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	tr, err := objects.GetServiceAccountToken(pod.Namespace, serviceAccount, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         audiences,
+			ExpirationSeconds: &expiration,
+			BoundObjectRef: &authenticationv1.BoundObjectReference{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]File{projection.Path: {Data: []byte(tr.Status.Token), Mode: defaultMode}}, nil
+}
+
+// mode returns the file mode of m, or of defaultMode when m is nil.
+func mode(m *int32, defaultMode int32) os.FileMode {
+	if m != nil {
+		return os.FileMode(*m) & os.ModePerm
+	}
+	return os.FileMode(defaultMode) & os.ModePerm
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
@@ -0,0 +1,190 @@
+// Package volume materializes the volumes of a pod in host directories the
+// virtual machine of the pod mounts over virtio-fs, one share per volume
+// with the name of the volume as mount tag. persistentVolumeClaim volumes
+// are disk images attached by the caller instead.
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+// UnsupportedReason is the reason of the pods rejected for an
+// *UnsupportedError.
+const UnsupportedReason = "UnsupportedVolume"
+
+// UnsupportedError is returned for a volume that cannot be shared with a
+// virtual machine.
+type UnsupportedError struct {
+	Volume string
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("volume %s: %s", e.Volume, e.Reason)
+}
+
+// MountError is returned when the content of a volume cannot be written,
+// e.g. its ConfigMap does not exist yet. Like the kubelet, the pod waits for
+// the object instead of failing.
+type MountError struct {
+	Volume string
+	Err    error
+}
+
+// MountErrorReason is the reason of the events recorded for a *MountError.
+const MountErrorReason = "FailedMount"
+
+func (e *MountError) Error() string {
+	return fmt.Sprintf("MountVolume.SetUp failed for volume %q: %v", e.Volume, e.Err)
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
+
+// Validate returns an *UnsupportedError or a *HostPathError for the first
+// volume of pod that cannot be shared with a virtual machine. hostPath
+// volumes must be in allowlist.
+func Validate(pod *v1.Pod, allowlist Allowlist) error {
+	for _, v := range pod.Spec.Volumes {
+		if len(v.Name) > spec.MaxShareTagLength {
+			return &UnsupportedError{Volume: v.Name, Reason: fmt.Sprintf("the name is longer than the %d bytes of a virtio-fs mount tag", spec.MaxShareTagLength)}
+		}
+		if v.HostPath != nil {
+			if err := validateHostPath(v, allowlist); err != nil {
+				return err
+			}
+			continue
+		}
+		if v.PersistentVolumeClaim != nil {
+			if len(v.Name) > spec.MaxDiskIdentifierLength {
+				return &UnsupportedError{Volume: v.Name, Reason: fmt.Sprintf("the name of a persistentVolumeClaim volume is longer than the %d bytes of a disk identifier", spec.MaxDiskIdentifierLength)}
+			}
+			continue
+		}
+		if !supported(v.VolumeSource) {
+			return &UnsupportedError{Volume: v.Name, Reason: "only configMap, secret, downwardAPI, projected, emptyDir, hostPath and persistentVolumeClaim volumes can be used by a virtual machine"}
+		}
+	}
+	return nil
+}
+
+// supported reports whether source is written by the provider.
+func supported(source v1.VolumeSource) bool {
+	return source.ConfigMap != nil || source.Secret != nil || source.DownwardAPI != nil || source.Projected != nil || source.EmptyDir != nil
+}
+
+// Prepare writes the volumes of pod in a directory per volume under dir and
+// returns the shares exposing them. ConfigMap, Secret, downwardAPI and
+// projected volumes are always shared read-only, emptyDir and hostPath
+// volumes are read-only when every mount of them is or, for hostPath, when
+// the rule of allowlist says so. persistentVolumeClaim volumes are skipped.
+// allocatable is the size of the virtual machine.
+func Prepare(dir string, pod *v1.Pod, objects Objects, allocatable v1.ResourceList, allowlist Allowlist) ([]spec.Share, error) {
+	if err := Validate(pod, allowlist); err != nil {
+		return nil, err
+	}
+	readOnly := readOnlyVolumes(pod)
+
+	var shares []spec.Share
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim != nil {
+			continue
+		}
+		if v.HostPath != nil {
+			path, ro, err := prepareHostPath(v, allowlist, readOnly[v.Name])
+			if err != nil {
+				return nil, err
+			}
+			shares = append(shares, spec.Share{Tag: v.Name, Path: path, ReadOnly: ro})
+			continue
+		}
+
+		path := filepath.Join(dir, v.Name)
+		if v.EmptyDir != nil {
+			// the medium and size limit of the volume are not enforced
+			if err := os.MkdirAll(path, 0o777); err != nil {
+				return nil, &MountError{Volume: v.Name, Err: err}
+			}
+			if err := os.Chmod(path, 0o777); err != nil {
+				return nil, &MountError{Volume: v.Name, Err: err}
+			}
+			shares = append(shares, spec.Share{Tag: v.Name, Path: path, ReadOnly: readOnly[v.Name]})
+			continue
+		}
+		if _, err := write(path, pod, v, objects, allocatable); err != nil {
+			return nil, err
+		}
+		shares = append(shares, spec.Share{Tag: v.Name, Path: path, ReadOnly: true})
+	}
+	return shares, nil
+}
+
+// Update rewrites the volumes of pod in dir whose content changed, e.g.
+// after an update of their ConfigMap, and returns their names. A volume
+// that cannot be written keeps its content.
+func Update(dir string, pod *v1.Pod, objects Objects, allocatable v1.ResourceList) ([]string, error) {
+	var updated []string
+	var errs []error
+	for _, v := range pod.Spec.Volumes {
+		if v.EmptyDir != nil || !supported(v.VolumeSource) {
+			continue
+		}
+		changed, err := write(filepath.Join(dir, v.Name), pod, v, objects, allocatable)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if changed {
+			updated = append(updated, v.Name)
+		}
+	}
+	return updated, errors.Join(errs...)
+}
+
+// write writes the content of the volume v of pod to path.
+func write(path string, pod *v1.Pod, v v1.Volume, objects Objects, allocatable v1.ResourceList) (bool, error) {
+	var payload map[string]File
+	var err error
+	switch {
+	case v.ConfigMap != nil:
+		payload, err = ConfigMapPayload(pod, v.ConfigMap, objects)
+	case v.Secret != nil:
+		payload, err = SecretPayload(pod, v.Secret, objects)
+	case v.DownwardAPI != nil:
+		payload, err = DownwardAPIPayload(pod, v.DownwardAPI, allocatable)
+	case v.Projected != nil:
+		payload, err = ProjectedPayload(pod, v.Projected, objects, allocatable)
+	}
+	if err != nil {
+		return false, &MountError{Volume: v.Name, Err: err}
+	}
+	changed, err := WriteAtomic(path, payload)
+	if err != nil {
+		return false, &MountError{Volume: v.Name, Err: err}
+	}
+	return changed, nil
+}
+
+// readOnlyVolumes reports for each volume mounted in pod whether every mount
+// of it is read-only.
+func readOnlyVolumes(pod *v1.Pod) map[string]bool {
+	readOnly := map[string]bool{}
+	for _, c := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		for _, m := range c.VolumeMounts {
+			if ro, ok := readOnly[m.Name]; ok {
+				readOnly[m.Name] = ro && m.ReadOnly
+			} else {
+				readOnly[m.Name] = m.ReadOnly
+			}
+		}
+	}
+	return readOnly
+}
@@ -0,0 +1,325 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
+)
+
+// fakeObjects holds ConfigMaps and Secrets by namespace/name.
+type fakeObjects struct {
+	configMaps map[string]*v1.ConfigMap
+	secrets    map[string]*v1.Secret
+}
+
+func (f fakeObjects) GetConfigMap(name, namespace string) (*v1.ConfigMap, error) {
+	if cm, ok := f.configMaps[namespace+"/"+name]; ok {
+		return cm, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+}
+
+func (f fakeObjects) GetSecret(name, namespace string) (*v1.Secret, error) {
+	if secret, ok := f.secrets[namespace+"/"+name]; ok {
+		return secret, nil
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+}
+
+// GetServiceAccountToken returns a token describing the request.
+func (f fakeObjects) GetServiceAccountToken(namespace, name string, tr *authenticationv1.TokenRequest) (*authenticationv1.TokenRequest, error) {
+	tr = tr.DeepCopy()
+	tr.Status.Token = fmt.Sprintf("%s/%s audiences=%v expiration=%d pod=%s", namespace, name, tr.Spec.Audiences, *tr.Spec.ExpirationSeconds, tr.Spec.BoundObjectRef.Name)
+	return tr, nil
+}
+
+func testObjects() fakeObjects {
+	return fakeObjects{
+		configMaps: map[string]*v1.ConfigMap{
+			"ci/settings": {
+				Data:       map[string]string{"app.conf": "level=debug", "region": "eu-west-1"},
+				BinaryData: map[string][]byte{"logo.png": {0x89, 'P', 'N', 'G'}},
+			},
+		},
+		secrets: map[string]*v1.Secret{
+			"ci/credentials": {Data: map[string][]byte{"token": []byte("s3cr3t"), "ca.crt": []byte("ca")}},
+		},
+	}
+}
+
+var testAllocatable = v1.ResourceList{
+	v1.ResourceCPU:    resource.MustParse("4"),
+	v1.ResourceMemory: resource.MustParse("8Gi"),
+}
+
+func testPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ci",
+			Name:        "runner",
+			Labels:      map[string]string{"app": "runner", "tier": "ci"},
+			Annotations: map[string]string{"note": `say "hi"`},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name: "runner",
+				Resources: v1.ResourceRequirements{
+					Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("2Gi")},
+				},
+			}},
+		},
+	}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestConfigMapPayload(t *testing.T) {
+	pod := testPod()
+	payload, err := ConfigMapPayload(pod, &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}, testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]File{
+		"app.conf": {Data: []byte("level=debug"), Mode: 0o644},
+		"region":   {Data: []byte("eu-west-1"), Mode: 0o644},
+		"logo.png": {Data: []byte{0x89, 'P', 'N', 'G'}, Mode: 0o644},
+	}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("expected %v, got %v", want, payload)
+	}
+
+	payload, err = ConfigMapPayload(pod, &v1.ConfigMapVolumeSource{
+		LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+		Items: []v1.KeyToPath{
+			{Key: "app.conf", Path: "etc/app.conf"},
+			{Key: "region", Path: "region", Mode: int32Ptr(0o600)},
+		},
+		DefaultMode: int32Ptr(0o440),
+	}, testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]File{
+		"etc/app.conf": {Data: []byte("level=debug"), Mode: 0o440},
+		"region":       {Data: []byte("eu-west-1"), Mode: 0o600},
+	}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("expected %v, got %v", want, payload)
+	}
+}
+
+func TestConfigMapPayloadMissing(t *testing.T) {
+	pod := testPod()
+	missingKey := &v1.ConfigMapVolumeSource{
+		LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+		Items:                []v1.KeyToPath{{Key: "missing", Path: "missing"}},
+	}
+	if _, err := ConfigMapPayload(pod, missingKey, testObjects()); err == nil {
+		t.Error("expected a missing key to fail")
+	}
+	missingKey.Optional = boolPtr(true)
+	if payload, err := ConfigMapPayload(pod, missingKey, testObjects()); err != nil || len(payload) != 0 {
+		t.Errorf("expected an optional missing key to be skipped, got %v, %v", payload, err)
+	}
+
+	missing := &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}}
+	if _, err := ConfigMapPayload(pod, missing, testObjects()); !apierrors.IsNotFound(err) {
+		t.Errorf("expected a missing ConfigMap to fail, got %v", err)
+	}
+	missing.Optional = boolPtr(true)
+	if payload, err := ConfigMapPayload(pod, missing, testObjects()); err != nil || len(payload) != 0 {
+		t.Errorf("expected an optional missing ConfigMap to give no files, got %v, %v", payload, err)
+	}
+}
+
+func TestSecretPayload(t *testing.T) {
+	payload, err := SecretPayload(testPod(), &v1.SecretVolumeSource{
+		SecretName:  "credentials",
+		Items:       []v1.KeyToPath{{Key: "token", Path: "token"}},
+		DefaultMode: int32Ptr(0o400),
+	}, testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]File{"token": {Data: []byte("s3cr3t"), Mode: 0o400}}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("expected %v, got %v", want, payload)
+	}
+}
+
+func TestDownwardAPIPayload(t *testing.T) {
+	payload, err := DownwardAPIPayload(testPod(), &v1.DownwardAPIVolumeSource{
+		Items: []v1.DownwardAPIVolumeFile{
+			{Path: "name", FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+			{Path: "labels", FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+			{Path: "annotations", FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.annotations"}, Mode: int32Ptr(0o600)},
+			{Path: "cpu_limit", ResourceFieldRef: &v1.ResourceFieldSelector{ContainerName: "runner", Resource: "limits.cpu"}},
+			{Path: "memory_limit", ResourceFieldRef: &v1.ResourceFieldSelector{ContainerName: "runner", Resource: "limits.memory", Divisor: resource.MustParse("1Mi")}},
+		},
+	}, testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]File{
+		"name":         {Data: []byte("runner"), Mode: 0o644},
+		"labels":       {Data: []byte("app=\"runner\"\ntier=\"ci\""), Mode: 0o644},
+		"annotations":  {Data: []byte(`note="say \"hi\""`), Mode: 0o600},
+		"cpu_limit":    {Data: []byte("4"), Mode: 0o644},
+		"memory_limit": {Data: []byte("2048"), Mode: 0o644},
+	}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("expected %v, got %v", want, payload)
+	}
+}
+
+func TestProjectedPayload(t *testing.T) {
+	payload, err := ProjectedPayload(testPod(), &v1.ProjectedVolumeSource{
+		Sources: []v1.VolumeProjection{
+			{ConfigMap: &v1.ConfigMapProjection{
+				LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+				Items:                []v1.KeyToPath{{Key: "app.conf", Path: "app.conf"}},
+			}},
+			{Secret: &v1.SecretProjection{
+				LocalObjectReference: v1.LocalObjectReference{Name: "credentials"},
+				Items:                []v1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+			}},
+			{DownwardAPI: &v1.DownwardAPIProjection{
+				Items: []v1.DownwardAPIVolumeFile{{Path: "namespace", FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+			}},
+			{ServiceAccountToken: &v1.ServiceAccountTokenProjection{Path: "token"}},
+			{ServiceAccountToken: &v1.ServiceAccountTokenProjection{Path: "vault-token", Audience: "vault", ExpirationSeconds: int64Ptr(600)}},
+		},
+		DefaultMode: int32Ptr(0o444),
+	}, testObjects(), testAllocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]File{
+		"app.conf":  {Data: []byte("level=debug"), Mode: 0o444},
+		"ca.crt":    {Data: []byte("ca"), Mode: 0o444},
+		"namespace": {Data: []byte("ci"), Mode: 0o444},
+		"token":     {Data: []byte("ci/default audiences=[] expiration=3600 pod=runner"), Mode: 0o444},
+		// the service account of the pod is default
+		"vault-token": {Data: []byte("ci/default audiences=[vault] expiration=600 pod=runner"), Mode: 0o444},
+	}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("expected %v, got %v", want, payload)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	pod := testPod()
+	pod.Spec.Volumes = []v1.Volume{
+		{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{}}},
+		{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data-web-0"}}},
+	}
+	if err := Validate(pod, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, v := range map[string]v1.Volume{
+		"unsupported": {Name: "data", VolumeSource: v1.VolumeSource{NFS: &v1.NFSVolumeSource{}}},
+		"long name":   {Name: "a-volume-name-longer-than-a-mount-tag", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		"long claim":  {Name: "a-name-longer-than-a-disk-id", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+	} {
+		pod.Spec.Volumes = []v1.Volume{v}
+		var unsupported *UnsupportedError
+		if err := Validate(pod, nil); !errors.As(err, &unsupported) || unsupported.Volume != v.Name {
+			t.Errorf("%s: expected an UnsupportedError, got %v", name, err)
+		}
+	}
+}
+
+func TestPrepareAndUpdate(t *testing.T) {
+	dir := t.TempDir()
+	objects := testObjects()
+	pod := testPod()
+	pod.Spec.Volumes = []v1.Volume{
+		{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}}},
+		{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+	}
+	pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{
+		{Name: "config", MountPath: "/etc/runner"},
+		{Name: "scratch", MountPath: "/tmp/scratch"},
+		{Name: "cache", MountPath: "/var/cache", ReadOnly: true},
+	}
+
+	shares, err := Prepare(dir, pod, objects, testAllocatable, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []spec.Share{
+		{Tag: "config", Path: filepath.Join(dir, "config"), ReadOnly: true},
+		{Tag: "scratch", Path: filepath.Join(dir, "scratch")},
+		{Tag: "cache", Path: filepath.Join(dir, "cache"), ReadOnly: true},
+	}
+	if !reflect.DeepEqual(shares, want) {
+		t.Errorf("expected %v, got %v", want, shares)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "config", "app.conf")); err != nil || string(data) != "level=debug" {
+		t.Errorf("expected the ConfigMap to be written, got %q, %v", data, err)
+	}
+
+	updated, err := Update(dir, pod, objects, testAllocatable)
+	if err != nil || len(updated) != 0 {
+		t.Errorf("expected no update, got %v, %v", updated, err)
+	}
+
+	objects.configMaps["ci/settings"] = &v1.ConfigMap{Data: map[string]string{"app.conf": "level=info"}}
+	updated, err = Update(dir, pod, objects, testAllocatable)
+	if err != nil || !reflect.DeepEqual(updated, []string{"config"}) {
+		t.Errorf("expected the config volume to be updated, got %v, %v", updated, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "config", "app.conf")); err != nil || string(data) != "level=info" {
+		t.Errorf("expected the ConfigMap update to be written, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config", "region")); !os.IsNotExist(err) {
+		t.Errorf("expected the removed key to be removed, got %v", err)
+	}
+
+	// a deleted ConfigMap keeps the last content
+	delete(objects.configMaps, "ci/settings")
+	var mountErr *MountError
+	if _, err := Update(dir, pod, objects, testAllocatable); !errors.As(err, &mountErr) || mountErr.Volume != "config" {
+		t.Errorf("expected a MountError, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "config", "app.conf")); err != nil || string(data) != "level=info" {
+		t.Errorf("expected the last content to be kept, got %q, %v", data, err)
+	}
+}
+
+func TestPrepareMissingConfigMap(t *testing.T) {
+	pod := testPod()
+	pod.Spec.Volumes = []v1.Volume{
+		{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}}}},
+	}
+	_, err := Prepare(t.TempDir(), pod, testObjects(), testAllocatable, nil)
+	var mountErr *MountError
+	if !errors.As(err, &mountErr) || mountErr.Volume != "config" {
+		t.Errorf("expected a MountError, got %v", err)
+	}
+}
@@ -11,7 +11,7 @@ import (
 // 	return os.MkdirAll(GetVMBundlePath(), 0777)
 // }
 
-// GetVMBundlePath gets macOS VM bundle path.
+// GetVMBundlePath gets the default macOS VM bundle path.
 func GetVMBundlePath() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -21,28 +21,33 @@ func GetVMBundlePath() string {
 }
 
 // GetAuxiliaryStoragePath gets a path for auxiliary storage.
-func GetAuxiliaryStoragePath() string {
-	return filepath.Join(GetVMBundlePath(), "AuxiliaryStorage")
+func GetAuxiliaryStoragePath(bundlePath string) string {
+	return filepath.Join(bundlePath, "AuxiliaryStorage")
 }
 
 // GetDiskImagePath gets a path for disk image.
-func GetDiskImagePath() string {
-	return filepath.Join(GetVMBundlePath(), "Disk.img")
+func GetDiskImagePath(bundlePath string) string {
+	return filepath.Join(bundlePath, "Disk.img")
 }
 
 // GetHardwareModelPath gets a path for hardware model.
-func GetHardwareModelPath() string {
-	return filepath.Join(GetVMBundlePath(), "HardwareModel")
+func GetHardwareModelPath(bundlePath string) string {
+	return filepath.Join(bundlePath, "HardwareModel")
 }
 
 // GetMachineIdentifierPath gets a path for machine identifier.
-func GetMachineIdentifierPath() string {
-	return filepath.Join(GetVMBundlePath(), "MachineIdentifier")
+func GetMachineIdentifierPath(bundlePath string) string {
+	return filepath.Join(bundlePath, "MachineIdentifier")
+}
+
+// GetEFIVariableStorePath gets a path for the EFI variable store of Linux guests.
+func GetEFIVariableStorePath(bundlePath string) string {
+	return filepath.Join(bundlePath, "EFIVariableStore")
 }
 
 // GetRestoreImagePath gets a path for restore image file.
-func GetRestoreImagePath() string {
-	return filepath.Join(GetVMBundlePath(), "RestoreImage.ipsw")
+func GetRestoreImagePath(bundlePath string) string {
+	return filepath.Join(bundlePath, "RestoreImage.ipsw")
 }
 
 // CreateFileAndWriteTo creates a new file and write data to it.
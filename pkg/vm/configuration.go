@@ -2,24 +2,26 @@ package vm
 
 import (
 	"fmt"
+	"net"
 	"os"
 
 	"github.com/Code-Hex/vz/v3"
+	"github.com/raikerian/macos-virtual-kubelet/pkg/vm/spec"
 )
 
-func SetupMacPlatformConfiguration() (*vz.MacPlatformConfiguration, error) {
-	auxiliaryStorage, err := vz.NewMacAuxiliaryStorage(GetAuxiliaryStoragePath())
+func SetupMacPlatformConfiguration(bundlePath string) (*vz.MacPlatformConfiguration, error) {
+	auxiliaryStorage, err := vz.NewMacAuxiliaryStorage(GetAuxiliaryStoragePath(bundlePath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a new mac auxiliary storage: %w", err)
 	}
 	hardwareModel, err := vz.NewMacHardwareModelWithDataPath(
-		GetHardwareModelPath(),
+		GetHardwareModelPath(bundlePath),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a new hardware model: %w", err)
 	}
 	machineIdentifier, err := vz.NewMacMachineIdentifierWithDataPath(
-		GetMachineIdentifierPath(),
+		GetMachineIdentifierPath(bundlePath),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a new machine identifier: %w", err)
@@ -31,98 +33,218 @@ func SetupMacPlatformConfiguration() (*vz.MacPlatformConfiguration, error) {
 	)
 }
 
-func CreateVMConfiguration(platformConfig vz.PlatformConfiguration, cpuCount uint, memorySize uint64, networkInterfaceIdentifier string) (*vz.VirtualMachineConfiguration, error) {
+// SetupGenericPlatformConfiguration returns the platform of Linux guests.
+// The machine identifier is generated and saved in the bundle on first boot.
+func SetupGenericPlatformConfiguration(bundlePath string) (*vz.GenericPlatformConfiguration, error) {
+	path := GetMachineIdentifierPath(bundlePath)
+	machineIdentifier, err := vz.NewGenericMachineIdentifierWithDataPath(path)
+	if err != nil {
+		if _, statErr := os.Stat(path); !os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("failed to load the machine identifier: %w", err)
+		}
+		machineIdentifier, err = vz.NewGenericMachineIdentifier()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a new machine identifier: %w", err)
+		}
+		if err := CreateFileAndWriteTo(machineIdentifier.DataRepresentation(), path); err != nil {
+			return nil, err
+		}
+	}
+	return vz.NewGenericPlatformConfiguration(
+		vz.WithGenericMachineIdentifier(machineIdentifier),
+	)
+}
+
+// CreatePlatformConfiguration returns the platform the guest of p runs on.
+func CreatePlatformConfiguration(p spec.Plan) (vz.PlatformConfiguration, error) {
+	if p.BootLoader == spec.BootLoaderMacOS {
+		return SetupMacPlatformConfiguration(p.BundlePath)
+	}
+	return SetupGenericPlatformConfiguration(p.BundlePath)
+}
+
+// CreateBootLoader returns the boot loader of p.
+func CreateBootLoader(p spec.Plan) (vz.BootLoader, error) {
+	switch p.BootLoader {
+	case spec.BootLoaderMacOS:
+		return vz.NewMacOSBootLoader()
+	case spec.BootLoaderLinux:
+		var opts []vz.LinuxBootLoaderOption
+		if p.CommandLine != "" {
+			opts = append(opts, vz.WithCommandLine(p.CommandLine))
+		}
+		if p.Initrd != "" {
+			opts = append(opts, vz.WithInitrd(p.Initrd))
+		}
+		return vz.NewLinuxBootLoader(p.Kernel, opts...)
+	case spec.BootLoaderEFI:
+		path := GetEFIVariableStorePath(p.BundlePath)
+		var opts []vz.NewEFIVariableStoreOption
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			opts = append(opts, vz.WithCreatingEFIVariableStore())
+		}
+		variableStore, err := vz.NewEFIVariableStore(path, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the EFI variable store: %w", err)
+		}
+		return vz.NewEFIBootLoader(vz.WithEFIVariableStore(variableStore))
+	default:
+		return nil, fmt.Errorf("unsupported boot loader %q", p.BootLoader)
+	}
+}
+
+func CreateVMConfiguration(p spec.Plan) (*vz.VirtualMachineConfiguration, error) {
+	s := p.Spec
 	// verify cpu count
-	if cpuCount > vz.VirtualMachineConfigurationMaximumAllowedCPUCount() {
-		return nil, fmt.Errorf("cpu count is too large: %d", cpuCount)
+	if s.CPUs > vz.VirtualMachineConfigurationMaximumAllowedCPUCount() {
+		return nil, fmt.Errorf("cpu count is too large: %d", s.CPUs)
 	}
-	if cpuCount < vz.VirtualMachineConfigurationMinimumAllowedCPUCount() {
-		return nil, fmt.Errorf("cpu count is too small: %d", cpuCount)
+	if s.CPUs < vz.VirtualMachineConfigurationMinimumAllowedCPUCount() {
+		return nil, fmt.Errorf("cpu count is too small: %d", s.CPUs)
 	}
 
 	// verify memory size
-	if memorySize > vz.VirtualMachineConfigurationMaximumAllowedMemorySize() {
-		return nil, fmt.Errorf("memory size is too large: %d", memorySize)
+	if s.Memory > vz.VirtualMachineConfigurationMaximumAllowedMemorySize() {
+		return nil, fmt.Errorf("memory size is too large: %d", s.Memory)
 	}
-	if memorySize < vz.VirtualMachineConfigurationMinimumAllowedMemorySize() {
-		return nil, fmt.Errorf("memory size is too small: %d", memorySize)
+	if s.Memory < vz.VirtualMachineConfigurationMinimumAllowedMemorySize() {
+		return nil, fmt.Errorf("memory size is too small: %d", s.Memory)
 	}
 
-	bootloader, err := vz.NewMacOSBootLoader()
+	bootloader, err := CreateBootLoader(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create boot loader: %w", err)
+	}
+	platformConfig, err := CreatePlatformConfiguration(p)
 	if err != nil {
 		return nil, err
 	}
 
 	config, err := vz.NewVirtualMachineConfiguration(
 		bootloader,
-		cpuCount,
-		memorySize,
+		s.CPUs,
+		s.Memory,
 	)
 	if err != nil {
 		return nil, err
 	}
 	config.SetPlatformVirtualMachineConfiguration(platformConfig)
-	graphicsDeviceConfig, err := CreateGraphicsDeviceConfiguration()
+	var graphicsDeviceConfig vz.GraphicsDeviceConfiguration
+	if p.Graphics == spec.GraphicsDeviceMac {
+		graphicsDeviceConfig, err = CreateGraphicsDeviceConfiguration(s.Display)
+	} else {
+		graphicsDeviceConfig, err = CreateVirtioGraphicsDeviceConfiguration(s.Display)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create graphics device configuration: %w", err)
 	}
 	config.SetGraphicsDevicesVirtualMachineConfiguration([]vz.GraphicsDeviceConfiguration{
 		graphicsDeviceConfig,
 	})
-	blockDeviceConfig, err := CreateBlockDeviceConfiguration(GetDiskImagePath())
+	diskPath := GetDiskImagePath(s.BundlePath)
+	if s.BootDisk != "" {
+		diskPath = s.BootDisk
+	}
+	blockDeviceConfig, err := CreateBlockDeviceConfiguration(diskPath, s.DiskSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create block device configuration: %w", err)
 	}
-	config.SetStorageDevicesVirtualMachineConfiguration([]vz.StorageDeviceConfiguration{blockDeviceConfig})
+	storageDevices := []vz.StorageDeviceConfiguration{blockDeviceConfig}
+	for _, disk := range s.Disks {
+		attachment, err := vz.NewDiskImageStorageDeviceAttachment(disk.Path, disk.ReadOnly)
+		if err != nil {
+			return nil, fmt.Errorf("failed to attach disk image %s: %w", disk.Path, err)
+		}
+		diskConfig, err := vz.NewVirtioBlockDeviceConfiguration(attachment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create block device configuration: %w", err)
+		}
+		if disk.ID != "" {
+			if err := diskConfig.SetBlockDeviceIdentifier(disk.ID); err != nil {
+				return nil, fmt.Errorf("failed to set the identifier of disk image %s: %w", disk.Path, err)
+			}
+		}
+		storageDevices = append(storageDevices, diskConfig)
+	}
+	config.SetStorageDevicesVirtualMachineConfiguration(storageDevices)
 
-	var networkInterface vz.BridgedNetwork
-	if networkInterfaceIdentifier != "" {
-		networkInterfaces := vz.NetworkInterfaces()
-		for _, b := range networkInterfaces {
-			if b.Identifier() == networkInterfaceIdentifier {
-				networkInterface = b
-				break
+	if len(s.Shares) > 0 {
+		sharingDevices := make([]vz.DirectorySharingDeviceConfiguration, 0, len(s.Shares))
+		for _, share := range s.Shares {
+			sharingDeviceConfig, err := CreateDirectorySharingDeviceConfiguration(share)
+			if err != nil {
+				return nil, fmt.Errorf("failed to share directory %s: %w", share.Path, err)
 			}
+			sharingDevices = append(sharingDevices, sharingDeviceConfig)
 		}
-		if networkInterface == nil {
-			return nil, fmt.Errorf("network interface %s not found", networkInterfaceIdentifier)
+		config.SetDirectorySharingDevicesVirtualMachineConfiguration(sharingDevices)
+	}
+
+	if s.Network.Mode != spec.NetworkModeIsolated {
+		networkDeviceConfig, err := networkDeviceConfiguration(s.Network)
+		if err != nil {
+			return nil, err
 		}
+		config.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{
+			networkDeviceConfig,
+		})
 	}
-	networkDeviceConfig, err := CreateNetworkDeviceConfiguration(networkInterface)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create network device configuration: %w", err)
+
+	if s.Devices.Pointing {
+		usbScreenPointingDevice, err := vz.NewUSBScreenCoordinatePointingDeviceConfiguration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pointing device configuration: %w", err)
+		}
+		pointingDevices := []vz.PointingDeviceConfiguration{usbScreenPointingDevice}
+
+		if p.Trackpad {
+			trackpad, err := vz.NewMacTrackpadConfiguration()
+			if err == nil {
+				pointingDevices = append(pointingDevices, trackpad)
+			}
+		}
+		config.SetPointingDevicesVirtualMachineConfiguration(pointingDevices)
 	}
-	config.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{
-		networkDeviceConfig,
-	})
 
-	usbScreenPointingDevice, err := vz.NewUSBScreenCoordinatePointingDeviceConfiguration()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create pointing device configuration: %w", err)
+	if s.Devices.Keyboard {
+		keyboardDeviceConfig, err := CreateKeyboardConfiguration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create keyboard device configuration: %w", err)
+		}
+		config.SetKeyboardsVirtualMachineConfiguration([]vz.KeyboardConfiguration{
+			keyboardDeviceConfig,
+		})
 	}
-	pointingDevices := []vz.PointingDeviceConfiguration{usbScreenPointingDevice}
 
-	trackpad, err := vz.NewMacTrackpadConfiguration()
-	if err == nil {
-		pointingDevices = append(pointingDevices, trackpad)
+	if s.Devices.Audio {
+		audioDeviceConfig, err := CreateAudioDeviceConfiguration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audio device configuration: %w", err)
+		}
+		config.SetAudioDevicesVirtualMachineConfiguration([]vz.AudioDeviceConfiguration{
+			audioDeviceConfig,
+		})
 	}
-	config.SetPointingDevicesVirtualMachineConfiguration(pointingDevices)
 
-	keyboardDeviceConfig, err := CreateKeyboardConfiguration()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create keyboard device configuration: %w", err)
+	if p.Entropy {
+		entropyDeviceConfig, err := vz.NewVirtioEntropyDeviceConfiguration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create entropy device configuration: %w", err)
+		}
+		config.SetEntropyDevicesVirtualMachineConfiguration([]*vz.VirtioEntropyDeviceConfiguration{
+			entropyDeviceConfig,
+		})
 	}
-	config.SetKeyboardsVirtualMachineConfiguration([]vz.KeyboardConfiguration{
-		keyboardDeviceConfig,
-	})
 
-	audioDeviceConfig, err := CreateAudioDeviceConfiguration()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create audio device configuration: %w", err)
+	if s.AgentPort != 0 {
+		socketDeviceConfig, err := vz.NewVirtioSocketDeviceConfiguration()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create socket device configuration: %w", err)
+		}
+		config.SetSocketDevicesVirtualMachineConfiguration([]vz.SocketDeviceConfiguration{
+			socketDeviceConfig,
+		})
 	}
-	config.SetAudioDevicesVirtualMachineConfiguration([]vz.AudioDeviceConfiguration{
-		audioDeviceConfig,
-	})
 
 	validated, err := config.Validate()
 	if err != nil {
@@ -135,12 +257,12 @@ func CreateVMConfiguration(platformConfig vz.PlatformConfiguration, cpuCount uin
 	return config, nil
 }
 
-func CreateGraphicsDeviceConfiguration() (*vz.MacGraphicsDeviceConfiguration, error) {
+func CreateGraphicsDeviceConfiguration(display spec.Display) (*vz.MacGraphicsDeviceConfiguration, error) {
 	graphicDeviceConfig, err := vz.NewMacGraphicsDeviceConfiguration()
 	if err != nil {
 		return nil, err
 	}
-	graphicsDisplayConfig, err := vz.NewMacGraphicsDisplayConfiguration(1920, 1200, 80)
+	graphicsDisplayConfig, err := vz.NewMacGraphicsDisplayConfiguration(display.Width, display.Height, display.PixelsPerInch)
 	if err != nil {
 		return nil, err
 	}
@@ -150,9 +272,26 @@ func CreateGraphicsDeviceConfiguration() (*vz.MacGraphicsDeviceConfiguration, er
 	return graphicDeviceConfig, nil
 }
 
-func CreateBlockDeviceConfiguration(diskPath string) (*vz.VirtioBlockDeviceConfiguration, error) {
-	// create disk image with 128 GiB
-	if err := vz.CreateDiskImage(diskPath, 128*1024*1024*1024); err != nil {
+// CreateVirtioGraphicsDeviceConfiguration returns the virtio GPU of Linux
+// guests. The pixel density is left to the guest.
+func CreateVirtioGraphicsDeviceConfiguration(display spec.Display) (*vz.VirtioGraphicsDeviceConfiguration, error) {
+	graphicDeviceConfig, err := vz.NewVirtioGraphicsDeviceConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	scanoutConfig, err := vz.NewVirtioGraphicsScanoutConfiguration(display.Width, display.Height)
+	if err != nil {
+		return nil, err
+	}
+	graphicDeviceConfig.SetScanouts(
+		scanoutConfig,
+	)
+	return graphicDeviceConfig, nil
+}
+
+func CreateBlockDeviceConfiguration(diskPath string, diskSize uint64) (*vz.VirtioBlockDeviceConfiguration, error) {
+	// create the disk image if the bundle does not have one yet
+	if err := vz.CreateDiskImage(diskPath, int64(diskSize)); err != nil {
 		if !os.IsExist(err) {
 			return nil, fmt.Errorf("failed to create disk image: %w", err)
 		}
@@ -168,7 +307,66 @@ func CreateBlockDeviceConfiguration(diskPath string) (*vz.VirtioBlockDeviceConfi
 	return vz.NewVirtioBlockDeviceConfiguration(diskImageAttachment)
 }
 
-func CreateNetworkDeviceConfiguration(networkInterface vz.BridgedNetwork) (*vz.VirtioNetworkDeviceConfiguration, error) {
+func CreateDirectorySharingDeviceConfiguration(share spec.Share) (*vz.VirtioFileSystemDeviceConfiguration, error) {
+	sharedDirectory, err := vz.NewSharedDirectory(share.Path, share.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	directoryShare, err := vz.NewSingleDirectoryShare(sharedDirectory)
+	if err != nil {
+		return nil, err
+	}
+	sharingDeviceConfig, err := vz.NewVirtioFileSystemDeviceConfiguration(share.Tag)
+	if err != nil {
+		return nil, err
+	}
+	sharingDeviceConfig.SetDirectoryShare(directoryShare)
+	return sharingDeviceConfig, nil
+}
+
+// networkDeviceConfiguration creates the network device attached as n.
+func networkDeviceConfiguration(n spec.Network) (*vz.VirtioNetworkDeviceConfiguration, error) {
+	if n.Mode == spec.NetworkModeUserspace {
+		networkDeviceConfig, err := CreateFileHandleNetworkDeviceConfiguration(n.File, n.MACAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create network device configuration: %w", err)
+		}
+		return networkDeviceConfig, nil
+	}
+
+	var networkInterface vz.BridgedNetwork
+	if n.Mode == spec.NetworkModeBridged {
+		for _, b := range vz.NetworkInterfaces() {
+			if b.Identifier() == n.Interface {
+				networkInterface = b
+				break
+			}
+		}
+		if networkInterface == nil {
+			return nil, fmt.Errorf("network interface %s not found", n.Interface)
+		}
+	}
+	networkDeviceConfig, err := CreateNetworkDeviceConfiguration(networkInterface, n.MACAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network device configuration: %w", err)
+	}
+	return networkDeviceConfig, nil
+}
+
+// BridgedInterfaces returns the identifiers of the host interfaces virtual
+// machines can be bridged to, e.g. en0.
+func BridgedInterfaces() []string {
+	var names []string
+	for _, b := range vz.NetworkInterfaces() {
+		names = append(names, b.Identifier())
+	}
+	return names
+}
+
+// CreateNetworkDeviceConfiguration creates a network device bridged to
+// networkInterface, or behind the NAT when it is nil, with the MAC address
+// mac unless it is empty.
+func CreateNetworkDeviceConfiguration(networkInterface vz.BridgedNetwork, mac string) (*vz.VirtioNetworkDeviceConfiguration, error) {
 	var attachment vz.NetworkDeviceAttachment
 	var err error
 	if networkInterface != nil {
@@ -183,7 +381,40 @@ func CreateNetworkDeviceConfiguration(networkInterface vz.BridgedNetwork) (*vz.V
 		}
 	}
 
-	return vz.NewVirtioNetworkDeviceConfiguration(attachment)
+	return createNetworkDeviceConfiguration(attachment, mac)
+}
+
+// CreateFileHandleNetworkDeviceConfiguration creates a network device
+// exchanging ethernet frames over the datagram socket file, with the MAC
+// address mac unless it is empty.
+func CreateFileHandleNetworkDeviceConfiguration(file *os.File, mac string) (*vz.VirtioNetworkDeviceConfiguration, error) {
+	if file == nil {
+		return nil, fmt.Errorf("no file handle to attach the network device to")
+	}
+	attachment, err := vz.NewFileHandleNetworkDeviceAttachment(file)
+	if err != nil {
+		return nil, err
+	}
+	return createNetworkDeviceConfiguration(attachment, mac)
+}
+
+func createNetworkDeviceConfiguration(attachment vz.NetworkDeviceAttachment, mac string) (*vz.VirtioNetworkDeviceConfiguration, error) {
+	config, err := vz.NewVirtioNetworkDeviceConfiguration(attachment)
+	if err != nil {
+		return nil, err
+	}
+	if mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %s: %w", mac, err)
+		}
+		macAddress, err := vz.NewMACAddress(hw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %s: %w", mac, err)
+		}
+		config.SetMACAddress(macAddress)
+	}
+	return config, nil
 }
 
 func CreateKeyboardConfiguration() (*vz.USBKeyboardConfiguration, error) {
@@ -0,0 +1,144 @@
+package spec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// AnnotationPrefix is the namespace of the pod annotations customizing the
+// virtual machine of a pod.
+const AnnotationPrefix = "macos.virtual-kubelet.io/"
+
+// Pod annotations overriding the provider configuration for a single pod.
+const (
+	// AnnotationDisplay sets the display as <width>x<height>[@<pixels per inch>],
+	// e.g. "2560x1440@144". The pixel density defaults to the configured one.
+	AnnotationDisplay = AnnotationPrefix + "display"
+	// AnnotationDiskSize sets the minimum size of the boot disk as a
+	// quantity, e.g. "200Gi". When the disk image of the bundle is smaller,
+	// the pod boots from its own clone of the image grown to that size and
+	// the guest grows its boot volume. The bundle image is left untouched.
+	AnnotationDiskSize = AnnotationPrefix + "disk-size"
+	// AnnotationNetwork sets the network attachment as "nat", "isolated",
+	// "userspace", "bridged" or "bridged:<interface>", e.g. "bridged:en1".
+	// "bridged" keeps the configured interface, if any, or detects one.
+	AnnotationNetwork = AnnotationPrefix + "network"
+	// AnnotationAudio attaches ("true") or removes ("false") the audio device.
+	AnnotationAudio = AnnotationPrefix + "audio"
+)
+
+// FromAnnotations returns base customized by the VM annotations of a pod.
+// Annotations outside of the VM ones are ignored.
+func FromAnnotations(base Spec, annotations map[string]string) (Spec, error) {
+	s := base
+	var errs field.ErrorList
+	path := field.NewPath("metadata", "annotations")
+
+	if v, ok := annotations[AnnotationDisplay]; ok {
+		display, err := parseDisplay(v, base.Display.PixelsPerInch)
+		if err != nil {
+			errs = append(errs, field.Invalid(path.Key(AnnotationDisplay), v, err.Error()))
+		}
+		s.Display = display
+	}
+
+	if v, ok := annotations[AnnotationDiskSize]; ok {
+		q, err := resource.ParseQuantity(v)
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(path.Key(AnnotationDiskSize), v, err.Error()))
+		case q.Sign() <= 0:
+			errs = append(errs, field.Invalid(path.Key(AnnotationDiskSize), v, "must be greater than 0"))
+		default:
+			s.BootDiskSize = uint64(q.Value())
+		}
+	}
+
+	if v, ok := annotations[AnnotationNetwork]; ok {
+		network, err := parseNetwork(v, base.Network)
+		if err != nil {
+			errs = append(errs, field.Invalid(path.Key(AnnotationNetwork), v, err.Error()))
+		}
+		s.Network = network
+	}
+
+	if v, ok := annotations[AnnotationAudio]; ok {
+		audio, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, field.Invalid(path.Key(AnnotationAudio), v, "must be true or false"))
+		}
+		s.Devices.Audio = audio
+	}
+
+	if len(errs) > 0 {
+		return base, errs.ToAggregate()
+	}
+	return s, nil
+}
+
+func parseDisplay(v string, defaultPixelsPerInch int64) (Display, error) {
+	size, ppi, hasPPI := strings.Cut(v, "@")
+	width, height, ok := strings.Cut(size, "x")
+	if !ok {
+		return Display{}, fmt.Errorf("must be <width>x<height>[@<pixels per inch>]")
+	}
+
+	d := Display{PixelsPerInch: defaultPixelsPerInch}
+	var err error
+	if d.Width, err = parsePositive(width); err != nil {
+		return Display{}, fmt.Errorf("invalid width: %w", err)
+	}
+	if d.Height, err = parsePositive(height); err != nil {
+		return Display{}, fmt.Errorf("invalid height: %w", err)
+	}
+	if hasPPI {
+		if d.PixelsPerInch, err = parsePositive(ppi); err != nil {
+			return Display{}, fmt.Errorf("invalid pixels per inch: %w", err)
+		}
+	}
+	return d, nil
+}
+
+func parsePositive(v string) (int64, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", v)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%d must be greater than 0", n)
+	}
+	return n, nil
+}
+
+func parseNetwork(v string, base Network) (Network, error) {
+	mode, iface, hasIface := strings.Cut(v, ":")
+	switch NetworkMode(mode) {
+	case NetworkModeNAT:
+		if hasIface {
+			return Network{}, fmt.Errorf("an interface is only used in bridged mode")
+		}
+		return Network{Mode: NetworkModeNAT}, nil
+	case NetworkModeIsolated, NetworkModeUserspace:
+		if hasIface {
+			return Network{}, fmt.Errorf("an interface is only used in bridged mode")
+		}
+		return Network{Mode: NetworkMode(mode)}, nil
+	case NetworkModeBridged:
+		if !hasIface {
+			if base.Mode != NetworkModeBridged {
+				return Network{Mode: NetworkModeBridged}, nil
+			}
+			return base, nil
+		}
+		if iface == "" {
+			return Network{}, fmt.Errorf("the interface must not be empty")
+		}
+		return Network{Mode: NetworkModeBridged, Interface: iface}, nil
+	default:
+		return Network{}, fmt.Errorf("mode must be %s, %s, %s or %s", NetworkModeNAT, NetworkModeBridged, NetworkModeIsolated, NetworkModeUserspace)
+	}
+}
@@ -0,0 +1,155 @@
+package spec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testBase = Spec{
+	DiskSize: 64 << 30,
+	Display:  Display{Width: 1920, Height: 1200, PixelsPerInch: 80},
+	Network:  Network{Mode: NetworkModeBridged, Interface: "en0"},
+	Devices:  Devices{Audio: true, Keyboard: true, Pointing: true},
+}
+
+func TestFromAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		want        func(s Spec) Spec
+	}{
+		{
+			name:        "no annotations",
+			annotations: map[string]string{"other": "value"},
+			want:        func(s Spec) Spec { return s },
+		},
+		{
+			name:        "display with default density",
+			annotations: map[string]string{AnnotationDisplay: "1024x768"},
+			want: func(s Spec) Spec {
+				s.Display = Display{Width: 1024, Height: 768, PixelsPerInch: 80}
+				return s
+			},
+		},
+		{
+			name:        "display with density",
+			annotations: map[string]string{AnnotationDisplay: "2560x1440@144"},
+			want: func(s Spec) Spec {
+				s.Display = Display{Width: 2560, Height: 1440, PixelsPerInch: 144}
+				return s
+			},
+		},
+		{
+			name:        "disk size",
+			annotations: map[string]string{AnnotationDiskSize: "200Gi"},
+			want: func(s Spec) Spec {
+				s.BootDiskSize = 200 << 30
+				return s
+			},
+		},
+		{
+			name:        "nat network",
+			annotations: map[string]string{AnnotationNetwork: "nat"},
+			want: func(s Spec) Spec {
+				s.Network = Network{Mode: NetworkModeNAT}
+				return s
+			},
+		},
+		{
+			name:        "isolated network",
+			annotations: map[string]string{AnnotationNetwork: "isolated"},
+			want: func(s Spec) Spec {
+				s.Network = Network{Mode: NetworkModeIsolated}
+				return s
+			},
+		},
+		{
+			name:        "userspace network",
+			annotations: map[string]string{AnnotationNetwork: "userspace"},
+			want: func(s Spec) Spec {
+				s.Network = Network{Mode: NetworkModeUserspace}
+				return s
+			},
+		},
+		{
+			name:        "bridged network keeps the configured interface",
+			annotations: map[string]string{AnnotationNetwork: "bridged"},
+			want:        func(s Spec) Spec { return s },
+		},
+		{
+			name:        "bridged network on another interface",
+			annotations: map[string]string{AnnotationNetwork: "bridged:en1"},
+			want: func(s Spec) Spec {
+				s.Network = Network{Mode: NetworkModeBridged, Interface: "en1"}
+				return s
+			},
+		},
+		{
+			name:        "audio disabled",
+			annotations: map[string]string{AnnotationAudio: "false"},
+			want: func(s Spec) Spec {
+				s.Devices.Audio = false
+				return s
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := FromAnnotations(testBase, tc.annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.want(testBase); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestFromAnnotationsErrors(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "display without height", annotations: map[string]string{AnnotationDisplay: "1024"}, want: AnnotationDisplay},
+		{name: "zero display width", annotations: map[string]string{AnnotationDisplay: "0x768"}, want: "invalid width"},
+		{name: "invalid display density", annotations: map[string]string{AnnotationDisplay: "1024x768@retina"}, want: "invalid pixels per inch"},
+		{name: "invalid disk size", annotations: map[string]string{AnnotationDiskSize: "big"}, want: AnnotationDiskSize},
+		{name: "negative disk size", annotations: map[string]string{AnnotationDiskSize: "-1Gi"}, want: "must be greater than 0"},
+		{name: "unknown network mode", annotations: map[string]string{AnnotationNetwork: "host"}, want: "mode must be"},
+		{name: "nat with interface", annotations: map[string]string{AnnotationNetwork: "nat:en0"}, want: "only used in bridged mode"},
+		{name: "isolated with interface", annotations: map[string]string{AnnotationNetwork: "isolated:en0"}, want: "only used in bridged mode"},
+		{name: "empty bridged interface", annotations: map[string]string{AnnotationNetwork: "bridged:"}, want: "must not be empty"},
+		{name: "invalid audio", annotations: map[string]string{AnnotationAudio: "loud"}, want: "must be true or false"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := FromAnnotations(testBase, tc.annotations)
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", got)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected error to mention %q, got %v", tc.want, err)
+			}
+			if !reflect.DeepEqual(got, testBase) {
+				t.Errorf("expected the base spec to be returned on error, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestFromAnnotationsBridgedWithoutConfiguredInterface(t *testing.T) {
+	base := testBase
+	base.Network = Network{Mode: NetworkModeNAT}
+	got, err := FromAnnotations(base, map[string]string{AnnotationNetwork: "bridged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Network != (Network{Mode: NetworkModeBridged}) {
+		t.Errorf("expected the interface to be left to detection, got %+v", got.Network)
+	}
+}
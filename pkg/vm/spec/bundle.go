@@ -0,0 +1,94 @@
+package spec
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// BundleMetadataFile is the file of a VM bundle describing the guest it
+// holds. Bundles without it hold macOS.
+const BundleMetadataFile = "Bundle.json"
+
+// Bundle describes the guest installed in a VM bundle.
+type Bundle struct {
+	Guest Guest `json:"guest"`
+	Boot  Boot  `json:"boot,omitempty"`
+}
+
+// Boot selects how a Linux guest boots. Either Kernel or EFI is set.
+// Paths are relative to the bundle.
+type Boot struct {
+	// Kernel is the uncompressed arm64 kernel image booted directly.
+	Kernel string `json:"kernel,omitempty"`
+	// Initrd is the initial ramdisk loaded with Kernel.
+	Initrd string `json:"initrd,omitempty"`
+	// CommandLine is the kernel command line, e.g. "console=hvc0 root=/dev/vda".
+	CommandLine string `json:"commandLine,omitempty"`
+	// EFI boots the disk image through UEFI, keeping the firmware
+	// variables in the bundle.
+	EFI bool `json:"efi,omitempty"`
+}
+
+// LoadBundle reads the metadata of the VM bundle at bundlePath.
+func LoadBundle(bundlePath string) (Bundle, error) {
+	data, err := os.ReadFile(filepath.Join(bundlePath, BundleMetadataFile))
+	if os.IsNotExist(err) {
+		return Bundle{Guest: GuestMacOS}, nil
+	}
+	if err != nil {
+		return Bundle{}, fmt.Errorf("failed to read bundle metadata: %w", err)
+	}
+
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return Bundle{}, fmt.Errorf("failed to parse bundle metadata %s: %w", bundlePath, err)
+	}
+	if errs := ValidateBundle(b); len(errs) > 0 {
+		return Bundle{}, fmt.Errorf("invalid bundle metadata %s: %w", bundlePath, errs.ToAggregate())
+	}
+	return b, nil
+}
+
+// ValidateBundle returns the problems of the metadata b.
+func ValidateBundle(b Bundle) field.ErrorList {
+	var errs field.ErrorList
+	boot := field.NewPath("boot")
+
+	switch b.Guest {
+	case GuestMacOS:
+		if b.Boot != (Boot{}) {
+			errs = append(errs, field.Forbidden(boot, "macOS boots from the auxiliary storage"))
+		}
+	case GuestLinux:
+		switch {
+		case b.Boot.Kernel != "" && b.Boot.EFI:
+			errs = append(errs, field.Invalid(boot, b.Boot, "kernel and efi are mutually exclusive"))
+		case b.Boot.Kernel == "" && !b.Boot.EFI:
+			errs = append(errs, field.Required(boot, "one of kernel or efi must be set"))
+		case b.Boot.EFI:
+			if b.Boot.Initrd != "" {
+				errs = append(errs, field.Forbidden(boot.Child("initrd"), "only used with a kernel"))
+			}
+			if b.Boot.CommandLine != "" {
+				errs = append(errs, field.Forbidden(boot.Child("commandLine"), "only used with a kernel"))
+			}
+		}
+		for _, f := range []struct {
+			name, path string
+		}{
+			{"kernel", b.Boot.Kernel},
+			{"initrd", b.Boot.Initrd},
+		} {
+			if f.path != "" && !filepath.IsLocal(f.path) {
+				errs = append(errs, field.Invalid(boot.Child(f.name), f.path, "must be a relative path inside the bundle"))
+			}
+		}
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("guest"), b.Guest, []string{string(GuestLinux), string(GuestMacOS)}))
+	}
+	return errs
+}
@@ -0,0 +1,90 @@
+package spec
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// BootLoader is the boot loader a virtual machine starts with.
+type BootLoader string
+
+const (
+	// BootLoaderMacOS boots macOS on the Mac platform.
+	BootLoaderMacOS BootLoader = "macos"
+	// BootLoaderLinux boots a Linux kernel directly.
+	BootLoaderLinux BootLoader = "linux"
+	// BootLoaderEFI boots the disk image through UEFI.
+	BootLoaderEFI BootLoader = "efi"
+)
+
+// GraphicsDevice is the kind of graphics device of a virtual machine.
+type GraphicsDevice string
+
+const (
+	// GraphicsDeviceMac is the Mac graphics device, only supported by macOS.
+	GraphicsDeviceMac GraphicsDevice = "mac"
+	// GraphicsDeviceVirtio is the virtio GPU used by Linux guests.
+	GraphicsDeviceVirtio GraphicsDevice = "virtio"
+)
+
+// Plan is the device level configuration of a virtual machine, resolved
+// from its spec and the metadata of its bundle. Virtualization.framework is
+// configured from it without further decisions, so it can be checked on any
+// platform.
+type Plan struct {
+	Spec
+
+	BootLoader BootLoader
+	// Kernel, Initrd and CommandLine are set for BootLoaderLinux. The paths
+	// are absolute.
+	Kernel      string
+	Initrd      string
+	CommandLine string
+
+	Graphics GraphicsDevice
+	// Trackpad attaches the Mac trackpad next to the USB pointing device.
+	Trackpad bool
+	// Entropy attaches a virtio entropy device feeding the guest RNG.
+	Entropy bool
+}
+
+// NewPlan returns the plan of a virtual machine booting s from bundle b.
+func NewPlan(s Spec, b Bundle) (Plan, error) {
+	if s.Guest != b.Guest {
+		return Plan{}, fmt.Errorf("bundle %s holds a %s guest, not %s", s.BundlePath, b.Guest, s.Guest)
+	}
+
+	p := Plan{Spec: s}
+	switch s.Guest {
+	case GuestMacOS:
+		p.BootLoader = BootLoaderMacOS
+		p.Graphics = GraphicsDeviceMac
+		p.Trackpad = s.Devices.Pointing
+	case GuestLinux:
+		if b.Boot.EFI {
+			p.BootLoader = BootLoaderEFI
+		} else {
+			p.BootLoader = BootLoaderLinux
+			p.Kernel = filepath.Join(s.BundlePath, b.Boot.Kernel)
+			if b.Boot.Initrd != "" {
+				p.Initrd = filepath.Join(s.BundlePath, b.Boot.Initrd)
+			}
+			p.CommandLine = b.Boot.CommandLine
+		}
+		p.Graphics = GraphicsDeviceVirtio
+		p.Entropy = true
+	default:
+		return Plan{}, fmt.Errorf("unsupported guest %q", s.Guest)
+	}
+	return p, nil
+}
+
+// LoadPlan returns the plan of a virtual machine booting s from the bundle
+// at s.BundlePath.
+func LoadPlan(s Spec) (Plan, error) {
+	b, err := LoadBundle(s.BundlePath)
+	if err != nil {
+		return Plan{}, err
+	}
+	return NewPlan(s, b)
+}
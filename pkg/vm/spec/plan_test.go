@@ -0,0 +1,170 @@
+package spec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeBundle(t *testing.T, metadata string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if metadata != "" {
+		if err := os.WriteFile(filepath.Join(dir, BundleMetadataFile), []byte(metadata), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadBundle(t *testing.T) {
+	testCases := []struct {
+		name     string
+		metadata string
+		want     Bundle
+		wantErr  string
+	}{
+		{
+			name: "no metadata is macOS",
+			want: Bundle{Guest: GuestMacOS},
+		},
+		{
+			name:     "linux kernel",
+			metadata: `{"guest": "linux", "boot": {"kernel": "vmlinuz", "initrd": "initrd.img", "commandLine": "console=hvc0 root=/dev/vda"}}`,
+			want:     Bundle{Guest: GuestLinux, Boot: Boot{Kernel: "vmlinuz", Initrd: "initrd.img", CommandLine: "console=hvc0 root=/dev/vda"}},
+		},
+		{
+			name:     "linux efi",
+			metadata: `{"guest": "linux", "boot": {"efi": true}}`,
+			want:     Bundle{Guest: GuestLinux, Boot: Boot{EFI: true}},
+		},
+		{
+			name:     "linux without boot",
+			metadata: `{"guest": "linux"}`,
+			wantErr:  "one of kernel or efi must be set",
+		},
+		{
+			name:     "kernel and efi",
+			metadata: `{"guest": "linux", "boot": {"kernel": "vmlinuz", "efi": true}}`,
+			wantErr:  "mutually exclusive",
+		},
+		{
+			name:     "efi with command line",
+			metadata: `{"guest": "linux", "boot": {"efi": true, "commandLine": "quiet"}}`,
+			wantErr:  "boot.commandLine",
+		},
+		{
+			name:     "kernel outside the bundle",
+			metadata: `{"guest": "linux", "boot": {"kernel": "../vmlinuz"}}`,
+			wantErr:  "must be a relative path inside the bundle",
+		},
+		{
+			name:     "macOS with boot",
+			metadata: `{"guest": "macos", "boot": {"kernel": "vmlinuz"}}`,
+			wantErr:  "auxiliary storage",
+		},
+		{
+			name:     "unknown guest",
+			metadata: `{"guest": "windows"}`,
+			wantErr:  "guest",
+		},
+		{
+			name:     "malformed",
+			metadata: `{"guest": `,
+			wantErr:  "failed to parse",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := LoadBundle(writeBundle(t, tc.metadata))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, b)
+			}
+		})
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	macOS := testBase
+	macOS.Guest = GuestMacOS
+	macOS.BundlePath = "/var/lib/vms/VM.bundle"
+	linux := testBase
+	linux.Guest = GuestLinux
+	linux.BundlePath = "/var/lib/vms/Linux.bundle"
+
+	testCases := []struct {
+		name   string
+		spec   Spec
+		bundle Bundle
+		want   Plan
+	}{
+		{
+			name:   "macOS",
+			spec:   macOS,
+			bundle: Bundle{Guest: GuestMacOS},
+			want: Plan{
+				Spec:       macOS,
+				BootLoader: BootLoaderMacOS,
+				Graphics:   GraphicsDeviceMac,
+				Trackpad:   true,
+			},
+		},
+		{
+			name:   "linux kernel",
+			spec:   linux,
+			bundle: Bundle{Guest: GuestLinux, Boot: Boot{Kernel: "vmlinuz", Initrd: "initrd.img", CommandLine: "console=hvc0"}},
+			want: Plan{
+				Spec:        linux,
+				BootLoader:  BootLoaderLinux,
+				Kernel:      "/var/lib/vms/Linux.bundle/vmlinuz",
+				Initrd:      "/var/lib/vms/Linux.bundle/initrd.img",
+				CommandLine: "console=hvc0",
+				Graphics:    GraphicsDeviceVirtio,
+				Entropy:     true,
+			},
+		},
+		{
+			name:   "linux efi",
+			spec:   linux,
+			bundle: Bundle{Guest: GuestLinux, Boot: Boot{EFI: true}},
+			want: Plan{
+				Spec:       linux,
+				BootLoader: BootLoaderEFI,
+				Graphics:   GraphicsDeviceVirtio,
+				Entropy:    true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewPlan(tc.spec, tc.bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, p)
+			}
+		})
+	}
+}
+
+func TestNewPlanGuestMismatch(t *testing.T) {
+	s := testBase
+	s.Guest = GuestLinux
+	if _, err := NewPlan(s, Bundle{Guest: GuestMacOS}); err == nil {
+		t.Fatal("expected a linux spec on a macOS bundle to fail")
+	}
+}
@@ -0,0 +1,115 @@
+package spec
+
+import "os"
+
+// NetworkMode selects how the network device of a virtual machine is attached.
+type NetworkMode string
+
+const (
+	// NetworkModeBridged bridges the virtual machine to a host interface.
+	NetworkModeBridged NetworkMode = "bridged"
+	// NetworkModeNAT puts the virtual machine behind the host NAT.
+	NetworkModeNAT NetworkMode = "nat"
+	// NetworkModeIsolated attaches no network device.
+	NetworkModeIsolated NetworkMode = "isolated"
+	// NetworkModeUserspace attaches the network device to a file handle
+	// served by the userspace network stack of the provider.
+	NetworkModeUserspace NetworkMode = "userspace"
+)
+
+// Guest is the operating system a virtual machine boots.
+type Guest string
+
+const (
+	// GuestMacOS boots macOS from the auxiliary storage of the bundle.
+	GuestMacOS Guest = "macos"
+	// GuestLinux boots an arm64 Linux kernel, directly or through EFI.
+	GuestLinux Guest = "linux"
+)
+
+// Spec describes the hardware of a virtual machine independently of
+// Virtualization.framework, so it can be built and validated anywhere.
+type Spec struct {
+	Guest Guest
+
+	// BundlePath is the VM bundle holding the disk image, auxiliary
+	// storage, hardware model and machine identifier.
+	BundlePath string
+
+	CPUs   uint
+	Memory uint64
+
+	// DiskSize is the size the disk image is created with when the bundle
+	// does not have one yet.
+	DiskSize uint64
+	// BootDiskSize is the minimum size of the disk the guest boots from, 0
+	// for the disk image of the bundle as is. The bundle image is never
+	// resized: a pod needing more boots from a grown clone of it.
+	BootDiskSize uint64
+	// BootDisk is the disk image the guest boots from instead of the one of
+	// the bundle, e.g. such a clone. The bundle image is used when empty.
+	BootDisk string
+
+	// Disks are the disk images attached after the boot disk.
+	Disks []Disk
+	// Shares are the host directories shared with the guest over virtio-fs.
+	Shares []Share
+
+	Display Display
+	Network Network
+	Devices Devices
+
+	// AgentPort is the virtio socket port the guest agent listens on.
+	// No socket device is attached when it is 0.
+	AgentPort uint32
+}
+
+// Disk is a disk image attached to a virtual machine.
+type Disk struct {
+	Path     string
+	ReadOnly bool
+	// ID is the identifier the guest sees the disk with, as
+	// /dev/disk/by-id/virtio-<ID> on Linux. None is set when it is empty.
+	ID string
+}
+
+// MaxDiskIdentifierLength is the longest identifier of a disk, in bytes.
+const MaxDiskIdentifierLength = 20
+
+// MaxShareTagLength is the longest mount tag of a virtio-fs share, in bytes.
+const MaxShareTagLength = 36
+
+// Share is a host directory the guest mounts with its tag.
+type Share struct {
+	Tag      string
+	Path     string
+	ReadOnly bool
+}
+
+// Display is the graphics display of a virtual machine.
+type Display struct {
+	Width         int64
+	Height        int64
+	PixelsPerInch int64
+}
+
+// Network is the network attachment of a virtual machine.
+type Network struct {
+	Mode NetworkMode
+	// Interface is the host interface used in bridged mode, e.g. en0. The
+	// interface of the default route is used when it is empty.
+	Interface string
+	// MACAddress is the address of the network device, e.g.
+	// 02:4a:0b:c0:0d:0e, a random one when empty.
+	MACAddress string
+	// File is the datagram socket the network device exchanges ethernet
+	// frames over in userspace mode.
+	File *os.File
+}
+
+// Devices selects the optional devices attached to a virtual machine.
+type Devices struct {
+	Audio    bool
+	Keyboard bool
+	Pointing bool
+}
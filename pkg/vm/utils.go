@@ -1,9 +1,11 @@
 package vm
 
 import (
+	"os"
 	"runtime"
 
 	"github.com/Code-Hex/vz/v3"
+	"github.com/raikerian/macos-virtual-kubelet/internal/sizing"
 )
 
 func ComputeCPUCount() uint {
@@ -36,3 +38,34 @@ func ComputeMemorySize() uint64 {
 	}
 	return memorySize
 }
+
+// SizeLimits returns the bounds of a virtual machine size allowed by
+// Virtualization.framework, raised to the minimums required by the restore
+// image of the bundle when it is available.
+func SizeLimits(bundlePath string) sizing.Limits {
+	limits := sizing.Limits{
+		MinCPUs:   vz.VirtualMachineConfigurationMinimumAllowedCPUCount(),
+		MaxCPUs:   vz.VirtualMachineConfigurationMaximumAllowedCPUCount(),
+		MinMemory: vz.VirtualMachineConfigurationMinimumAllowedMemorySize(),
+		MaxMemory: vz.VirtualMachineConfigurationMaximumAllowedMemorySize(),
+	}
+
+	if _, err := os.Stat(GetRestoreImagePath(bundlePath)); err != nil {
+		return limits
+	}
+	image, err := vz.LoadMacOSRestoreImageFromPath(GetRestoreImagePath(bundlePath))
+	if err != nil {
+		return limits
+	}
+	requirements := image.MostFeaturefulSupportedConfiguration()
+	if requirements == nil {
+		return limits
+	}
+	if cpus := uint(requirements.MinimumSupportedCPUCount()); cpus > limits.MinCPUs {
+		limits.MinCPUs = cpus
+	}
+	if memory := requirements.MinimumSupportedMemorySize(); memory > limits.MinMemory {
+		limits.MinMemory = memory
+	}
+	return limits
+}
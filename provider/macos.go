@@ -31,24 +31,23 @@ type MacOSProvider struct {
 	operatingSystem    string
 	internalIP         string
 	daemonEndpointPort int32
+	reserved           corev1.ResourceList
 }
 
-const (
-	DefaultPods = 110
-)
-
 var (
 	errNotImplemented = fmt.Errorf("not implemented by MacOS provider")
 )
 
 // NewMacOSProvider creates a new MacOS provider.
-func NewMacOSProvider(rm *manager.ResourceManager, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32) *MacOSProvider {
+// The reserved resources are kept for the host and never allocated to pods.
+func NewMacOSProvider(rm *manager.ResourceManager, nodeName, operatingSystem, internalIP string, daemonEndpointPort int32, reserved corev1.ResourceList) *MacOSProvider {
 	return &MacOSProvider{
 		rm:                 rm,
 		nodeName:           nodeName,
 		operatingSystem:    operatingSystem,
 		internalIP:         internalIP,
 		daemonEndpointPort: daemonEndpointPort,
+		reserved:           reserved,
 	}
 }
 
@@ -61,8 +60,7 @@ func (p *MacOSProvider) CreatePod(ctx context.Context, pod *corev1.Pod) error {
 // UpdatePod takes a Kubernetes Pod and updates it within the provider.
 func (p *MacOSProvider) UpdatePod(ctx context.Context, pod *corev1.Pod) error {
 	log.G(ctx).Infof("Received UpdatePod request for %s/%s.\n", pod.Namespace, pod.Name)
-
-	return errNotImplemented
+	return p.rm.UpdatePod(ctx, pod)
 }
 
 // DeletePod takes a Kubernetes Pod and deletes it from the provider.
@@ -131,10 +129,15 @@ func (p *MacOSProvider) ConfigureNode(ctx context.Context, n *corev1.Node) {
 	// if p.config.ProviderID != "" {
 	// 	n.Spec.ProviderID = p.config.ProviderID
 	// }
-	capacity := p.capacity(ctx)
-	n.Status.Capacity = capacity
-	n.Status.Allocatable = capacity
-	// n.Status.Conditions = p.nodeConditions()
+	p.UpdateCapacity(ctx, &n.Status)
+	if n.Labels == nil {
+		n.Labels = map[string]string{}
+	}
+	for _, handler := range p.rm.RuntimeHandlers() {
+		n.Labels[RuntimeHandlerLabelPrefix+handler] = "true"
+	}
+	n.Status.Phase = corev1.NodeRunning
+	n.Status.Conditions = initialNodeConditions()
 	n.Status.Addresses = p.nodeAddresses(ctx)
 	n.Status.DaemonEndpoints = corev1.NodeDaemonEndpoints{
 		KubeletEndpoint: corev1.DaemonEndpoint{
@@ -146,6 +149,16 @@ func (p *MacOSProvider) ConfigureNode(ctx context.Context, n *corev1.Node) {
 	// n.ObjectMeta.Labels["node.kubernetes.io/exclude-from-external-load-balancers"] = "true"
 }
 
+// UpdateCapacity sets the capacity and allocatable resources of the node,
+// e.g. after the number of VM slots changed.
+func (p *MacOSProvider) UpdateCapacity(ctx context.Context, status *corev1.NodeStatus) {
+	capacity := p.capacity(ctx)
+	allocatable := allocatableResources(capacity, p.reserved)
+	status.Capacity = capacity
+	status.Allocatable = allocatable
+	p.rm.SetAllocatable(allocatable)
+}
+
 // Capacity returns a resource list containing the capacity limits.
 func (p *MacOSProvider) capacity(ctx context.Context) corev1.ResourceList {
 	v, err := mem.VirtualMemoryWithContext(ctx)
@@ -164,15 +177,82 @@ func (p *MacOSProvider) capacity(ctx context.Context) corev1.ResourceList {
 	}
 
 	rl := corev1.ResourceList{
-		"cpu":               *resource.NewQuantity(int64(c), resource.DecimalSI),
-		"memory":            *resource.NewQuantity(int64(v.Total), resource.BinarySI),
-		"ephemeral-storage": *resource.NewQuantity(int64(d.Total), resource.BinarySI),
-		"pods":              *resource.NewQuantity(DefaultPods, resource.DecimalSI),
+		"cpu":                   *resource.NewQuantity(int64(c), resource.DecimalSI),
+		"memory":                *resource.NewQuantity(int64(v.Total), resource.BinarySI),
+		"ephemeral-storage":     *resource.NewQuantity(int64(d.Total), resource.BinarySI),
+		"pods":                  *resource.NewQuantity(int64(p.rm.VMSlots()), resource.DecimalSI),
+		manager.ResourceVMSlots: *resource.NewQuantity(int64(p.rm.VMSlots()), resource.DecimalSI),
 	}
 	return rl
 }
 
+// allocatableResources returns capacity minus reserved, never going below zero.
+func allocatableResources(capacity, reserved corev1.ResourceList) corev1.ResourceList {
+	allocatable := capacity.DeepCopy()
+	for name, r := range reserved {
+		q, ok := allocatable[name]
+		if !ok {
+			continue
+		}
+		q.Sub(r)
+		if q.Sign() < 0 {
+			q.Set(0)
+		}
+		allocatable[name] = q
+	}
+	return allocatable
+}
+
+// ProbeHost collects the host resource usage node conditions are derived from.
+func (p *MacOSProvider) ProbeHost(ctx context.Context) (HostStats, error) {
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return HostStats{}, fmt.Errorf("failed to get memory usage: %w", err)
+	}
+
+	d, err := disk.UsageWithContext(ctx, "/")
+	if err != nil {
+		return HostStats{}, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+
+	info, err := host.InfoWithContext(ctx)
+	if err != nil {
+		return HostStats{}, fmt.Errorf("failed to get process count: %w", err)
+	}
+
+	maxProcs, err := maxPIDs()
+	if err != nil {
+		return HostStats{}, fmt.Errorf("failed to get process limit: %w", err)
+	}
+
+	return HostStats{
+		MemoryTotal:     v.Total,
+		MemoryAvailable: v.Available,
+		DiskTotal:       d.Total,
+		DiskFree:        d.Free,
+		PIDs:            info.Procs,
+		MaxPIDs:         maxProcs,
+		VMs:             p.rm.UsedVMSlots(),
+		MaxVMs:          p.rm.VMSlots(),
+	}, nil
+}
+
 func (p *MacOSProvider) nodeAddresses(ctx context.Context) []corev1.NodeAddress {
+	return []corev1.NodeAddress{
+		{
+			Type:    corev1.NodeInternalIP,
+			Address: NodeInternalIP(ctx),
+		},
+		{
+			Type:    corev1.NodeHostName,
+			Address: p.nodeName,
+		},
+	}
+}
+
+// NodeInternalIP returns the IPv4 address of the node on its default
+// interface, or an empty string when it has none.
+func NodeInternalIP(ctx context.Context) string {
 	ifs, err := psnet.InterfacesWithContext(ctx)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("Error getting network interfaces")
@@ -195,17 +275,7 @@ func (p *MacOSProvider) nodeAddresses(ctx context.Context) []corev1.NodeAddress
 			break
 		}
 	}
-
-	return []corev1.NodeAddress{
-		{
-			Type:    corev1.NodeInternalIP,
-			Address: addr,
-		},
-		{
-			Type:    corev1.NodeHostName,
-			Address: p.nodeName,
-		},
-	}
+	return addr
 }
 
 func (p *MacOSProvider) nodeInfo(ctx context.Context) corev1.NodeSystemInfo {
@@ -0,0 +1,235 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/virtual-kubelet/virtual-kubelet/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeVMSlotPressure is reported when the host cannot start any more virtual machines.
+const NodeVMSlotPressure corev1.NodeConditionType = "VMSlotPressure"
+
+const (
+	DefaultNodeStatusUpdateFrequency = 10 * time.Second
+
+	DefaultMemoryPressureThreshold = 10
+	DefaultDiskPressureThreshold   = 10
+	DefaultPIDPressureThreshold    = 10
+)
+
+// HostStats is a snapshot of the host resources node conditions are derived from.
+type HostStats struct {
+	MemoryTotal     uint64
+	MemoryAvailable uint64
+	DiskTotal       uint64
+	DiskFree        uint64
+	PIDs            uint64
+	MaxPIDs         uint64
+	VMs             int
+	MaxVMs          int
+}
+
+// HostProbe collects the current HostStats.
+type HostProbe func(ctx context.Context) (HostStats, error)
+
+// NodeConditionThresholds are the percentages of memory, disk and PIDs that
+// must remain available before the matching pressure condition is reported.
+type NodeConditionThresholds struct {
+	MemoryAvailablePercent float64
+	DiskAvailablePercent   float64
+	PIDAvailablePercent    float64
+}
+
+// NodeConditionManager implements node.NodeProvider. It periodically probes
+// the host and notifies virtual-kubelet whenever a node condition changes.
+type NodeConditionManager struct {
+	mu         sync.Mutex
+	node       *corev1.Node
+	probe      HostProbe
+	thresholds NodeConditionThresholds
+	interval   time.Duration
+	// dirty is set when the node changed outside of the conditions
+	dirty bool
+}
+
+// NewNodeConditionManager creates a NodeConditionManager for node, probing the
+// host with probe every interval.
+func NewNodeConditionManager(node *corev1.Node, probe HostProbe, thresholds NodeConditionThresholds, interval time.Duration) *NodeConditionManager {
+	if interval <= 0 {
+		interval = DefaultNodeStatusUpdateFrequency
+	}
+	return &NodeConditionManager{
+		node:       node.DeepCopy(),
+		probe:      probe,
+		thresholds: thresholds,
+		interval:   interval,
+	}
+}
+
+// Ping checks if the node is still active.
+func (m *NodeConditionManager) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// NotifyNodeStatus starts probing the host and calls cb every time the node
+// conditions change. It does not block.
+func (m *NodeConditionManager) NotifyNodeStatus(ctx context.Context, cb func(*corev1.Node)) {
+	go m.run(ctx, cb)
+}
+
+func (m *NodeConditionManager) run(ctx context.Context, cb func(*corev1.Node)) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		if n := m.update(ctx); n != nil {
+			cb(n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UpdateStatus applies f to the node status. The node is reported to
+// virtual-kubelet after the next probe.
+func (m *NodeConditionManager) UpdateStatus(f func(*corev1.NodeStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.node.Status)
+	m.dirty = true
+}
+
+// update probes the host and returns a copy of the node if any condition or
+// the status changed.
+func (m *NodeConditionManager) update(ctx context.Context) *corev1.Node {
+	stats, err := m.probe(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("Error probing host for node conditions")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conditions, changed := updateConditions(m.node.Status.Conditions, desiredConditions(stats, err, m.thresholds), metav1.Now())
+	if !changed && !m.dirty {
+		return nil
+	}
+	m.node.Status.Conditions = conditions
+	m.dirty = false
+	return m.node.DeepCopy()
+}
+
+// initialNodeConditions returns the conditions reported before the host was probed.
+func initialNodeConditions() []corev1.NodeCondition {
+	now := metav1.Now()
+	conditions, _ := updateConditions(nil, desiredConditions(HostStats{}, nil, NodeConditionThresholds{}), now)
+	return conditions
+}
+
+// desiredConditions computes the node conditions from the host stats.
+// Timestamps are filled in by updateConditions.
+func desiredConditions(stats HostStats, probeErr error, t NodeConditionThresholds) []corev1.NodeCondition {
+	ready := corev1.NodeCondition{
+		Type:    corev1.NodeReady,
+		Status:  corev1.ConditionTrue,
+		Reason:  "KubeletReady",
+		Message: "macOS virtual kubelet is ready",
+	}
+	if probeErr != nil {
+		ready.Status = corev1.ConditionFalse
+		ready.Reason = "KubeletNotReady"
+		ready.Message = fmt.Sprintf("failed to probe host: %v", probeErr)
+	}
+
+	return []corev1.NodeCondition{
+		ready,
+		pressureCondition(corev1.NodeMemoryPressure, "Memory", belowThreshold(stats.MemoryAvailable, stats.MemoryTotal, t.MemoryAvailablePercent)),
+		pressureCondition(corev1.NodeDiskPressure, "Disk", belowThreshold(stats.DiskFree, stats.DiskTotal, t.DiskAvailablePercent)),
+		pressureCondition(corev1.NodePIDPressure, "PID", belowThreshold(stats.MaxPIDs-min(stats.PIDs, stats.MaxPIDs), stats.MaxPIDs, t.PIDAvailablePercent)),
+		vmSlotCondition(stats.VMs, stats.MaxVMs),
+		{
+			Type:    corev1.NodeNetworkUnavailable,
+			Status:  corev1.ConditionFalse,
+			Reason:  "RouteCreated",
+			Message: "macOS virtual kubelet does not require routes",
+		},
+	}
+}
+
+// belowThreshold reports whether available is less than percent of total.
+// Unknown totals never report pressure.
+func belowThreshold(available, total uint64, percent float64) bool {
+	if total == 0 {
+		return false
+	}
+	return float64(available)/float64(total)*100 < percent
+}
+
+func pressureCondition(t corev1.NodeConditionType, resource string, pressure bool) corev1.NodeCondition {
+	if pressure {
+		return corev1.NodeCondition{
+			Type:    t,
+			Status:  corev1.ConditionTrue,
+			Reason:  "KubeletHasInsufficient" + resource,
+			Message: fmt.Sprintf("kubelet has insufficient %s available", resource),
+		}
+	}
+	return corev1.NodeCondition{
+		Type:    t,
+		Status:  corev1.ConditionFalse,
+		Reason:  "KubeletHasSufficient" + resource,
+		Message: fmt.Sprintf("kubelet has sufficient %s available", resource),
+	}
+}
+
+func vmSlotCondition(vms, maxVMs int) corev1.NodeCondition {
+	if maxVMs > 0 && vms >= maxVMs {
+		return corev1.NodeCondition{
+			Type:    NodeVMSlotPressure,
+			Status:  corev1.ConditionTrue,
+			Reason:  "VMSlotsExhausted",
+			Message: fmt.Sprintf("all %d virtual machine slots are in use", maxVMs),
+		}
+	}
+	return corev1.NodeCondition{
+		Type:    NodeVMSlotPressure,
+		Status:  corev1.ConditionFalse,
+		Reason:  "VMSlotsAvailable",
+		Message: fmt.Sprintf("%d of %d virtual machine slots are in use", vms, maxVMs),
+	}
+}
+
+// updateConditions merges desired into current, keeping the transition time of
+// conditions whose status did not change. It reports whether anything changed.
+func updateConditions(current, desired []corev1.NodeCondition, now metav1.Time) ([]corev1.NodeCondition, bool) {
+	byType := make(map[corev1.NodeConditionType]corev1.NodeCondition, len(current))
+	for _, c := range current {
+		byType[c.Type] = c
+	}
+
+	changed := len(current) != len(desired)
+	out := make([]corev1.NodeCondition, 0, len(desired))
+	for _, c := range desired {
+		c.LastHeartbeatTime = now
+		c.LastTransitionTime = now
+		if prev, ok := byType[c.Type]; ok && prev.Status == c.Status {
+			c.LastTransitionTime = prev.LastTransitionTime
+			if prev.Reason != c.Reason || prev.Message != c.Message {
+				changed = true
+			}
+		} else {
+			changed = true
+		}
+		out = append(out, c)
+	}
+	return out, changed
+}
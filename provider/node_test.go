@@ -0,0 +1,163 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var testThresholds = NodeConditionThresholds{
+	MemoryAvailablePercent: 10,
+	DiskAvailablePercent:   10,
+	PIDAvailablePercent:    10,
+}
+
+func conditionStatus(conditions []corev1.NodeCondition, t corev1.NodeConditionType) corev1.ConditionStatus {
+	for _, c := range conditions {
+		if c.Type == t {
+			return c.Status
+		}
+	}
+	return corev1.ConditionUnknown
+}
+
+func TestDesiredConditions(t *testing.T) {
+	healthy := HostStats{
+		MemoryTotal: 100, MemoryAvailable: 50,
+		DiskTotal: 100, DiskFree: 50,
+		PIDs: 10, MaxPIDs: 100,
+		VMs: 1, MaxVMs: 2,
+	}
+
+	testCases := []struct {
+		name     string
+		stats    func(s HostStats) HostStats
+		probeErr error
+		want     map[corev1.NodeConditionType]corev1.ConditionStatus
+	}{
+		{
+			name:  "healthy",
+			stats: func(s HostStats) HostStats { return s },
+			want: map[corev1.NodeConditionType]corev1.ConditionStatus{
+				corev1.NodeReady:          corev1.ConditionTrue,
+				corev1.NodeMemoryPressure: corev1.ConditionFalse,
+				corev1.NodeDiskPressure:   corev1.ConditionFalse,
+				corev1.NodePIDPressure:    corev1.ConditionFalse,
+				NodeVMSlotPressure:        corev1.ConditionFalse,
+			},
+		},
+		{
+			name: "memory, disk and pid pressure",
+			stats: func(s HostStats) HostStats {
+				s.MemoryAvailable = 5
+				s.DiskFree = 9
+				s.PIDs = 95
+				return s
+			},
+			want: map[corev1.NodeConditionType]corev1.ConditionStatus{
+				corev1.NodeMemoryPressure: corev1.ConditionTrue,
+				corev1.NodeDiskPressure:   corev1.ConditionTrue,
+				corev1.NodePIDPressure:    corev1.ConditionTrue,
+			},
+		},
+		{
+			name: "vm slots exhausted",
+			stats: func(s HostStats) HostStats {
+				s.VMs = 2
+				return s
+			},
+			want: map[corev1.NodeConditionType]corev1.ConditionStatus{
+				NodeVMSlotPressure: corev1.ConditionTrue,
+			},
+		},
+		{
+			name:     "probe failure",
+			stats:    func(s HostStats) HostStats { return HostStats{} },
+			probeErr: errors.New("boom"),
+			want: map[corev1.NodeConditionType]corev1.ConditionStatus{
+				corev1.NodeReady:          corev1.ConditionFalse,
+				corev1.NodeMemoryPressure: corev1.ConditionFalse,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conditions := desiredConditions(tc.stats(healthy), tc.probeErr, testThresholds)
+			for typ, want := range tc.want {
+				if got := conditionStatus(conditions, typ); got != want {
+					t.Errorf("expected %s to be %s, got %s", typ, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateConditionsKeepsTransitionTime(t *testing.T) {
+	first := metav1.NewTime(time.Unix(100, 0))
+	second := metav1.NewTime(time.Unix(200, 0))
+
+	desired := desiredConditions(HostStats{MemoryTotal: 100, MemoryAvailable: 50}, nil, testThresholds)
+	current, changed := updateConditions(nil, desired, first)
+	if !changed {
+		t.Fatal("expected initial conditions to be reported as changed")
+	}
+
+	current, changed = updateConditions(current, desired, second)
+	if changed {
+		t.Fatal("expected identical conditions not to be reported as changed")
+	}
+	for _, c := range current {
+		if !c.LastTransitionTime.Equal(&first) {
+			t.Errorf("expected %s transition time to be kept, got %v", c.Type, c.LastTransitionTime)
+		}
+		if !c.LastHeartbeatTime.Equal(&second) {
+			t.Errorf("expected %s heartbeat time to be updated, got %v", c.Type, c.LastHeartbeatTime)
+		}
+	}
+
+	desired = desiredConditions(HostStats{MemoryTotal: 100, MemoryAvailable: 1}, nil, testThresholds)
+	current, changed = updateConditions(current, desired, second)
+	if !changed {
+		t.Fatal("expected memory pressure to be reported as changed")
+	}
+	for _, c := range current {
+		if c.Type == corev1.NodeMemoryPressure && !c.LastTransitionTime.Equal(&second) {
+			t.Errorf("expected memory pressure transition time to be updated, got %v", c.LastTransitionTime)
+		}
+	}
+}
+
+func TestNodeConditionManagerNotifiesOnChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := make(chan HostStats, 1)
+	probe := func(context.Context) (HostStats, error) {
+		return <-stats, nil
+	}
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+	m := NewNodeConditionManager(node, probe, testThresholds, time.Millisecond)
+
+	updates := make(chan *corev1.Node, 1)
+	m.NotifyNodeStatus(ctx, func(n *corev1.Node) { updates <- n })
+
+	stats <- HostStats{VMs: 1, MaxVMs: 2}
+	n := <-updates
+	if got := conditionStatus(n.Status.Conditions, NodeVMSlotPressure); got != corev1.ConditionFalse {
+		t.Fatalf("expected %s to be False, got %s", NodeVMSlotPressure, got)
+	}
+
+	// An unchanged probe must not trigger a notification.
+	stats <- HostStats{VMs: 1, MaxVMs: 2}
+	stats <- HostStats{VMs: 2, MaxVMs: 2}
+	n = <-updates
+	if got := conditionStatus(n.Status.Conditions, NodeVMSlotPressure); got != corev1.ConditionTrue {
+		t.Fatalf("expected %s to be True, got %s", NodeVMSlotPressure, got)
+	}
+}
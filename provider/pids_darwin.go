@@ -0,0 +1,9 @@
+package provider
+
+import "golang.org/x/sys/unix"
+
+// maxPIDs returns the maximum number of processes the host allows.
+func maxPIDs() (uint64, error) {
+	n, err := unix.SysctlUint32("kern.maxproc")
+	return uint64(n), err
+}
@@ -0,0 +1,19 @@
+//go:build !darwin
+// +build !darwin
+
+package provider
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxPIDs returns the maximum number of processes the host allows.
+func maxPIDs() (uint64, error) {
+	b, err := os.ReadFile("/proc/sys/kernel/pid_max")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
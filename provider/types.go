@@ -9,6 +9,12 @@ const (
 	OperatingSystemWindows = "windows"
 )
 
+// RuntimeHandlerLabelPrefix prefixes the node labels advertising the
+// RuntimeClass handlers the node supports, e.g.
+// runtimehandler.macos.virtual-kubelet.io/linux-vm=true. RuntimeClasses
+// select the node with them in scheduling.nodeSelector.
+const RuntimeHandlerLabelPrefix = "runtimehandler.macos.virtual-kubelet.io/"
+
 type OperatingSystems map[string]bool //nolint:golint
 
 var (
@@ -16,7 +22,7 @@ var (
 	// that can be used as a kubelet node.
 	ValidOperatingSystems = OperatingSystems{
 		OperatingSystemMacOS:   true,
-		OperatingSystemLinux:   false,
+		OperatingSystemLinux:   true,
 		OperatingSystemWindows: false,
 	}
 )